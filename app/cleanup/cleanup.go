@@ -0,0 +1,57 @@
+package cleanup
+
+import (
+	"context"
+	"errors"
+
+	"github.com/adrianliechti/go-cli"
+	"github.com/adrianliechti/loop/app"
+	"github.com/adrianliechti/loop/pkg/kubernetes"
+	"github.com/adrianliechti/loop/pkg/session"
+)
+
+var Command = &cli.Command{
+	Name:  "cleanup",
+	Usage: "roll back hosts entries, aliases, contexts, pods and intercepted services left behind by crashed sessions",
+
+	HideHelpCommand: true,
+
+	Action: func(ctx context.Context, cmd *cli.Command) error {
+		ctx = kubernetes.WithKubeconfig(ctx, cmd.String(app.KubeconfigFlag.Name))
+
+		sessions, err := session.List()
+
+		if err != nil {
+			return err
+		}
+
+		var result error
+		var cleaned int
+
+		for _, s := range sessions {
+			if s.Alive() {
+				cli.Infof("Skipping running session %d (%s)", s.PID, s.Summary())
+				continue
+			}
+
+			cli.Infof("★ Rolling back session %d: %s", s.PID, s.Summary())
+
+			if err := s.Rollback(ctx); err != nil {
+				result = errors.Join(result, err)
+				continue
+			}
+
+			cleaned++
+		}
+
+		if result != nil {
+			return result
+		}
+
+		if cleaned == 0 {
+			cli.Info("Nothing to clean up")
+		}
+
+		return nil
+	},
+}
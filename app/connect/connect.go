@@ -3,13 +3,29 @@ package connect
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log/slog"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
 
 	"github.com/adrianliechti/go-cli"
 	"github.com/adrianliechti/loop/app"
+	"github.com/adrianliechti/loop/pkg/address"
 	"github.com/adrianliechti/loop/pkg/catapult"
+	"github.com/adrianliechti/loop/pkg/dns"
+	"github.com/adrianliechti/loop/pkg/filter"
 	"github.com/adrianliechti/loop/pkg/gateway"
+	"github.com/adrianliechti/loop/pkg/helper"
+	"github.com/adrianliechti/loop/pkg/hostname"
+	"github.com/adrianliechti/loop/pkg/jump"
 	"github.com/adrianliechti/loop/pkg/kubernetes"
+	"github.com/adrianliechti/loop/pkg/source"
+	"github.com/adrianliechti/loop/pkg/source/istio"
+	"github.com/adrianliechti/loop/pkg/source/knative"
+	"github.com/adrianliechti/loop/pkg/status"
 	"github.com/adrianliechti/loop/pkg/system"
 )
 
@@ -17,13 +33,73 @@ var Command = &cli.Command{
 	Name:  "connect",
 	Usage: "connect Kubernetes network",
 
+	Commands: []*cli.Command{
+		CommandStatus,
+	},
+
 	Flags: []cli.Flag{
 		app.ScopeFlag,
 		app.NamespacesFlag,
+
+		app.ContextsFlag,
+
+		&cli.StringFlag{
+			Name:  "primary",
+			Usage: "context that serves unqualified names (defaults to the first --context)",
+		},
+
+		&cli.StringFlag{
+			Name:  "selector",
+			Usage: "only expose resources matching this label selector (e.g. team=payments)",
+		},
+
+		&cli.StringSliceFlag{
+			Name:  "include",
+			Usage: "only expose resources whose name or namespace/name matches this glob",
+		},
+
+		&cli.StringSliceFlag{
+			Name:  "exclude",
+			Usage: "do not expose resources whose name or namespace/name matches this glob (e.g. 'kube-*')",
+		},
+
+		&cli.StringSliceFlag{
+			Name:  "name-template",
+			Usage: "publish services under names from this Go template instead of the cluster DNS names (e.g. '{{.Service}}.{{.Namespace}}.dev.internal'; fields: Service, Namespace, Cluster, Hostname, Pod; endpoints and pod IPs are named below the result unless it uses Hostname)",
+		},
+
+		&cli.StringSliceFlag{
+			Name:  "host-template",
+			Usage: "publish Ingress and route hosts under names from this Go template (e.g. '{{.Host}}.{{.Cluster}}'; fields: Host, Cluster)",
+		},
+
+		&cli.BoolFlag{
+			Name:  "dns",
+			Usage: "resolve names through an embedded DNS server instead of the hosts file",
+		},
+
+		&cli.BoolFlag{
+			Name:  "tun",
+			Usage: "route the pod and service networks through a TUN device, so raw ClusterIPs and pod IPs work too (Linux)",
+		},
+
+		&cli.BoolFlag{
+			Name:  "jump",
+			Usage: "carry all traffic through a single loop-tunnel pod to the service ClusterIPs instead of port-forwarding to each pod",
+		},
+
+		&cli.BoolFlag{
+			Name:  "router",
+			Usage: "route Ingress and HTTPRoute hosts locally, straight to the backend pods instead of through the ingress controller",
+		},
 	},
 
 	Action: func(ctx context.Context, cmd *cli.Command) error {
-		client := app.MustClient(ctx, cmd)
+		clusters, err := listClusters(ctx, cmd)
+
+		if err != nil {
+			return err
+		}
 
 		scope := app.Scope(ctx, cmd)
 		namespaces := app.Namespaces(ctx, cmd)
@@ -34,58 +110,370 @@ var Command = &cli.Command{
 			return err
 		}
 
+		var privileged *helper.Client
+
+		// Only the hosts file and loopback aliases need root; leave them to a
+		// helper so the Kubernetes client and its exec plugins run as the user.
 		if !elevated {
-			cli.Fatal("This command must be run as root!")
+			if cmd.Bool("dns") {
+				return errors.New("--dns changes the system resolver and must be run as root")
+			}
+
+			if cmd.Bool("tun") {
+				return errors.New("--tun creates a network interface and must be run as root")
+			}
+
+			cli.Info("★ Starting privileged helper for hosts file and loopback changes")
+
+			client, err := helper.Spawn(ctx)
+
+			if err != nil {
+				return err
+			}
+
+			warnPrivilegedPorts()
+
+			privileged = client
+		}
+
+		if cmd.Bool("router") {
+			cli.Infof("★ Router terminates HTTPS with the certificate authority in %s; trust it once to avoid warnings", gateway.DefaultAuthorityPath())
 		}
 
-		return Connect(ctx, client, namespaces, scope)
+		return Connect(ctx, clusters, &ConnectOptions{
+			Scope:      scope,
+			Namespaces: namespaces,
+
+			Selector: cmd.String("selector"),
+			Include:  cmd.StringSlice("include"),
+			Exclude:  cmd.StringSlice("exclude"),
+
+			NameTemplates: cmd.StringSlice("name-template"),
+			HostTemplates: cmd.StringSlice("host-template"),
+
+			DNS:    cmd.Bool("dns"),
+			TUN:    cmd.Bool("tun"),
+			Jump:   cmd.Bool("jump"),
+			Router: cmd.Bool("router"),
+
+			Helper: privileged,
+		})
 	},
 }
 
-func Connect(ctx context.Context, client kubernetes.Client, namespaces []string, scope string) error {
+type ConnectOptions struct {
+	Scope      string
+	Namespaces []string
+
+	// Selector, Include and Exclude narrow down the exposed resources; see
+	// filter.FilterOptions.
+	Selector string
+	Include  []string
+	Exclude  []string
+
+	// NameTemplates and HostTemplates replace the names of services and of
+	// Ingress and route hosts; see hostname.Names. Qualifying them per
+	// cluster is then up to the templates.
+	NameTemplates []string
+	HostTemplates []string
+
+	// DNS serves the names through an embedded resolver, which also answers
+	// wildcard hosts, search-domain lookups and SRV records.
+	DNS bool
+
+	// TUN routes the pod and service networks of the primary cluster into
+	// the process, for clients connecting to raw ClusterIPs and pod IPs.
+	// Other clusters' networks may overlap, so they are left out.
+	TUN bool
+
+	// Jump deploys one loop-tunnel pod per cluster into the scope namespace
+	// and carries every connection through it; see
+	// catapult.CatapultOptions.Jump.
+	Jump bool
+
+	// Router serves HTTP hosts through a local reverse proxy that routes
+	// to the backend pods itself; see gateway.GatewayOptions.Router.
+	Router bool
+
+	// Helper applies hosts sections and loopback aliases on behalf of an
+	// unprivileged process; nil changes them directly.
+	Helper *helper.Client
+}
+
+// Cluster is a kubeconfig context to connect to.
+type Cluster struct {
+	// Name qualifies the cluster's names, e.g. orders.shop.staging; the
+	// primary publishes the unqualified names too. It is empty when
+	// connecting a single cluster.
+	Name string
+
+	Client kubernetes.Client
+}
+
+// listClusters returns the clusters to connect to, the primary first.
+func listClusters(ctx context.Context, cmd *cli.Command) ([]Cluster, error) {
+	contexts := app.Contexts(ctx, cmd)
+
+	if len(contexts) == 0 {
+		return []Cluster{{Client: app.MustClient(ctx, cmd)}}, nil
+	}
+
+	if primary := cmd.String("primary"); primary != "" {
+		i := slices.Index(contexts, primary)
+
+		if i < 0 {
+			return nil, fmt.Errorf("primary context %q is not among the contexts", primary)
+		}
+
+		contexts = append([]string{primary}, slices.Delete(slices.Clone(contexts), i, i+1)...)
+	}
+
+	var result []Cluster
+
+	for _, kubeContext := range contexts {
+		client, err := app.ClientWithContext(ctx, cmd, kubeContext)
+
+		if err != nil {
+			return nil, err
+		}
+
+		name := clusterName(kubeContext)
+
+		if slices.ContainsFunc(result, func(c Cluster) bool { return c.Name == name }) {
+			return nil, fmt.Errorf("contexts map to the same name %q", name)
+		}
+
+		result = append(result, Cluster{
+			Name:   name,
+			Client: client,
+		})
+	}
+
+	return result, nil
+}
+
+// Connect exposes the services and gateways of every cluster locally. The
+// first cluster is the primary: its names are published as is, the others
+// only qualified with their cluster name.
+func Connect(ctx context.Context, clusters []Cluster, options *ConnectOptions) error {
+	if options == nil {
+		options = new(ConnectOptions)
+	}
+
+	if len(clusters) == 0 {
+		return errors.New("no cluster to connect")
+	}
+
+	scope := options.Scope
+	namespaces := options.Namespaces
+
 	if scope == "" && len(namespaces) > 0 {
 		scope = namespaces[0]
 	}
 
 	if scope == "" {
-		scope = client.Namespace()
+		scope = clusters[0].Client.Namespace()
 	}
 
-	catapult, err := catapult.New(client, catapult.CatapultOptions{
-		Scope:      scope,
-		Namespaces: namespaces,
+	filterOptions := filter.FilterOptions{
+		Selector: options.Selector,
+		Include:  options.Include,
+		Exclude:  options.Exclude,
+	}
 
-		Logger: slog.Default(),
+	serviceNames, err := hostname.New(options.NameTemplates)
 
-		AddFunc: func(address string, hosts []string, ports []int) {
-			slog.InfoContext(ctx, "adding tunnel", "address", address, "hosts", hosts, "ports", ports)
-		},
+	if err != nil {
+		return err
+	}
 
-		DeleteFunc: func(address string, hosts []string, ports []int) {
-			slog.InfoContext(ctx, "removing tunnel", "address", address, "hosts", hosts, "ports", ports)
-		},
-	})
+	hostNames, err := hostname.New(options.HostTemplates)
 
 	if err != nil {
 		return err
 	}
 
-	gateway, err := gateway.New(client, gateway.GatewayOptions{
-		Namespaces: namespaces,
+	var resolver *dns.Server
 
-		Logger: slog.Default(),
+	if options.DNS {
+		server, err := dns.New(dns.ServerOptions{
+			Search: []string{
+				scope + ".svc.cluster.local",
+				"svc.cluster.local",
+				"cluster.local",
+			},
 
-		AddFunc: func(address string, hosts []string, ports []int) {
-			slog.InfoContext(ctx, "adding tunnel", "address", address, "hosts", hosts, "ports", ports)
-		},
+			Logger: slog.Default(),
+		})
 
-		DeleteFunc: func(address string, hosts []string, ports []int) {
-			slog.InfoContext(ctx, "removing tunnel", "address", address, "hosts", hosts, "ports", ports)
-		},
-	})
+		if err != nil {
+			return err
+		}
 
-	if err != nil {
-		return err
+		resolver = server
+	}
+
+	var starters []func(context.Context) error
+	var sources []status.Source
+
+	for i, cluster := range clusters {
+		catapultNetwork, gatewayNetwork, err := clusterNetworks(i)
+
+		if err != nil {
+			return err
+		}
+
+		// each component tracks opted-out namespaces to refresh itself
+		catapultFilter, err := filter.New(filterOptions)
+
+		if err != nil {
+			return err
+		}
+
+		gatewayFilter, err := filter.New(filterOptions)
+
+		if err != nil {
+			return err
+		}
+
+		catapultAddresses, err := address.New(address.AllocatorOptions{
+			Network: catapultNetwork,
+			Path:    address.DefaultPath(sectionName("catapult", cluster.Name)),
+
+			Logger: slog.Default(),
+		})
+
+		if err != nil {
+			return err
+		}
+
+		gatewayAddresses, err := address.New(address.AllocatorOptions{
+			Network: gatewayNetwork,
+			Path:    address.DefaultPath(sectionName("gateway", cluster.Name)),
+
+			Logger: slog.Default(),
+		})
+
+		if err != nil {
+			return err
+		}
+
+		var catapultHosts, gatewayHosts system.Hosts
+		var loopback system.Loopback
+
+		if resolver != nil {
+			catapultHosts = resolver.Section(sectionName("catapult", cluster.Name))
+			gatewayHosts = resolver.Section(sectionName("gateway", cluster.Name))
+		}
+
+		if options.Helper != nil {
+			loopback = options.Helper
+
+			if resolver == nil {
+				catapultHosts = options.Helper.Section(sectionTitle("Loop Catapult", cluster.Name))
+				gatewayHosts = options.Helper.Section(sectionTitle("Loop Gateway", cluster.Name))
+			}
+		}
+
+		var jumpPod *jump.Pod
+
+		if options.Jump {
+			jumpPod = jump.New(cluster.Client, jump.PodOptions{
+				Namespace: scope,
+			})
+
+			defer jumpPod.Close()
+		}
+
+		catapult, err := catapult.New(cluster.Client, catapult.CatapultOptions{
+			Scope:      scope,
+			Namespaces: namespaces,
+
+			Cluster: cluster.Name,
+			Primary: i == 0,
+
+			Names: serviceNames,
+
+			Hosts:     catapultHosts,
+			Loopback:  loopback,
+			Filter:    catapultFilter,
+			Addresses: catapultAddresses,
+
+			Jump: jumpPod,
+
+			Logger: slog.Default(),
+
+			AddFunc: func(address string, hosts []string, ports []int) {
+				slog.InfoContext(ctx, "adding tunnel", "address", address, "hosts", hosts, "ports", ports)
+			},
+
+			DeleteFunc: func(address string, hosts []string, ports []int) {
+				slog.InfoContext(ctx, "removing tunnel", "address", address, "hosts", hosts, "ports", ports)
+			},
+		})
+
+		if err != nil {
+			return err
+		}
+
+		gateway, err := gateway.New(cluster.Client, gateway.GatewayOptions{
+			Namespaces: namespaces,
+
+			Cluster: cluster.Name,
+			Primary: i == 0,
+
+			Names: hostNames,
+
+			Hosts:     gatewayHosts,
+			Loopback:  loopback,
+			Filter:    gatewayFilter,
+			Addresses: gatewayAddresses,
+
+			Jump: jumpPod,
+
+			Router: options.Router,
+
+			Sources: []source.Source{
+				istio.New(cluster.Client, namespaces),
+				knative.New(cluster.Client, namespaces),
+			},
+
+			Logger: slog.Default(),
+
+			AddFunc: func(address string, hosts []string, ports []int) {
+				slog.InfoContext(ctx, "adding tunnel", "address", address, "hosts", hosts, "ports", ports)
+			},
+
+			DeleteFunc: func(address string, hosts []string, ports []int) {
+				slog.InfoContext(ctx, "removing tunnel", "address", address, "hosts", hosts, "ports", ports)
+			},
+
+			FailFunc: func(host string, err error) {
+				if err == nil {
+					slog.InfoContext(ctx, "host resolved", "host", host)
+					return
+				}
+
+				slog.WarnContext(ctx, "cannot resolve host", "host", host, "error", err)
+			},
+		})
+
+		if err != nil {
+			return err
+		}
+
+		starters = append(starters, catapult.Start, gateway.Start)
+		sources = append(sources, catapult, gateway)
+
+		if options.TUN && i == 0 {
+			tun, err := newTun(ctx, cluster.Client, catapult)
+
+			if err != nil {
+				return err
+			}
+
+			starters = append(starters, tun.Start)
+		}
 	}
 
 	// Share a cancellable context so the first failure tears down the other
@@ -94,19 +482,106 @@ func Connect(ctx context.Context, client kubernetes.Client, namespaces []string,
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	errs := make(chan error, 2)
+	reporter := status.New(status.ServerOptions{
+		Sources: sources,
+	})
+
+	starters = append(starters, reporter.Start)
+
+	if resolver != nil {
+		starters = append(starters, resolver.Start)
+	}
 
-	go func() {
-		errs <- catapult.Start(ctx)
-	}()
+	errs := make(chan error, len(starters))
 
-	go func() {
-		errs <- gateway.Start(ctx)
-	}()
+	for _, start := range starters {
+		go func() {
+			errs <- start(ctx)
+		}()
+	}
 
-	first := <-errs
+	result := <-errs
 	cancel()
-	second := <-errs
 
-	return errors.Join(first, second)
+	for range len(starters) - 1 {
+		result = errors.Join(result, <-errs)
+	}
+
+	return result
+}
+
+// clusterNetworks returns the catapult and gateway address ranges of the
+// i-th cluster. The primary keeps the ranges of a single-cluster session;
+// the others follow after the resolver's 127.246.0.0/16.
+func clusterNetworks(i int) (string, string, error) {
+	if i == 0 {
+		return "127.244.0.0/16", "127.245.0.0/16", nil
+	}
+
+	octet := 246 + 2*i
+
+	if octet+1 > 255 {
+		return "", "", errors.New("too many contexts, at most 5 are supported")
+	}
+
+	return fmt.Sprintf("127.%d.0.0/16", octet), fmt.Sprintf("127.%d.0.0/16", octet+1), nil
+}
+
+func sectionName(name, cluster string) string {
+	if cluster == "" {
+		return name
+	}
+
+	return name + "-" + cluster
+}
+
+// sectionTitle returns the hosts file section catapult and gateway would
+// use by themselves.
+func sectionTitle(name, cluster string) string {
+	if cluster == "" {
+		return name
+	}
+
+	return name + " " + cluster
+}
+
+// warnPrivilegedPorts points out that Linux reserves the ports below 1024,
+// where services commonly listen, for root.
+func warnPrivilegedPorts() {
+	if runtime.GOOS != "linux" {
+		return
+	}
+
+	data, err := os.ReadFile("/proc/sys/net/ipv4/ip_unprivileged_port_start")
+
+	if err != nil {
+		return
+	}
+
+	if start, _ := strconv.Atoi(strings.TrimSpace(string(data))); start > 0 {
+		cli.Warnf("Ports below %d need root, run 'sudo sysctl net.ipv4.ip_unprivileged_port_start=0' to forward them", start)
+	}
+}
+
+// clusterName turns a context name such as "arn:aws:eks:...:cluster/dev"
+// into a DNS label.
+func clusterName(context string) string {
+	var b strings.Builder
+
+	for _, r := range strings.ToLower(context) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+			continue
+		}
+
+		b.WriteRune('-')
+	}
+
+	name := strings.Trim(b.String(), "-")
+
+	if len(name) > 63 {
+		name = strings.Trim(name[len(name)-63:], "-")
+	}
+
+	return name
 }
@@ -0,0 +1,123 @@
+package connect
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/adrianliechti/go-cli"
+	"github.com/adrianliechti/loop/pkg/status"
+)
+
+var CommandStatus = &cli.Command{
+	Name:  "status",
+	Usage: "show tunnels of running connect sessions",
+
+	Action: func(ctx context.Context, cmd *cli.Command) error {
+		sessions, err := status.List(ctx)
+
+		if err != nil {
+			return err
+		}
+
+		if len(sessions) == 0 {
+			return errors.New("no running connect session found")
+		}
+
+		for _, s := range sessions {
+			if len(sessions) > 1 {
+				cli.Infof("Session %d (started %s)", s.PID, s.Started.Format("15:04:05"))
+			}
+
+			printTunnels(s.Tunnels)
+		}
+
+		return nil
+	},
+}
+
+func printTunnels(tunnels []status.Tunnel) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+
+	fmt.Fprintln(w, "ADDRESS\tHOSTS\tPORTS\tTARGET\tCONNS\tSENT\tRECEIVED\tLAST ERROR")
+
+	for _, t := range tunnels {
+		target := t.Target
+
+		if target == "" && len(t.Targets) > 0 {
+			target = t.Targets[0]
+		}
+
+		if target == "" {
+			target = "-"
+		}
+
+		if len(t.Targets) > 1 {
+			target = fmt.Sprintf("%s (+%d)", target, len(t.Targets)-1)
+		}
+
+		// hosts that could not be resolved have no address yet
+		address := t.Address
+
+		if address == "" {
+			address = "-"
+		}
+
+		lastError := "-"
+
+		if t.LastError != "" {
+			lastError = fmt.Sprintf("%s (%s)", t.LastError, t.LastErrorTime.Format("15:04:05"))
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\n",
+			address,
+			strings.Join(t.Hosts, ","),
+			formatPorts(t.Ports, t.UDPPorts),
+			target,
+			t.Active,
+			formatBytes(t.BytesSent),
+			formatBytes(t.BytesReceived),
+			lastError,
+		)
+	}
+}
+
+func formatPorts(ports, udpPorts []int) string {
+	var result []string
+
+	for _, p := range ports {
+		result = append(result, strconv.Itoa(p))
+	}
+
+	for _, p := range udpPorts {
+		result = append(result, strconv.Itoa(p)+"/udp")
+	}
+
+	if len(result) == 0 {
+		return "-"
+	}
+
+	return strings.Join(result, ",")
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,98 @@
+package connect
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"net/url"
+
+	"github.com/adrianliechti/loop/pkg/catapult"
+	"github.com/adrianliechti/loop/pkg/forward"
+	"github.com/adrianliechti/loop/pkg/kubernetes"
+	"github.com/adrianliechti/loop/pkg/tun"
+)
+
+// newTun routes the pod and service networks of a cluster to catapult,
+// which resolves ClusterIPs and pod IPs to their pods.
+func newTun(ctx context.Context, client kubernetes.Client, catapult *catapult.Catapult) (*tun.Tun, error) {
+	prefixes, err := clusterPrefixes(ctx, client)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return tun.New(tun.Options{
+		Prefixes: prefixes,
+
+		Dial: func(ctx context.Context, network string, addr netip.AddrPort) (net.Conn, error) {
+			var dial forward.DialFunc
+
+			if network == "udp" {
+				dial = catapult.LookupUDP(addr.Addr().String(), int(addr.Port()))
+			} else {
+				dial = catapult.Lookup(addr.Addr().String(), int(addr.Port()))
+			}
+
+			if dial == nil {
+				return nil, fmt.Errorf("no service or pod at %s", addr.Addr())
+			}
+
+			return dial(ctx)
+		},
+
+		Logger: slog.Default(),
+	}), nil
+}
+
+// clusterPrefixes returns the pod and service CIDRs of both families. A
+// range holding the API server address is left out, or the connection to
+// it would be routed into the tunnel it carries.
+func clusterPrefixes(ctx context.Context, client kubernetes.Client) ([]netip.Prefix, error) {
+	var cidrs []string
+
+	if pods, err := client.PodCIDRs(ctx); err == nil {
+		cidrs = append(cidrs, pods...)
+	} else {
+		slog.WarnContext(ctx, "cannot determine pod CIDRs, routing service CIDRs only", "error", err)
+	}
+
+	services, err := client.ServiceCIDRs(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	cidrs = append(cidrs, services...)
+
+	var apiServer netip.Addr
+
+	if u, err := url.Parse(client.Config().Host); err == nil {
+		apiServer, _ = netip.ParseAddr(u.Hostname())
+	}
+
+	var result []netip.Prefix
+
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if apiServer.IsValid() && prefix.Contains(apiServer) {
+			slog.WarnContext(ctx, "not routing the range of the API server", "prefix", prefix)
+			continue
+		}
+
+		result = append(result, prefix)
+	}
+
+	if len(result) == 0 {
+		return nil, errors.New("no cluster networks to route")
+	}
+
+	return result, nil
+}
@@ -12,6 +12,15 @@ var KubeconfigFlag = &cli.StringFlag{
 	Usage: "path to the kubeconfig file",
 }
 
+var ContextsFlag = &cli.StringSliceFlag{
+	Name:  "context",
+	Usage: "kubeconfig contexts to use",
+}
+
+func Contexts(ctx context.Context, cmd *cli.Command) []string {
+	return cmd.StringSlice(ContextsFlag.Name)
+}
+
 func Client(ctx context.Context, cmd *cli.Command) (kubernetes.Client, error) {
 	return ClientWithContext(ctx, cmd, "")
 }
@@ -0,0 +1,74 @@
+package helper
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strconv"
+
+	"github.com/adrianliechti/go-cli"
+	"github.com/adrianliechti/loop/pkg/helper"
+	"github.com/adrianliechti/loop/pkg/system"
+)
+
+var Command = &cli.Command{
+	Name:  "helper",
+	Usage: "apply hosts and loopback changes for an unprivileged connect session",
+
+	Hidden:          true,
+	HideHelpCommand: true,
+
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "socket",
+			Usage:    "unix socket to listen on",
+			Required: true,
+		},
+
+		&cli.StringFlag{
+			Name:     "uid",
+			Usage:    "user allowed to connect",
+			Required: true,
+		},
+
+		&cli.StringFlag{
+			Name:  "pid",
+			Usage: "client process to follow",
+		},
+	},
+
+	Action: func(ctx context.Context, cmd *cli.Command) error {
+		elevated, err := system.IsElevated()
+
+		if err != nil {
+			return err
+		}
+
+		if !elevated {
+			return errors.New("the helper must be run as root")
+		}
+
+		uid, err := strconv.Atoi(cmd.String("uid"))
+
+		if err != nil {
+			return err
+		}
+
+		var pid int
+
+		if value := cmd.String("pid"); value != "" {
+			if pid, err = strconv.Atoi(value); err != nil {
+				return err
+			}
+		}
+
+		return helper.New(helper.ServerOptions{
+			Path: cmd.String("socket"),
+
+			UID: uid,
+			PID: pid,
+
+			Logger: slog.Default(),
+		}).Start(ctx)
+	},
+}
@@ -0,0 +1,74 @@
+package intercept
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/adrianliechti/go-cli"
+	"github.com/adrianliechti/loop/pkg/kubernetes"
+	"github.com/adrianliechti/loop/pkg/remote/intercept"
+
+	"k8s.io/client-go/rest"
+)
+
+// GuardCommand runs in the intercept pod; see intercept.Guard.
+var GuardCommand = &cli.Command{
+	Name:  "intercept-guard",
+	Usage: "restore an intercepted service once its session stops renewing the lease",
+
+	Hidden:          true,
+	HideHelpCommand: true,
+
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "namespace",
+			Usage:    "namespace of the intercept",
+			Required: true,
+		},
+
+		&cli.StringFlag{
+			Name:     "name",
+			Usage:    "intercept pod, account and lease",
+			Required: true,
+		},
+
+		&cli.StringFlag{
+			Name:     "service",
+			Usage:    "intercepted service",
+			Required: true,
+		},
+
+		&cli.StringFlag{
+			Name:     "labels",
+			Usage:    "labels of the intercept pod, as JSON",
+			Required: true,
+		},
+	},
+
+	Action: func(ctx context.Context, cmd *cli.Command) error {
+		var labels map[string]string
+
+		if err := json.Unmarshal([]byte(cmd.String("labels")), &labels); err != nil {
+			return err
+		}
+
+		config, err := rest.InClusterConfig()
+
+		if err != nil {
+			return err
+		}
+
+		client, err := kubernetes.NewFromConfig(config, cmd.String("namespace"))
+
+		if err != nil {
+			return err
+		}
+
+		return intercept.Guard(ctx, client, cmd.String("namespace"), intercept.GuardOptions{
+			Name:    cmd.String("name"),
+			Service: cmd.String("service"),
+
+			Labels: labels,
+		})
+	},
+}
@@ -0,0 +1,56 @@
+package intercept
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/adrianliechti/go-cli"
+	"github.com/adrianliechti/loop/app"
+	"github.com/adrianliechti/loop/pkg/remote/intercept"
+)
+
+var Command = &cli.Command{
+	Name:  "intercept",
+	Usage: "route a service's cluster traffic to a local process",
+
+	ArgsUsage: "svc/name",
+
+	HideHelpCommand: true,
+
+	Flags: []cli.Flag{
+		app.NamespaceFlag,
+
+		&cli.StringSliceFlag{
+			Name:  "port",
+			Usage: "service port to intercept and the local port to send it to (e.g. 8080:3000, or 8080 for both)",
+		},
+	},
+
+	Action: func(ctx context.Context, cmd *cli.Command) error {
+		client := app.MustClient(ctx, cmd)
+
+		if cmd.Args().Len() != 1 {
+			return errors.New("exactly one service is required, e.g. svc/orders")
+		}
+
+		name := cmd.Args().First()
+
+		for _, prefix := range []string{"svc/", "service/", "services/"} {
+			name = strings.TrimPrefix(name, prefix)
+		}
+
+		ports, err := intercept.ParsePorts(cmd.StringSlice("port"))
+
+		if err != nil {
+			return err
+		}
+
+		return intercept.Run(ctx, client, &intercept.RunOptions{
+			Namespace: app.Namespace(ctx, cmd),
+			Service:   name,
+
+			Ports: ports,
+		})
+	},
+}
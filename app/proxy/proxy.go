@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+
+	"github.com/adrianliechti/go-cli"
+	"github.com/adrianliechti/loop/app"
+	"github.com/adrianliechti/loop/pkg/catapult"
+	"github.com/adrianliechti/loop/pkg/gateway"
+	"github.com/adrianliechti/loop/pkg/kubernetes"
+	"github.com/adrianliechti/loop/pkg/proxy"
+	"github.com/adrianliechti/loop/pkg/source"
+	"github.com/adrianliechti/loop/pkg/source/istio"
+	"github.com/adrianliechti/loop/pkg/source/knative"
+)
+
+var Command = &cli.Command{
+	Name:  "proxy",
+	Usage: "serve a SOCKS5 and HTTP proxy into the Kubernetes network, no root required",
+
+	HideHelpCommand: true,
+
+	Flags: []cli.Flag{
+		app.ScopeFlag,
+		app.NamespacesFlag,
+
+		&cli.StringFlag{
+			Name:  "address",
+			Usage: "address to listen on (default " + proxy.DefaultAddress + ")",
+		},
+	},
+
+	Action: func(ctx context.Context, cmd *cli.Command) error {
+		client := app.MustClient(ctx, cmd)
+
+		return Proxy(ctx, client, &ProxyOptions{
+			Address: cmd.String("address"),
+
+			Scope:      app.Scope(ctx, cmd),
+			Namespaces: app.Namespaces(ctx, cmd),
+		})
+	},
+}
+
+type ProxyOptions struct {
+	Address string
+
+	Scope      string
+	Namespaces []string
+}
+
+// Proxy resolves the names catapult and gateway would publish, plus
+// ClusterIPs and pod IPs, without touching the hosts file or the network
+// configuration.
+func Proxy(ctx context.Context, client kubernetes.Client, options *ProxyOptions) error {
+	if options == nil {
+		options = new(ProxyOptions)
+	}
+
+	address := options.Address
+
+	if address == "" {
+		address = proxy.DefaultAddress
+	}
+
+	scope := options.Scope
+	namespaces := options.Namespaces
+
+	if scope == "" && len(namespaces) > 0 {
+		scope = namespaces[0]
+	}
+
+	if scope == "" {
+		scope = client.Namespace()
+	}
+
+	catapult, err := catapult.New(client, catapult.CatapultOptions{
+		Scope:      scope,
+		Namespaces: namespaces,
+
+		Virtual: true,
+
+		Logger: slog.Default(),
+	})
+
+	if err != nil {
+		return err
+	}
+
+	gateway, err := gateway.New(client, gateway.GatewayOptions{
+		Namespaces: namespaces,
+
+		Sources: []source.Source{
+			istio.New(client, namespaces),
+			knative.New(client, namespaces),
+		},
+
+		Virtual: true,
+
+		Logger: slog.Default(),
+	})
+
+	if err != nil {
+		return err
+	}
+
+	server := proxy.New(proxy.ServerOptions{
+		Address: address,
+
+		Resolvers: []proxy.Resolver{
+			catapult,
+			gateway,
+		},
+
+		Logger: slog.Default(),
+	})
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	starters := []func(context.Context) error{
+		catapult.Start,
+		gateway.Start,
+		server.Start,
+	}
+
+	errs := make(chan error, len(starters))
+
+	for _, start := range starters {
+		go func() {
+			errs <- start(ctx)
+		}()
+	}
+
+	cli.Info("★ Proxy ready, e.g. curl --proxy socks5h://" + address + " http://<service>.<namespace>")
+
+	result := <-errs
+	cancel()
+
+	for range len(starters) - 1 {
+		result = errors.Join(result, <-errs)
+	}
+
+	return result
+}
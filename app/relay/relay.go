@@ -0,0 +1,30 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"os"
+
+	"github.com/adrianliechti/go-cli"
+	"github.com/adrianliechti/loop/pkg/jump"
+)
+
+var Command = &cli.Command{
+	Name:  "relay",
+	Usage: "relay framed datagrams between stdio and a UDP address inside a loop-tunnel pod",
+
+	ArgsUsage: "<address>",
+
+	Hidden:          true,
+	HideHelpCommand: true,
+
+	Action: func(ctx context.Context, cmd *cli.Command) error {
+		address := cmd.Args().First()
+
+		if address == "" {
+			return errors.New("address missing")
+		}
+
+		return jump.Relay(ctx, os.Stdin, os.Stdout, address)
+	},
+}
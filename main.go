@@ -12,12 +12,18 @@ import (
 	"github.com/adrianliechti/loop/app"
 	"github.com/adrianliechti/loop/app/bridge"
 	"github.com/adrianliechti/loop/app/build"
+	"github.com/adrianliechti/loop/app/cleanup"
 	"github.com/adrianliechti/loop/app/connect"
 	"github.com/adrianliechti/loop/app/docker"
 	"github.com/adrianliechti/loop/app/granite"
+	"github.com/adrianliechti/loop/app/helper"
+	"github.com/adrianliechti/loop/app/intercept"
 	"github.com/adrianliechti/loop/app/prism"
+	"github.com/adrianliechti/loop/app/proxy"
+	"github.com/adrianliechti/loop/app/relay"
 	"github.com/adrianliechti/loop/app/run"
 	"github.com/adrianliechti/loop/app/tunnel"
+	"github.com/adrianliechti/loop/pkg/session"
 
 	"github.com/lmittmann/tint"
 )
@@ -33,6 +39,10 @@ func main() {
 		TimeFormat: time.Kitchen,
 	})))
 
+	if recoverable(os.Args) {
+		recoverSessions(ctx)
+	}
+
 	app := initApp()
 
 	if err := app.Run(ctx, os.Args); err != nil {
@@ -57,7 +67,10 @@ func initApp() cli.Command {
 			bridge.Command,
 
 			connect.Command,
+			proxy.Command,
 			tunnel.Command,
+			intercept.Command,
+			intercept.GuardCommand,
 
 			run.Command,
 
@@ -66,6 +79,44 @@ func initApp() cli.Command {
 
 			build.Command,
 			docker.Command,
+
+			cleanup.Command,
+			helper.Command,
+			relay.Command,
 		},
 	}
 }
+
+// recoverable reports whether a command may start with a session recovery.
+// The helper runs under sudo on behalf of a session, relay and
+// intercept-guard run in pods, and printing the version needs no cluster.
+func recoverable(args []string) bool {
+	if len(args) < 2 {
+		return true
+	}
+
+	switch args[1] {
+	case "helper", "relay", "intercept-guard", "version", "--version", "-v":
+		return false
+	}
+
+	return true
+}
+
+// recoverSessions rolls back what crashed sessions left behind. Anything
+// that needs more permissions than this process has is left for
+// `loop cleanup`.
+func recoverSessions(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	sessions, err := session.Recover(ctx)
+
+	if err != nil {
+		slog.Debug("failed to roll back stale sessions", "error", err)
+	}
+
+	if len(sessions) > 0 {
+		cli.Warnf("Crashed loop sessions left changes behind, run 'sudo loop cleanup' to remove them")
+	}
+}
@@ -0,0 +1,294 @@
+package address
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rogpeppe/go-internal/lockedfile"
+)
+
+const (
+	// retention is how long an unused assignment keeps its address reserved.
+	retention = 30 * 24 * time.Hour
+
+	// idleSessions is how many sessions may pass without using a key before
+	// its assignment is dropped, so keys of deleted services do not pile up.
+	idleSessions = 20
+)
+
+// Allocator hands out loopback addresses for keys such as "namespace/name".
+// A key starts at an address derived from its hash and probes linearly to the
+// next free one on collision, so the same set of keys always yields the same
+// addresses. Assignments are persisted, so a key keeps its address across
+// sessions even if other keys joined in between. The file is read and
+// written under one lock, so concurrent sessions sharing it never hand out
+// the same address twice or lose each other's assignments.
+type Allocator struct {
+	options AllocatorOptions
+	network netip.Prefix
+
+	mu      sync.Mutex
+	entries map[string]*entry
+	owners  map[netip.Addr]string
+	active  map[string]bool
+}
+
+type AllocatorOptions struct {
+	// Network is the IPv4 range addresses are taken from, e.g. 127.244.0.0/16.
+	Network string
+
+	// Path is the file assignments are persisted to; empty keeps them in
+	// memory only.
+	Path string
+
+	Logger *slog.Logger
+}
+
+type entry struct {
+	Address netip.Addr `json:"address"`
+	Used    time.Time  `json:"used"`
+
+	// Sessions counts the sessions started since the key was last used.
+	Sessions int `json:"sessions,omitempty"`
+}
+
+func New(options AllocatorOptions) (*Allocator, error) {
+	network, err := netip.ParsePrefix(options.Network)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !network.Addr().Is4() || network.Bits() > 30 {
+		return nil, fmt.Errorf("invalid address range %s", options.Network)
+	}
+
+	a := &Allocator{
+		options: options,
+		network: network.Masked(),
+
+		entries: make(map[string]*entry),
+		owners:  make(map[netip.Addr]string),
+		active:  make(map[string]bool),
+	}
+
+	// every session ages the assignments it finds
+	a.update(func() error {
+		for _, e := range a.entries {
+			e.Sessions++
+		}
+
+		return nil
+	})
+
+	return a, nil
+}
+
+// DefaultPath returns the file assignments of the named allocator are
+// persisted to, or an empty string if there is no config directory.
+func DefaultPath(name string) string {
+	dir, err := os.UserConfigDir()
+
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(dir, "loop", name+"-addresses.json")
+}
+
+// Allocate returns the address assigned to key, assigning one on first use.
+func (a *Allocator) Allocate(key string) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if e, ok := a.entries[key]; ok && a.active[key] {
+		return e.Address.String(), nil
+	}
+
+	var addr netip.Addr
+
+	err := a.update(func() error {
+		if e, ok := a.entries[key]; ok && a.owners[e.Address] == key {
+			e.Used = time.Now()
+			e.Sessions = 0
+
+			addr = e.Address
+			a.active[key] = true
+
+			a.log("address assigned", "key", key, "address", addr)
+			return nil
+		}
+
+		free, probes, err := a.probe(key)
+
+		if err != nil {
+			return err
+		}
+
+		addr = free
+
+		a.entries[key] = &entry{Address: addr, Used: time.Now()}
+		a.owners[addr] = key
+		a.active[key] = true
+
+		if probes > 0 {
+			a.log("address assigned", "key", key, "address", addr, "collisions", probes)
+		} else {
+			a.log("address assigned", "key", key, "address", addr)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	return addr.String(), nil
+}
+
+// probe finds the first free address in the key's sequence. Addresses held
+// by keys that are not in use this session stay reserved unless they expired.
+func (a *Allocator) probe(key string) (netip.Addr, int, error) {
+	size := uint32(1) << (32 - a.network.Bits())
+	base := binary.BigEndian.Uint32(a.network.Addr().AsSlice())
+
+	h := md5.Sum([]byte(key))
+	offset := binary.BigEndian.Uint32(h[:4]) & (size - 1)
+
+	for i := range size {
+		n := (offset + i) & (size - 1)
+
+		// skip the network and broadcast address of the range
+		if n == 0 || n == size-1 {
+			continue
+		}
+
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], base+n)
+
+		addr := netip.AddrFrom4(b)
+		owner, taken := a.owners[addr]
+
+		if taken && (a.active[owner] || time.Since(a.entries[owner].Used) < retention) {
+			continue
+		}
+
+		if taken {
+			delete(a.entries, owner)
+			delete(a.owners, addr)
+		}
+
+		return addr, int(i), nil
+	}
+
+	return netip.Addr{}, 0, fmt.Errorf("no free address left in %s", a.network)
+}
+
+// update runs fn on the assignments as persisted, then persists them
+// again, all under the file lock. A failure to read or write the file only
+// costs stability across restarts, so it is logged and fn runs on the
+// assignments in memory instead.
+func (a *Allocator) update(fn func() error) error {
+	if a.options.Path == "" {
+		return fn()
+	}
+
+	var result error
+	var called bool
+
+	err := os.MkdirAll(filepath.Dir(a.options.Path), 0755)
+
+	if err == nil {
+		err = lockedfile.Transform(a.options.Path, func(data []byte) ([]byte, error) {
+			called = true
+
+			if err := a.merge(data); err != nil {
+				a.logError("failed to load address assignments", err)
+			}
+
+			if result = fn(); result != nil {
+				return nil, result
+			}
+
+			return json.MarshalIndent(a.entries, "", "  ")
+		})
+	}
+
+	if !called {
+		a.logError("failed to load address assignments", err)
+		return fn()
+	}
+
+	if err != nil && result == nil {
+		a.logError("failed to save address assignments", err)
+	}
+
+	return result
+}
+
+// merge replaces the assignments with the persisted ones, dropping those
+// expired or idle for too long, while the keys in use by this session keep
+// their addresses.
+func (a *Allocator) merge(data []byte) error {
+	entries := make(map[string]*entry)
+
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return err
+		}
+	}
+
+	active := make(map[string]*entry)
+
+	for key := range a.active {
+		active[key] = a.entries[key]
+	}
+
+	clear(a.entries)
+	clear(a.owners)
+
+	for key, e := range active {
+		a.entries[key] = e
+		a.owners[e.Address] = key
+	}
+
+	for key, e := range entries {
+		if _, ok := active[key]; ok {
+			continue
+		}
+
+		if e == nil || !a.network.Contains(e.Address) || time.Since(e.Used) > retention || e.Sessions > idleSessions {
+			continue
+		}
+
+		if _, taken := a.owners[e.Address]; taken {
+			continue
+		}
+
+		a.entries[key] = e
+		a.owners[e.Address] = key
+	}
+
+	return nil
+}
+
+func (a *Allocator) log(msg string, args ...any) {
+	if a.options.Logger != nil {
+		a.options.Logger.Info(msg, args...)
+	}
+}
+
+func (a *Allocator) logError(msg string, err error) {
+	if a.options.Logger != nil {
+		a.options.Logger.Error(msg, "error", err)
+	}
+}
@@ -0,0 +1,160 @@
+package address
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestAllocateUnique(t *testing.T) {
+	// a /28 has 14 usable addresses, so most keys collide
+	a, err := New(AllocatorOptions{Network: "127.244.0.0/28"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[string]string)
+
+	for i := range 14 {
+		key := fmt.Sprintf("shop/svc-%d", i)
+		addr, err := a.Allocate(key)
+
+		if err != nil {
+			t.Fatalf("%s: %v", key, err)
+		}
+
+		if addr == "127.244.0.0" || addr == "127.244.0.15" {
+			t.Errorf("%s: got reserved address %s", key, addr)
+		}
+
+		if other, ok := seen[addr]; ok {
+			t.Fatalf("%s and %s both got %s", other, key, addr)
+		}
+
+		seen[addr] = key
+
+		if again, _ := a.Allocate(key); again != addr {
+			t.Errorf("%s: got %s, then %s", key, addr, again)
+		}
+	}
+
+	if _, err := a.Allocate("shop/one-too-many"); err == nil {
+		t.Error("expected error once the range is exhausted")
+	}
+}
+
+func TestAllocateDeterministic(t *testing.T) {
+	keys := []string{"shop/orders", "shop/payments", "shop/web", "db/postgres"}
+
+	allocate := func() []string {
+		a, err := New(AllocatorOptions{Network: "127.244.0.0/29"})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var result []string
+
+		for _, key := range keys {
+			addr, err := a.Allocate(key)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			result = append(result, addr)
+		}
+
+		return result
+	}
+
+	first, second := allocate(), allocate()
+
+	for i := range keys {
+		if first[i] != second[i] {
+			t.Errorf("%s: got %s, then %s", keys[i], first[i], second[i])
+		}
+	}
+}
+
+func TestAllocatePersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "addresses.json")
+
+	a, err := New(AllocatorOptions{Network: "127.244.0.0/16", Path: path})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	orders, _ := a.Allocate("shop/orders")
+
+	// a new session hands out the address of the previous one
+	b, err := New(AllocatorOptions{Network: "127.244.0.0/16", Path: path})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if addr, _ := b.Allocate("shop/orders"); addr != orders {
+		t.Errorf("want %s after restart, got %s", orders, addr)
+	}
+
+	c, err := New(AllocatorOptions{Network: "127.245.0.0/16", Path: path})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if addr, _ := c.Allocate("shop/orders"); addr == orders {
+		t.Errorf("assignment outside the range was reused: %s", addr)
+	}
+}
+
+func TestAllocateShared(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "addresses.json")
+
+	// two sessions running at once, both probing the same tiny range
+	a, _ := New(AllocatorOptions{Network: "127.244.0.0/29", Path: path})
+	b, _ := New(AllocatorOptions{Network: "127.244.0.0/29", Path: path})
+
+	seen := make(map[string]string)
+
+	for i := range 6 {
+		allocator := a
+
+		if i%2 == 1 {
+			allocator = b
+		}
+
+		key := fmt.Sprintf("shop/svc-%d", i)
+		addr, err := allocator.Allocate(key)
+
+		if err != nil {
+			t.Fatalf("%s: %v", key, err)
+		}
+
+		if other, ok := seen[addr]; ok {
+			t.Fatalf("%s and %s both got %s", other, key, addr)
+		}
+
+		seen[addr] = key
+	}
+}
+
+func TestAllocatePrunesIdleKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "addresses.json")
+
+	a, _ := New(AllocatorOptions{Network: "127.244.0.0/16", Path: path})
+	a.Allocate("shop/deleted")
+
+	for range idleSessions + 1 {
+		New(AllocatorOptions{Network: "127.244.0.0/16", Path: path})
+	}
+
+	b, _ := New(AllocatorOptions{Network: "127.244.0.0/16", Path: path})
+
+	if _, ok := b.entries["shop/deleted"]; ok {
+		t.Error("idle assignment was kept")
+	}
+}
@@ -2,24 +2,31 @@ package catapult
 
 import (
 	"context"
-	"crypto/md5"
-	"errors"
 	"fmt"
-	"io"
 	"log/slog"
 	"maps"
 	"net"
 	"slices"
+	"strconv"
+	"strings"
 	"sync"
-	"time"
 
+	"github.com/adrianliechti/loop/pkg/address"
+	"github.com/adrianliechti/loop/pkg/filter"
+	"github.com/adrianliechti/loop/pkg/forward"
+	"github.com/adrianliechti/loop/pkg/hostname"
+	"github.com/adrianliechti/loop/pkg/jump"
 	"github.com/adrianliechti/loop/pkg/kubernetes"
+	"github.com/adrianliechti/loop/pkg/reconcile"
+	"github.com/adrianliechti/loop/pkg/source"
+	"github.com/adrianliechti/loop/pkg/status"
 	"github.com/adrianliechti/loop/pkg/system"
 
 	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/fields"
-	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/tools/cache"
 )
 
@@ -27,19 +34,67 @@ type Catapult struct {
 	client  kubernetes.Client
 	options CatapultOptions
 
-	hosts *system.HostsSection
+	loopback  system.Loopback
+	addresses *address.Allocator
 
-	tunnels []*tunnel
+	reconciler *reconcile.Reconciler[*tunnel]
 
-	mu       sync.Mutex
-	pods     map[string]corev1.Pod
-	services map[string]corev1.Service
+	// sources are catapult's own, for Services, followed by those of the
+	// options.
+	sources []source.Source
+
+	mu             sync.Mutex
+	relays         map[string]*jump.Pod
+	pods           map[string]corev1.Pod
+	services       map[string]corev1.Service
+	endpointslices map[string]discoveryv1.EndpointSlice
 }
 
 type CatapultOptions struct {
 	Scope      string
 	Namespaces []string
 
+	// Cluster qualifies every name with a suffix, e.g. orders.shop.staging,
+	// so several clusters can be connected at once. Primary publishes the
+	// regular names as well.
+	Cluster string
+	Primary bool
+
+	// Names replaces the names of services and bare pods, e.g. with
+	// orders.shop.dev.internal, along with those of headless endpoints, pod
+	// IPs and SRV targets, e.g. db-0.db.shop.dev.internal.
+	Names *hostname.Names
+
+	// Hosts publishes the tunnel names; defaults to a section of the
+	// system hosts file.
+	Hosts system.Hosts
+
+	// Loopback adds the tunnel addresses to the loopback interface;
+	// defaults to changing it directly.
+	Loopback system.Loopback
+
+	// Filter selects the resources to expose; nil exposes all of them.
+	Filter *filter.Filter
+
+	// Sources add names for services from resources beyond Services; only
+	// routes naming their Service are used. See the packages under source.
+	Sources []source.Source
+
+	// Addresses assigns the local tunnel addresses; defaults to an allocator
+	// over 127.244.0.0/16 persisted in the user config directory.
+	Addresses *address.Allocator
+
+	// Jump carries every connection through a single loop-tunnel pod, which
+	// dials the service ClusterIP over SSH instead of port-forwarding to a
+	// pod. Traffic is then load balanced and policed as for in-cluster
+	// clients, and only the jump pod needs pods/portforward.
+	Jump *jump.Pod
+
+	// Virtual keeps the tunnels off the network: nothing is aliased or
+	// bound, connections come in through Lookup instead, e.g. from the
+	// rootless proxy. Names are not published unless Hosts is set.
+	Virtual bool
+
 	Logger *slog.Logger
 
 	AddFunc    func(address string, hosts []string, ports []int)
@@ -47,250 +102,921 @@ type CatapultOptions struct {
 }
 
 func New(client kubernetes.Client, options CatapultOptions) (*Catapult, error) {
-	hosts, err := system.NewHostsSection("Loop Catapult")
+	hosts := options.Hosts
 
-	if err != nil {
-		return nil, err
+	if hosts == nil && options.Virtual {
+		hosts = system.DiscardHosts
+	}
+
+	if hosts == nil {
+		name := "Loop Catapult"
+
+		if options.Cluster != "" {
+			name += " " + options.Cluster
+		}
+
+		section, err := system.NewHostsSection(name)
+
+		if err != nil {
+			return nil, err
+		}
+
+		hosts = section
+	}
+
+	loopback := options.Loopback
+
+	if loopback == nil {
+		loopback = system.DefaultLoopback
+	}
+
+	addresses := options.Addresses
+
+	if addresses == nil {
+		name := "catapult"
+
+		if options.Cluster != "" {
+			name += "-" + options.Cluster
+		}
+
+		path := address.DefaultPath(name)
+
+		// virtual addresses only identify tunnels, nothing to keep stable
+		if options.Virtual {
+			path = ""
+		}
+
+		allocator, err := address.New(address.AllocatorOptions{
+			Network: "127.244.0.0/16",
+			Path:    path,
+
+			Logger: options.Logger,
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		addresses = allocator
 	}
 
-	return &Catapult{
+	c := &Catapult{
 		client:  client,
 		options: options,
 
-		hosts: hosts,
+		loopback:  loopback,
+		addresses: addresses,
 
-		tunnels: make([]*tunnel, 0),
+		reconciler: reconcile.New[*tunnel](reconcile.Options{
+			Hosts:  hosts,
+			Logger: options.Logger,
+
+			AddFunc:    options.AddFunc,
+			DeleteFunc: options.DeleteFunc,
+		}),
+
+		relays:         make(map[string]*jump.Pod),
+		pods:           make(map[string]corev1.Pod),
+		services:       make(map[string]corev1.Service),
+		endpointslices: make(map[string]discoveryv1.EndpointSlice),
+	}
 
-		pods:     make(map[string]corev1.Pod),
-		services: make(map[string]corev1.Service),
-	}, nil
+	c.sources = slices.Concat([]source.Source{&serviceSource{c: c}}, options.Sources)
+
+	return c, nil
 }
 
 func (c *Catapult) Start(ctx context.Context) error {
-	c.hosts.Clear()
-	c.hosts.Flush()
+	c.reconciler.Reset()
+
 	defer func() {
-		c.hosts.Clear()
-		c.hosts.Flush()
-		for _, t := range c.tunnels {
-			t.Stop()
+		c.reconciler.Close()
+
+		c.mu.Lock()
+		relays := slices.Collect(maps.Values(c.relays))
+		c.mu.Unlock()
+
+		for _, r := range relays {
+			r.Close()
 		}
 	}()
 
-	namespaces := c.options.Namespaces
+	for _, namespace := range c.namespaces() {
+		if err := c.watchPods(ctx, c.client, namespace); err != nil {
+			return err
+		}
 
-	if len(namespaces) == 0 {
-		namespaces = []string{""}
+		if err := c.watchEndpointSlices(ctx, c.client, namespace); err != nil {
+			return err
+		}
 	}
 
-	for _, namespace := range namespaces {
-		if err := c.watchPods(ctx, c.client, namespace); err != nil {
-			return err
+	for _, s := range c.sources {
+		err := s.Start(ctx, c.notify)
+
+		if err == nil {
+			continue
 		}
 
-		if err := c.watchServices(ctx, c.client, namespace); err != nil {
+		// Added sources are optional extras; one the user cannot read must
+		// not keep the others from working.
+		if !slices.Contains(c.options.Sources, s) {
 			return err
 		}
+
+		if c.options.Logger != nil {
+			c.options.Logger.WarnContext(ctx, "failed to start source", "source", s.Name(), "error", err)
+		}
 	}
 
-	if err := c.Refresh(ctx); err != nil {
+	if err := c.options.Filter.Watch(ctx, c.client, c.notify, c.options.Logger); err != nil {
 		return err
 	}
 
-	for {
-		select {
-		case <-time.After(10 * time.Second):
-		case <-ctx.Done():
-			return nil
-		}
+	return c.reconciler.Run(ctx, c.Refresh)
+}
 
-		if err := c.Refresh(ctx); err != nil {
-			if c.options.Logger != nil {
-				c.options.Logger.ErrorContext(ctx, "refresh failed", "error", err)
-			}
-		}
+// namespaces returns the namespaces to watch, "" for all of them.
+func (c *Catapult) namespaces() []string {
+	if len(c.options.Namespaces) == 0 {
+		return []string{""}
 	}
+
+	return c.options.Namespaces
 }
 
-func (c *Catapult) Refresh(ctx context.Context) error {
-	var result error
+// Status reports the running tunnels.
+func (c *Catapult) Status() []status.Tunnel {
+	tunnels := c.reconciler.Tunnels()
 
+	result := make([]status.Tunnel, 0, len(tunnels))
+
+	for _, t := range tunnels {
+		s := t.Status()
+		s.Source = "catapult"
+		s.Cluster = c.options.Cluster
+
+		result = append(result, s)
+	}
+
+	return result
+}
+
+// notify schedules a refresh; events arriving while one is pending are
+// coalesced into it.
+func (c *Catapult) notify() {
+	c.reconciler.Notify()
+}
+
+func (c *Catapult) Refresh(ctx context.Context) error {
 	desired := c.listTunnel()
 
-	desiredByAddr := make(map[string]*tunnel, len(desired))
 	for _, t := range desired {
-		desiredByAddr[t.address] = t
+		t.Virtual = c.options.Virtual
+		t.Loopback = c.loopback
 	}
 
-	previousByAddr := make(map[string]*tunnel, len(c.tunnels))
-	for _, t := range c.tunnels {
-		previousByAddr[t.address] = t
+	return c.reconciler.Apply(ctx, desired)
+}
+
+func (c *Catapult) listTunnel() []*tunnel {
+	c.mu.Lock()
+	allServices := slices.Collect(maps.Values(c.services))
+	allSlices := slices.Collect(maps.Values(c.endpointslices))
+	allPods := slices.Collect(maps.Values(c.pods))
+	c.mu.Unlock()
+
+	// Manually managed slices often list pod IPs without a targetRef; fall
+	// back to the pod informer to find the pod to forward to.
+	podsByIP := make(map[string]corev1.Pod)
+	podsByName := make(map[string]corev1.Pod)
+
+	for _, pod := range allPods {
+		for _, ip := range pod.Status.PodIPs {
+			podsByIP[pod.Namespace+"/"+ip.IP] = pod
+		}
+
+		podsByName[reconcile.ResourceKey(&pod)] = pod
 	}
 
-	// Stop tunnels whose address is gone, OR whose descriptor changed
-	// (different hosts/ports/target pod). Anything still equivalent is reused.
-	for addr, t := range previousByAddr {
-		desiredT, kept := desiredByAddr[addr]
+	// pods behind a service are published through it and get no tunnel of
+	// their own
+	covered := make(map[string]bool)
 
-		if kept && t.equivalent(desiredT) {
+	slicesByService := make(map[string][]discoveryv1.EndpointSlice)
+
+	for _, slice := range allSlices {
+		name := slice.Labels[discoveryv1.LabelServiceName]
+
+		if name == "" {
 			continue
 		}
 
-		c.hosts.Remove(t.address)
+		key := slice.Namespace + "/" + name
+		slicesByService[key] = append(slicesByService[key], slice)
+	}
+
+	// Services claim addresses in a fixed order, so colliding names resolve
+	// the same way in every session.
+	slices.SortFunc(allServices, func(a, b corev1.Service) int {
+		return strings.Compare(reconcile.ResourceKey(&a), reconcile.ResourceKey(&b))
+	})
+
+	names := c.serviceNames()
+
+	tunnels := make([]*tunnel, 0)
 
-		if err := t.Stop(); err != nil {
-			result = errors.Join(result, err)
+	for _, service := range allServices {
+		if !c.options.Filter.Match(&service) {
 			continue
 		}
 
-		if c.options.DeleteFunc != nil {
-			c.options.DeleteFunc(t.address, t.hosts, slices.Collect(maps.Keys(t.ports)))
+		if service.Spec.Type == corev1.ServiceTypeExternalName {
+			if t := c.externalTunnel(service, names[reconcile.ResourceKey(&service)]); t != nil {
+				tunnels = append(tunnels, t)
+			}
+
+			continue
 		}
-	}
 
-	// Build the new active tunnel set. Reuse the prior tunnel object (keeping
-	// its running goroutine + cancel func) only when the descriptor is
-	// equivalent; otherwise start the new one.
-	next := make([]*tunnel, 0, len(desired))
+		var endpoints []endpoint
+		var hostnames []string
+		var aliases []string
+
+		for _, slice := range slicesByService[reconcile.ResourceKey(&service)] {
+			ports := selectPorts(service, corev1.ProtocolTCP, slice.Ports)
+			udpPorts := selectPorts(service, corev1.ProtocolUDP, slice.Ports)
+
+			for _, e := range slice.Endpoints {
+				// An unset condition means ready, as the API documents.
+				if !kubernetes.Deref(e.Conditions.Ready, true) {
+					continue
+				}
+
+				if len(e.Addresses) == 0 {
+					continue
+				}
+
+				name := ""
+				address := e.Addresses[0]
+
+				if e.TargetRef != nil && e.TargetRef.Kind == "Pod" {
+					name = e.TargetRef.Name
+				}
+
+				for _, addr := range e.Addresses {
+					if name != "" {
+						break
+					}
+
+					if pod, ok := podsByIP[slice.Namespace+"/"+addr]; ok {
+						name = pod.Name
+					}
+				}
+
+				// Addresses outside the pod network (external databases
+				// behind a selector-less service) are reached via the relay,
+				// as is everything through a jump pod.
+				if name != "" && c.options.Jump == nil {
+					address = ""
+				}
+
+				if slices.ContainsFunc(endpoints, func(e endpoint) bool { return e.name == name && e.address == address }) {
+					continue
+				}
+
+				endpoints = append(endpoints, endpoint{
+					name:    name,
+					address: address,
+					ip:      e.Addresses[0],
+
+					ports:    ports,
+					udpPorts: udpPorts,
+				})
+
+				if name != "" {
+					covered[slice.Namespace+"/"+name] = true
+				}
+
+				// cluster DNS names endpoints without a hostname after
+				// their IP, e.g. 10-0-0-5.db.shop.svc.cluster.local
+				alias := dashedIP(e.Addresses[0])
+				hostname := kubernetes.Deref(e.Hostname, "")
+
+				// a pod's hostname applies when its subdomain names the
+				// service, even where the slice leaves it out
+				if pod, ok := podsByName[slice.Namespace+"/"+name]; ok && hostname == "" && pod.Spec.Hostname != "" && pod.Spec.Subdomain == service.Name {
+					hostname = pod.Spec.Hostname
+				}
+
+				if hostname == "" {
+					hostname = name
+				}
+
+				if hostname == "" {
+					hostname = alias
+				}
+
+				hostnames = append(hostnames, hostname)
+				aliases = append(aliases, alias)
+			}
+		}
+
+		if service.Spec.ClusterIP == corev1.ClusterIPNone {
+			for i, e := range endpoints {
+				hosts := c.endpointHosts(service, hostnames[i], aliases[i], e.name)
+
+				// the endpoint tunnel reaches exactly this pod, so it serves
+				// the pod-IP names as well
+				if pod, ok := podsByName[service.Namespace+"/"+e.name]; ok && e.name != "" {
+					hosts = append(hosts, c.podIPHosts(pod)...)
+				}
+
+				if len(hosts) == 0 {
+					continue
+				}
+
+				address, ok := c.allocate(fmt.Sprintf("%s.%s.%s.svc.cluster.local", hostnames[i], service.Name, service.Namespace))
+
+				if !ok {
+					continue
+				}
+
+				t := c.newTunnel(service.Namespace, []endpoint{e}, address, e.ports, e.udpPorts, hosts)
+				t.SRV = c.serviceRecords(service, hostname.Fields{Hostname: hostnames[i], Pod: e.name}, e.ports, e.udpPorts)
+
+				tunnels = append(tunnels, t)
+			}
 
-	for _, t := range desired {
-		if prev, ok := previousByAddr[t.address]; ok && prev.equivalent(t) {
-			next = append(next, prev)
 			continue
 		}
 
-		if err := t.Start(ctx, nil); err != nil {
-			result = errors.Join(result, err)
+		if len(endpoints) == 0 {
 			continue
 		}
 
-		c.hosts.Add(t.address, t.hosts...)
+		slices.SortFunc(endpoints, func(a, b endpoint) int {
+			return strings.Compare(a.name+"/"+a.address, b.name+"/"+b.address)
+		})
+
+		// Listen on every service port any endpoint serves; the dialer skips
+		// endpoints that lack a port, e.g. mid-rollout of a renamed port.
+		ports := make(map[int]int)
+		udpPorts := make(map[int]int)
+
+		for _, e := range endpoints {
+			for s, t := range e.ports {
+				if _, ok := ports[s]; !ok {
+					ports[s] = t
+				}
+			}
+
+			for s, t := range e.udpPorts {
+				if _, ok := udpPorts[s]; !ok {
+					udpPorts[s] = t
+				}
+			}
+		}
+
+		// kube-proxy picks the pod behind the ClusterIP
+		if c.options.Jump != nil {
+			endpoints = []endpoint{jumpEndpoint(service.Spec.ClusterIP, ports, udpPorts)}
+
+			ports = endpoints[0].ports
+			udpPorts = endpoints[0].udpPorts
+		}
+
+		hosts := names[reconcile.ResourceKey(&service)]
+		address, ok := c.allocate(reconcile.ResourceKey(&service))
 
-		if c.options.AddFunc != nil {
-			c.options.AddFunc(t.address, t.hosts, slices.Collect(maps.Keys(t.ports)))
+		if !ok {
+			continue
 		}
 
-		next = append(next, t)
+		t := c.newTunnel(service.Namespace, endpoints, address, ports, udpPorts, hosts)
+		t.SRV = c.serviceRecords(service, hostname.Fields{}, ports, udpPorts)
+		t.IPs = service.Spec.ClusterIPs
+
+		tunnels = append(tunnels, t)
 	}
 
-	c.tunnels = next
+	slices.SortFunc(allPods, func(a, b corev1.Pod) int {
+		return strings.Compare(reconcile.ResourceKey(&a), reconcile.ResourceKey(&b))
+	})
+
+	// a service of the same name keeps the plain name
+	serviceNames := make(map[string]bool)
 
-	// Do not flush if context is cancelled - let defer cleanup handle it
-	if ctx.Err() != nil {
-		return ctx.Err()
+	for _, service := range allServices {
+		serviceNames[reconcile.ResourceKey(&service)] = true
 	}
 
-	if err := c.hosts.Flush(); err != nil {
-		return errors.Join(result, err)
+	for _, pod := range allPods {
+		key := reconcile.ResourceKey(&pod)
+
+		if covered[key] || !c.options.Filter.Match(&pod) {
+			continue
+		}
+
+		if t := c.podTunnel(pod, !serviceNames[key]); t != nil {
+			tunnels = append(tunnels, t)
+		}
 	}
 
-	return result
+	return tunnels
 }
 
-func (c *Catapult) listTunnel() []*tunnel {
+// Lookup returns a dialer for port on a service name or ClusterIP, or on a
+// pod IP, and nil if catapult does not know host.
+func (c *Catapult) Lookup(host string, port int) forward.DialFunc {
+	return c.lookup("tcp", host, port)
+}
+
+// LookupUDP is Lookup for UDP ports; each write on the connection it dials
+// is sent as one datagram.
+func (c *Catapult) LookupUDP(host string, port int) forward.DialFunc {
+	return c.lookup("udp", host, port)
+}
+
+func (c *Catapult) lookup(network, host string, port int) forward.DialFunc {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
 	c.mu.Lock()
-	allServices := slices.Collect(maps.Values(c.services))
-	allPods := slices.Collect(maps.Values(c.pods))
-	c.mu.Unlock()
+	defer c.mu.Unlock()
 
-	tunnels := make([]*tunnel, 0)
+	for _, t := range c.reconciler.Tunnels() {
+		if !slices.Contains(t.Names, host) && !slices.Contains(t.IPs, host) {
+			continue
+		}
 
-	for _, service := range allServices {
-		if len(service.Spec.Selector) == 0 {
+		ports := t.TCP
+
+		if network == "udp" {
+			ports = t.UDP
+		}
+
+		if _, ok := ports[port]; !ok {
+			return func(ctx context.Context) (net.Conn, error) {
+				return nil, fmt.Errorf("%s does not expose %s port %d", host, network, port)
+			}
+		}
+
+		return t.Dialer(network, port)
+	}
+
+	if net.ParseIP(host) == nil {
+		return nil
+	}
+
+	for _, pod := range c.pods {
+		if pod.Spec.HostNetwork || !c.options.Filter.Match(&pod) {
 			continue
 		}
 
-		matching := selectPods(allPods, service.Namespace, labels.SelectorFromSet(service.Spec.Selector))
+		if !slices.ContainsFunc(pod.Status.PodIPs, func(ip corev1.PodIP) bool { return ip.IP == host }) {
+			continue
+		}
 
-		if service.Spec.ClusterIP == corev1.ClusterIPNone {
-			for _, pod := range matching {
-				hosts := []string{
-					fmt.Sprintf("%s.%s.%s.svc.cluster.local", pod.Name, service.Name, service.Namespace),
-				}
+		// port-forwarding carries no UDP; the relay sends it to the pod IP
+		if c.options.Jump != nil || network != "tcp" {
+			return func(ctx context.Context) (net.Conn, error) {
+				return c.relay(pod.Namespace)(ctx, network, net.JoinHostPort(host, strconv.Itoa(port)))
+			}
+		}
+
+		return func(ctx context.Context) (net.Conn, error) {
+			return c.client.PodDial(ctx, pod.Namespace, pod.Name, network, port)
+		}
+	}
+
+	return nil
+}
+
+// jumpEndpoint returns an endpoint that the jump pod dials at address, on
+// the service ports rather than the pods' target ports.
+func jumpEndpoint(address string, ports, udpPorts map[int]int) endpoint {
+	e := endpoint{
+		address: address,
 
-				address := mapAddress(hosts[0])
-				ports := selectPorts(service, pod.Spec.Containers...)
+		ports:    make(map[int]int),
+		udpPorts: make(map[int]int),
+	}
+
+	for port := range ports {
+		e.ports[port] = port
+	}
 
-				tunnels = append(tunnels, newTunnel(c.client, pod.Namespace, pod.Name, address, ports, hosts))
+	for port := range udpPorts {
+		e.udpPorts[port] = port
+	}
+
+	return e
+}
+
+// podTunnel forwards the declared container ports of a pod that no service
+// covers, so single pods can be reached like a service: under its pod-IP
+// name, e.g. 10-0-0-5.shop.pod.cluster.local, and unless a service has the
+// same name, under its own. Pods behind a headless service get their pod-IP
+// names on its endpoint tunnels; those behind a ClusterIP are only reached
+// by IP through Lookup, rather than with an address each.
+func (c *Catapult) podTunnel(pod corev1.Pod, named bool) *tunnel {
+	if pod.Spec.HostNetwork || len(pod.Status.PodIPs) == 0 || !reconcile.PodReady(pod) {
+		return nil
+	}
+
+	ports := make(map[int]int)
+	udpPorts := make(map[int]int)
+
+	for _, container := range pod.Spec.Containers {
+		for _, port := range container.Ports {
+			if port.ContainerPort <= 0 {
+				continue
+			}
+
+			switch port.Protocol {
+			case "", corev1.ProtocolTCP:
+				ports[int(port.ContainerPort)] = int(port.ContainerPort)
+			case corev1.ProtocolUDP:
+				udpPorts[int(port.ContainerPort)] = int(port.ContainerPort)
 			}
+		}
+	}
+
+	e := endpoint{
+		name: pod.Name,
+		ip:   pod.Status.PodIPs[0].IP,
+
+		ports:    ports,
+		udpPorts: udpPorts,
+	}
+
+	// the jump pod dials the pod IP itself
+	if c.options.Jump != nil {
+		e.address = e.ip
+	}
+
+	if len(e.ports) == 0 && len(e.udpPorts) == 0 {
+		return nil
+	}
+
+	hosts := c.podIPHosts(pod)
+
+	for _, domain := range c.domains() {
+		if !named || c.options.Names != nil {
+			break
+		}
+
+		if domain != "svc.cluster.local" {
+			hosts = append(hosts, fmt.Sprintf("%s.%s.%s", pod.Name, pod.Namespace, domain))
+			continue
+		}
+
+		if pod.Namespace == c.options.Scope {
+			hosts = append(hosts, pod.Name)
+		}
+
+		hosts = append(hosts, fmt.Sprintf("%s.%s", pod.Name, pod.Namespace))
+	}
+
+	if names, ok := c.options.Names.Render(hostname.Fields{Service: pod.Name, Namespace: pod.Namespace, Cluster: c.options.Cluster, Pod: pod.Name}); ok && named {
+		hosts = append(hosts, names...)
+	}
+
+	if len(hosts) == 0 {
+		return nil
+	}
+
+	address, ok := c.allocate(hosts[0])
+
+	if !ok {
+		return nil
+	}
+
+	t := c.newTunnel(pod.Namespace, []endpoint{e}, address, e.ports, e.udpPorts, hosts)
+
+	return t
+}
+
+// podIPHosts returns the cluster DNS names of a pod's IPs, e.g.
+// 10-0-0-5.shop.pod.cluster.local. Templates render them like the pod's
+// own name, below it, e.g. 10-0-0-5.web-7f9c.shop.dev.internal.
+func (c *Catapult) podIPHosts(pod corev1.Pod) []string {
+	var hosts []string
+
+	if c.options.Names != nil {
+		for _, ip := range pod.Status.PodIPs {
+			names, _ := c.options.Names.Render(hostname.Fields{Service: pod.Name, Namespace: pod.Namespace, Cluster: c.options.Cluster, Hostname: dashedIP(ip.IP), Pod: pod.Name})
+			hosts = append(hosts, names...)
+		}
+
+		return hosts
+	}
+
+	for _, domain := range c.domains() {
+		podDomain := "pod." + domain
+
+		if domain == "svc.cluster.local" {
+			podDomain = "pod.cluster.local"
+		}
+
+		for _, ip := range pod.Status.PodIPs {
+			hosts = append(hosts, fmt.Sprintf("%s.%s.%s", dashedIP(ip.IP), pod.Namespace, podDomain))
+		}
+	}
+
+	return hosts
+}
+
+// externalTunnel maps an ExternalName service to a local address whose
+// connections are dialed from inside the cluster, so the target sees cluster
+// egress (e.g. a firewall-allowlisted managed database). Only the declared
+// TCP ports can be forwarded: without ports there is nothing to listen on,
+// and the relay only sends UDP to addresses, not names.
+func (c *Catapult) externalTunnel(service corev1.Service, hosts []string) *tunnel {
+	target := strings.TrimSuffix(service.Spec.ExternalName, ".")
 
+	if target == "" {
+		return nil
+	}
+
+	ports := make(map[int]int)
+
+	for _, port := range service.Spec.Ports {
+		if port.Protocol != "" && port.Protocol != corev1.ProtocolTCP {
 			continue
 		}
 
-		if len(matching) == 0 {
+		if port.Port > 0 {
+			ports[int(port.Port)] = int(port.Port)
+		}
+	}
+
+	if len(ports) == 0 {
+		return nil
+	}
+
+	address, ok := c.allocate(reconcile.ResourceKey(&service))
+
+	if !ok {
+		return nil
+	}
+
+	endpoints := []endpoint{
+		{address: target, ports: ports},
+	}
+
+	t := c.newTunnel(service.Namespace, endpoints, address, ports, nil, hosts)
+	t.SRV = c.serviceRecords(service, hostname.Fields{}, ports, nil)
+
+	return t
+}
+
+// allocate returns the local address for key, logging when none is left.
+func (c *Catapult) allocate(key string) (string, bool) {
+	address, err := c.addresses.Allocate(key)
+
+	if err != nil {
+		if c.options.Logger != nil {
+			c.options.Logger.Error("failed to allocate address", "key", key, "error", err)
+		}
+
+		return "", false
+	}
+
+	return address, true
+}
+
+// domains returns the suffixes names are published under: the cluster DNS
+// domain unless the names are qualified only, and the cluster name if set.
+func (c *Catapult) domains() []string {
+	var domains []string
+
+	if c.options.Cluster == "" || c.options.Primary {
+		domains = append(domains, "svc.cluster.local")
+	}
+
+	if c.options.Cluster != "" {
+		domains = append(domains, c.options.Cluster)
+	}
+
+	return domains
+}
+
+func (c *Catapult) serviceHosts(service corev1.Service) []string {
+	if names, ok := c.options.Names.Render(hostname.Fields{Service: service.Name, Namespace: service.Namespace, Cluster: c.options.Cluster}); ok {
+		return names
+	}
+
+	var hosts []string
+
+	for _, domain := range c.domains() {
+		if domain != "svc.cluster.local" {
+			hosts = append(hosts, fmt.Sprintf("%s.%s.%s", service.Name, service.Namespace, domain))
 			continue
 		}
 
-		pod := matching[0]
+		if service.Namespace == c.options.Scope {
+			hosts = append(hosts, service.Name)
+		}
 
-		hosts := []string{
+		hosts = append(hosts,
 			fmt.Sprintf("%s.%s", service.Name, service.Namespace),
 			fmt.Sprintf("%s.%s.svc.cluster.local", service.Name, service.Namespace),
+		)
+	}
+
+	return hosts
+}
+
+// endpointHosts returns the names of one endpoint of a headless service:
+// its hostname below the service and, if different, its IP-based alias.
+func (c *Catapult) endpointHosts(service corev1.Service, name, alias, pod string) []string {
+	var hosts []string
+
+	if c.options.Names != nil {
+		for _, h := range slices.Compact([]string{name, alias}) {
+			names, _ := c.options.Names.Render(hostname.Fields{Service: service.Name, Namespace: service.Namespace, Cluster: c.options.Cluster, Hostname: h, Pod: pod})
+			hosts = append(hosts, names...)
 		}
 
-		if service.Namespace == c.options.Scope {
-			hosts = append([]string{service.Name}, hosts...)
+		return hosts
+	}
+
+	for _, domain := range c.domains() {
+		hosts = append(hosts, fmt.Sprintf("%s.%s.%s.%s", name, service.Name, service.Namespace, domain))
+
+		if alias != name {
+			hosts = append(hosts, fmt.Sprintf("%s.%s.%s.%s", alias, service.Name, service.Namespace, domain))
 		}
+	}
+
+	return hosts
+}
+
+// serviceRecords returns the SRV records of a service under each of its
+// names, pointing at the service or, for a headless service, at the
+// endpoint whose Hostname and Pod are given.
+func (c *Catapult) serviceRecords(service corev1.Service, endpoint hostname.Fields, ports, udpPorts map[int]int) []system.SRV {
+	var records []system.SRV
 
-		address := mapAddress(service.Spec.ClusterIP)
-		ports := selectPorts(service, pod.Spec.Containers...)
+	fields := hostname.Fields{Service: service.Name, Namespace: service.Namespace, Cluster: c.options.Cluster}
 
-		tunnels = append(tunnels, newTunnel(c.client, pod.Namespace, pod.Name, address, ports, hosts))
+	if names, ok := c.options.Names.Render(fields); ok {
+		targets := names
+
+		if endpoint.Hostname != "" {
+			fields.Hostname = endpoint.Hostname
+			fields.Pod = endpoint.Pod
+
+			targets, _ = c.options.Names.Render(fields)
+		}
+
+		if len(targets) == 0 {
+			return nil
+		}
+
+		// pair names and targets by template where both rendered
+		for i, name := range names {
+			target := targets[min(i, len(targets)-1)]
+			records = append(records, selectRecords(service, name, target, ports, udpPorts)...)
+		}
+
+		return records
 	}
 
-	return tunnels
+	for _, domain := range c.domains() {
+		name := fmt.Sprintf("%s.%s.%s", service.Name, service.Namespace, domain)
+		target := name
+
+		if endpoint.Hostname != "" {
+			target = endpoint.Hostname + "." + name
+		}
+
+		records = append(records, selectRecords(service, name, target, ports, udpPorts)...)
+	}
+
+	return records
 }
 
-func resourceKey(obj metav1.Object) string {
-	return fmt.Sprintf("%s/%s", obj.GetNamespace(), obj.GetName())
+// relay returns a dialer that opens connections from a loop-tunnel pod in the
+// namespace. The pod is only created on the first connection.
+func (c *Catapult) relay(namespace string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if c.options.Jump != nil {
+		return c.options.Jump.Dial
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	pod, ok := c.relays[namespace]
+
+	if !ok {
+		pod = jump.New(c.client, jump.PodOptions{
+			Namespace: namespace,
+		})
+
+		c.relays[namespace] = pod
+	}
+
+	return pod.Dial
 }
 
 func (c *Catapult) watchPods(ctx context.Context, client kubernetes.Client, namespace string) error {
-	list, err := c.client.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{})
+	return reconcile.WatchPods(ctx, client, namespace, &c.mu, c.pods, func(old, pod *corev1.Pod) {
+		if pod == nil {
+			c.evict(old)
+		} else if old != nil && !reconcile.PodReady(*pod) {
+			c.evict(pod)
+		}
+
+		c.notify()
+	})
+}
+
+// evict drops a pod from every running tunnel as soon as the informer sees it
+// go away, so reconnects fail over without waiting for the next refresh.
+func (c *Catapult) evict(pod *corev1.Pod) {
+	tunnels := c.reconciler.Tunnels()
+
+	for _, t := range tunnels {
+		t.Evict(pod.Namespace, func(e endpoint) bool {
+			return e.name == pod.Name
+		})
+	}
+}
+
+func (c *Catapult) watchServices(ctx context.Context, client kubernetes.Client, namespace string) error {
+	list, err := c.client.CoreV1().Services(namespace).List(ctx, metav1.ListOptions{})
 
 	if err != nil {
 		return err
 	}
 
 	c.mu.Lock()
-	for _, p := range list.Items {
-		c.pods[resourceKey(&p)] = p
+	for _, s := range list.Items {
+		c.services[reconcile.ResourceKey(&s)] = s
 	}
 	c.mu.Unlock()
 
 	handlers := cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
-			p := obj.(*corev1.Pod)
+			s := obj.(*corev1.Service)
 			c.mu.Lock()
-			c.pods[resourceKey(p)] = *p
+			c.services[reconcile.ResourceKey(s)] = *s
 			c.mu.Unlock()
+
+			c.notify()
 		},
 
 		UpdateFunc: func(oldObj, newObj interface{}) {
-			p := newObj.(*corev1.Pod)
+			s := newObj.(*corev1.Service)
 			c.mu.Lock()
-			c.pods[resourceKey(p)] = *p
+			c.services[reconcile.ResourceKey(s)] = *s
 			c.mu.Unlock()
+
+			c.notify()
 		},
 
 		DeleteFunc: func(obj interface{}) {
-			p := obj.(*corev1.Pod)
+			// a missed deletion arrives as a tombstone
+			if t, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = t.Obj
+			}
+
+			s, ok := obj.(*corev1.Service)
+
+			if !ok {
+				return
+			}
+
 			c.mu.Lock()
-			delete(c.pods, resourceKey(p))
+			delete(c.services, reconcile.ResourceKey(s))
 			c.mu.Unlock()
+
+			c.notify()
 		},
 	}
 
-	watcher := cache.NewListWatchFromClient(client.CoreV1().RESTClient(), "pods", namespace, fields.Everything())
+	watcher := cache.ToListWatcherWithWatchListSemantics(&cache.ListWatch{
+		ListWithContextFunc: func(ctx context.Context, options metav1.ListOptions) (runtime.Object, error) {
+			return client.CoreV1().Services(namespace).List(ctx, options)
+		},
 
-	_, controller := cache.NewInformer(watcher, &corev1.Pod{}, 0, handlers)
+		WatchFuncWithContext: func(ctx context.Context, options metav1.ListOptions) (watch.Interface, error) {
+			return client.CoreV1().Services(namespace).Watch(ctx, options)
+		},
+	}, client)
+
+	_, controller := cache.NewInformer(watcher, &corev1.Service{}, 0, handlers)
 	go controller.Run(ctx.Done())
 
 	return nil
 }
 
-func (c *Catapult) watchServices(ctx context.Context, client kubernetes.Client, namespace string) error {
-	list, err := c.client.CoreV1().Services(namespace).List(ctx, metav1.ListOptions{})
+// watchEndpointSlices keeps the EndpointSlices of a namespace, which name
+// the ready endpoints of each service and the target ports they serve.
+func (c *Catapult) watchEndpointSlices(ctx context.Context, client kubernetes.Client, namespace string) error {
+	list, err := c.client.DiscoveryV1().EndpointSlices(namespace).List(ctx, metav1.ListOptions{})
 
 	if err != nil {
 		return err
@@ -298,104 +1024,124 @@ func (c *Catapult) watchServices(ctx context.Context, client kubernetes.Client,
 
 	c.mu.Lock()
 	for _, s := range list.Items {
-		c.services[resourceKey(&s)] = s
+		c.endpointslices[reconcile.ResourceKey(&s)] = s
 	}
 	c.mu.Unlock()
 
 	handlers := cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
-			s := obj.(*corev1.Service)
+			s := obj.(*discoveryv1.EndpointSlice)
 			c.mu.Lock()
-			c.services[resourceKey(s)] = *s
+			c.endpointslices[reconcile.ResourceKey(s)] = *s
 			c.mu.Unlock()
+
+			c.notify()
 		},
 
 		UpdateFunc: func(oldObj, newObj interface{}) {
-			s := newObj.(*corev1.Service)
+			s := newObj.(*discoveryv1.EndpointSlice)
 			c.mu.Lock()
-			c.services[resourceKey(s)] = *s
+			c.endpointslices[reconcile.ResourceKey(s)] = *s
 			c.mu.Unlock()
+
+			c.notify()
 		},
 
 		DeleteFunc: func(obj interface{}) {
-			s := obj.(*corev1.Service)
+			// a missed deletion arrives as a tombstone
+			if t, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = t.Obj
+			}
+
+			s, ok := obj.(*discoveryv1.EndpointSlice)
+
+			if !ok {
+				return
+			}
+
 			c.mu.Lock()
-			delete(c.services, resourceKey(s))
+			delete(c.endpointslices, reconcile.ResourceKey(s))
 			c.mu.Unlock()
+
+			c.notify()
 		},
 	}
 
-	watcher := cache.NewListWatchFromClient(client.CoreV1().RESTClient(), "services", namespace, fields.Everything())
+	watcher := cache.ToListWatcherWithWatchListSemantics(&cache.ListWatch{
+		ListWithContextFunc: func(ctx context.Context, options metav1.ListOptions) (runtime.Object, error) {
+			return client.DiscoveryV1().EndpointSlices(namespace).List(ctx, options)
+		},
 
-	_, controller := cache.NewInformer(watcher, &corev1.Service{}, 0, handlers)
+		WatchFuncWithContext: func(ctx context.Context, options metav1.ListOptions) (watch.Interface, error) {
+			return client.DiscoveryV1().EndpointSlices(namespace).Watch(ctx, options)
+		},
+	}, client)
+
+	_, controller := cache.NewInformer(watcher, &discoveryv1.EndpointSlice{}, 0, handlers)
 	go controller.Run(ctx.Done())
 
 	return nil
 }
 
-func selectPods(pods []corev1.Pod, namespace string, selector labels.Selector) []corev1.Pod {
-	var result []corev1.Pod
+// dashedIP returns an IP the way cluster DNS spells it in a name, e.g.
+// 10-0-0-5 or fd00--5.
+func dashedIP(ip string) string {
+	return strings.NewReplacer(".", "-", ":", "-").Replace(ip)
+}
 
-	for _, pod := range pods {
-		if pod.Namespace != namespace {
-			continue
-		}
+// selectPorts maps the service ports of the given protocol to the target
+// ports an EndpointSlice resolved them to. Slice ports carry the service
+// port's name, which is how kube-proxy pairs them.
+func selectPorts(service corev1.Service, protocol corev1.Protocol, endpointPorts []discoveryv1.EndpointPort) map[int]int {
+	return reconcile.ServicePorts(service, protocol, func(port corev1.ServicePort) int {
+		target := 0
 
-		if pod.Status.Phase != corev1.PodRunning {
-			continue
-		}
+		for _, p := range endpointPorts {
+			if kubernetes.Deref(p.Name, "") != port.Name {
+				continue
+			}
 
-		if !selector.Matches(labels.Set(pod.Labels)) {
-			continue
-		}
+			if kubernetes.Deref(p.Protocol, corev1.ProtocolTCP) != protocol {
+				continue
+			}
 
-		result = append(result, pod)
-	}
+			if p.Port != nil && *p.Port > 0 {
+				target = int(*p.Port)
+			}
+		}
 
-	return result
+		return target
+	})
 }
 
-func selectPorts(service corev1.Service, containers ...corev1.Container) map[int]int {
-	ports := make(map[int]int)
+// selectRecords returns the SRV records cluster DNS publishes for the named
+// ports of a service under name, e.g. _http._tcp.web.shop.svc.cluster.local.
+func selectRecords(service corev1.Service, name, target string, ports, udpPorts map[int]int) []system.SRV {
+	var records []system.SRV
 
 	for _, port := range service.Spec.Ports {
-		servicePort := int(port.Port)
-		containerPort := 0
-
-		if port.Protocol != "" && port.Protocol != corev1.ProtocolTCP {
+		if port.Name == "" {
 			continue
 		}
 
-		for _, c := range containers {
-			for _, p := range c.Ports {
-				if p.Name != "" && p.Name == port.TargetPort.String() {
-					containerPort = int(p.ContainerPort)
-				}
-			}
-		}
+		protocol := "tcp"
+		forwarded := ports
 
-		if port.TargetPort.IntVal > 0 {
-			containerPort = int(port.TargetPort.IntVal)
+		if port.Protocol == corev1.ProtocolUDP {
+			protocol = "udp"
+			forwarded = udpPorts
 		}
 
-		if servicePort > 0 && containerPort > 0 {
-			ports[servicePort] = containerPort
+		if _, ok := forwarded[int(port.Port)]; !ok {
+			continue
 		}
-	}
-
-	return ports
-}
 
-func mapAddress(address string) string {
-	h := md5.New()
-	io.WriteString(h, address)
-
-	addr := h.Sum(nil)
-
-	addr = addr[:4]
-	addr[0] = 127
-	addr[1] = 244
+		records = append(records, system.SRV{
+			Name:   fmt.Sprintf("_%s._%s.%s", port.Name, protocol, name),
+			Target: target,
+			Port:   int(port.Port),
+		})
+	}
 
-	ip := net.IP(addr)
-	return ip.String()
+	return records
 }
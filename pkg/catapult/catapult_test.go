@@ -0,0 +1,503 @@
+package catapult
+
+import (
+	"context"
+	"runtime"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/adrianliechti/loop/pkg/address"
+	"github.com/adrianliechti/loop/pkg/hostname"
+	"github.com/adrianliechti/loop/pkg/kubernetes"
+	"github.com/adrianliechti/loop/pkg/source"
+	"github.com/adrianliechti/loop/pkg/system"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	discoveryv1client "k8s.io/client-go/kubernetes/typed/discovery/v1"
+)
+
+// fakeClient serves the typed clients catapult watches from a fake
+// clientset; anything else panics through the nil embedded Client.
+type fakeClient struct {
+	kubernetes.Client
+
+	clientset *fake.Clientset
+}
+
+func (c *fakeClient) CoreV1() corev1client.CoreV1Interface {
+	return c.clientset.CoreV1()
+}
+
+func (c *fakeClient) DiscoveryV1() discoveryv1client.DiscoveryV1Interface {
+	return c.clientset.DiscoveryV1()
+}
+
+// IsWatchListSemanticsUnSupported keeps the informers on plain list/watch,
+// which is all the fake clientset implements.
+func (c *fakeClient) IsWatchListSemanticsUnSupported() bool {
+	return c.clientset.IsWatchListSemanticsUnSupported()
+}
+
+type fakeHosts struct{}
+
+func (fakeHosts) Add(address string, hosts ...string)          {}
+func (fakeHosts) AddSRV(address string, records ...system.SRV) {}
+func (fakeHosts) Remove(address string)                        {}
+func (fakeHosts) Clear()                                       {}
+func (fakeHosts) Flush() error                                 { return nil }
+
+type change struct {
+	added bool
+	hosts []string
+}
+
+func TestRefreshFollowsEvents(t *testing.T) {
+	// Tunnels bind to 127.244.0.0/16, which only Linux routes without
+	// aliasing the loopback interface first.
+	if runtime.GOOS != "linux" {
+		t.Skip("requires the 127.0.0.0/8 loopback range")
+	}
+
+	clientset := fake.NewClientset()
+	client := &fakeClient{clientset: clientset}
+
+	// keep the assignments in memory instead of the user config directory
+	addresses, _ := address.New(address.AllocatorOptions{Network: "127.244.0.0/16"})
+
+	changes := make(chan change, 16)
+
+	c, err := New(client, CatapultOptions{
+		Namespaces: []string{"shop"},
+
+		Hosts: fakeHosts{},
+
+		Addresses: addresses,
+
+		AddFunc: func(address string, hosts []string, ports []int) {
+			changes <- change{added: true, hosts: hosts}
+		},
+
+		DeleteFunc: func(address string, hosts []string, ports []int) {
+			changes <- change{added: false, hosts: hosts}
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- c.Start(ctx)
+	}()
+
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// give the informers a moment to establish their watches
+	time.Sleep(100 * time.Millisecond)
+
+	createService(t, clientset, "orders", "10.96.0.10", "10.0.0.5")
+
+	start := time.Now()
+	got := waitChange(t, changes)
+
+	if !got.added || got.hosts[0] != "orders.shop" {
+		t.Fatalf("want orders.shop added, got %+v", got)
+	}
+
+	if latency := time.Since(start); latency > time.Second {
+		t.Errorf("service applied after %s, want under 1s", latency)
+	}
+
+	if err := clientset.CoreV1().Services("shop").Delete(t.Context(), "orders", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	start = time.Now()
+	got = waitChange(t, changes)
+
+	if got.added || got.hosts[0] != "orders.shop" {
+		t.Fatalf("want orders.shop removed, got %+v", got)
+	}
+
+	if latency := time.Since(start); latency > time.Second {
+		t.Errorf("deletion applied after %s, want under 1s", latency)
+	}
+}
+
+func waitChange(t *testing.T, changes <-chan change) change {
+	t.Helper()
+
+	select {
+	case c := <-changes:
+		return c
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for refresh")
+	}
+
+	return change{}
+}
+
+func createService(t *testing.T, clientset *fake.Clientset, name, clusterIP, podIP string) {
+	t.Helper()
+
+	ctx := t.Context()
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name + "-0",
+			Namespace: "shop",
+		},
+
+		Status: corev1.PodStatus{
+			Phase: corev1.PodRunning,
+			PodIP: podIP,
+
+			PodIPs: []corev1.PodIP{{IP: podIP}},
+
+			Conditions: []corev1.PodCondition{
+				{Type: corev1.PodReady, Status: corev1.ConditionTrue},
+			},
+		},
+	}
+
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "shop",
+		},
+
+		Spec: corev1.ServiceSpec{
+			ClusterIP: clusterIP,
+
+			Ports: []corev1.ServicePort{
+				{Name: "http", Port: 18080, Protocol: corev1.ProtocolTCP},
+			},
+		},
+	}
+
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name + "-abcde",
+			Namespace: "shop",
+
+			Labels: map[string]string{
+				discoveryv1.LabelServiceName: name,
+			},
+		},
+
+		AddressType: discoveryv1.AddressTypeIPv4,
+
+		Endpoints: []discoveryv1.Endpoint{
+			{
+				Addresses: []string{podIP},
+
+				TargetRef: &corev1.ObjectReference{
+					Kind:      "Pod",
+					Namespace: "shop",
+					Name:      pod.Name,
+				},
+			},
+		},
+
+		Ports: []discoveryv1.EndpointPort{
+			{
+				Name:     kubernetes.Ptr("http"),
+				Port:     kubernetes.Ptr(int32(8080)),
+				Protocol: kubernetes.Ptr(corev1.ProtocolTCP),
+			},
+		},
+	}
+
+	if _, err := clientset.CoreV1().Pods("shop").Create(ctx, pod, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := clientset.DiscoveryV1().EndpointSlices("shop").Create(ctx, slice, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := clientset.CoreV1().Services("shop").Create(ctx, service, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPodNames(t *testing.T) {
+	addresses, _ := address.New(address.AllocatorOptions{Network: "127.244.0.0/16"})
+
+	c, err := New(nil, CatapultOptions{
+		Scope: "shop",
+
+		Addresses: addresses,
+		Virtual:   true,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ready := corev1.PodStatus{
+		Phase: corev1.PodRunning,
+
+		Conditions: []corev1.PodCondition{
+			{Type: corev1.PodReady, Status: corev1.ConditionTrue},
+		},
+	}
+
+	// a bare pod with a declared port, and a pod behind a headless service
+	// that names it through its hostname and subdomain; only the bare pod
+	// gets a tunnel of its own
+	debug := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "debug", Namespace: "shop"},
+
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Ports: []corev1.ContainerPort{{ContainerPort: 8080}}},
+			},
+		},
+
+		Status: ready,
+	}
+
+	debug.Status.PodIPs = []corev1.PodIP{{IP: "10.0.0.7"}}
+
+	db := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "db-7f9c", Namespace: "shop"},
+
+		Spec: corev1.PodSpec{
+			Hostname:  "primary",
+			Subdomain: "db",
+
+			Containers: []corev1.Container{
+				{Ports: []corev1.ContainerPort{{ContainerPort: 5432}}},
+			},
+		},
+
+		Status: ready,
+	}
+
+	db.Status.PodIPs = []corev1.PodIP{{IP: "10.0.0.8"}}
+
+	c.pods["shop/debug"] = debug
+	c.pods["shop/db-7f9c"] = db
+
+	c.services["shop/db"] = corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "shop"},
+
+		Spec: corev1.ServiceSpec{
+			ClusterIP: corev1.ClusterIPNone,
+
+			Ports: []corev1.ServicePort{{Name: "sql", Port: 5432}},
+		},
+	}
+
+	c.endpointslices["shop/db-abcde"] = discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "db-abcde",
+			Namespace: "shop",
+
+			Labels: map[string]string{discoveryv1.LabelServiceName: "db"},
+		},
+
+		Endpoints: []discoveryv1.Endpoint{
+			{
+				Addresses: []string{"10.0.0.8"},
+				TargetRef: &corev1.ObjectReference{Kind: "Pod", Name: "db-7f9c"},
+			},
+		},
+
+		Ports: []discoveryv1.EndpointPort{
+			{Name: kubernetes.Ptr("sql"), Port: kubernetes.Ptr(int32(5432))},
+		},
+	}
+
+	var hosts []string
+
+	for _, t := range c.listTunnel() {
+		hosts = append(hosts, t.Names...)
+	}
+
+	want := []string{
+		"primary.db.shop.svc.cluster.local",
+		"10-0-0-8.db.shop.svc.cluster.local",
+		"10-0-0-8.shop.pod.cluster.local",
+		"10-0-0-7.shop.pod.cluster.local",
+		"debug",
+		"debug.shop",
+	}
+
+	if !slices.Equal(hosts, want) {
+		t.Fatalf("want %v, got %v", want, hosts)
+	}
+
+	// templates name endpoints and pod IPs below what they render, and SRV
+	// records point at those names
+	c.options.Names, _ = hostname.New([]string{"{{.Service}}.{{.Namespace}}.dev.internal"})
+
+	hosts = nil
+
+	var records []system.SRV
+
+	for _, t := range c.listTunnel() {
+		hosts = append(hosts, t.Names...)
+		records = append(records, t.SRV...)
+	}
+
+	want = []string{
+		"primary.db.shop.dev.internal",
+		"10-0-0-8.db.shop.dev.internal",
+		"10-0-0-8.db-7f9c.shop.dev.internal",
+		"10-0-0-7.debug.shop.dev.internal",
+		"debug.shop.dev.internal",
+	}
+
+	if !slices.Equal(hosts, want) {
+		t.Fatalf("want %v, got %v", want, hosts)
+	}
+
+	wantRecords := []system.SRV{
+		{Name: "_sql._tcp.db.shop.dev.internal", Target: "primary.db.shop.dev.internal", Port: 5432},
+	}
+
+	if !slices.Equal(records, wantRecords) {
+		t.Fatalf("want %v, got %v", wantRecords, records)
+	}
+}
+
+func TestExternalEndpoints(t *testing.T) {
+	addresses, _ := address.New(address.AllocatorOptions{Network: "127.244.0.0/16"})
+
+	c, err := New(nil, CatapultOptions{
+		Scope: "shop",
+
+		Addresses: addresses,
+		Virtual:   true,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a selector-less service whose manually managed slice points at a
+	// database outside the pod network, next to a pod endpoint
+	c.services["shop/warehouse"] = corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "warehouse", Namespace: "shop"},
+
+		Spec: corev1.ServiceSpec{
+			ClusterIP: "10.96.0.20",
+
+			Ports: []corev1.ServicePort{{Name: "sql", Port: 5432}},
+		},
+	}
+
+	c.endpointslices["shop/warehouse-1"] = discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "warehouse-1",
+			Namespace: "shop",
+
+			Labels: map[string]string{discoveryv1.LabelServiceName: "warehouse"},
+		},
+
+		Endpoints: []discoveryv1.Endpoint{
+			{Addresses: []string{"192.168.10.5"}},
+			{
+				Addresses: []string{"10.0.0.9"},
+				TargetRef: &corev1.ObjectReference{Kind: "Pod", Name: "warehouse-0"},
+			},
+		},
+
+		Ports: []discoveryv1.EndpointPort{
+			{Name: kubernetes.Ptr("sql"), Port: kubernetes.Ptr(int32(5432))},
+		},
+	}
+
+	tunnels := c.listTunnel()
+
+	if len(tunnels) != 1 {
+		t.Fatalf("want one tunnel, got %d", len(tunnels))
+	}
+
+	want := []string{"192.168.10.5", "warehouse-0"}
+
+	if got := tunnels[0].Status().Targets; !slices.Equal(got, want) {
+		t.Fatalf("want targets %v, got %v", want, got)
+	}
+}
+
+// fakeSource names shop/warehouse and a service catapult does not know.
+type fakeSource struct{}
+
+func (fakeSource) Name() string                                   { return "fake" }
+func (fakeSource) Start(ctx context.Context, notify func()) error { return nil }
+
+func (fakeSource) Routes() []source.Route {
+	return []source.Route{
+		{Host: "warehouse.example.internal", Service: "shop/warehouse", Object: &metav1.ObjectMeta{Namespace: "shop", Name: "warehouse"}},
+		{Host: "ghost.example.internal", Service: "shop/ghost", Object: &metav1.ObjectMeta{Namespace: "shop", Name: "ghost"}},
+	}
+}
+
+func TestSourceNames(t *testing.T) {
+	addresses, _ := address.New(address.AllocatorOptions{Network: "127.244.0.0/16"})
+
+	c, err := New(nil, CatapultOptions{
+		Addresses: addresses,
+		Virtual:   true,
+
+		Sources: []source.Source{fakeSource{}},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.services["shop/warehouse"] = corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "warehouse", Namespace: "shop"},
+
+		Spec: corev1.ServiceSpec{
+			ClusterIP: "10.96.0.20",
+
+			Ports: []corev1.ServicePort{{Name: "sql", Port: 5432}},
+		},
+	}
+
+	c.endpointslices["shop/warehouse-1"] = discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "warehouse-1",
+			Namespace: "shop",
+
+			Labels: map[string]string{discoveryv1.LabelServiceName: "warehouse"},
+		},
+
+		Endpoints: []discoveryv1.Endpoint{
+			{Addresses: []string{"192.168.10.5"}},
+		},
+
+		Ports: []discoveryv1.EndpointPort{
+			{Name: kubernetes.Ptr("sql"), Port: kubernetes.Ptr(int32(5432))},
+		},
+	}
+
+	tunnels := c.listTunnel()
+
+	if len(tunnels) != 1 {
+		t.Fatalf("want one tunnel, got %d", len(tunnels))
+	}
+
+	want := []string{"warehouse.shop", "warehouse.shop.svc.cluster.local", "warehouse.example.internal"}
+
+	if got := tunnels[0].Names; !slices.Equal(got, want) {
+		t.Fatalf("want names %v, got %v", want, got)
+	}
+}
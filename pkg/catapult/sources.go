@@ -0,0 +1,84 @@
+package catapult
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/adrianliechti/loop/pkg/reconcile"
+	"github.com/adrianliechti/loop/pkg/source"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// serviceSource yields the names of Services, so catapult finds them
+// through a source like those added in its options. Headless services are
+// left out: their endpoints get names of their own.
+type serviceSource struct {
+	c *Catapult
+}
+
+func (s *serviceSource) Name() string {
+	return "service"
+}
+
+func (s *serviceSource) Start(ctx context.Context, notify func()) error {
+	for _, namespace := range s.c.namespaces() {
+		if err := s.c.watchServices(ctx, s.c.client, namespace); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *serviceSource) Routes() []source.Route {
+	s.c.mu.Lock()
+	services := slices.Collect(maps.Values(s.c.services))
+	s.c.mu.Unlock()
+
+	slices.SortFunc(services, func(a, b corev1.Service) int {
+		return strings.Compare(reconcile.ResourceKey(&a), reconcile.ResourceKey(&b))
+	})
+
+	var result []source.Route
+
+	for i := range services {
+		service := &services[i]
+
+		if service.Spec.ClusterIP == corev1.ClusterIPNone {
+			continue
+		}
+
+		for _, host := range s.c.serviceHosts(*service) {
+			result = append(result, source.Route{
+				Host:    host,
+				Service: reconcile.ResourceKey(service),
+				Object:  service,
+			})
+		}
+	}
+
+	return result
+}
+
+// serviceNames collects the names the sources give each service, keyed by
+// namespace/name. Routes that name no service have no tunnel here to join.
+func (c *Catapult) serviceNames() map[string][]string {
+	names := make(map[string][]string)
+
+	for _, src := range c.sources {
+		for _, r := range src.Routes() {
+			if r.Service == "" || !c.options.Filter.Match(r.Object) {
+				continue
+			}
+
+			if !slices.Contains(names[r.Service], r.Host) {
+				names[r.Service] = append(names[r.Service], r.Host)
+			}
+		}
+	}
+
+	return names
+}
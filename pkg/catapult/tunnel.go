@@ -2,95 +2,75 @@ package catapult
 
 import (
 	"context"
-	"errors"
-	"log/slog"
-	"maps"
-	"slices"
+	"net"
+	"strconv"
 
-	"github.com/adrianliechti/loop/pkg/kubernetes"
-	"github.com/adrianliechti/loop/pkg/system"
+	"github.com/adrianliechti/loop/pkg/reconcile"
 )
 
-type tunnel struct {
-	client kubernetes.Client
-
-	name      string
-	namespace string
-
-	hosts []string
-
+// tunnel forwards a service, one endpoint of a headless service, or a pod.
+type tunnel = reconcile.PortTunnel[endpoint]
+
+// endpoint is a pod backing a tunnel, along with the target port each
+// service port resolves to on it. Endpoints outside the pod network (an
+// ExternalName target, a manually managed IP) carry an address instead and
+// are dialed through the relay, as are pods reached through a jump pod.
+// Port-forwarding carries no UDP, so datagrams to a pod go through the
+// relay to its IP.
+type endpoint struct {
+	name    string
 	address string
-	ports   map[int]int
+	ip      string
 
-	cancel context.CancelFunc
+	ports    map[int]int
+	udpPorts map[int]int
 }
 
-func newTunnel(client kubernetes.Client, namespace, name, address string, ports map[int]int, hosts []string) *tunnel {
-	return &tunnel{
-		client: client,
-
-		name:      name,
-		namespace: namespace,
-
-		address: address,
-		ports:   ports,
-
-		hosts: hosts,
+// String returns the pod name, or the address for endpoints without a pod.
+func (e endpoint) String() string {
+	if e.name != "" {
+		return e.name
 	}
+
+	return e.address
 }
 
-func (t *tunnel) Start(ctx context.Context, readyChan chan struct{}) error {
-	if t.cancel != nil {
-		t.cancel()
-		t.cancel = nil
-	}
+func (c *Catapult) newTunnel(namespace string, targets []endpoint, address string, ports, udpPorts map[int]int, hosts []string) *tunnel {
+	t := reconcile.NewPortTunnel(namespace, targets, address, ports, udpPorts, hosts)
+	t.Dial = c.dial(namespace)
 
-	ctx, t.cancel = context.WithCancel(ctx)
+	return t
+}
 
-	if err := system.AliasIP(ctx, t.address); err != nil {
-		return err
-	}
+// dial returns how the tunnels of a namespace reach their endpoints: pods
+// through port-forwarding, everything else through the relay, on the
+// target port the service port resolves to on each endpoint.
+func (c *Catapult) dial(namespace string) func(ctx context.Context, e endpoint, network string, port int) (net.Conn, error) {
+	return func(ctx context.Context, e endpoint, network string, port int) (net.Conn, error) {
+		target := e.ports[port]
 
-	go func() {
-		if err := t.client.PodPortForward(ctx, t.namespace, t.name, t.address, t.ports, readyChan); err != nil {
-			slog.ErrorContext(ctx, "failed to forward", "address", t.address, "ports", t.ports, "error", err)
+		if network == "udp" {
+			target = e.udpPorts[port]
 		}
-	}()
-
-	return nil
-}
 
-// equivalent reports whether two tunnels target the same workload with the
-// same hosts and port mappings — i.e. whether the running goroutine is still
-// correct for the new desired state.
-func (t *tunnel) equivalent(o *tunnel) bool {
-	if t.namespace != o.namespace || t.name != o.name {
-		return false
-	}
+		if target == 0 {
+			return nil, reconcile.ErrSkip
+		}
 
-	if !maps.Equal(t.ports, o.ports) {
-		return false
-	}
+		if e.address == "" && network == "tcp" {
+			return c.client.PodDial(ctx, namespace, e.name, network, target)
+		}
 
-	a := slices.Clone(t.hosts)
-	b := slices.Clone(o.hosts)
-	slices.Sort(a)
-	slices.Sort(b)
+		address := e.address
 
-	return slices.Equal(a, b)
-}
-
-func (t *tunnel) Stop() error {
-	if t.cancel != nil {
-		t.cancel()
-		t.cancel = nil
-	}
+		if address == "" {
+			address = e.ip
+		}
 
-	var result error
+		if address == "" {
+			return nil, reconcile.ErrSkip
+		}
 
-	if err := system.UnaliasIP(context.Background(), t.address); err != nil {
-		result = errors.Join(result, err)
+		return c.relay(namespace)(ctx, network, net.JoinHostPort(address, strconv.Itoa(target)))
 	}
-
-	return result
 }
@@ -0,0 +1,667 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adrianliechti/loop/pkg/session"
+	"github.com/adrianliechti/loop/pkg/system"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func init() {
+	session.Register("resolver", func(ctx context.Context, r session.Resource) error {
+		owner, err := strconv.Atoi(r.Attributes["owner"])
+
+		if err != nil {
+			return fmt.Errorf("invalid resolver owner: %w", err)
+		}
+
+		return resetResolver(ctx, owner)
+	})
+}
+
+// resolverResource journals the system resolver configuration, which would
+// otherwise keep sending cluster domains to a server that is gone. The
+// configuration is tagged with the owner's pid, so concurrent sessions
+// only ever remove their own.
+func resolverResource() session.Resource {
+	return session.Resource{
+		Kind: "resolver",
+		Name: "loop",
+
+		Attributes: map[string]string{
+			"owner": strconv.Itoa(os.Getpid()),
+		},
+	}
+}
+
+// DefaultAddress is the loopback address the resolver listens on. It sits
+// outside the ranges catapult and gateway map services into, and always
+// uses port 53 because not every platform can route to another port.
+const DefaultAddress = "127.246.0.53"
+
+type Server struct {
+	options ServerOptions
+
+	mu       sync.Mutex
+	sections map[string]*Section
+
+	records  map[string][]net.IP
+	wildcard map[string][]net.IP
+	services map[string][]system.SRV
+
+	domains []string
+	running bool
+
+	// resolverMu serializes changes to the system resolver configuration.
+	resolverMu sync.Mutex
+	configured []string
+}
+
+type ServerOptions struct {
+	Address string
+
+	// Search lists the suffixes tried for names that do not resolve as
+	// given, e.g. "shop.svc.cluster.local" so that "orders" finds
+	// "orders.shop.svc.cluster.local".
+	Search []string
+
+	// Upstreams receive queries the server has no records for. They default
+	// to the system's nameservers, read before the resolver is configured.
+	Upstreams []string
+
+	Logger *slog.Logger
+}
+
+func New(options ServerOptions) (*Server, error) {
+	if options.Address == "" {
+		options.Address = DefaultAddress
+	}
+
+	if options.Upstreams == nil {
+		options.Upstreams = systemUpstreams()
+	}
+
+	options.Upstreams = slices.DeleteFunc(options.Upstreams, func(addr string) bool {
+		return addr == options.Address
+	})
+
+	var search []string
+
+	for _, s := range options.Search {
+		if s = normalize(s); validDomain(s) {
+			search = append(search, s)
+		}
+	}
+
+	options.Search = search
+
+	return &Server{
+		options: options,
+
+		sections: make(map[string]*Section),
+
+		records:  make(map[string][]net.IP),
+		wildcard: make(map[string][]net.IP),
+		services: make(map[string][]system.SRV),
+	}, nil
+}
+
+// Section returns the named set of records, creating it on first use. Each
+// publisher (catapult, gateway) owns one and flushes it independently.
+func (s *Server) Section(name string) *Section {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if section, ok := s.sections[name]; ok {
+		return section
+	}
+
+	section := newSection(s)
+	s.sections[name] = section
+
+	return section
+}
+
+// Start serves DNS over UDP and TCP and routes the published domains to the
+// server until ctx is cancelled.
+func (s *Server) Start(ctx context.Context) error {
+	if err := system.AliasIP(ctx, s.options.Address); err != nil {
+		return err
+	}
+
+	defer system.UnaliasIP(context.Background(), s.options.Address)
+
+	addr := net.JoinHostPort(s.options.Address, "53")
+
+	udp, err := net.ListenPacket("udp", addr)
+
+	if err != nil {
+		return err
+	}
+
+	defer udp.Close()
+
+	tcp, err := net.Listen("tcp", addr)
+
+	if err != nil {
+		return err
+	}
+
+	defer tcp.Close()
+
+	defer func() {
+		s.resolverMu.Lock()
+		defer s.resolverMu.Unlock()
+
+		s.mu.Lock()
+		s.running = false
+		s.mu.Unlock()
+
+		s.configured = nil
+
+		if err := resetResolver(context.Background(), os.Getpid()); err != nil {
+			s.logError(ctx, "failed to reset resolver", err)
+			return
+		}
+
+		session.Release(resolverResource())
+	}()
+
+	s.mu.Lock()
+	s.running = true
+	s.mu.Unlock()
+
+	if err := s.syncResolver(ctx); err != nil {
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		udp.Close()
+		tcp.Close()
+	}()
+
+	errs := make(chan error, 2)
+
+	go func() {
+		errs <- s.serveUDP(udp)
+	}()
+
+	go func() {
+		errs <- s.serveTCP(tcp)
+	}()
+
+	select {
+	case err := <-errs:
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		return err
+
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+func (s *Server) serveUDP(conn net.PacketConn) error {
+	buf := make([]byte, 65535)
+
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+
+		if err != nil {
+			return err
+		}
+
+		req := make([]byte, n)
+		copy(req, buf[:n])
+
+		go func() {
+			resp, err := s.handle("udp", req)
+
+			if err != nil {
+				return
+			}
+
+			conn.WriteTo(resp, peer)
+		}()
+	}
+}
+
+func (s *Server) serveTCP(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			defer conn.Close()
+
+			for {
+				conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+				var size uint16
+
+				if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+					return
+				}
+
+				req := make([]byte, size)
+
+				if _, err := io.ReadFull(conn, req); err != nil {
+					return
+				}
+
+				resp, err := s.handle("tcp", req)
+
+				if err != nil {
+					return
+				}
+
+				if err := binary.Write(conn, binary.BigEndian, uint16(len(resp))); err != nil {
+					return
+				}
+
+				if _, err := conn.Write(resp); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// handle answers a request received over network, "udp" or "tcp". Names
+// the server does not know are forwarded over the same network.
+func (s *Server) handle(network string, req []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+
+	header, err := p.Start(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	q, err := p.Question()
+
+	if err != nil {
+		return nil, err
+	}
+
+	name := normalize(q.Name.String())
+
+	ips, srv, found := s.lookup(name, q.Type)
+
+	if !found {
+		if resp, err := s.forward(network, req); err == nil {
+			return resp, nil
+		}
+	}
+
+	rcode := dnsmessage.RCodeSuccess
+
+	if !found {
+		rcode = dnsmessage.RCodeNameError
+	}
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 header.ID,
+		Response:           true,
+		Authoritative:      found,
+		RecursionDesired:   header.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              rcode,
+	})
+
+	b.EnableCompression()
+
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+
+	if err := b.Question(q); err != nil {
+		return nil, err
+	}
+
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+
+	rh := dnsmessage.ResourceHeader{
+		Name:  q.Name,
+		Class: dnsmessage.ClassINET,
+		TTL:   5,
+	}
+
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil && q.Type == dnsmessage.TypeA {
+			if err := b.AResource(rh, dnsmessage.AResource{A: [4]byte(ip4)}); err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		if ip.To4() == nil && q.Type == dnsmessage.TypeAAAA {
+			if err := b.AAAAResource(rh, dnsmessage.AAAAResource{AAAA: [16]byte(ip.To16())}); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, r := range srv {
+		target, err := dnsmessage.NewName(r.Target + ".")
+
+		if err != nil {
+			continue
+		}
+
+		if err := b.SRVResource(rh, dnsmessage.SRVResource{Priority: 0, Weight: 100, Port: uint16(r.Port), Target: target}); err != nil {
+			return nil, err
+		}
+	}
+
+	return b.Finish()
+}
+
+// lookup resolves name as given, then through the search suffixes. It
+// reports found for names the server knows even if they carry no record of
+// the requested type, so the client gets an empty answer instead of asking
+// elsewhere.
+func (s *Server) lookup(name string, qtype dnsmessage.Type) ([]net.IP, []system.SRV, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	candidates := []string{name}
+
+	for _, suffix := range s.options.Search {
+		if strings.HasSuffix(name, "."+suffix) {
+			continue
+		}
+
+		candidates = append(candidates, name+"."+suffix)
+	}
+
+	for _, candidate := range candidates {
+		if qtype == dnsmessage.TypeSRV {
+			if records, ok := s.services[candidate]; ok {
+				return nil, records, true
+			}
+		}
+
+		if ips, ok := s.records[candidate]; ok {
+			return ips, nil, true
+		}
+
+		// Gateway API semantics: *.example.com matches any name below
+		// example.com, but not example.com itself.
+		for suffix := candidate; ; {
+			i := strings.Index(suffix, ".")
+
+			if i < 0 {
+				break
+			}
+
+			suffix = suffix[i+1:]
+
+			if ips, ok := s.wildcard[suffix]; ok {
+				return ips, nil, true
+			}
+		}
+	}
+
+	return nil, nil, false
+}
+
+func (s *Server) forward(network string, req []byte) ([]byte, error) {
+	var result error
+
+	for _, upstream := range s.options.Upstreams {
+		resp, err := exchange(network, net.JoinHostPort(upstream, "53"), req)
+
+		if err != nil {
+			result = errors.Join(result, err)
+			continue
+		}
+
+		return resp, nil
+	}
+
+	if result == nil {
+		result = errors.New("no upstream nameservers")
+	}
+
+	return nil, result
+}
+
+// exchange sends a request to a nameserver. Requests that came in over TCP
+// go out over TCP, as their answers may not fit a datagram; so do UDP
+// requests whose answer came back truncated, so the client gets the full
+// answer instead of retrying over TCP against this server.
+func exchange(network, address string, req []byte) ([]byte, error) {
+	if network == "tcp" {
+		return exchangeTCP(address, req)
+	}
+
+	resp, err := exchangeUDP(address, req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var p dnsmessage.Parser
+
+	if header, err := p.Start(resp); err == nil && header.Truncated {
+		if full, err := exchangeTCP(address, req); err == nil {
+			return full, nil
+		}
+	}
+
+	return resp, nil
+}
+
+func exchangeUDP(address string, req []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", address, 2*time.Second)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return buf[:n], nil
+}
+
+func exchangeTCP(address string, req []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", address, 2*time.Second)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	msg := binary.BigEndian.AppendUint16(nil, uint16(len(req)))
+	msg = append(msg, req...)
+
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	var size uint16
+
+	if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+
+	resp := make([]byte, size)
+
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// rebuild merges every section into the lookup tables and, when the set of
+// routed domains changed, updates the system resolver configuration.
+func (s *Server) rebuild() error {
+	s.mu.Lock()
+
+	records := make(map[string][]net.IP)
+	wildcard := make(map[string][]net.IP)
+	services := make(map[string][]system.SRV)
+
+	for _, section := range s.sections {
+		section.mu.Lock()
+
+		for address, hosts := range section.published {
+			ip := net.ParseIP(address)
+
+			if ip == nil {
+				continue
+			}
+
+			for _, host := range hosts {
+				host = normalize(host)
+
+				if suffix, ok := strings.CutPrefix(host, "*."); ok {
+					wildcard[suffix] = append(wildcard[suffix], ip)
+					continue
+				}
+
+				records[host] = append(records[host], ip)
+			}
+		}
+
+		for _, list := range section.publishedSRV {
+			for _, r := range list {
+				r.Name = normalize(r.Name)
+				r.Target = normalize(r.Target)
+
+				services[r.Name] = append(services[r.Name], r)
+			}
+		}
+
+		section.mu.Unlock()
+	}
+
+	s.records = records
+	s.wildcard = wildcard
+	s.services = services
+
+	s.domains = routeDomains(records, wildcard)
+	s.mu.Unlock()
+
+	return s.syncResolver(context.Background())
+}
+
+// syncResolver routes the current domains to the server while it is running.
+func (s *Server) syncResolver(ctx context.Context) error {
+	s.resolverMu.Lock()
+	defer s.resolverMu.Unlock()
+
+	s.mu.Lock()
+	domains := s.domains
+	running := s.running
+	s.mu.Unlock()
+
+	if !running || (s.configured != nil && slices.Equal(domains, s.configured)) {
+		return nil
+	}
+
+	session.Record(resolverResource())
+
+	if err := configureResolver(ctx, os.Getpid(), s.options.Address, domains, s.options.Search); err != nil {
+		return err
+	}
+
+	s.configured = domains
+
+	return nil
+}
+
+// routeDomains returns the domains the system resolver should send to the
+// server: cluster.local as a whole, and every other name individually so
+// unrelated names in the same parent domain (or TLD, for "svc.ns") keep
+// resolving through the regular nameservers.
+func routeDomains(records, wildcard map[string][]net.IP) []string {
+	set := make(map[string]bool)
+
+	for name := range records {
+		if !validDomain(name) {
+			continue
+		}
+
+		switch {
+		case name == "cluster.local" || strings.HasSuffix(name, ".cluster.local"):
+			set["cluster.local"] = true
+
+		case !strings.Contains(name, "."):
+			// single labels are reached through the search domains
+
+		default:
+			set[name] = true
+		}
+	}
+
+	for suffix := range wildcard {
+		if !validDomain(suffix) {
+			continue
+		}
+
+		set[suffix] = true
+	}
+
+	domains := make([]string, 0, len(set))
+
+	for d := range set {
+		domains = append(domains, d)
+	}
+
+	slices.Sort(domains)
+
+	return domains
+}
+
+func (s *Server) logError(ctx context.Context, msg string, err error) {
+	if s.options.Logger != nil {
+		s.options.Logger.ErrorContext(ctx, msg, "error", err)
+	}
+}
+
+func normalize(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
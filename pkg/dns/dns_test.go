@@ -0,0 +1,230 @@
+package dns
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/adrianliechti/loop/pkg/system"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+
+	s, err := New(ServerOptions{
+		Search:    []string{"shop.svc.cluster.local", "svc.cluster.local", "cluster.local"},
+		Upstreams: []string{},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	section := s.Section("test")
+
+	section.Add("127.244.0.1", "orders.shop", "orders.shop.svc.cluster.local")
+	section.AddSRV("127.244.0.1", system.SRV{Name: "_http._tcp.orders.shop.svc.cluster.local", Target: "orders.shop.svc.cluster.local", Port: 8080})
+	section.Add("127.245.0.1", "*.apps.example.com", "web.example.com")
+
+	if err := section.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func query(t *testing.T, s *Server, name string, qtype dnsmessage.Type) dnsmessage.Message {
+	t.Helper()
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 1, RecursionDesired: true})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET})
+
+	req, err := b.Finish()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := s.handle("udp", req)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var m dnsmessage.Message
+
+	if err := m.Unpack(resp); err != nil {
+		t.Fatal(err)
+	}
+
+	return m
+}
+
+func TestLookup(t *testing.T) {
+	s := newTestServer(t)
+
+	tests := []struct {
+		name  string
+		want  string
+		rcode dnsmessage.RCode
+	}{
+		{name: "orders.shop.svc.cluster.local.", want: "127.244.0.1"},
+		{name: "ORDERS.shop.", want: "127.244.0.1"},
+		{name: "orders.", want: "127.244.0.1"},
+		{name: "orders.shop.svc.", want: "127.244.0.1"},
+		{name: "a.apps.example.com.", want: "127.245.0.1"},
+		{name: "a.b.apps.example.com.", want: "127.245.0.1"},
+		{name: "web.example.com.", want: "127.245.0.1"},
+		{name: "apps.example.com.", rcode: dnsmessage.RCodeNameError},
+		{name: "missing.shop.svc.cluster.local.", rcode: dnsmessage.RCodeNameError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := query(t, s, tt.name, dnsmessage.TypeA)
+
+			if m.Header.RCode != tt.rcode {
+				t.Fatalf("rcode = %v, want %v", m.Header.RCode, tt.rcode)
+			}
+
+			if tt.want == "" {
+				return
+			}
+
+			if len(m.Answers) != 1 {
+				t.Fatalf("got %d answers, want 1", len(m.Answers))
+			}
+
+			a := m.Answers[0].Body.(*dnsmessage.AResource).A
+
+			if got := dnsIP(a); got != tt.want {
+				t.Fatalf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLookupAAAAForKnownNameIsEmpty(t *testing.T) {
+	s := newTestServer(t)
+
+	m := query(t, s, "orders.shop.svc.cluster.local.", dnsmessage.TypeAAAA)
+
+	if m.Header.RCode != dnsmessage.RCodeSuccess || len(m.Answers) != 0 {
+		t.Fatalf("got rcode %v with %d answers, want empty success", m.Header.RCode, len(m.Answers))
+	}
+}
+
+func TestLookupSRV(t *testing.T) {
+	s := newTestServer(t)
+
+	m := query(t, s, "_http._tcp.orders.shop.svc.cluster.local.", dnsmessage.TypeSRV)
+
+	if len(m.Answers) != 1 {
+		t.Fatalf("got %d answers, want 1", len(m.Answers))
+	}
+
+	srv := m.Answers[0].Body.(*dnsmessage.SRVResource)
+
+	if srv.Port != 8080 || srv.Target.String() != "orders.shop.svc.cluster.local." {
+		t.Fatalf("got %s:%d", srv.Target, srv.Port)
+	}
+}
+
+func TestRouteDomains(t *testing.T) {
+	s := newTestServer(t)
+
+	want := []string{"apps.example.com", "cluster.local", "orders.shop", "web.example.com"}
+
+	if !slices.Equal(s.domains, want) {
+		t.Fatalf("got %v, want %v", s.domains, want)
+	}
+}
+
+func dnsIP(a [4]byte) string {
+	return fmt.Sprintf("%d.%d.%d.%d", a[0], a[1], a[2], a[3])
+}
+
+// TestExchangeRetriesTruncatedOverTCP serves a truncated answer over UDP
+// and the full one over TCP on the same port.
+func TestExchangeRetriesTruncatedOverTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	conn, err := net.ListenPacket("udp", l.Addr().String())
+
+	if err != nil {
+		t.Skipf("cannot listen on the same UDP port: %v", err)
+	}
+
+	defer conn.Close()
+
+	answer := func(truncated bool) []byte {
+		b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 1, Response: true, Truncated: truncated})
+		b.StartQuestions()
+		b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName("big.example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+
+		resp, _ := b.Finish()
+		return resp
+	}
+
+	go func() {
+		buf := make([]byte, 512)
+
+		for {
+			_, peer, err := conn.ReadFrom(buf)
+
+			if err != nil {
+				return
+			}
+
+			conn.WriteTo(answer(true), peer)
+		}
+	}()
+
+	go func() {
+		c, err := l.Accept()
+
+		if err != nil {
+			return
+		}
+
+		defer c.Close()
+
+		var size uint16
+		binary.Read(c, binary.BigEndian, &size)
+		io.ReadFull(c, make([]byte, size))
+
+		resp := answer(false)
+
+		binary.Write(c, binary.BigEndian, uint16(len(resp)))
+		c.Write(resp)
+	}()
+
+	resp, err := exchange("udp", l.Addr().String(), answer(false))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var p dnsmessage.Parser
+	header, err := p.Start(resp)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if header.Truncated {
+		t.Error("expected the full answer over TCP, got the truncated one")
+	}
+}
@@ -0,0 +1,140 @@
+//go:build darwin
+
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/adrianliechti/loop/pkg/session"
+)
+
+// resolverDir holds per-domain resolver(5) files; mDNSResponder sends
+// queries for each file's domain to the nameserver listed in it.
+const resolverDir = "/etc/resolver"
+
+// resolverMarker starts the files the server writes, tagged with the pid
+// of the owning session; files of older versions carry no pid.
+var resolverMarker = regexp.MustCompile(`^# Managed by Loop(?: \[pid (\d+)\])?\n`)
+
+func configureResolver(ctx context.Context, owner int, address string, domains, search []string) error {
+	if err := os.MkdirAll(resolverDir, 0755); err != nil {
+		return err
+	}
+
+	managed, err := managedResolvers()
+
+	if err != nil {
+		return err
+	}
+
+	var result error
+
+	for name, pid := range managed {
+		if pid != owner || slices.Contains(domains, name) {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(resolverDir, name)); err != nil {
+			result = errors.Join(result, err)
+		}
+	}
+
+	for _, domain := range domains {
+		path := filepath.Join(resolverDir, domain)
+
+		if _, err := os.Stat(path); err == nil {
+			pid, ok := managed[domain]
+
+			// never overwrite resolver files someone else placed, or those
+			// of another running session
+			if !ok || (pid != owner && pid != 0 && session.ProcessAlive(pid)) {
+				continue
+			}
+		}
+
+		text := fmt.Sprintf("# Managed by Loop [pid %d]\nnameserver %s\n", owner, address)
+
+		if len(search) > 0 {
+			text += fmt.Sprintf("search %s\n", strings.Join(search, " "))
+		}
+
+		if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+			result = errors.Join(result, err)
+		}
+	}
+
+	return result
+}
+
+func resetResolver(ctx context.Context, owner int) error {
+	managed, err := managedResolvers()
+
+	if err != nil {
+		return err
+	}
+
+	var result error
+
+	for name, pid := range managed {
+		if pid != owner {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(resolverDir, name)); err != nil {
+			result = errors.Join(result, err)
+		}
+	}
+
+	return result
+}
+
+// managedResolvers returns the resolver files written by loop and the pid of
+// the session owning each, zero if unknown.
+func managedResolvers() (map[string]int, error) {
+	entries, err := os.ReadDir(resolverDir)
+
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	result := make(map[string]int)
+
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(resolverDir, e.Name()))
+
+		if err != nil {
+			continue
+		}
+
+		m := resolverMarker.FindSubmatch(data)
+
+		if m == nil {
+			continue
+		}
+
+		pid, _ := strconv.Atoi(string(m[1]))
+		result[e.Name()] = pid
+	}
+
+	return result, nil
+}
+
+func systemUpstreams() []string {
+	return parseResolvConf("/etc/resolv.conf")
+}
@@ -0,0 +1,89 @@
+//go:build linux
+
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// resolverLink names the dummy interface that carries the split DNS settings
+// of one session, so systemd-resolved routes only the published domains to
+// the server and drops the configuration together with the link. Interface
+// names are limited to 15 characters.
+func resolverLink(owner int) string {
+	return fmt.Sprintf("loopdns%d", owner)
+}
+
+func configureResolver(ctx context.Context, owner int, address string, domains, search []string) error {
+	if _, err := os.Stat("/run/systemd/resolve"); err != nil {
+		return errors.New("embedded DNS requires systemd-resolved")
+	}
+
+	resolverLink := resolverLink(owner)
+
+	if _, err := net.InterfaceByName(resolverLink); err != nil {
+		if err := run(ctx, "ip", "link", "add", resolverLink, "type", "dummy"); err != nil {
+			return err
+		}
+
+		if err := run(ctx, "ip", "link", "set", resolverLink, "up"); err != nil {
+			return err
+		}
+	}
+
+	if err := run(ctx, "resolvectl", "dns", resolverLink, address); err != nil {
+		return err
+	}
+
+	args := []string{"domain", resolverLink}
+
+	for _, d := range domains {
+		args = append(args, "~"+d)
+	}
+
+	args = append(args, search...)
+
+	if len(args) == 2 {
+		args = append(args, "")
+	}
+
+	if err := run(ctx, "resolvectl", args...); err != nil {
+		return err
+	}
+
+	return run(ctx, "resolvectl", "default-route", resolverLink, "false")
+}
+
+func resetResolver(ctx context.Context, owner int) error {
+	if _, err := net.InterfaceByName(resolverLink(owner)); err != nil {
+		return nil
+	}
+
+	return run(ctx, "ip", "link", "delete", resolverLink(owner))
+}
+
+func systemUpstreams() []string {
+	// The stub resolv.conf only lists 127.0.0.53; the real upstreams are
+	// in the file resolved maintains for non-stub clients.
+	if servers := parseResolvConf("/run/systemd/resolve/resolv.conf"); len(servers) > 0 {
+		return servers
+	}
+
+	return parseResolvConf("/etc/resolv.conf")
+}
+
+func run(ctx context.Context, name string, args ...string) error {
+	output, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+
+	if err != nil {
+		return errors.New(strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
@@ -0,0 +1,20 @@
+//go:build !linux && !darwin && !windows
+
+package dns
+
+import (
+	"context"
+	"errors"
+)
+
+func configureResolver(ctx context.Context, owner int, address string, domains, search []string) error {
+	return errors.New("embedded DNS is not supported on this platform")
+}
+
+func resetResolver(ctx context.Context, owner int) error {
+	return nil
+}
+
+func systemUpstreams() []string {
+	return nil
+}
@@ -0,0 +1,50 @@
+//go:build windows
+
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// resolverComment tags the Name Resolution Policy Table rules the server
+// adds with the owner's pid, so cleanup only removes those of one session.
+func resolverComment(owner int) string {
+	return fmt.Sprintf("loop [pid %d]", owner)
+}
+
+func configureResolver(ctx context.Context, owner int, address string, domains, search []string) error {
+	script := []string{removeRules(owner)}
+
+	for _, d := range domains {
+		// ".example.com" matches subdomains, "example.com" the name itself
+		script = append(script, fmt.Sprintf("Add-DnsClientNrptRule -Namespace '.%[1]s','%[1]s' -NameServers '%[2]s' -Comment '%[3]s'", d, address, resolverComment(owner)))
+	}
+
+	return powershell(ctx, strings.Join(script, "; "))
+}
+
+func resetResolver(ctx context.Context, owner int) error {
+	return powershell(ctx, removeRules(owner))
+}
+
+func removeRules(owner int) string {
+	return fmt.Sprintf("Get-DnsClientNrptRule | Where-Object Comment -eq '%s' | ForEach-Object { Remove-DnsClientNrptRule -Name $_.Name -Force }", resolverComment(owner))
+}
+
+func systemUpstreams() []string {
+	return nil
+}
+
+func powershell(ctx context.Context, script string) error {
+	output, err := exec.CommandContext(ctx, "powershell", "-NoProfile", "-NonInteractive", "-Command", script).CombinedOutput()
+
+	if err != nil {
+		return errors.New(strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
@@ -0,0 +1,72 @@
+package dns
+
+import (
+	"sync"
+
+	"github.com/adrianliechti/loop/pkg/system"
+)
+
+// Section is a publisher's set of records. Changes are staged like in a
+// hosts section and only become visible to clients on Flush.
+type Section struct {
+	server *Server
+
+	hosts map[string][]string
+	srv   map[string][]system.SRV
+
+	mu           sync.Mutex
+	published    map[string][]string
+	publishedSRV map[string][]system.SRV
+}
+
+var _ system.Hosts = (*Section)(nil)
+
+func newSection(server *Server) *Section {
+	return &Section{
+		server: server,
+
+		hosts: make(map[string][]string),
+		srv:   make(map[string][]system.SRV),
+
+		published:    make(map[string][]string),
+		publishedSRV: make(map[string][]system.SRV),
+	}
+}
+
+func (s *Section) Add(address string, hosts ...string) {
+	s.hosts[address] = hosts
+}
+
+func (s *Section) AddSRV(address string, records ...system.SRV) {
+	s.srv[address] = records
+}
+
+func (s *Section) Remove(address string) {
+	delete(s.hosts, address)
+	delete(s.srv, address)
+}
+
+func (s *Section) Clear() {
+	clear(s.hosts)
+	clear(s.srv)
+}
+
+func (s *Section) Flush() error {
+	s.mu.Lock()
+
+	s.published = make(map[string][]string, len(s.hosts))
+
+	for address, hosts := range s.hosts {
+		s.published[address] = append([]string(nil), hosts...)
+	}
+
+	s.publishedSRV = make(map[string][]system.SRV, len(s.srv))
+
+	for address, records := range s.srv {
+		s.publishedSRV[address] = append([]system.SRV(nil), records...)
+	}
+
+	s.mu.Unlock()
+
+	return s.server.rebuild()
+}
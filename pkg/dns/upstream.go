@@ -0,0 +1,63 @@
+package dns
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strings"
+)
+
+// parseResolvConf returns the nameservers listed in a resolv.conf file,
+// skipping loopback stubs that would route queries back to the system
+// resolver and therefore to this server.
+func parseResolvConf(path string) []string {
+	f, err := os.Open(path)
+
+	if err != nil {
+		return nil
+	}
+
+	defer f.Close()
+
+	var result []string
+
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+
+		ip := net.ParseIP(fields[1])
+
+		if ip == nil || ip.IsLoopback() {
+			continue
+		}
+
+		result = append(result, ip.String())
+	}
+
+	return result
+}
+
+// validDomain guards names that end up in file paths and resolver commands;
+// they come from cluster objects and must not be trusted blindly.
+func validDomain(name string) bool {
+	if name == "" || len(name) > 253 || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "-") {
+		return false
+	}
+
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z':
+		case r >= '0' && r <= '9':
+		case r == '-' || r == '.' || r == '_':
+		default:
+			return false
+		}
+	}
+
+	return !strings.Contains(name, "..")
+}
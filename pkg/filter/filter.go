@@ -0,0 +1,180 @@
+package filter
+
+import (
+	"context"
+	"log/slog"
+	"path"
+	"sync"
+
+	"github.com/adrianliechti/loop/pkg/kubernetes"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Annotation opts a resource, or every resource of a namespace, out of
+// local exposure when set to "false".
+const Annotation = "loop.adrianliechti.io/expose"
+
+// Filter decides which resources are exposed locally. A nil Filter exposes
+// everything.
+type Filter struct {
+	selector labels.Selector
+
+	include []string
+	exclude []string
+
+	mu     sync.Mutex
+	hidden map[string]bool
+}
+
+type FilterOptions struct {
+	// Selector is a label selector such as "team=payments,tier!=internal".
+	Selector string
+
+	// Include and Exclude are globs matched against "name" and
+	// "namespace/name", e.g. "kube-*" or "shop/*-internal".
+	Include []string
+	Exclude []string
+}
+
+func New(options FilterOptions) (*Filter, error) {
+	selector, err := labels.Parse(options.Selector)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pattern := range append(options.Include, options.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Filter{
+		selector: selector,
+
+		include: options.Include,
+		exclude: options.Exclude,
+
+		hidden: make(map[string]bool),
+	}, nil
+}
+
+// Match reports whether obj should be exposed.
+func (f *Filter) Match(obj metav1.Object) bool {
+	if f == nil {
+		return true
+	}
+
+	if obj.GetAnnotations()[Annotation] == "false" {
+		return false
+	}
+
+	f.mu.Lock()
+	hidden := f.hidden[obj.GetNamespace()]
+	f.mu.Unlock()
+
+	if hidden {
+		return false
+	}
+
+	if !f.selector.Matches(labels.Set(obj.GetLabels())) {
+		return false
+	}
+
+	if len(f.include) > 0 && !matchAny(f.include, obj) {
+		return false
+	}
+
+	return !matchAny(f.exclude, obj)
+}
+
+// Watch tracks the namespaces opted out through the annotation and calls
+// changed whenever that set changes. Reading namespaces needs cluster-wide
+// permissions; without them only annotated resources are skipped.
+func (f *Filter) Watch(ctx context.Context, client kubernetes.Client, changed func(), logger *slog.Logger) error {
+	if f == nil {
+		return nil
+	}
+
+	if _, err := client.CoreV1().Namespaces().List(ctx, metav1.ListOptions{Limit: 1}); err != nil {
+		if kubernetes.IsForbidden(err) {
+			if logger != nil {
+				logger.WarnContext(ctx, "cannot read namespaces, namespace annotations are ignored", "annotation", Annotation)
+			}
+
+			return nil
+		}
+
+		return err
+	}
+
+	update := func(ns *corev1.Namespace, deleted bool) {
+		hidden := !deleted && ns.Annotations[Annotation] == "false"
+
+		f.mu.Lock()
+		prev := f.hidden[ns.Name]
+
+		if hidden {
+			f.hidden[ns.Name] = true
+		} else {
+			delete(f.hidden, ns.Name)
+		}
+
+		f.mu.Unlock()
+
+		if prev != hidden && changed != nil {
+			changed()
+		}
+	}
+
+	handlers := cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			update(obj.(*corev1.Namespace), false)
+		},
+
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			update(newObj.(*corev1.Namespace), false)
+		},
+
+		DeleteFunc: func(obj interface{}) {
+			if ns, ok := obj.(*corev1.Namespace); ok {
+				update(ns, true)
+			}
+		},
+	}
+
+	watcher := cache.ToListWatcherWithWatchListSemantics(&cache.ListWatch{
+		ListWithContextFunc: func(ctx context.Context, options metav1.ListOptions) (runtime.Object, error) {
+			return client.CoreV1().Namespaces().List(ctx, options)
+		},
+
+		WatchFuncWithContext: func(ctx context.Context, options metav1.ListOptions) (watch.Interface, error) {
+			return client.CoreV1().Namespaces().Watch(ctx, options)
+		},
+	}, client)
+
+	_, controller := cache.NewInformer(watcher, &corev1.Namespace{}, 0, handlers)
+	go controller.Run(ctx.Done())
+
+	return nil
+}
+
+func matchAny(patterns []string, obj metav1.Object) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, obj.GetName()); ok {
+			return true
+		}
+
+		if ok, _ := path.Match(pattern, obj.GetNamespace()+"/"+obj.GetName()); ok {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,78 @@
+package filter
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestMatch(t *testing.T) {
+	service := func(namespace, name string, labels, annotations map[string]string) *corev1.Service {
+		return &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   namespace,
+				Name:        name,
+				Labels:      labels,
+				Annotations: annotations,
+			},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		options FilterOptions
+		service *corev1.Service
+		want    bool
+	}{
+		{"no filter", FilterOptions{}, service("shop", "orders", nil, nil), true},
+		{"selector match", FilterOptions{Selector: "team=payments"}, service("shop", "orders", map[string]string{"team": "payments"}, nil), true},
+		{"selector mismatch", FilterOptions{Selector: "team=payments"}, service("shop", "orders", map[string]string{"team": "search"}, nil), false},
+		{"include name", FilterOptions{Include: []string{"order*"}}, service("shop", "orders", nil, nil), true},
+		{"include namespace", FilterOptions{Include: []string{"shop/*"}}, service("shop", "orders", nil, nil), true},
+		{"include miss", FilterOptions{Include: []string{"shop/*"}}, service("billing", "orders", nil, nil), false},
+		{"exclude name", FilterOptions{Exclude: []string{"kube-*"}}, service("kube-system", "kube-dns", nil, nil), false},
+		{"exclude wins", FilterOptions{Include: []string{"*"}, Exclude: []string{"*/orders"}}, service("shop", "orders", nil, nil), false},
+		{"annotation", FilterOptions{}, service("shop", "orders", nil, map[string]string{Annotation: "false"}), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := New(tt.options)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := f.Match(tt.service); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchNamespace(t *testing.T) {
+	f, err := New(FilterOptions{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.hidden["internal"] = true
+
+	obj := &metav1.ObjectMeta{Namespace: "internal", Name: "orders"}
+
+	if f.Match(obj) {
+		t.Error("service in opted-out namespace was exposed")
+	}
+}
+
+func TestNewRejectsInvalid(t *testing.T) {
+	if _, err := New(FilterOptions{Selector: "team in payments"}); err == nil {
+		t.Error("expected error for invalid selector")
+	}
+
+	if _, err := New(FilterOptions{Exclude: []string{"["}}); err == nil {
+		t.Error("expected error for invalid glob")
+	}
+}
@@ -0,0 +1,64 @@
+package forward
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+)
+
+// DialFunc opens the upstream side of a forwarded connection.
+type DialFunc func(ctx context.Context) (net.Conn, error)
+
+// TCP accepts connections on l and pipes each one to a fresh upstream from
+// dial until ctx is cancelled or the listener fails.
+func TCP(ctx context.Context, l net.Listener, dial DialFunc) error {
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	for {
+		conn, err := l.Accept()
+
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+
+			return err
+		}
+
+		go func() {
+			defer conn.Close()
+
+			upstream, err := dial(ctx)
+
+			if err != nil {
+				return
+			}
+
+			defer upstream.Close()
+
+			Pipe(conn, upstream)
+		}()
+	}
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// Pipe copies data in both directions and returns once the upstream side is
+// done. Half-closes are propagated where both ends support them.
+func Pipe(conn, upstream net.Conn) {
+	go func() {
+		io.Copy(upstream, conn)
+
+		if c, ok := upstream.(closeWriter); ok {
+			c.CloseWrite()
+		}
+	}()
+
+	io.Copy(conn, upstream)
+}
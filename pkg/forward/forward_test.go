@@ -0,0 +1,138 @@
+package forward
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// echo returns a DialFunc whose upstream echoes every chunk back.
+func echo() DialFunc {
+	return func(ctx context.Context) (net.Conn, error) {
+		local, remote := net.Pipe()
+
+		go func() {
+			defer remote.Close()
+			io.Copy(remote, remote)
+		}()
+
+		return local, nil
+	}
+}
+
+func TestUDPKeepsDatagramsPerPeer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go UDP(ctx, conn, echo())
+
+	for _, message := range []string{"first", "second"} {
+		client, err := net.Dial("udp", conn.LocalAddr().String())
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer client.Close()
+
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+
+		if _, err := client.Write([]byte(message)); err != nil {
+			t.Fatal(err)
+		}
+
+		buf := make([]byte, 1024)
+		n, err := client.Read(buf)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := string(buf[:n]); got != message {
+			t.Fatalf("got %q, want %q", got, message)
+		}
+	}
+}
+
+func TestTCPPipesConnections(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go TCP(ctx, l, echo())
+
+	client, err := net.Dial("tcp", l.Addr().String())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer client.Close()
+
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 4)
+
+	if _, err := io.ReadFull(client, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := string(buf); got != "ping" {
+		t.Fatalf("got %q, want %q", got, "ping")
+	}
+}
+
+func TestStatsTracksConnections(t *testing.T) {
+	var stats Stats
+
+	conn, err := echo()(context.Background())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn = stats.Track(conn)
+
+	if got := stats.Active(); got != 1 {
+		t.Fatalf("want 1 active connection, got %d", got)
+	}
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 4)
+
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// closing twice must not count the connection twice
+	conn.Close()
+	conn.Close()
+
+	if got := stats.Active(); got != 0 {
+		t.Errorf("want 0 active connections, got %d", got)
+	}
+
+	if sent, received := stats.Bytes(); sent != 4 || received != 4 {
+		t.Errorf("want 4 bytes each way, got %d sent, %d received", sent, received)
+	}
+}
@@ -0,0 +1,92 @@
+package forward
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats counts the upstream connections of a forwarder and the bytes they
+// carried. The zero value is ready to use.
+type Stats struct {
+	active   atomic.Int64
+	sent     atomic.Int64
+	received atomic.Int64
+
+	mu          sync.Mutex
+	lastError   error
+	lastErrorAt time.Time
+}
+
+// Track counts conn as active until it is closed, along with the bytes
+// written to and read from it.
+func (s *Stats) Track(conn net.Conn) net.Conn {
+	s.active.Add(1)
+
+	return &trackedConn{Conn: conn, stats: s}
+}
+
+// Fail records err as the most recent failure.
+func (s *Stats) Fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastError = err
+	s.lastErrorAt = time.Now()
+}
+
+// Active returns the number of open upstream connections.
+func (s *Stats) Active() int64 {
+	return s.active.Load()
+}
+
+// Bytes returns the bytes sent to and received from upstreams so far.
+func (s *Stats) Bytes() (sent, received int64) {
+	return s.sent.Load(), s.received.Load()
+}
+
+// LastError returns the most recent failure and when it happened.
+func (s *Stats) LastError() (error, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.lastError, s.lastErrorAt
+}
+
+type trackedConn struct {
+	net.Conn
+
+	stats *Stats
+	once  sync.Once
+}
+
+func (c *trackedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.stats.received.Add(int64(n))
+
+	return n, err
+}
+
+func (c *trackedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.stats.sent.Add(int64(n))
+
+	return n, err
+}
+
+func (c *trackedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+
+	return nil
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() {
+		c.stats.active.Add(-1)
+	})
+
+	return c.Conn.Close()
+}
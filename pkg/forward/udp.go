@@ -0,0 +1,131 @@
+package forward
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// udpFlowTimeout closes a relay session after this long without traffic in
+// either direction, mirroring the conntrack UDP timeout most nodes use.
+const udpFlowTimeout = 60 * time.Second
+
+type udpFlow struct {
+	packets chan []byte
+	cancel  context.CancelFunc
+	timer   *time.Timer
+}
+
+// UDP relays datagrams received on conn. Every local peer gets its own
+// upstream from dial; each datagram is written as one chunk and each chunk
+// read back is returned to the peer as one datagram.
+func UDP(ctx context.Context, conn net.PacketConn, dial DialFunc) error {
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	var mu sync.Mutex
+	flows := make(map[string]*udpFlow)
+
+	buf := make([]byte, 65535)
+
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+
+			return err
+		}
+
+		packet := make([]byte, n)
+		copy(packet, buf[:n])
+
+		key := peer.String()
+
+		mu.Lock()
+		flow, ok := flows[key]
+
+		if !ok {
+			flowCtx, cancel := context.WithCancel(ctx)
+
+			flow = &udpFlow{
+				packets: make(chan []byte, 64),
+				cancel:  cancel,
+				timer:   time.AfterFunc(udpFlowTimeout, cancel),
+			}
+
+			flows[key] = flow
+
+			go func() {
+				relayUDP(flowCtx, conn, peer, flow, dial)
+
+				mu.Lock()
+				delete(flows, key)
+				mu.Unlock()
+
+				cancel()
+			}()
+		}
+		mu.Unlock()
+
+		flow.timer.Reset(udpFlowTimeout)
+
+		// Behave like a congested link instead of stalling every other peer
+		// on this port while one session is slow to start.
+		select {
+		case flow.packets <- packet:
+		default:
+		}
+	}
+}
+
+func relayUDP(ctx context.Context, conn net.PacketConn, peer net.Addr, flow *udpFlow, dial DialFunc) {
+	upstream, err := dial(ctx)
+
+	if err != nil {
+		return
+	}
+
+	defer upstream.Close()
+
+	go func() {
+		<-ctx.Done()
+		upstream.Close()
+	}()
+
+	go func() {
+		for {
+			select {
+			case packet := <-flow.packets:
+				if _, err := upstream.Write(packet); err != nil {
+					flow.cancel()
+					return
+				}
+
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, 65535)
+
+	for {
+		n, err := upstream.Read(buf)
+
+		if n > 0 {
+			flow.timer.Reset(udpFlowTimeout)
+			conn.WriteTo(buf[:n], peer)
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package gateway
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// authorityLifetime is how long the root users trust lasts; it is
+	// replaced authorityRenewal before it expires.
+	authorityLifetime = 2 * 365 * 24 * time.Hour
+	authorityRenewal  = 30 * 24 * time.Hour
+
+	// leafLifetime stays below what browsers accept for server
+	// certificates; leaves are reissued as they expire.
+	leafLifetime = 30 * 24 * time.Hour
+)
+
+// authority issues the certificates the router terminates TLS with. The
+// root is kept in the user config directory and reused across sessions, so
+// the user trusts it once; its key is only readable by the user.
+type authority struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+
+	mu     sync.Mutex
+	leaves map[string]*tls.Certificate
+}
+
+// DefaultAuthorityPath returns the file the router's root certificate is
+// written to for the user to trust, or an empty string if there is no config
+// directory. The key is kept next to it; see authorityKeyPath.
+func DefaultAuthorityPath() string {
+	dir, err := os.UserConfigDir()
+
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(dir, "loop", "router-ca.pem")
+}
+
+func authorityKeyPath(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + "-key.pem"
+}
+
+// newAuthority loads the root kept at path, or creates one and keeps it
+// there when there is none, it is about to expire or its key is readable
+// by others. Without a path, the root lives for the session only.
+func newAuthority(path string) (*authority, error) {
+	if path != "" {
+		if a, err := loadAuthority(path); err == nil {
+			return a, nil
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serialNumber(),
+		Subject:      pkix.Name{CommonName: "Loop Router CA " + time.Now().Format(time.DateOnly)},
+
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter:  time.Now().Add(authorityLifetime),
+
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		MaxPathLenZero:        true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := x509.ParseCertificate(der)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if path != "" {
+		if err := saveAuthority(path, der, key); err != nil {
+			return nil, err
+		}
+	}
+
+	return &authority{
+		cert: cert,
+		key:  key,
+
+		leaves: make(map[string]*tls.Certificate),
+	}, nil
+}
+
+func loadAuthority(path string) (*authority, error) {
+	keyPath := authorityKeyPath(path)
+
+	info, err := os.Stat(keyPath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Windows has no modes; the config directory is the user's own
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("%s is readable by others", keyPath)
+	}
+
+	certData, err := os.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	keyData, err := os.ReadFile(keyPath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	pair, err := tls.X509KeyPair(certData, keyData)
+
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+
+	if !ok || !pair.Leaf.IsCA {
+		return nil, fmt.Errorf("%s holds no router root", path)
+	}
+
+	if time.Now().Add(authorityRenewal).After(pair.Leaf.NotAfter) {
+		return nil, fmt.Errorf("%s expires soon", path)
+	}
+
+	return &authority{
+		cert: pair.Leaf,
+		key:  key,
+
+		leaves: make(map[string]*tls.Certificate),
+	}, nil
+}
+
+// saveAuthority writes the key before the certificate, so a certificate on
+// disk always has its key next to it.
+func saveAuthority(path string, der []byte, key *ecdsa.PrivateKey) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+
+	if err != nil {
+		return err
+	}
+
+	keyPath := authorityKeyPath(path)
+
+	// WriteFile keeps the mode of an existing file
+	if err := os.Remove(keyPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// Certificate issues a certificate for the requested server name, caching
+// it for the session. The router only asks for the names it publishes.
+func (a *authority) Certificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(hello.ServerName)
+
+	if name == "" {
+		name = "localhost"
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if cert, ok := a.leaves[name]; ok && time.Now().Before(cert.Leaf.NotAfter) {
+		return cert, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		return nil, err
+	}
+
+	expires := time.Now().Add(leafLifetime)
+
+	if a.cert.NotAfter.Before(expires) {
+		expires = a.cert.NotAfter
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serialNumber(),
+		Subject:      pkix.Name{CommonName: name},
+
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter:  expires,
+
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	if ip := net.ParseIP(name); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{name}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, a.cert, &key.PublicKey, a.key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+
+	if err != nil {
+		return nil, err
+	}
+
+	cert := &tls.Certificate{
+		Certificate: [][]byte{der, a.cert.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+
+	a.leaves[name] = cert
+
+	return cert, nil
+}
+
+func serialNumber() *big.Int {
+	n, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	return n
+}
@@ -0,0 +1,379 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adrianliechti/loop/pkg/reconcile"
+	"github.com/adrianliechti/loop/pkg/source"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	gatewayv1 "sigs.k8s.io/gateway-api/apis/v1"
+)
+
+const (
+	// gatewayNameLabel is set by controllers that provision a data plane per
+	// Gateway on the resources they create for it.
+	gatewayNameLabel = "gateway.networking.k8s.io/gateway-name"
+
+	ingressClassAnnotation        = "kubernetes.io/ingress.class"
+	defaultIngressClassAnnotation = "ingressclass.kubernetes.io/is-default-class"
+)
+
+// ingressControllerFunc returns the data plane service of the controller
+// serving an ingress, or false if it cannot be found.
+type ingressControllerFunc func(i networkingv1.Ingress) (*corev1.Service, bool)
+
+// gatewayService finds the data plane service of a gateway: by its status
+// address if the controller published one, otherwise by the gateway name
+// label, as on clusters without a load balancer implementation.
+func gatewayService(g gatewayv1.Gateway, services []corev1.Service) (*corev1.Service, bool) {
+	if addr := gatewayAddress(g); addr != "" {
+		if service, ok := findService(services, addr); ok {
+			return service, true
+		}
+	}
+
+	var candidates []*corev1.Service
+
+	for i := range services {
+		s := &services[i]
+
+		if s.Namespace == g.Namespace && s.Labels[gatewayNameLabel] == g.Name {
+			candidates = append(candidates, s)
+		}
+	}
+
+	return pickService(candidates)
+}
+
+// ingressService finds the data plane service of an ingress: by its status
+// address if the controller published one, otherwise through the
+// controller deployment of its ingress class.
+func ingressService(i networkingv1.Ingress, services []corev1.Service, controllers ingressControllerFunc) (*corev1.Service, bool) {
+	if addr := ingressAddress(i); addr != "" {
+		if service, ok := findService(services, addr); ok {
+			return service, true
+		}
+	}
+
+	if controllers == nil {
+		return nil, false
+	}
+
+	return controllers(i)
+}
+
+// sourceService finds the data plane service of a source route: by name,
+// by the pods it selects, or by its address, whichever the source knows.
+func sourceService(r source.Route, services []corev1.Service) (*corev1.Service, bool) {
+	if r.Service != "" {
+		for i := range services {
+			if s := &services[i]; reconcile.ResourceKey(s) == r.Service {
+				return s, true
+			}
+		}
+	}
+
+	if len(r.Selector) > 0 {
+		var candidates []*corev1.Service
+
+		// Pod labels are not at hand; a service whose selector contains the
+		// route's, or is contained in it, is taken to reach the same pods.
+		for i := range services {
+			s := &services[i]
+
+			if len(s.Spec.Selector) == 0 {
+				continue
+			}
+
+			if labels.SelectorFromSet(r.Selector).Matches(labels.Set(s.Spec.Selector)) || labels.SelectorFromSet(s.Spec.Selector).Matches(labels.Set(r.Selector)) {
+				candidates = append(candidates, s)
+			}
+		}
+
+		if service, ok := pickService(candidates); ok {
+			return service, true
+		}
+	}
+
+	if r.Address != "" {
+		return findService(services, r.Address)
+	}
+
+	return nil, false
+}
+
+// ingressAddress returns the ingress's load balancer address. Managed load
+// balancers may publish only a Hostname (e.g. AWS NLB/ELB) instead of an
+// IP, so it falls back to the Hostname when the IP is empty.
+func ingressAddress(i networkingv1.Ingress) string {
+	var addr string
+
+	for _, ing := range i.Status.LoadBalancer.Ingress {
+		if ing.IP != "" {
+			return ing.IP
+		}
+
+		if ing.Hostname != "" {
+			addr = ing.Hostname
+		}
+	}
+
+	return addr
+}
+
+// controllerCacheTTL is how long the ingress classes and deployments read
+// for the controller fallback are reused. Refreshes fire on pod events, and
+// clusters without load balancers (kind, k3d) need the fallback on every
+// one of them.
+const controllerCacheTTL = 5 * time.Minute
+
+var deploymentsResource = appsv1.SchemeGroupVersion.WithResource("deployments")
+
+// controllerCache memoises the reads of ingressControllers, failures
+// included, so a missing permission is not retried every refresh.
+type controllerCache struct {
+	mu     sync.Mutex
+	loaded time.Time
+
+	classes     []networkingv1.IngressClass
+	deployments []appsv1.Deployment
+	err         error
+}
+
+// loadControllers returns the ingress classes and the deployments that may
+// run their controllers, reading them at most once per controllerCacheTTL.
+// Deployments are listed as metadata only, in the namespaces loop watches,
+// and only those named after a class are read in full. What the user may
+// not read is left out: its controllers are unknown, not an error.
+func (c *Gateway) loadControllers(ctx context.Context) ([]networkingv1.IngressClass, []appsv1.Deployment, error) {
+	cache := &c.controllers
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if !cache.loaded.IsZero() && time.Since(cache.loaded) < controllerCacheTTL {
+		return cache.classes, cache.deployments, cache.err
+	}
+
+	options := metav1.ListOptions{ResourceVersion: "0"}
+
+	cache.loaded = time.Now()
+	cache.classes, cache.deployments, cache.err = nil, nil, nil
+
+	classList, err := c.client.NetworkingV1().IngressClasses().List(ctx, options)
+
+	if apierrors.IsForbidden(err) {
+		return nil, nil, nil
+	}
+
+	if err != nil {
+		cache.err = fmt.Errorf("ingress classes: %w", err)
+		return nil, nil, cache.err
+	}
+
+	cache.classes = classList.Items
+
+	namespaces := c.options.Namespaces
+
+	if len(namespaces) == 0 {
+		namespaces = []string{""}
+	}
+
+	for _, namespace := range namespaces {
+		list, err := c.client.Metadata().Resource(deploymentsResource).Namespace(namespace).List(ctx, options)
+
+		if apierrors.IsForbidden(err) {
+			continue
+		}
+
+		if err != nil {
+			cache.err = fmt.Errorf("deployments: %w", err)
+			return nil, nil, cache.err
+		}
+
+		for _, item := range list.Items {
+			if !controllerCandidate(item, cache.classes) {
+				continue
+			}
+
+			d, err := c.client.AppsV1().Deployments(item.Namespace).Get(ctx, item.Name, metav1.GetOptions{})
+
+			if apierrors.IsForbidden(err) || apierrors.IsNotFound(err) {
+				continue
+			}
+
+			if err != nil {
+				cache.err = fmt.Errorf("deployment %s/%s: %w", item.Namespace, item.Name, err)
+				return nil, nil, cache.err
+			}
+
+			cache.deployments = append(cache.deployments, *d)
+		}
+	}
+
+	return cache.classes, cache.deployments, nil
+}
+
+// controllerCandidate reports whether a deployment may run the controller
+// of one of the classes, going by its name or app label: controllers are
+// named after their class or controller, e.g. ingress-nginx-controller for
+// k8s.io/ingress-nginx. servesIngressClass has the final word.
+func controllerCandidate(d metav1.PartialObjectMetadata, classes []networkingv1.IngressClass) bool {
+	names := []string{d.Name, d.Labels["app.kubernetes.io/name"], d.Labels["app"]}
+
+	for _, class := range classes {
+		hints := []string{class.Name}
+
+		if class.Spec.Controller != "" {
+			hints = append(hints, path.Base(class.Spec.Controller))
+		}
+
+		for _, hint := range hints {
+			for _, name := range names {
+				if hint != "" && strings.Contains(name, hint) {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// ingressControllers returns a lookup for ingresses without a usable status
+// address. Ingress classes and deployments are read on first use and reused
+// across refreshes; a controller the user may not read is not found.
+func (c *Gateway) ingressControllers(ctx context.Context, services []corev1.Service) ingressControllerFunc {
+	var loaded bool
+
+	var classes []networkingv1.IngressClass
+	var deployments []appsv1.Deployment
+	var err error
+
+	return func(i networkingv1.Ingress) (*corev1.Service, bool) {
+		if !loaded {
+			loaded = true
+
+			if classes, deployments, err = c.loadControllers(ctx); err != nil {
+				c.logFallback(ctx, err)
+			}
+		}
+
+		if err != nil {
+			return nil, false
+		}
+
+		class, ok := ingressClass(i, classes)
+
+		if !ok {
+			return nil, false
+		}
+
+		var candidates []*corev1.Service
+
+		for _, d := range deployments {
+			if !servesIngressClass(d, class) {
+				continue
+			}
+
+			for j := range services {
+				s := &services[j]
+
+				if s.Namespace != d.Namespace || len(s.Spec.Selector) == 0 {
+					continue
+				}
+
+				if labels.SelectorFromSet(s.Spec.Selector).Matches(labels.Set(d.Spec.Template.Labels)) {
+					candidates = append(candidates, s)
+				}
+			}
+		}
+
+		return pickService(candidates)
+	}
+}
+
+func (c *Gateway) logFallback(ctx context.Context, err error) {
+	if c.options.Logger == nil {
+		return
+	}
+
+	c.options.Logger.DebugContext(ctx, "cannot look up ingress controllers", "error", err)
+}
+
+// ingressClass returns the class an ingress names, by field or legacy
+// annotation, or the cluster's default class if it names none.
+func ingressClass(i networkingv1.Ingress, classes []networkingv1.IngressClass) (networkingv1.IngressClass, bool) {
+	name := i.Annotations[ingressClassAnnotation]
+
+	if i.Spec.IngressClassName != nil {
+		name = *i.Spec.IngressClassName
+	}
+
+	for _, class := range classes {
+		if name != "" && class.Name == name {
+			return class, true
+		}
+
+		if name == "" && class.Annotations[defaultIngressClassAnnotation] == "true" {
+			return class, true
+		}
+	}
+
+	return networkingv1.IngressClass{}, false
+}
+
+// servesIngressClass reports whether a deployment runs the controller of
+// an ingress class. Controllers are told which class to serve on their
+// command line, e.g. --controller-class=k8s.io/ingress-nginx or
+// --ingress-class=nginx.
+func servesIngressClass(d appsv1.Deployment, class networkingv1.IngressClass) bool {
+	for _, container := range d.Spec.Template.Spec.Containers {
+		for _, arg := range slices.Concat(container.Command, container.Args) {
+			key, value, ok := strings.Cut(arg, "=")
+
+			if !ok {
+				continue
+			}
+
+			if class.Spec.Controller != "" && value == class.Spec.Controller {
+				return true
+			}
+
+			if value == class.Name && strings.Contains(strings.ToLower(key), "class") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// pickService chooses among services selecting the same data plane. The one
+// with the most ports wins, so a controller's traffic service is preferred
+// over e.g. its admission webhook; ties go to the first name.
+func pickService(candidates []*corev1.Service) (*corev1.Service, bool) {
+	if len(candidates) == 0 {
+		return nil, false
+	}
+
+	return slices.MinFunc(candidates, func(a, b *corev1.Service) int {
+		if n := len(b.Spec.Ports) - len(a.Spec.Ports); n != 0 {
+			return n
+		}
+
+		return strings.Compare(reconcile.ResourceKey(a), reconcile.ResourceKey(b))
+	}), true
+}
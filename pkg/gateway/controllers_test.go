@@ -0,0 +1,228 @@
+package gateway
+
+import (
+	"testing"
+
+	"github.com/adrianliechti/loop/pkg/kubernetes"
+	"github.com/adrianliechti/loop/pkg/reconcile"
+	"github.com/adrianliechti/loop/pkg/source"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	metadatafake "k8s.io/client-go/metadata/fake"
+	k8stesting "k8s.io/client-go/testing"
+	gatewayv1 "sigs.k8s.io/gateway-api/apis/v1"
+)
+
+func TestGatewayServiceByLabel(t *testing.T) {
+	services := []corev1.Service{
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "other",
+				Name:      "shared-istio",
+				Labels:    map[string]string{gatewayNameLabel: "shared"},
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "infra",
+				Name:      "shared-istio",
+				Labels:    map[string]string{gatewayNameLabel: "shared"},
+			},
+		},
+	}
+
+	g := gatewayv1.Gateway{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "infra", Name: "shared"},
+	}
+
+	service, ok := gatewayService(g, services)
+
+	if !ok || reconcile.ResourceKey(service) != "infra/shared-istio" {
+		t.Fatalf("expected infra/shared-istio, got %v", service)
+	}
+}
+
+func TestSourceServiceBySelector(t *testing.T) {
+	services := []corev1.Service{
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "istio-system", Name: "istiod"},
+			Spec:       corev1.ServiceSpec{Selector: map[string]string{"app": "istiod"}},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "istio-system", Name: "istio-ingressgateway"},
+			Spec:       corev1.ServiceSpec{Selector: map[string]string{"istio": "ingressgateway"}},
+		},
+	}
+
+	r := source.Route{
+		Host:     "shop.example.com",
+		Selector: map[string]string{"istio": "ingressgateway", "app": "istio-ingressgateway"},
+	}
+
+	service, ok := sourceService(r, services)
+
+	if !ok || reconcile.ResourceKey(service) != "istio-system/istio-ingressgateway" {
+		t.Fatalf("expected istio-system/istio-ingressgateway, got %v", service)
+	}
+}
+
+func TestIngressControllers(t *testing.T) {
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ingress-nginx", Name: "ingress-nginx-controller"},
+
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: map[string]string{"app": "ingress-nginx"},
+				},
+
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name: "controller",
+							Args: []string{"/nginx-ingress-controller", "--controller-class=k8s.io/ingress-nginx"},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	clientset := fake.NewClientset(
+		&networkingv1.IngressClass{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "nginx",
+				Annotations: map[string]string{defaultIngressClassAnnotation: "true"},
+			},
+
+			Spec: networkingv1.IngressClassSpec{Controller: "k8s.io/ingress-nginx"},
+		},
+
+		deployment,
+	)
+
+	selector := map[string]string{"app": "ingress-nginx"}
+
+	services := []corev1.Service{
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ingress-nginx", Name: "ingress-nginx-controller-admission"},
+			Spec: corev1.ServiceSpec{
+				Selector: selector,
+				Ports:    []corev1.ServicePort{{Name: "https-webhook", Port: 443}},
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ingress-nginx", Name: "ingress-nginx-controller"},
+			Spec: corev1.ServiceSpec{
+				Selector: selector,
+				Ports:    []corev1.ServicePort{{Name: "http", Port: 80}, {Name: "https", Port: 443}},
+			},
+		},
+	}
+
+	// web is not named after a class and is never read in full
+	metadata := newFakeMetadata(
+		deploymentMetadata(deployment.ObjectMeta),
+		deploymentMetadata(metav1.ObjectMeta{Namespace: "shop", Name: "web"}),
+	)
+
+	c := &Gateway{
+		client: &fakeClient{clientset: clientset, metadata: metadata},
+	}
+
+	controllers := c.ingressControllers(t.Context(), services)
+
+	tests := []struct {
+		name string
+
+		class *string
+		want  string
+	}{
+		{name: "default class", want: "ingress-nginx/ingress-nginx-controller"},
+		{name: "named class", class: kubernetes.Ptr("nginx"), want: "ingress-nginx/ingress-nginx-controller"},
+		{name: "unknown class", class: kubernetes.Ptr("traefik")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i := networkingv1.Ingress{
+				Spec: networkingv1.IngressSpec{IngressClassName: tt.class},
+			}
+
+			service, ok := ingressService(i, services, controllers)
+
+			if tt.want == "" {
+				if ok {
+					t.Fatalf("expected no service, got %s", reconcile.ResourceKey(service))
+				}
+
+				return
+			}
+
+			if !ok || reconcile.ResourceKey(service) != tt.want {
+				t.Fatalf("expected %s, got %v", tt.want, service)
+			}
+		})
+	}
+
+	for _, action := range clientset.Actions() {
+		if get, ok := action.(k8stesting.GetAction); ok && get.GetResource().Resource == "deployments" && get.GetName() != deployment.Name {
+			t.Fatalf("unexpected read of deployment %s", get.GetName())
+		}
+	}
+}
+
+// newFakeMetadata serves objects as metadata, like the API server does for
+// a metav1.PartialObjectMetadata list.
+func newFakeMetadata(objects ...runtime.Object) *metadatafake.FakeMetadataClient {
+	scheme := metadatafake.NewTestScheme()
+	metav1.AddMetaToScheme(scheme)
+
+	return metadatafake.NewSimpleMetadataClient(scheme, objects...)
+}
+
+func deploymentMetadata(meta metav1.ObjectMeta) *metav1.PartialObjectMetadata {
+	return &metav1.PartialObjectMetadata{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+		ObjectMeta: meta,
+	}
+}
+
+func TestIngressControllersForbidden(t *testing.T) {
+	clientset := fake.NewClientset(
+		&networkingv1.IngressClass{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "nginx",
+				Annotations: map[string]string{defaultIngressClassAnnotation: "true"},
+			},
+
+			Spec: networkingv1.IngressClassSpec{Controller: "k8s.io/ingress-nginx"},
+		},
+	)
+
+	metadata := newFakeMetadata()
+
+	metadata.PrependReactor("list", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(deploymentsResource.GroupResource(), "", nil)
+	})
+
+	c := &Gateway{
+		client: &fakeClient{clientset: clientset, metadata: metadata},
+	}
+
+	classes, deployments, err := c.loadControllers(t.Context())
+
+	if err != nil {
+		t.Fatalf("expected forbidden to be no error, got %v", err)
+	}
+
+	if len(classes) != 1 || len(deployments) != 0 {
+		t.Fatalf("expected the class and no deployments, got %d and %d", len(classes), len(deployments))
+	}
+}
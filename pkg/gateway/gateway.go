@@ -2,26 +2,34 @@ package gateway
 
 import (
 	"context"
-	"crypto/md5"
-	"errors"
 	"fmt"
-	"io"
 	"log/slog"
 	"maps"
 	"net"
 	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/adrianliechti/loop/pkg/address"
+	"github.com/adrianliechti/loop/pkg/filter"
+	"github.com/adrianliechti/loop/pkg/forward"
+	"github.com/adrianliechti/loop/pkg/hostname"
+	"github.com/adrianliechti/loop/pkg/jump"
 	"github.com/adrianliechti/loop/pkg/kubernetes"
+	"github.com/adrianliechti/loop/pkg/reconcile"
+	"github.com/adrianliechti/loop/pkg/source"
+	"github.com/adrianliechti/loop/pkg/status"
 	"github.com/adrianliechti/loop/pkg/system"
 
 	corev1 "k8s.io/api/core/v1"
 	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/tools/cache"
 	gatewayv1 "sigs.k8s.io/gateway-api/apis/v1"
 )
@@ -30,317 +38,835 @@ type Gateway struct {
 	client  kubernetes.Client
 	options GatewayOptions
 
-	hosts *system.HostsSection
+	loopback  system.Loopback
+	addresses *address.Allocator
 
-	tunnels []*tunnel
+	reconciler *reconcile.Reconciler[*tunnel]
+
+	router *router
+
+	// sources are the gateway's own, for Ingresses and Gateway API
+	// resources, followed by those of the options.
+	sources []source.Source
 
 	mu         sync.Mutex
 	services   map[string]corev1.Service
 	gateways   map[string]gatewayv1.Gateway
 	httproutes map[string]gatewayv1.HTTPRoute
+	grpcroutes map[string]gatewayv1.GRPCRoute
+	tlsroutes  map[string]gatewayv1.TLSRoute
+	tcproutes  map[string]gatewayv1.TCPRoute
 	ingresses  map[string]networkingv1.Ingress
+
+	pods          map[string]corev1.Pod
+	podNamespaces map[string]bool
+
+	// failures are the hosts that could not be resolved to a tunnel on the
+	// latest refresh.
+	failures map[string]failure
+
+	controllers controllerCache
+}
+
+type failure struct {
+	err   error
+	since time.Time
 }
 
 type GatewayOptions struct {
 	Namespaces []string
 
+	// Cluster qualifies every name with a suffix, e.g.
+	// shop.example.com.staging, so several clusters can be connected at
+	// once. Primary publishes the names as is as well.
+	Cluster string
+	Primary bool
+
+	// Names replaces the names hosts are published under, e.g. with
+	// shop.example.com.dev.internal; the Host and Cluster fields apply.
+	Names *hostname.Names
+
+	// Hosts publishes the tunnel names; defaults to a section of the
+	// system hosts file.
+	Hosts system.Hosts
+
+	// Loopback adds the tunnel addresses to the loopback interface;
+	// defaults to changing it directly.
+	Loopback system.Loopback
+
+	// Filter selects the resources to expose; nil exposes all of them.
+	Filter *filter.Filter
+
+	// Addresses assigns the local tunnel addresses; defaults to an allocator
+	// over 127.245.0.0/16 persisted in the user config directory.
+	Addresses *address.Allocator
+
+	// Router serves HTTP hosts through a local reverse proxy instead of the
+	// ingress controller. It applies Ingress rules and HTTPRoute matches
+	// itself, forwards straight to the backend pods, and terminates HTTPS
+	// with certificates from a local authority (see DefaultAuthorityPath).
+	Router bool
+
+	// Sources add hosts from resources beyond Ingresses and Gateway API
+	// routes, e.g. those of a service mesh; see the packages under source.
+	Sources []source.Source
+
+	// Jump carries every connection through a single loop-tunnel pod, which
+	// dials the controller's ClusterIP, or with the router the backend
+	// service, over SSH instead of port-forwarding to a pod. Controller
+	// pods need not be readable then, and UDP listeners are reachable too;
+	// port-forwarding carries no UDP, so without it UDP ports are left out.
+	Jump *jump.Pod
+
+	// Virtual keeps the tunnels off the network: nothing is aliased or
+	// bound, connections come in through Lookup instead, e.g. from the
+	// rootless proxy. Names are not published unless Hosts is set.
+	Virtual bool
+
 	Logger *slog.Logger
 
 	AddFunc    func(address string, hosts []string, ports []int)
 	DeleteFunc func(address string, hosts []string, ports []int)
+
+	// FailFunc is called when a host cannot be resolved to a tunnel, e.g.
+	// for lack of a controller service or running pod, and with a nil
+	// error once it resolves again.
+	FailFunc func(host string, err error)
 }
 
 func New(client kubernetes.Client, options GatewayOptions) (*Gateway, error) {
-	hosts, err := system.NewHostsSection("Loop Gateway")
+	hosts := options.Hosts
 
-	if err != nil {
-		return nil, err
+	if hosts == nil && options.Virtual {
+		hosts = system.DiscardHosts
 	}
 
-	return &Gateway{
+	if hosts == nil {
+		name := "Loop Gateway"
+
+		if options.Cluster != "" {
+			name += " " + options.Cluster
+		}
+
+		section, err := system.NewHostsSection(name)
+
+		if err != nil {
+			return nil, err
+		}
+
+		hosts = section
+	}
+
+	loopback := options.Loopback
+
+	if loopback == nil {
+		loopback = system.DefaultLoopback
+	}
+
+	addresses := options.Addresses
+
+	if addresses == nil {
+		name := "gateway"
+
+		if options.Cluster != "" {
+			name += "-" + options.Cluster
+		}
+
+		path := address.DefaultPath(name)
+
+		// virtual addresses only identify tunnels, nothing to keep stable
+		if options.Virtual {
+			path = ""
+		}
+
+		allocator, err := address.New(address.AllocatorOptions{
+			Network: "127.245.0.0/16",
+			Path:    path,
+
+			Logger: options.Logger,
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		addresses = allocator
+	}
+
+	var r *router
+
+	if options.Router {
+		authority, err := newAuthority(DefaultAuthorityPath())
+
+		if err != nil {
+			return nil, err
+		}
+
+		r = newRouter(client, authority, options.Logger)
+
+		if options.Jump != nil {
+			r.dial = options.Jump.Dial
+		}
+	}
+
+	c := &Gateway{
 		client:  client,
 		options: options,
 
-		hosts: hosts,
+		router: r,
+
+		loopback:  loopback,
+		addresses: addresses,
+
+		reconciler: reconcile.New[*tunnel](reconcile.Options{
+			Hosts:  hosts,
+			Logger: options.Logger,
 
-		tunnels: make([]*tunnel, 0),
+			AddFunc:    options.AddFunc,
+			DeleteFunc: options.DeleteFunc,
+		}),
 
 		services:   make(map[string]corev1.Service),
 		gateways:   make(map[string]gatewayv1.Gateway),
 		httproutes: make(map[string]gatewayv1.HTTPRoute),
+		grpcroutes: make(map[string]gatewayv1.GRPCRoute),
+		tlsroutes:  make(map[string]gatewayv1.TLSRoute),
+		tcproutes:  make(map[string]gatewayv1.TCPRoute),
 		ingresses:  make(map[string]networkingv1.Ingress),
-	}, nil
+
+		pods:          make(map[string]corev1.Pod),
+		podNamespaces: make(map[string]bool),
+
+		failures: make(map[string]failure),
+	}
+
+	c.sources = slices.Concat([]source.Source{&ingressSource{c: c}, &gatewaySource{c: c}}, options.Sources)
+
+	return c, nil
 }
 
 func (c *Gateway) Start(ctx context.Context) error {
-	c.hosts.Clear()
-	c.hosts.Flush()
+	c.reconciler.Reset()
 
 	defer func() {
-		c.hosts.Clear()
-		c.hosts.Flush()
-
-		for _, t := range c.tunnels {
-			t.Stop()
-		}
+		c.reconciler.Close()
 	}()
 
-	namespaces := c.options.Namespaces
-
-	if len(namespaces) == 0 {
-		namespaces = []string{""}
+	if c.router != nil {
+		if err := c.router.Start(ctx); err != nil {
+			return err
+		}
 	}
 
 	if err := c.watchServices(ctx, c.client, ""); err != nil {
 		return err
 	}
 
-	for _, namespace := range namespaces {
-		if err := c.watchGateways(ctx, c.client, namespace); err != nil {
-			return err
+	for _, s := range c.sources {
+		err := s.Start(ctx, c.notify)
+
+		if err == nil {
+			continue
 		}
 
-		if err := c.watchHTTPRoutes(ctx, c.client, namespace); err != nil {
+		// Added sources are optional extras; one the user cannot read must
+		// not keep the others from working.
+		if !slices.Contains(c.options.Sources, s) {
 			return err
 		}
 
-		if err := c.watchIngresses(ctx, c.client, namespace); err != nil {
-			return err
+		if c.options.Logger != nil {
+			c.options.Logger.WarnContext(ctx, "failed to start source", "source", s.Name(), "error", err)
 		}
 	}
 
-	if err := c.Refresh(ctx); err != nil {
+	if err := c.options.Filter.Watch(ctx, c.client, c.notify, c.options.Logger); err != nil {
 		return err
 	}
 
-	for {
-		select {
-		case <-time.After(10 * time.Second):
-		case <-ctx.Done():
-			return nil
-		}
+	return c.reconciler.Run(ctx, c.Refresh)
+}
 
-		if err := c.Refresh(ctx); err != nil {
-			if c.options.Logger != nil {
-				c.options.Logger.ErrorContext(ctx, "refresh failed", "error", err)
-			}
-		}
+// Status reports the running tunnels.
+func (c *Gateway) Status() []status.Tunnel {
+	tunnels := c.reconciler.Tunnels()
+
+	result := make([]status.Tunnel, 0, len(tunnels))
+
+	for _, t := range tunnels {
+		s := t.Status()
+		s.Source = "gateway"
+		s.Cluster = c.options.Cluster
+
+		result = append(result, s)
 	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, host := range slices.Sorted(maps.Keys(c.failures)) {
+		f := c.failures[host]
+
+		result = append(result, status.Tunnel{
+			Source:  "gateway",
+			Cluster: c.options.Cluster,
+
+			Hosts: []string{host},
+
+			LastError:     f.err.Error(),
+			LastErrorTime: &f.since,
+		})
+	}
+
+	return result
 }
 
-func (c *Gateway) Refresh(ctx context.Context) error {
-	var result error
+// notify schedules a refresh; events arriving while one is pending are
+// coalesced into it.
+func (c *Gateway) notify() {
+	c.reconciler.Notify()
+}
 
+func (c *Gateway) Refresh(ctx context.Context) error {
 	desired, err := c.listTunnel(ctx)
 
 	if err != nil {
 		return err
 	}
 
-	desiredByAddr := make(map[string]*tunnel, len(desired))
 	for _, t := range desired {
-		desiredByAddr[t.address] = t
+		t.Virtual = c.options.Virtual
+		t.Loopback = c.loopback
 	}
 
-	previousByAddr := make(map[string]*tunnel, len(c.tunnels))
-	for _, t := range c.tunnels {
-		previousByAddr[t.address] = t
+	return c.reconciler.Apply(ctx, desired)
+}
+
+// namespaces returns the namespaces to watch, "" for all of them.
+func (c *Gateway) namespaces() []string {
+	if len(c.options.Namespaces) == 0 {
+		return []string{""}
 	}
 
-	// Stop tunnels whose address is gone, OR whose descriptor changed
-	// (different hosts/ports/target pod). Anything still equivalent is reused.
-	for addr, t := range previousByAddr {
-		desiredT, kept := desiredByAddr[addr]
+	return c.options.Namespaces
+}
 
-		if kept && t.equivalent(desiredT) {
-			continue
-		}
+// listRoutes returns the routes of every kind the filter admits, sorted by
+// key.
+func (c *Gateway) listRoutes() []route {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-		c.hosts.Remove(t.address)
+	var routes []route
 
-		if err := t.Stop(); err != nil {
-			result = errors.Join(result, err)
-			continue
+	for _, r := range c.httproutes {
+		if c.options.Filter.Match(&r) {
+			routes = append(routes, newRoute("HTTPRoute", &r, r.Spec.CommonRouteSpec, r.Spec.Hostnames, r.Status.RouteStatus))
 		}
+	}
 
-		if c.options.DeleteFunc != nil {
-			c.options.DeleteFunc(t.address, t.hosts, slices.Collect(maps.Keys(t.ports)))
+	for _, r := range c.grpcroutes {
+		if c.options.Filter.Match(&r) {
+			routes = append(routes, newRoute("GRPCRoute", &r, r.Spec.CommonRouteSpec, r.Spec.Hostnames, r.Status.RouteStatus))
 		}
 	}
 
-	// Build the new active tunnel set. Reuse the prior tunnel object (keeping
-	// its running goroutine + cancel func) only when the descriptor is
-	// equivalent; otherwise start the new one.
-	next := make([]*tunnel, 0, len(desired))
-
-	for _, t := range desired {
-		if prev, ok := previousByAddr[t.address]; ok && prev.equivalent(t) {
-			next = append(next, prev)
-			continue
+	for _, r := range c.tlsroutes {
+		if c.options.Filter.Match(&r) {
+			routes = append(routes, newRoute("TLSRoute", &r, r.Spec.CommonRouteSpec, r.Spec.Hostnames, r.Status.RouteStatus))
 		}
+	}
 
-		if err := t.Start(ctx, nil); err != nil {
-			result = errors.Join(result, err)
-			continue
+	for _, r := range c.tcproutes {
+		if c.options.Filter.Match(&r) {
+			routes = append(routes, newRoute("TCPRoute", &r, r.Spec.CommonRouteSpec, nil, r.Status.RouteStatus))
 		}
+	}
+
+	slices.SortFunc(routes, func(a, b route) int {
+		return strings.Compare(a.Key(), b.Key())
+	})
 
-		c.hosts.Add(t.address, t.hosts...)
+	return routes
+}
+
+// namespaceLabels reads the labels of namespaces, each once. Only
+// listeners selecting route namespaces need them.
+func (c *Gateway) namespaceLabels(ctx context.Context) namespaceLabelsFunc {
+	namespaces := make(map[string]labels.Set)
 
-		if c.options.AddFunc != nil {
-			c.options.AddFunc(t.address, t.hosts, slices.Collect(maps.Keys(t.ports)))
+	return func(name string) (labels.Set, bool) {
+		if set, ok := namespaces[name]; ok {
+			return set, set != nil
 		}
 
-		next = append(next, t)
-	}
+		ns, err := c.client.CoreV1().Namespaces().Get(ctx, name, metav1.GetOptions{})
 
-	c.tunnels = next
+		if err != nil {
+			namespaces[name] = nil
+			return nil, false
+		}
 
-	// Do not flush if context is cancelled - let defer cleanup handle it
-	if ctx.Err() != nil {
-		return ctx.Err()
-	}
+		namespaces[name] = labels.Set(ns.Labels)
 
-	if err := c.hosts.Flush(); err != nil {
-		return errors.Join(result, err)
+		return namespaces[name], true
 	}
-
-	return result
 }
 
 func (c *Gateway) listTunnel(ctx context.Context) ([]*tunnel, error) {
 	c.mu.Lock()
 	ingresses := slices.Collect(maps.Values(c.ingresses))
 	gateways := slices.Collect(maps.Values(c.gateways))
-	httproutes := slices.Collect(maps.Values(c.httproutes))
 	services := slices.Collect(maps.Values(c.services))
 	c.mu.Unlock()
 
+	routes := c.listRoutes()
+
+	slices.SortFunc(ingresses, func(a, b networkingv1.Ingress) int {
+		return strings.Compare(reconcile.ResourceKey(&a), reconcile.ResourceKey(&b))
+	})
+
 	tunnels := make(map[string]*tunnel)
 
-	mappings := make(map[string]string)
+	// Hosts map to the controller service behind the address they are
+	// published on.
+	mappings := make(map[string]*corev1.Service)
 
-	for _, i := range ingresses {
-		// Managed load balancers may publish only a Hostname (e.g. AWS NLB/ELB)
-		// instead of an IP, so fall back to Hostname when IP is empty.
-		var addr string
+	ingressControllers := c.ingressControllers(ctx, services)
 
-		for _, ing := range i.Status.LoadBalancer.Ingress {
-			if ing.IP != "" {
-				addr = ing.IP
-				break
-			}
+	// failures records why a host got no tunnel; hosts served through
+	// another resource in the end are dropped from it.
+	failures := make(map[string]error)
 
-			if ing.Hostname != "" {
-				addr = ing.Hostname
+	// With the router, HTTP hosts resolve to it and it applies the rules.
+	var rules []httpRule
+	routerHosts := make(map[string]bool)
+
+	if c.router != nil {
+		for _, i := range ingresses {
+			if !c.options.Filter.Match(&i) {
+				continue
 			}
-		}
 
-		if addr == "" {
-			continue
+			for _, rule := range ingressRules(i, services) {
+				rules = append(rules, rule)
+
+				if rule.Host != "" {
+					routerHosts[rule.Host] = true
+				}
+			}
 		}
+	}
 
-		for _, r := range i.Spec.Rules {
-			if r.Host == "" {
+	for _, src := range c.sources {
+		for _, r := range src.Routes() {
+			if !c.options.Filter.Match(r.Object) {
 				continue
 			}
 
-			mappings[r.Host] = addr
-		}
-	}
+			var service *corev1.Service
+			var ok bool
 
-	for _, g := range gateways {
-		var hosts []string
+			// an ingress without a usable address is served by the
+			// controller of its class
+			if i, isIngress := r.Object.(*networkingv1.Ingress); isIngress {
+				service, ok = ingressService(*i, services, ingressControllers)
+			} else {
+				service, ok = sourceService(r, services)
+			}
 
-		for _, l := range g.Spec.Listeners {
-			if l.Hostname == nil {
+			if !ok {
+				failures[r.Host] = fmt.Errorf("%w for %s %s", errNoService, src.Name(), reconcile.ResourceKey(r.Object))
 				continue
 			}
 
-			hosts = append(hosts, string(*l.Hostname))
+			mappings[r.Host] = service
 		}
+	}
 
-		addr := gatewayAddress(g)
+	// TCP routes have no hostnames to share a tunnel by; each gets its own
+	// address with the listener ports it attached to, named after it. With
+	// the router, HTTPRoutes turn into its rules.
+	var streams []tcpStream
+
+	namespaceLabels := c.namespaceLabels(ctx)
+
+	for _, r := range routes {
+		if c.router != nil && r.Kind == "HTTPRoute" {
+			for _, b := range bindRoute(r, gateways, namespaceLabels) {
+				rules = append(rules, httpRouteRules(*r.Object.(*gatewayv1.HTTPRoute), b.Hostnames)...)
+
+				for _, host := range b.Hostnames {
+					routerHosts[host] = true
+				}
+			}
 
-		if addr == "" {
 			continue
 		}
 
-		for _, host := range hosts {
-			mappings[host] = addr
+		if r.Kind != "TCPRoute" {
+			continue
 		}
-	}
 
-	for _, r := range httproutes {
-		var addr string
+		for _, b := range bindRoute(r, gateways, namespaceLabels) {
+			service, ok := gatewayService(*b.Gateway, services)
 
-		for _, p := range r.Spec.ParentRefs {
-			if p.Kind == nil || *p.Kind != "Gateway" {
+			if !ok {
+				failures[r.Key()] = fmt.Errorf("%w for gateway %s", errNoService, reconcile.ResourceKey(b.Gateway))
 				continue
 			}
 
-			for _, g := range gateways {
-				if g.Namespace != r.Namespace || g.Name != string(p.Name) {
-					continue
-				}
+			streams = append(streams, tcpStream{key: r.Key(), name: r.Name + "." + r.Namespace, service: service, ports: b.Ports})
+		}
+	}
 
-				if a := gatewayAddress(g); a != "" {
-					addr = a
-				}
+	if c.router != nil {
+		sortRules(rules)
+		var endpoints map[string]*endpoints
+
+		// the jump pod resolves backends by their service names
+		if c.options.Jump == nil {
+			endpoints = c.routerEndpoints(ctx, services, rules)
+		}
+
+		var hosts []string
+
+		names := make(map[string]string)
+
+		for _, host := range slices.Sorted(maps.Keys(routerHosts)) {
+			delete(mappings, host)
+
+			for _, name := range c.qualify(host) {
+				hosts = append(hosts, name)
+				names[strings.ToLower(name)] = host
 			}
 		}
 
-		if addr == "" {
+		c.router.Update(rules, endpoints, names)
+
+		if t := c.routerTunnel(hosts); t != nil {
+			tunnels[routerKey] = t
+		}
+	}
+
+	// Walk the hosts in a fixed order, so colliding services claim their
+	// addresses the same way in every session.
+	for _, host := range slices.Sorted(maps.Keys(mappings)) {
+		service := mappings[host]
+
+		// One tunnel per controller service, even if it is reached through
+		// several load balancer addresses.
+		key := reconcile.ResourceKey(service)
+
+		if tunnel, ok := tunnels[key]; ok {
+			tunnel.Names = slices.Concat(tunnel.Names, c.qualify(host))
 			continue
 		}
 
-		for _, host := range r.Spec.Hostnames {
-			mappings[string(host)] = addr
+		t, err := c.controllerTunnel(ctx, service, key, c.qualify(host))
+
+		if err != nil {
+			failures[host] = err
+			continue
 		}
+
+		tunnels[key] = t
 	}
 
-	for host, addr := range mappings {
-		if strings.Contains(host, "*") {
+	for _, stream := range streams {
+		t, err := c.controllerTunnel(ctx, stream.service, stream.key, c.qualify(stream.name))
+
+		if err != nil {
+			failures[stream.key] = err
 			continue
 		}
 
-		if tunnel, ok := tunnels[addr]; ok {
-			tunnel.hosts = append(tunnel.hosts, host)
+		maps.DeleteFunc(t.TCP, func(port, target int) bool {
+			return !slices.Contains(stream.ports, port)
+		})
+
+		t.UDP = nil
+
+		if len(t.TCP) == 0 {
+			failures[stream.key] = fmt.Errorf("service %s exposes none of the listener ports %v", reconcile.ResourceKey(stream.service), stream.ports)
 			continue
 		}
 
-		service, ok := findService(services, addr)
+		delete(failures, stream.key)
+		tunnels[stream.key] = t
+	}
 
-		if !ok {
+	for host := range routerHosts {
+		delete(failures, host)
+	}
+
+	for _, host := range slices.Sorted(maps.Keys(mappings)) {
+		if _, ok := failures[host]; !ok {
 			continue
 		}
 
-		pods, err := c.client.CoreV1().Pods(service.Namespace).List(ctx, metav1.ListOptions{
-			FieldSelector: "status.phase=Running",
-			LabelSelector: labels.SelectorFromSet(service.Spec.Selector).String(),
-		})
+		if key := reconcile.ResourceKey(mappings[host]); tunnels[key] != nil {
+			delete(failures, host)
+		}
+	}
 
-		if err != nil {
+	c.reportFailures(failures)
+
+	return slices.Collect(maps.Values(tunnels)), nil
+}
+
+// reportFailures keeps the failures for Status and passes changes on to
+// FailFunc, so a host that keeps failing is reported once.
+func (c *Gateway) reportFailures(failures map[string]error) {
+	c.mu.Lock()
+
+	type change struct {
+		host string
+		err  error
+	}
+
+	var changes []change
+
+	for host, err := range failures {
+		if f, ok := c.failures[host]; ok && f.err.Error() == err.Error() {
 			continue
 		}
 
-		if len(pods.Items) == 0 {
+		c.failures[host] = failure{err: err, since: time.Now()}
+		changes = append(changes, change{host, err})
+	}
+
+	for host := range c.failures {
+		if _, ok := failures[host]; !ok {
+			delete(c.failures, host)
+			changes = append(changes, change{host, nil})
+		}
+	}
+	c.mu.Unlock()
+
+	if c.options.FailFunc == nil {
+		return
+	}
+
+	slices.SortFunc(changes, func(a, b change) int {
+		return strings.Compare(a.host, b.host)
+	})
+
+	for _, ch := range changes {
+		c.options.FailFunc(ch.host, ch.err)
+	}
+}
+
+// routerKey allocates the router's address; it cannot collide with the
+// namespace/name keys of services.
+const routerKey = "router"
+
+// routerTunnel returns the tunnel publishing the router's hosts, or nil if
+// there are none.
+func (c *Gateway) routerTunnel(hosts []string) *tunnel {
+	if len(hosts) == 0 {
+		return nil
+	}
+
+	address, err := c.addresses.Allocate(routerKey)
+
+	if err != nil {
+		if c.options.Logger != nil {
+			c.options.Logger.Error("failed to allocate address", "key", routerKey, "error", err)
+		}
+
+		return nil
+	}
+
+	// the router serves every connection in process
+	return newTunnel("", []string{routerKey}, address, map[int]int{80: 80, 443: 443}, nil, hosts, func(ctx context.Context, target, network string, port int) (net.Conn, error) {
+		return c.router.Dial(ctx, port)
+	})
+}
+
+// routerEndpoints resolves the backends of the rules to their ready pods.
+func (c *Gateway) routerEndpoints(ctx context.Context, services []corev1.Service, rules []httpRule) map[string]*endpoints {
+	result := make(map[string]*endpoints)
+
+	for _, rule := range rules {
+		for _, b := range rule.Backends {
+			if _, ok := result[b.Addr()]; ok {
+				continue
+			}
+
+			index := slices.IndexFunc(services, func(s corev1.Service) bool {
+				return s.Namespace == b.Namespace && s.Name == b.Name
+			})
+
+			if index < 0 {
+				continue
+			}
+
+			service := services[index]
+
+			ready, err := c.readyPods(ctx, &service)
+
+			if err != nil {
+				if c.options.Logger != nil {
+					c.options.Logger.DebugContext(ctx, "no endpoints for backend", "backend", b.Addr(), "error", err)
+				}
+
+				continue
+			}
+
+			port, ok := selectPorts(service, corev1.ProtocolTCP, ready[0].Spec.Containers...)[b.Port]
+
+			if !ok {
+				continue
+			}
+
+			e := &endpoints{
+				namespace: service.Namespace,
+				port:      port,
+			}
+
+			for _, pod := range ready {
+				e.targets = append(e.targets, pod.Name)
+			}
+
+			result[b.Addr()] = e
+		}
+	}
+
+	return result
+}
+
+// tcpStream is a TCPRoute attached to a gateway served by service.
+type tcpStream struct {
+	key     string
+	service *corev1.Service
+	ports   []int
+
+	// name is published for the route, e.g. db.shop, as it has no
+	// hostnames of its own
+	name string
+}
+
+// controllerTunnel returns a tunnel to the ready pods behind a gateway
+// controller service, on an address allocated for key.
+func (c *Gateway) controllerTunnel(ctx context.Context, service *corev1.Service, key string, hosts []string) (*tunnel, error) {
+	if c.options.Jump != nil {
+		return c.jumpTunnel(service, key, hosts)
+	}
+
+	ready, err := c.readyPods(ctx, service)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Named target ports are resolved against the first endpoint; the
+	// controller replicas share the same container spec.
+	pod := ready[0]
+
+	var targets []string
+
+	for _, p := range ready {
+		targets = append(targets, p.Name)
+	}
+
+	address, err := c.addresses.Allocate(key)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to allocate address: %w", err)
+	}
+
+	ports := selectPorts(*service, corev1.ProtocolTCP, pod.Spec.Containers...)
+
+	return newTunnel(service.Namespace, targets, address, ports, nil, hosts, func(ctx context.Context, name, network string, port int) (net.Conn, error) {
+		return c.client.PodDial(ctx, service.Namespace, name, network, port)
+	}), nil
+}
+
+// jumpTunnel returns a tunnel to a controller service's ClusterIP through
+// the jump pod, on the service ports.
+func (c *Gateway) jumpTunnel(service *corev1.Service, key string, hosts []string) (*tunnel, error) {
+	if service.Spec.ClusterIP == "" || service.Spec.ClusterIP == corev1.ClusterIPNone {
+		return nil, fmt.Errorf("%w: service %s has no ClusterIP", errNoService, reconcile.ResourceKey(service))
+	}
+
+	address, err := c.addresses.Allocate(key)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to allocate address: %w", err)
+	}
+
+	ports := make(map[int]int)
+	udpPorts := make(map[int]int)
+
+	for _, p := range service.Spec.Ports {
+		switch p.Protocol {
+		case "", corev1.ProtocolTCP:
+			ports[int(p.Port)] = int(p.Port)
+		case corev1.ProtocolUDP:
+			udpPorts[int(p.Port)] = int(p.Port)
+		}
+	}
+
+	return newTunnel(service.Namespace, []string{service.Spec.ClusterIP}, address, ports, udpPorts, hosts, func(ctx context.Context, ip, network string, port int) (net.Conn, error) {
+		return c.options.Jump.Dial(ctx, network, net.JoinHostPort(ip, strconv.Itoa(port)))
+	}), nil
+}
+
+// Lookup returns a dialer for port on an ingress or gateway host, matching
+// wildcard listeners too, and nil if the host is unknown.
+func (c *Gateway) Lookup(host string, port int) forward.DialFunc {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, t := range c.reconciler.Tunnels() {
+		if !slices.ContainsFunc(t.Names, func(pattern string) bool { return matchHost(pattern, host) }) {
 			continue
 		}
 
-		pod := pods.Items[0]
+		if _, ok := t.TCP[port]; !ok {
+			return func(ctx context.Context) (net.Conn, error) {
+				return nil, fmt.Errorf("%s does not expose port %d", host, port)
+			}
+		}
+
+		return t.Dialer("tcp", port)
+	}
 
-		address := mapAddress(service.Spec.ClusterIP)
-		ports := selectPorts(*service, pod.Spec.Containers...)
+	return nil
+}
 
-		tunnel := newTunnel(c.client, pod.Namespace, pod.Name, address, ports, []string{host})
-		tunnels[addr] = tunnel
+// matchHost reports whether host matches a hostname such as
+// "*.example.com", where the wildcard stands for one or more labels.
+func matchHost(pattern, host string) bool {
+	pattern = strings.ToLower(pattern)
+
+	if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+		return strings.HasSuffix(host, suffix) && len(host) > len(suffix)
 	}
 
-	return slices.Collect(maps.Values(tunnels)), nil
+	return pattern == host
 }
 
-func resourceKey(obj metav1.Object) string {
-	return fmt.Sprintf("%s/%s", obj.GetNamespace(), obj.GetName())
+// qualify returns the names host is published under.
+func (c *Gateway) qualify(host string) []string {
+	if names, ok := c.options.Names.Render(hostname.Fields{Host: host, Cluster: c.options.Cluster}); ok {
+		return names
+	}
+
+	if c.options.Cluster == "" {
+		return []string{host}
+	}
+
+	qualified := host + "." + c.options.Cluster
+
+	if c.options.Primary {
+		return []string{host, qualified}
+	}
+
+	return []string{qualified}
 }
 
 func (c *Gateway) watchServices(ctx context.Context, client kubernetes.Client, namespace string) error {
@@ -352,7 +878,7 @@ func (c *Gateway) watchServices(ctx context.Context, client kubernetes.Client, n
 
 	c.mu.Lock()
 	for _, s := range list.Items {
-		c.services[resourceKey(&s)] = s
+		c.services[reconcile.ResourceKey(&s)] = s
 	}
 	c.mu.Unlock()
 
@@ -360,26 +886,50 @@ func (c *Gateway) watchServices(ctx context.Context, client kubernetes.Client, n
 		AddFunc: func(obj interface{}) {
 			s := obj.(*corev1.Service)
 			c.mu.Lock()
-			c.services[resourceKey(s)] = *s
+			c.services[reconcile.ResourceKey(s)] = *s
 			c.mu.Unlock()
+
+			c.notify()
 		},
 
 		UpdateFunc: func(oldObj, newObj interface{}) {
 			s := newObj.(*corev1.Service)
 			c.mu.Lock()
-			c.services[resourceKey(s)] = *s
+			c.services[reconcile.ResourceKey(s)] = *s
 			c.mu.Unlock()
+
+			c.notify()
 		},
 
 		DeleteFunc: func(obj interface{}) {
-			s := obj.(*corev1.Service)
+			// a missed deletion arrives as a tombstone
+			if t, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = t.Obj
+			}
+
+			s, ok := obj.(*corev1.Service)
+
+			if !ok {
+				return
+			}
+
 			c.mu.Lock()
-			delete(c.services, resourceKey(s))
+			delete(c.services, reconcile.ResourceKey(s))
 			c.mu.Unlock()
+
+			c.notify()
 		},
 	}
 
-	watcher := cache.NewListWatchFromClient(client.CoreV1().RESTClient(), "services", namespace, fields.Everything())
+	watcher := cache.ToListWatcherWithWatchListSemantics(&cache.ListWatch{
+		ListWithContextFunc: func(ctx context.Context, options metav1.ListOptions) (runtime.Object, error) {
+			return client.CoreV1().Services(namespace).List(ctx, options)
+		},
+
+		WatchFuncWithContext: func(ctx context.Context, options metav1.ListOptions) (watch.Interface, error) {
+			return client.CoreV1().Services(namespace).Watch(ctx, options)
+		},
+	}, client)
 
 	_, controller := cache.NewInformer(watcher, &corev1.Service{}, 0, handlers)
 	go controller.Run(ctx.Done())
@@ -400,7 +950,7 @@ func (c *Gateway) watchGateways(ctx context.Context, client kubernetes.Client, n
 
 	c.mu.Lock()
 	for _, g := range list.Items {
-		c.gateways[resourceKey(&g)] = g
+		c.gateways[reconcile.ResourceKey(&g)] = g
 	}
 	c.mu.Unlock()
 
@@ -408,26 +958,50 @@ func (c *Gateway) watchGateways(ctx context.Context, client kubernetes.Client, n
 		AddFunc: func(obj interface{}) {
 			g := obj.(*gatewayv1.Gateway)
 			c.mu.Lock()
-			c.gateways[resourceKey(g)] = *g
+			c.gateways[reconcile.ResourceKey(g)] = *g
 			c.mu.Unlock()
+
+			c.notify()
 		},
 
 		UpdateFunc: func(oldObj, newObj interface{}) {
 			g := newObj.(*gatewayv1.Gateway)
 			c.mu.Lock()
-			c.gateways[resourceKey(g)] = *g
+			c.gateways[reconcile.ResourceKey(g)] = *g
 			c.mu.Unlock()
+
+			c.notify()
 		},
 
 		DeleteFunc: func(obj interface{}) {
-			g := obj.(*gatewayv1.Gateway)
+			// a missed deletion arrives as a tombstone
+			if t, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = t.Obj
+			}
+
+			g, ok := obj.(*gatewayv1.Gateway)
+
+			if !ok {
+				return
+			}
+
 			c.mu.Lock()
-			delete(c.gateways, resourceKey(g))
+			delete(c.gateways, reconcile.ResourceKey(g))
 			c.mu.Unlock()
+
+			c.notify()
 		},
 	}
 
-	watcher := cache.NewListWatchFromClient(client.GatewayV1().RESTClient(), "gateways", namespace, fields.Everything())
+	watcher := cache.ToListWatcherWithWatchListSemantics(&cache.ListWatch{
+		ListWithContextFunc: func(ctx context.Context, options metav1.ListOptions) (runtime.Object, error) {
+			return client.GatewayV1().Gateways(namespace).List(ctx, options)
+		},
+
+		WatchFuncWithContext: func(ctx context.Context, options metav1.ListOptions) (watch.Interface, error) {
+			return client.GatewayV1().Gateways(namespace).Watch(ctx, options)
+		},
+	}, client)
 
 	_, controller := cache.NewInformer(watcher, &gatewayv1.Gateway{}, 0, handlers)
 	go controller.Run(ctx.Done())
@@ -435,8 +1009,14 @@ func (c *Gateway) watchGateways(ctx context.Context, client kubernetes.Client, n
 	return nil
 }
 
-func (c *Gateway) watchHTTPRoutes(ctx context.Context, client kubernetes.Client, namespace string) error {
-	list, err := c.client.GatewayV1().HTTPRoutes(namespace).List(ctx, metav1.ListOptions{})
+// watchRoutes keeps items in sync with the routes of one kind. Route kinds
+// whose CRDs are not installed are skipped.
+func watchRoutes[T any, P interface {
+	*T
+	metav1.Object
+	runtime.Object
+}](ctx context.Context, c *Gateway, items map[string]T, lw *cache.ListWatch) error {
+	list, err := lw.ListWithContextFunc(ctx, metav1.ListOptions{})
 
 	if err != nil {
 		if kubernetes.IsNotFound(err) {
@@ -447,37 +1027,57 @@ func (c *Gateway) watchHTTPRoutes(ctx context.Context, client kubernetes.Client,
 	}
 
 	c.mu.Lock()
-	for _, r := range list.Items {
-		c.httproutes[resourceKey(&r)] = r
-	}
+	meta.EachListItem(list, func(obj runtime.Object) error {
+		if r, ok := obj.(P); ok {
+			items[reconcile.ResourceKey(r)] = *r
+		}
+
+		return nil
+	})
 	c.mu.Unlock()
 
 	handlers := cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
-			r := obj.(*gatewayv1.HTTPRoute)
+			r := obj.(P)
 			c.mu.Lock()
-			c.httproutes[resourceKey(r)] = *r
+			items[reconcile.ResourceKey(r)] = *r
 			c.mu.Unlock()
+
+			c.notify()
 		},
 
 		UpdateFunc: func(oldObj, newObj interface{}) {
-			r := newObj.(*gatewayv1.HTTPRoute)
+			r := newObj.(P)
 			c.mu.Lock()
-			c.httproutes[resourceKey(r)] = *r
+			items[reconcile.ResourceKey(r)] = *r
 			c.mu.Unlock()
+
+			c.notify()
 		},
 
 		DeleteFunc: func(obj interface{}) {
-			r := obj.(*gatewayv1.HTTPRoute)
+			// a missed deletion arrives as a tombstone
+			if t, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = t.Obj
+			}
+
+			r, ok := obj.(P)
+
+			if !ok {
+				return
+			}
+
 			c.mu.Lock()
-			delete(c.httproutes, resourceKey(r))
+			delete(items, reconcile.ResourceKey(r))
 			c.mu.Unlock()
+
+			c.notify()
 		},
 	}
 
-	watcher := cache.NewListWatchFromClient(client.GatewayV1().RESTClient(), "httproutes", namespace, fields.Everything())
+	watcher := cache.ToListWatcherWithWatchListSemantics(lw, c.client)
 
-	_, controller := cache.NewInformer(watcher, &gatewayv1.HTTPRoute{}, 0, handlers)
+	_, controller := cache.NewInformer(watcher, P(new(T)), 0, handlers)
 	go controller.Run(ctx.Done())
 
 	return nil
@@ -496,7 +1096,7 @@ func (c *Gateway) watchIngresses(ctx context.Context, client kubernetes.Client,
 
 	c.mu.Lock()
 	for _, i := range list.Items {
-		c.ingresses[resourceKey(&i)] = i
+		c.ingresses[reconcile.ResourceKey(&i)] = i
 	}
 	c.mu.Unlock()
 
@@ -504,26 +1104,50 @@ func (c *Gateway) watchIngresses(ctx context.Context, client kubernetes.Client,
 		AddFunc: func(obj interface{}) {
 			i := obj.(*networkingv1.Ingress)
 			c.mu.Lock()
-			c.ingresses[resourceKey(i)] = *i
+			c.ingresses[reconcile.ResourceKey(i)] = *i
 			c.mu.Unlock()
+
+			c.notify()
 		},
 
 		UpdateFunc: func(oldObj, newObj interface{}) {
 			i := newObj.(*networkingv1.Ingress)
 			c.mu.Lock()
-			c.ingresses[resourceKey(i)] = *i
+			c.ingresses[reconcile.ResourceKey(i)] = *i
 			c.mu.Unlock()
+
+			c.notify()
 		},
 
 		DeleteFunc: func(obj interface{}) {
-			i := obj.(*networkingv1.Ingress)
+			// a missed deletion arrives as a tombstone
+			if t, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = t.Obj
+			}
+
+			i, ok := obj.(*networkingv1.Ingress)
+
+			if !ok {
+				return
+			}
+
 			c.mu.Lock()
-			delete(c.ingresses, resourceKey(i))
+			delete(c.ingresses, reconcile.ResourceKey(i))
 			c.mu.Unlock()
+
+			c.notify()
 		},
 	}
 
-	watcher := cache.NewListWatchFromClient(client.NetworkingV1().RESTClient(), "ingresses", namespace, fields.Everything())
+	watcher := cache.ToListWatcherWithWatchListSemantics(&cache.ListWatch{
+		ListWithContextFunc: func(ctx context.Context, options metav1.ListOptions) (runtime.Object, error) {
+			return client.NetworkingV1().Ingresses(namespace).List(ctx, options)
+		},
+
+		WatchFuncWithContext: func(ctx context.Context, options metav1.ListOptions) (watch.Interface, error) {
+			return client.NetworkingV1().Ingresses(namespace).Watch(ctx, options)
+		},
+	}, client)
 
 	_, controller := cache.NewInformer(watcher, &networkingv1.Ingress{}, 0, handlers)
 	go controller.Run(ctx.Done())
@@ -570,47 +1194,24 @@ func gatewayAddress(g gatewayv1.Gateway) string {
 	return addr
 }
 
-func selectPorts(service corev1.Service, containers ...corev1.Container) map[int]int {
-	ports := make(map[int]int)
-
-	for _, port := range service.Spec.Ports {
-		servicePort := int(port.Port)
-		containerPort := 0
-
-		if port.Protocol != "" && port.Protocol != corev1.ProtocolTCP {
-			continue
+// selectPorts maps the service ports of the given protocol to the container
+// ports they target, resolving named target ports through the containers.
+func selectPorts(service corev1.Service, protocol corev1.Protocol, containers ...corev1.Container) map[int]int {
+	return reconcile.ServicePorts(service, protocol, func(port corev1.ServicePort) int {
+		if port.TargetPort.IntVal > 0 {
+			return int(port.TargetPort.IntVal)
 		}
 
+		target := 0
+
 		for _, c := range containers {
 			for _, p := range c.Ports {
 				if p.Name != "" && p.Name == port.TargetPort.String() {
-					containerPort = int(p.ContainerPort)
+					target = int(p.ContainerPort)
 				}
 			}
 		}
 
-		if port.TargetPort.IntVal > 0 {
-			containerPort = int(port.TargetPort.IntVal)
-		}
-
-		if servicePort > 0 && containerPort > 0 {
-			ports[servicePort] = containerPort
-		}
-	}
-
-	return ports
-}
-
-func mapAddress(address string) string {
-	h := md5.New()
-	io.WriteString(h, address)
-
-	addr := h.Sum(nil)
-
-	addr = addr[:4]
-	addr[0] = 127
-	addr[1] = 245
-
-	ip := net.IP(addr)
-	return ip.String()
+		return target
+	})
 }
@@ -0,0 +1,411 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adrianliechti/loop/pkg/address"
+	"github.com/adrianliechti/loop/pkg/kubernetes"
+	"github.com/adrianliechti/loop/pkg/system"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+	appsv1client "k8s.io/client-go/kubernetes/typed/apps/v1"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	networkingv1client "k8s.io/client-go/kubernetes/typed/networking/v1"
+	"k8s.io/client-go/metadata"
+	metadatafake "k8s.io/client-go/metadata/fake"
+	gatewayv1 "sigs.k8s.io/gateway-api/apis/v1"
+	gatewayfake "sigs.k8s.io/gateway-api/pkg/client/clientset/versioned/fake"
+	gatewayv1client "sigs.k8s.io/gateway-api/pkg/client/clientset/versioned/typed/apis/v1"
+)
+
+// fakeClient serves the typed clients gateway watches from fake
+// clientsets; anything else panics through the nil embedded Client.
+type fakeClient struct {
+	kubernetes.Client
+
+	clientset *fake.Clientset
+	gateway   *gatewayfake.Clientset
+	metadata  *metadatafake.FakeMetadataClient
+}
+
+func (c *fakeClient) AppsV1() appsv1client.AppsV1Interface {
+	return c.clientset.AppsV1()
+}
+
+func (c *fakeClient) CoreV1() corev1client.CoreV1Interface {
+	return c.clientset.CoreV1()
+}
+
+func (c *fakeClient) NetworkingV1() networkingv1client.NetworkingV1Interface {
+	return c.clientset.NetworkingV1()
+}
+
+func (c *fakeClient) Metadata() metadata.Interface {
+	if c.metadata == nil {
+		c.metadata = newFakeMetadata()
+	}
+
+	return c.metadata
+}
+
+func (c *fakeClient) GatewayV1() gatewayv1client.GatewayV1Interface {
+	return c.gateway.GatewayV1()
+}
+
+// IsWatchListSemanticsUnSupported keeps the informers on plain list/watch,
+// which is all the fake clientsets implement.
+func (c *fakeClient) IsWatchListSemanticsUnSupported() bool {
+	return true
+}
+
+type fakeHosts struct{}
+
+func (fakeHosts) Add(address string, hosts ...string)          {}
+func (fakeHosts) AddSRV(address string, records ...system.SRV) {}
+func (fakeHosts) Remove(address string)                        {}
+func (fakeHosts) Clear()                                       {}
+func (fakeHosts) Flush() error                                 { return nil }
+
+func TestRefreshFollowsEvents(t *testing.T) {
+	// Tunnels bind to 127.245.0.0/16, which only Linux routes without
+	// aliasing the loopback interface first.
+	if runtime.GOOS != "linux" {
+		t.Skip("requires the 127.0.0.0/8 loopback range")
+	}
+
+	clientset := fake.NewClientset(
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "ingress-nginx-controller",
+				Namespace: "ingress-nginx",
+			},
+
+			Spec: corev1.ServiceSpec{
+				ClusterIP:  "10.96.0.20",
+				ClusterIPs: []string{"10.96.0.20"},
+
+				Selector: map[string]string{"app": "ingress-nginx"},
+
+				Ports: []corev1.ServicePort{
+					{Name: "http", Port: 18081, TargetPort: intstr.FromInt32(80)},
+				},
+			},
+		},
+
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "ingress-nginx-controller-0",
+				Namespace: "ingress-nginx",
+
+				Labels: map[string]string{"app": "ingress-nginx"},
+			},
+
+			Status: corev1.PodStatus{
+				Phase: corev1.PodRunning,
+
+				Conditions: []corev1.PodCondition{
+					{Type: corev1.PodReady, Status: corev1.ConditionTrue},
+				},
+			},
+		},
+	)
+
+	client := &fakeClient{
+		clientset: clientset,
+		gateway:   gatewayfake.NewClientset(),
+	}
+
+	// keep the assignments in memory instead of the user config directory
+	addresses, _ := address.New(address.AllocatorOptions{Network: "127.245.0.0/16"})
+
+	added := make(chan []string, 16)
+
+	c, err := New(client, GatewayOptions{
+		Hosts: fakeHosts{},
+
+		Addresses: addresses,
+
+		AddFunc: func(address string, hosts []string, ports []int) {
+			added <- hosts
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- c.Start(ctx)
+	}()
+
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// give the informers a moment to establish their watches
+	time.Sleep(100 * time.Millisecond)
+
+	ingress := &networkingv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "shop",
+			Namespace: "shop",
+		},
+
+		Spec: networkingv1.IngressSpec{
+			Rules: []networkingv1.IngressRule{
+				{Host: "shop.example.com"},
+			},
+		},
+
+		Status: networkingv1.IngressStatus{
+			LoadBalancer: networkingv1.IngressLoadBalancerStatus{
+				Ingress: []networkingv1.IngressLoadBalancerIngress{
+					{IP: "10.96.0.20"},
+				},
+			},
+		},
+	}
+
+	if _, err := clientset.NetworkingV1().Ingresses("shop").Create(t.Context(), ingress, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+
+	select {
+	case hosts := <-added:
+		if len(hosts) != 1 || hosts[0] != "shop.example.com" {
+			t.Fatalf("want shop.example.com, got %v", hosts)
+		}
+
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for refresh")
+	}
+
+	if latency := time.Since(start); latency > time.Second {
+		t.Errorf("ingress applied after %s, want under 1s", latency)
+	}
+}
+
+func TestListTunnelReportsFailures(t *testing.T) {
+	clientset := fake.NewClientset()
+
+	client := &fakeClient{
+		clientset: clientset,
+		gateway:   gatewayfake.NewClientset(),
+	}
+
+	addresses, _ := address.New(address.AllocatorOptions{Network: "127.245.0.0/16"})
+
+	failed := make(map[string]error)
+
+	c, err := New(client, GatewayOptions{
+		Hosts:     fakeHosts{},
+		Addresses: addresses,
+
+		FailFunc: func(host string, err error) {
+			failed[host] = err
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ingress := func(name, host, ip string) networkingv1.Ingress {
+		return networkingv1.Ingress{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "shop"},
+			Spec: networkingv1.IngressSpec{
+				Rules: []networkingv1.IngressRule{{Host: host}},
+			},
+			Status: networkingv1.IngressStatus{
+				LoadBalancer: networkingv1.IngressLoadBalancerStatus{
+					Ingress: []networkingv1.IngressLoadBalancerIngress{{IP: ip}},
+				},
+			},
+		}
+	}
+
+	c.services["ingress-nginx/ingress-nginx-controller"] = corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "ingress-nginx-controller", Namespace: "ingress-nginx"},
+		Spec: corev1.ServiceSpec{
+			ClusterIPs: []string{"10.96.0.20"},
+			Selector:   map[string]string{"app": "ingress-nginx"},
+		},
+	}
+
+	c.ingresses["shop/shop"] = ingress("shop", "shop.example.com", "10.96.0.20")
+	c.ingresses["shop/blog"] = ingress("blog", "blog.example.com", "10.96.0.99")
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	tunnels, err := c.listTunnel(ctx)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tunnels) != 0 {
+		t.Fatalf("expected no tunnels, got %d", len(tunnels))
+	}
+
+	if !errors.Is(failed["shop.example.com"], errNoPods) {
+		t.Errorf("expected no running pod for shop.example.com, got %v", failed["shop.example.com"])
+	}
+
+	if !errors.Is(failed["blog.example.com"], errNoService) {
+		t.Errorf("expected no service for blog.example.com, got %v", failed["blog.example.com"])
+	}
+
+	if status := c.Status(); len(status) != 2 || status[0].LastError == "" {
+		t.Errorf("expected the failures in the status, got %+v", status)
+	}
+}
+
+func TestListTunnelTCPRoutes(t *testing.T) {
+	client := &fakeClient{
+		clientset: fake.NewClientset(),
+		gateway:   gatewayfake.NewClientset(),
+	}
+
+	addresses, _ := address.New(address.AllocatorOptions{Network: "127.246.0.0/16"})
+
+	failed := make(map[string]error)
+
+	c, err := New(client, GatewayOptions{
+		Hosts:     fakeHosts{},
+		Addresses: addresses,
+
+		FailFunc: func(host string, err error) {
+			failed[host] = err
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.gateways["shop/local"] = gatewayv1.Gateway{
+		ObjectMeta: metav1.ObjectMeta{Name: "local", Namespace: "shop"},
+		Spec: gatewayv1.GatewaySpec{
+			Listeners: []gatewayv1.Listener{
+				{Name: "http", Port: 80, Protocol: gatewayv1.HTTPProtocolType},
+				{Name: "postgres", Port: 5432, Protocol: gatewayv1.TCPProtocolType},
+				{Name: "redis", Port: 6379, Protocol: gatewayv1.TCPProtocolType},
+			},
+		},
+	}
+
+	c.services["shop/local-gateway"] = corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "local-gateway",
+			Namespace: "shop",
+			Labels:    map[string]string{gatewayNameLabel: "local"},
+		},
+		Spec: corev1.ServiceSpec{
+			Selector: map[string]string{"app": "gateway"},
+			Ports: []corev1.ServicePort{
+				{Name: "http", Port: 80, TargetPort: intstr.FromInt32(8080)},
+				{Name: "postgres", Port: 5432, TargetPort: intstr.FromInt32(5432)},
+			},
+		},
+	}
+
+	c.pods["shop/gateway-0"] = corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "gateway-0", Namespace: "shop", Labels: map[string]string{"app": "gateway"}},
+		Status: corev1.PodStatus{
+			Phase:      corev1.PodRunning,
+			Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}},
+		},
+	}
+
+	c.podNamespaces["shop"] = true
+
+	parent := func(section string) []gatewayv1.ParentReference {
+		return []gatewayv1.ParentReference{{Name: "local", SectionName: kubernetes.Ptr(gatewayv1.SectionName(section))}}
+	}
+
+	c.httproutes["shop/web"] = gatewayv1.HTTPRoute{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "shop"},
+		Spec: gatewayv1.HTTPRouteSpec{
+			CommonRouteSpec: gatewayv1.CommonRouteSpec{ParentRefs: parent("http")},
+			Hostnames:       []gatewayv1.Hostname{"shop.local"},
+		},
+	}
+
+	c.tcproutes["shop/db"] = gatewayv1.TCPRoute{
+		ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "shop"},
+		Spec: gatewayv1.TCPRouteSpec{
+			CommonRouteSpec: gatewayv1.CommonRouteSpec{ParentRefs: parent("postgres")},
+		},
+	}
+
+	c.tcproutes["shop/cache"] = gatewayv1.TCPRoute{
+		ObjectMeta: metav1.ObjectMeta{Name: "cache", Namespace: "shop"},
+		Spec: gatewayv1.TCPRouteSpec{
+			CommonRouteSpec: gatewayv1.CommonRouteSpec{ParentRefs: parent("redis")},
+		},
+	}
+
+	tunnels, err := c.listTunnel(t.Context())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var web, db *tunnel
+
+	for _, t := range tunnels {
+		if slices.Contains(t.Names, "shop.local") {
+			web = t
+		} else {
+			db = t
+		}
+	}
+
+	if len(tunnels) != 2 || web == nil || db == nil {
+		t.Fatalf("want a tunnel for the host and one for the TCP route, got %d", len(tunnels))
+	}
+
+	// the TCP route has an address of its own, with only its listener port
+	if db.Address() == web.Address() {
+		t.Errorf("want the TCP route on its own address, got %s for both", db.Address())
+	}
+
+	if want := []string{"db.shop"}; !slices.Equal(db.Names, want) {
+		t.Errorf("want the TCP route named %v, got %v", want, db.Names)
+	}
+
+	if want := map[int]int{5432: 5432}; !maps.Equal(db.TCP, want) {
+		t.Errorf("want TCP ports %v, got %v", want, db.TCP)
+	}
+
+	if want := map[int]int{80: 8080, 5432: 5432}; !maps.Equal(web.TCP, want) {
+		t.Errorf("want TCP ports %v, got %v", want, web.TCP)
+	}
+
+	if err := failed["tcproute/shop/cache"]; err == nil || !strings.Contains(err.Error(), "exposes none of the listener ports [6379]") {
+		t.Errorf("want the cache route to fail on its listener port, got %v", err)
+	}
+
+	if _, ok := failed["tcproute/shop/db"]; ok {
+		t.Errorf("want no failure for the db route, got %v", failed["tcproute/shop/db"])
+	}
+}
@@ -0,0 +1,90 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/adrianliechti/loop/pkg/kubernetes"
+	"github.com/adrianliechti/loop/pkg/reconcile"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+var (
+	errNoService = errors.New("no service found")
+	errNoPods    = errors.New("no running pod")
+)
+
+// readyPods returns the ready pods behind a service, sorted by name, from
+// the pod cache of its namespace.
+func (c *Gateway) readyPods(ctx context.Context, service *corev1.Service) ([]corev1.Pod, error) {
+	if len(service.Spec.Selector) == 0 {
+		return nil, fmt.Errorf("%w: service %s has no selector", errNoPods, reconcile.ResourceKey(service))
+	}
+
+	if err := c.watchPods(ctx, service.Namespace); err != nil {
+		return nil, err
+	}
+
+	selector := labels.SelectorFromSet(service.Spec.Selector)
+
+	var result []corev1.Pod
+
+	c.mu.Lock()
+	for _, pod := range c.pods {
+		if pod.Namespace == service.Namespace && reconcile.PodReady(pod) && selector.Matches(labels.Set(pod.Labels)) {
+			result = append(result, pod)
+		}
+	}
+	c.mu.Unlock()
+
+	if len(result) == 0 {
+		return nil, fmt.Errorf("%w for service %s", errNoPods, reconcile.ResourceKey(service))
+	}
+
+	slices.SortFunc(result, func(a, b corev1.Pod) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return result, nil
+}
+
+// watchPods starts caching the pods of a namespace. Controllers usually run
+// outside the namespaces loop is scoped to, so namespaces are watched as
+// their services come up rather than up front. A namespace that cannot be
+// listed, e.g. for lack of permission, is retried on the next refresh.
+func (c *Gateway) watchPods(ctx context.Context, namespace string) error {
+	c.mu.Lock()
+	watched := c.podNamespaces[namespace]
+	c.mu.Unlock()
+
+	if watched {
+		return nil
+	}
+
+	err := reconcile.WatchPods(ctx, c.client, namespace, &c.mu, c.pods, func(old, pod *corev1.Pod) {
+		// only changes to what readyPods selects by move tunnels
+		if old == nil || pod == nil || reconcile.PodReady(*old) != reconcile.PodReady(*pod) || !maps.Equal(old.Labels, pod.Labels) {
+			c.notify()
+		}
+	})
+
+	if err != nil {
+		if kubernetes.IsForbidden(err) {
+			return fmt.Errorf("forbidden to list pods in namespace %s", namespace)
+		}
+
+		return fmt.Errorf("cannot list pods in namespace %s: %w", namespace, err)
+	}
+
+	c.mu.Lock()
+	c.podNamespaces[namespace] = true
+	c.mu.Unlock()
+
+	return nil
+}
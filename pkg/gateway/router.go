@@ -0,0 +1,306 @@
+package gateway
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/adrianliechti/loop/pkg/kubernetes"
+)
+
+// router serves HTTP routes in process. It evaluates Ingress rules and
+// HTTPRoute matches itself and forwards requests straight to the backend
+// pods, so it keeps working when the ingress controller does not.
+type router struct {
+	client    kubernetes.Client
+	authority *authority
+
+	logger *slog.Logger
+
+	mu        sync.RWMutex
+	rules     []httpRule
+	endpoints map[string]*endpoints
+
+	// names maps the published names, e.g. those qualified with the
+	// cluster, to the hosts they stand for, so rules see the names they
+	// were written for. Certificates are only issued for these names.
+	names map[string]string
+
+	// plain and secure are the in-process listeners the tunnel ports are
+	// forwarded to.
+	plain  string
+	secure string
+
+	proxy *httputil.ReverseProxy
+
+	// dial, if set, connects to backends by their service address from
+	// inside the cluster instead of to their pods.
+	dial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// endpoints are the ready pods of a backend, with the container port the
+// backend's service port targets.
+type endpoints struct {
+	namespace string
+	port      int
+
+	mu      sync.Mutex
+	targets []string
+	next    int
+}
+
+type backendKey struct{}
+
+func newRouter(client kubernetes.Client, authority *authority, logger *slog.Logger) *router {
+	r := &router{
+		client:    client,
+		authority: authority,
+
+		logger: logger,
+
+		endpoints: make(map[string]*endpoints),
+	}
+
+	r.proxy = &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			backend := pr.In.Context().Value(backendKey{}).(httpBackend)
+
+			pr.SetURL(&url.URL{Scheme: "http", Host: backend.Addr()})
+			pr.SetXForwarded()
+
+			pr.Out.Host = pr.In.Host
+		},
+
+		Transport: &http.Transport{
+			DialContext: r.dialBackend,
+		},
+
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			// the error names internal addresses; only the log gets it
+			r.log(req.Context(), "failed to forward request", "host", req.Host, "path", req.URL.Path, "error", err)
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		},
+	}
+
+	return r
+}
+
+// Start serves the router until ctx is cancelled.
+func (r *router) Start(ctx context.Context) error {
+	plain, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		return err
+	}
+
+	secure, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		plain.Close()
+		return err
+	}
+
+	r.plain = plain.Addr().String()
+	r.secure = secure.Addr().String()
+
+	server := &http.Server{
+		Handler: r,
+	}
+
+	tlsConfig := &tls.Config{
+		GetCertificate: r.certificate,
+		NextProtos:     []string{"http/1.1"},
+	}
+
+	go server.Serve(plain)
+	go server.Serve(tls.NewListener(secure, tlsConfig))
+
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	return nil
+}
+
+// Update replaces the rules, backend endpoints and published names;
+// requests in flight keep the ones they started with.
+func (r *router) Update(rules []httpRule, endpoints map[string]*endpoints, names map[string]string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.rules = rules
+	r.endpoints = endpoints
+	r.names = names
+}
+
+// Dial connects to the router as a tunnel port would: 443 speaks TLS,
+// everything else plain HTTP.
+func (r *router) Dial(ctx context.Context, port int) (net.Conn, error) {
+	addr := r.plain
+
+	if port == 443 {
+		addr = r.secure
+	}
+
+	if addr == "" {
+		return nil, errors.New("router not started")
+	}
+
+	var d net.Dialer
+
+	return d.DialContext(ctx, "tcp", addr)
+}
+
+func (r *router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.RLock()
+	req.Host = r.unqualify(req.Host)
+	rule := matchRule(r.rules, req)
+	r.mu.RUnlock()
+
+	if rule == nil {
+		http.Error(w, fmt.Sprintf("no route for %s%s", req.Host, req.URL.Path), http.StatusNotFound)
+		return
+	}
+
+	backend, ok := pickBackend(rule.Backends, rand.IntN)
+
+	if !ok {
+		// as the Gateway API specifies for rules without usable backends
+		http.Error(w, "no backend for route", http.StatusInternalServerError)
+		return
+	}
+
+	r.proxy.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), backendKey{}, backend)))
+}
+
+// certificate issues the certificate for a name the router publishes, so
+// the authority never signs anything else.
+func (r *router) certificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	_, ok := r.lookup(hello.ServerName)
+	r.mu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("no route for %q", hello.ServerName)
+	}
+
+	return r.authority.Certificate(hello)
+}
+
+// unqualify returns the host a published name stands for, keeping the port.
+func (r *router) unqualify(host string) string {
+	name, port, err := net.SplitHostPort(host)
+
+	if err != nil {
+		name, port = host, ""
+	}
+
+	original, ok := r.lookup(name)
+
+	if !ok {
+		return host
+	}
+
+	if port != "" {
+		return net.JoinHostPort(original, port)
+	}
+
+	return original
+}
+
+// lookup returns the host a published name stands for. A wildcard name maps
+// to its wildcard host with the same first labels; the most specific one
+// wins, as in matchHost.
+func (r *router) lookup(name string) (string, bool) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+
+	original, ok := r.names[name]
+
+	if !ok {
+		longest := ""
+
+		for pattern, o := range r.names {
+			suffix, wildcard := strings.CutPrefix(pattern, "*")
+			originalSuffix, originalWildcard := strings.CutPrefix(o, "*")
+
+			if !wildcard || !originalWildcard || len(suffix) <= len(longest) {
+				continue
+			}
+
+			if strings.HasSuffix(name, suffix) && len(name) > len(suffix) {
+				longest = suffix
+				original, ok = strings.TrimSuffix(name, suffix)+originalSuffix, true
+			}
+		}
+	}
+
+	return original, ok
+}
+
+// dialBackend connects to a backend's pods round-robin, failing over to
+// the next pod when one cannot be reached, or to its service through dial.
+func (r *router) dialBackend(ctx context.Context, network, addr string) (net.Conn, error) {
+	if r.dial != nil {
+		return r.dial(ctx, network, addr)
+	}
+
+	r.mu.RLock()
+	e, ok := r.endpoints[addr]
+	r.mu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("no ready endpoints for %s", addr)
+	}
+
+	var result error
+
+	for _, name := range e.candidates() {
+		conn, err := r.client.PodDial(ctx, e.namespace, name, "tcp", e.port)
+
+		if err != nil {
+			result = errors.Join(result, err)
+			continue
+		}
+
+		return conn, nil
+	}
+
+	if result == nil {
+		result = fmt.Errorf("no ready endpoints for %s", addr)
+	}
+
+	return nil, result
+}
+
+func (r *router) log(ctx context.Context, msg string, args ...any) {
+	if r.logger == nil {
+		return
+	}
+
+	r.logger.WarnContext(ctx, msg, args...)
+}
+
+func (e *endpoints) candidates() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if len(e.targets) == 0 {
+		return nil
+	}
+
+	start := e.next % len(e.targets)
+	e.next++
+
+	return append(slices.Clone(e.targets[start:]), e.targets[:start]...)
+}
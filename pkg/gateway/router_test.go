@@ -0,0 +1,112 @@
+package gateway
+
+import (
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestUnqualify(t *testing.T) {
+	r := &router{
+		names: map[string]string{
+			"shop.example.com.staging": "shop.example.com",
+			"*.example.com.staging":    "*.example.com",
+			"*.api.example.com.dev":    "*.api.example.com",
+			"*.com.dev":                "*.com",
+		},
+	}
+
+	for host, want := range map[string]string{
+		"Shop.Example.com.staging:443": "shop.example.com:443",
+		"a.example.com.staging":        "a.example.com",
+		"v1.api.example.com.dev":       "v1.api.example.com",
+		"example.com.staging":          "example.com.staging",
+	} {
+		if got := r.unqualify(host); got != want {
+			t.Errorf("unqualify(%q) = %q, want %q", host, got, want)
+		}
+	}
+}
+
+func TestCertificateOnlyForPublishedNames(t *testing.T) {
+	authority, err := newAuthority("")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &router{
+		authority: authority,
+
+		names: map[string]string{
+			"shop.example.com":  "shop.example.com",
+			"*.example.com.dev": "*.example.com",
+		},
+	}
+
+	for _, name := range []string{"shop.example.com", "api.example.com.dev"} {
+		cert, err := r.certificate(&tls.ClientHelloInfo{ServerName: name})
+
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		if err := cert.Leaf.VerifyHostname(name); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+
+	if _, err := r.certificate(&tls.ClientHelloInfo{ServerName: "bank.example.org"}); err == nil {
+		t.Error("want no certificate for a name the router does not publish")
+	}
+}
+
+func TestAuthorityPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "router-ca.pem")
+
+	first, err := newAuthority(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the next session reuses the root the user trusts
+	second, err := newAuthority(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !second.cert.Equal(first.cert) {
+		t.Fatal("want the root reused")
+	}
+
+	if runtime.GOOS == "windows" {
+		return
+	}
+
+	info, err := os.Stat(authorityKeyPath(path))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Fatalf("want the key readable by the user only, got %v", perm)
+	}
+
+	// a key others could read may have leaked
+	os.Chmod(authorityKeyPath(path), 0644)
+
+	third, err := newAuthority(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if third.cert.Equal(first.cert) {
+		t.Fatal("want a new root once the key was exposed")
+	}
+}
@@ -0,0 +1,278 @@
+package gateway
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/adrianliechti/loop/pkg/kubernetes"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	gatewayv1 "sigs.k8s.io/gateway-api/apis/v1"
+)
+
+// route is what binding needs to know about an xRoute of any kind.
+type route struct {
+	Kind      gatewayv1.Kind
+	Namespace string
+	Name      string
+
+	ParentRefs []gatewayv1.ParentReference
+	Hostnames  []gatewayv1.Hostname
+
+	Status gatewayv1.RouteStatus
+
+	// Object is the route resource itself.
+	Object metav1.Object
+}
+
+func newRoute(kind gatewayv1.Kind, obj metav1.Object, spec gatewayv1.CommonRouteSpec, hostnames []gatewayv1.Hostname, status gatewayv1.RouteStatus) route {
+	return route{
+		Kind:      kind,
+		Namespace: obj.GetNamespace(),
+		Name:      obj.GetName(),
+
+		ParentRefs: spec.ParentRefs,
+		Hostnames:  hostnames,
+
+		Status: status,
+
+		Object: obj,
+	}
+}
+
+// Key identifies the route across kinds.
+func (r route) Key() string {
+	return strings.ToLower(string(r.Kind)) + "/" + r.Namespace + "/" + r.Name
+}
+
+// binding is a gateway a route attached to, with the hostnames and listener
+// ports it serves there.
+type binding struct {
+	Gateway   *gatewayv1.Gateway
+	Hostnames []string
+	Ports     []int
+}
+
+// namespaceLabelsFunc returns the labels of a namespace, or false if they
+// cannot be read.
+type namespaceLabelsFunc func(name string) (labels.Set, bool)
+
+// bindRoute attaches a route to its parent gateways as the Gateway API
+// specifies: parentRefs default to Gateways in the route's namespace, may
+// name a listener by sectionName and port, and only attach where the
+// listener's allowedRoutes admit the route's namespace and kind. A parent the
+// controller reports as not Accepted is skipped; one it accepted is trusted
+// when the namespace labels a selector needs cannot be read.
+func bindRoute(r route, gateways []gatewayv1.Gateway, namespaceLabels namespaceLabelsFunc) []binding {
+	var result []binding
+
+	for _, ref := range r.ParentRefs {
+		if kubernetes.Deref(ref.Group, gatewayv1.GroupName) != gatewayv1.GroupName || kubernetes.Deref(ref.Kind, "Gateway") != "Gateway" {
+			continue
+		}
+
+		namespace := string(kubernetes.Deref(ref.Namespace, gatewayv1.Namespace(r.Namespace)))
+
+		index := slices.IndexFunc(gateways, func(g gatewayv1.Gateway) bool {
+			return g.Namespace == namespace && g.Name == string(ref.Name)
+		})
+
+		if index < 0 {
+			continue
+		}
+
+		g := &gateways[index]
+		accepted := parentAccepted(r, ref)
+
+		if accepted == metav1.ConditionFalse {
+			continue
+		}
+
+		var hostnames []string
+		var ports []int
+
+		for _, l := range g.Spec.Listeners {
+			if ref.SectionName != nil && l.Name != *ref.SectionName {
+				continue
+			}
+
+			if ref.Port != nil && l.Port != *ref.Port {
+				continue
+			}
+
+			if !kindAllowed(l, r.Kind) {
+				continue
+			}
+
+			allowed, known := namespaceAllowed(l, g.Namespace, r.Namespace, namespaceLabels)
+
+			if !known {
+				allowed = accepted == metav1.ConditionTrue
+			}
+
+			if !allowed {
+				continue
+			}
+
+			hosts := intersectHostnames(l.Hostname, r.Hostnames)
+
+			// a route naming hostnames does not attach to listeners serving
+			// none of them
+			if len(r.Hostnames) > 0 && len(hosts) == 0 {
+				continue
+			}
+
+			for _, host := range hosts {
+				if !slices.Contains(hostnames, host) {
+					hostnames = append(hostnames, host)
+				}
+			}
+
+			if port := int(l.Port); !slices.Contains(ports, port) {
+				ports = append(ports, port)
+			}
+		}
+
+		if len(ports) == 0 {
+			continue
+		}
+
+		result = append(result, binding{
+			Gateway:   g,
+			Hostnames: hostnames,
+			Ports:     ports,
+		})
+	}
+
+	return result
+}
+
+// parentAccepted returns the Accepted condition a controller reported for
+// the parent, or Unknown if there is none yet.
+func parentAccepted(r route, ref gatewayv1.ParentReference) metav1.ConditionStatus {
+	for _, p := range r.Status.Parents {
+		if !sameParent(p.ParentRef, ref, r.Namespace) {
+			continue
+		}
+
+		if c := findCondition(p.Conditions, string(gatewayv1.RouteConditionAccepted)); c != nil {
+			return c.Status
+		}
+	}
+
+	return metav1.ConditionUnknown
+}
+
+func sameParent(a, b gatewayv1.ParentReference, namespace string) bool {
+	return a.Name == b.Name &&
+		kubernetes.Deref(a.Group, gatewayv1.GroupName) == kubernetes.Deref(b.Group, gatewayv1.GroupName) &&
+		kubernetes.Deref(a.Kind, "Gateway") == kubernetes.Deref(b.Kind, "Gateway") &&
+		kubernetes.Deref(a.Namespace, gatewayv1.Namespace(namespace)) == kubernetes.Deref(b.Namespace, gatewayv1.Namespace(namespace)) &&
+		kubernetes.Deref(a.SectionName, "") == kubernetes.Deref(b.SectionName, "") &&
+		kubernetes.Deref(a.Port, 0) == kubernetes.Deref(b.Port, 0)
+}
+
+func findCondition(conditions []metav1.Condition, kind string) *metav1.Condition {
+	for i := range conditions {
+		if conditions[i].Type == kind {
+			return &conditions[i]
+		}
+	}
+
+	return nil
+}
+
+// kindAllowed checks the listener's allowed kinds, which default to the
+// route kinds of its protocol.
+func kindAllowed(l gatewayv1.Listener, kind gatewayv1.Kind) bool {
+	if l.AllowedRoutes != nil && len(l.AllowedRoutes.Kinds) > 0 {
+		return slices.ContainsFunc(l.AllowedRoutes.Kinds, func(k gatewayv1.RouteGroupKind) bool {
+			return kubernetes.Deref(k.Group, gatewayv1.GroupName) == gatewayv1.GroupName && k.Kind == kind
+		})
+	}
+
+	switch l.Protocol {
+	case gatewayv1.HTTPProtocolType, gatewayv1.HTTPSProtocolType:
+		return kind == "HTTPRoute" || kind == "GRPCRoute"
+	case gatewayv1.TLSProtocolType:
+		return kind == "TLSRoute"
+	case gatewayv1.TCPProtocolType:
+		return kind == "TCPRoute"
+	case gatewayv1.UDPProtocolType:
+		return kind == "UDPRoute"
+	}
+
+	return false
+}
+
+// namespaceAllowed checks the listener's allowed namespaces, which default
+// to the gateway's own. known is false when a selector applies but the
+// route namespace's labels are unreadable.
+func namespaceAllowed(l gatewayv1.Listener, gatewayNamespace, routeNamespace string, namespaceLabels namespaceLabelsFunc) (allowed, known bool) {
+	from := gatewayv1.NamespacesFromSame
+
+	if l.AllowedRoutes != nil && l.AllowedRoutes.Namespaces != nil && l.AllowedRoutes.Namespaces.From != nil {
+		from = *l.AllowedRoutes.Namespaces.From
+	}
+
+	switch from {
+	case gatewayv1.NamespacesFromAll:
+		return true, true
+
+	case gatewayv1.NamespacesFromSame:
+		return gatewayNamespace == routeNamespace, true
+
+	case gatewayv1.NamespacesFromSelector:
+		selector, err := metav1.LabelSelectorAsSelector(l.AllowedRoutes.Namespaces.Selector)
+
+		if err != nil {
+			return false, true
+		}
+
+		if namespaceLabels == nil {
+			return false, false
+		}
+
+		set, ok := namespaceLabels(routeNamespace)
+
+		if !ok {
+			return false, false
+		}
+
+		return selector.Matches(set), true
+	}
+
+	return false, true
+}
+
+// intersectHostnames returns the hostnames a route serves on a listener:
+// the route's own where they fall under the listener's, the listener's
+// where it is narrower than a route wildcard, and the listener's if the
+// route names none.
+func intersectHostnames(listener *gatewayv1.Hostname, hostnames []gatewayv1.Hostname) []string {
+	if len(hostnames) == 0 {
+		if listener == nil {
+			return nil
+		}
+
+		return []string{string(*listener)}
+	}
+
+	var result []string
+
+	for _, h := range hostnames {
+		host := string(h)
+
+		switch {
+		case listener == nil:
+			result = append(result, host)
+		case matchHost(string(*listener), host):
+			result = append(result, host)
+		case matchHost(host, string(*listener)):
+			result = append(result, string(*listener))
+		}
+	}
+
+	return result
+}
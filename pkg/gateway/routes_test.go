@@ -0,0 +1,297 @@
+package gateway
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/adrianliechti/loop/pkg/kubernetes"
+	"github.com/adrianliechti/loop/pkg/reconcile"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	gatewayv1 "sigs.k8s.io/gateway-api/apis/v1"
+)
+
+func TestBindRoute(t *testing.T) {
+	all := gatewayv1.NamespacesFromAll
+	selector := gatewayv1.NamespacesFromSelector
+
+	listener := func(name string, port int32, hostname string, from *gatewayv1.FromNamespaces) gatewayv1.Listener {
+		l := gatewayv1.Listener{
+			Name:     gatewayv1.SectionName(name),
+			Port:     gatewayv1.PortNumber(port),
+			Protocol: gatewayv1.HTTPProtocolType,
+		}
+
+		if hostname != "" {
+			l.Hostname = kubernetes.Ptr(gatewayv1.Hostname(hostname))
+		}
+
+		if from != nil {
+			l.AllowedRoutes = &gatewayv1.AllowedRoutes{
+				Namespaces: &gatewayv1.RouteNamespaces{From: from},
+			}
+
+			if *from == selector {
+				l.AllowedRoutes.Namespaces.Selector = &metav1.LabelSelector{
+					MatchLabels: map[string]string{"gateway-access": "true"},
+				}
+			}
+		}
+
+		return l
+	}
+
+	gateways := []gatewayv1.Gateway{
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "infra", Name: "shared"},
+			Spec: gatewayv1.GatewaySpec{
+				Listeners: []gatewayv1.Listener{
+					listener("public", 80, "*.example.com", &all),
+					listener("internal", 8080, "", &selector),
+				},
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "shop", Name: "local"},
+			Spec: gatewayv1.GatewaySpec{
+				Listeners: []gatewayv1.Listener{
+					listener("http", 80, "", nil),
+					{
+						Name:     "tls",
+						Port:     443,
+						Protocol: gatewayv1.TLSProtocolType,
+					},
+					{
+						Name:     "postgres",
+						Port:     5432,
+						Protocol: gatewayv1.TCPProtocolType,
+					},
+				},
+			},
+		},
+	}
+
+	namespaces := map[string]labels.Set{
+		"shop":    {"gateway-access": "true"},
+		"billing": {},
+	}
+
+	namespaceLabels := func(name string) (labels.Set, bool) {
+		set, ok := namespaces[name]
+		return set, ok
+	}
+
+	parent := func(namespace, name, section string, port int32) gatewayv1.ParentReference {
+		ref := gatewayv1.ParentReference{Name: gatewayv1.ObjectName(name)}
+
+		if namespace != "" {
+			ref.Namespace = kubernetes.Ptr(gatewayv1.Namespace(namespace))
+		}
+
+		if section != "" {
+			ref.SectionName = kubernetes.Ptr(gatewayv1.SectionName(section))
+		}
+
+		if port != 0 {
+			ref.Port = kubernetes.Ptr(gatewayv1.PortNumber(port))
+		}
+
+		return ref
+	}
+
+	accepted := func(ref gatewayv1.ParentReference, status metav1.ConditionStatus) gatewayv1.RouteStatus {
+		return gatewayv1.RouteStatus{
+			Parents: []gatewayv1.RouteParentStatus{
+				{
+					ParentRef: ref,
+					Conditions: []metav1.Condition{
+						{Type: string(gatewayv1.RouteConditionAccepted), Status: status},
+					},
+				},
+			},
+		}
+	}
+
+	t.Run("tcp route attaches to listener ports", func(t *testing.T) {
+		r := route{
+			Kind:       "TCPRoute",
+			Namespace:  "shop",
+			ParentRefs: []gatewayv1.ParentReference{parent("", "local", "", 0)},
+		}
+
+		bindings := bindRoute(r, gateways, namespaceLabels)
+
+		if len(bindings) != 1 || !slices.Equal(bindings[0].Ports, []int{5432}) || len(bindings[0].Hostnames) != 0 {
+			t.Fatalf("expected a binding on port 5432 without hostnames, got %+v", bindings)
+		}
+	})
+
+	tests := []struct {
+		name string
+
+		route route
+		want  map[string][]string
+	}{
+		{
+			name: "same namespace by default",
+			route: route{
+				Namespace:  "shop",
+				ParentRefs: []gatewayv1.ParentReference{parent("", "local", "", 0)},
+				Hostnames:  []gatewayv1.Hostname{"shop.local"},
+			},
+			want: map[string][]string{"shop/local": {"shop.local"}},
+		},
+		{
+			name: "parent in another namespace needs its namespace",
+			route: route{
+				Namespace:  "shop",
+				ParentRefs: []gatewayv1.ParentReference{parent("", "shared", "", 0)},
+				Hostnames:  []gatewayv1.Hostname{"shop.example.com"},
+			},
+		},
+		{
+			name: "cross-namespace parent allowed from all",
+			route: route{
+				Namespace:  "shop",
+				ParentRefs: []gatewayv1.ParentReference{parent("infra", "shared", "", 0)},
+				Hostnames:  []gatewayv1.Hostname{"shop.example.com"},
+			},
+			want: map[string][]string{"infra/shared": {"shop.example.com"}},
+		},
+		{
+			name: "hostname outside the listener wildcard",
+			route: route{
+				Namespace:  "shop",
+				ParentRefs: []gatewayv1.ParentReference{parent("infra", "shared", "public", 0)},
+				Hostnames:  []gatewayv1.Hostname{"shop.example.org"},
+			},
+		},
+		{
+			name: "route without hostnames inherits the listener's",
+			route: route{
+				Namespace:  "billing",
+				ParentRefs: []gatewayv1.ParentReference{parent("infra", "shared", "public", 0)},
+			},
+			want: map[string][]string{"infra/shared": {"*.example.com"}},
+		},
+		{
+			name: "route wildcard narrowed to the listener hostname",
+			route: route{
+				Namespace:  "shop",
+				ParentRefs: []gatewayv1.ParentReference{parent("infra", "shared", "", 80)},
+				Hostnames:  []gatewayv1.Hostname{"*.com"},
+			},
+			want: map[string][]string{"infra/shared": {"*.example.com"}},
+		},
+		{
+			name: "section name selects the listener",
+			route: route{
+				Namespace:  "billing",
+				ParentRefs: []gatewayv1.ParentReference{parent("infra", "shared", "internal", 0)},
+				Hostnames:  []gatewayv1.Hostname{"billing.internal"},
+			},
+		},
+		{
+			name: "selector admits labelled namespaces",
+			route: route{
+				Namespace:  "shop",
+				ParentRefs: []gatewayv1.ParentReference{parent("infra", "shared", "internal", 0)},
+				Hostnames:  []gatewayv1.Hostname{"shop.internal"},
+			},
+			want: map[string][]string{"infra/shared": {"shop.internal"}},
+		},
+		{
+			name: "port selects the listener",
+			route: route{
+				Namespace:  "shop",
+				ParentRefs: []gatewayv1.ParentReference{parent("infra", "shared", "", 8080)},
+				Hostnames:  []gatewayv1.Hostname{"shop.internal"},
+			},
+			want: map[string][]string{"infra/shared": {"shop.internal"}},
+		},
+		{
+			name: "unknown port",
+			route: route{
+				Namespace:  "shop",
+				ParentRefs: []gatewayv1.ParentReference{parent("infra", "shared", "", 9090)},
+				Hostnames:  []gatewayv1.Hostname{"shop.example.com"},
+			},
+		},
+		{
+			name: "unreadable namespace trusts an accepted status",
+			route: route{
+				Namespace:  "orders",
+				ParentRefs: []gatewayv1.ParentReference{parent("infra", "shared", "internal", 0)},
+				Hostnames:  []gatewayv1.Hostname{"orders.internal"},
+				Status:     accepted(parent("infra", "shared", "internal", 0), metav1.ConditionTrue),
+			},
+			want: map[string][]string{"infra/shared": {"orders.internal"}},
+		},
+		{
+			name: "unreadable namespace without status",
+			route: route{
+				Namespace:  "orders",
+				ParentRefs: []gatewayv1.ParentReference{parent("infra", "shared", "internal", 0)},
+				Hostnames:  []gatewayv1.Hostname{"orders.internal"},
+			},
+		},
+		{
+			name: "rejected by the controller",
+			route: route{
+				Namespace:  "shop",
+				ParentRefs: []gatewayv1.ParentReference{parent("", "local", "", 0)},
+				Hostnames:  []gatewayv1.Hostname{"shop.local"},
+				Status:     accepted(parent("", "local", "", 0), metav1.ConditionFalse),
+			},
+		},
+		{
+			name: "kind not allowed on tls listener",
+			route: route{
+				Kind:       "HTTPRoute",
+				Namespace:  "shop",
+				ParentRefs: []gatewayv1.ParentReference{parent("", "local", "tls", 0)},
+				Hostnames:  []gatewayv1.Hostname{"shop.local"},
+			},
+		},
+		{
+			name: "several parents",
+			route: route{
+				Namespace: "shop",
+				ParentRefs: []gatewayv1.ParentReference{
+					parent("", "local", "", 0),
+					parent("infra", "shared", "public", 0),
+				},
+				Hostnames: []gatewayv1.Hostname{"shop.example.com"},
+			},
+			want: map[string][]string{
+				"shop/local":   {"shop.example.com"},
+				"infra/shared": {"shop.example.com"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.route.Kind == "" {
+				tt.route.Kind = "HTTPRoute"
+			}
+
+			got := make(map[string][]string)
+
+			for _, b := range bindRoute(tt.route, gateways, namespaceLabels) {
+				got[reconcile.ResourceKey(b.Gateway)] = b.Hostnames
+			}
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("expected bindings %v, got %v", tt.want, got)
+			}
+
+			for key, hosts := range tt.want {
+				if !slices.Equal(got[key], hosts) {
+					t.Fatalf("expected bindings %v, got %v", tt.want, got)
+				}
+			}
+		})
+	}
+}
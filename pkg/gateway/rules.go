@@ -0,0 +1,389 @@
+package gateway
+
+import (
+	"net"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/adrianliechti/loop/pkg/kubernetes"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	gatewayv1 "sigs.k8s.io/gateway-api/apis/v1"
+)
+
+// httpRule is a single match of an Ingress rule or HTTPRoute, with the
+// backends it sends requests to.
+type httpRule struct {
+	// Host is an exact name, a wildcard like *.example.com, or empty for
+	// any host.
+	Host string
+
+	Path    pathMatch
+	Headers []headerMatch
+
+	Backends []httpBackend
+}
+
+type pathMatch struct {
+	// Exact matches the path only; otherwise it is a prefix matched on
+	// whole path elements, so /shop matches /shop/cart but not /shopping.
+	Exact bool
+	Value string
+}
+
+type headerMatch struct {
+	Name  string
+	Value string
+
+	// Pattern replaces Value for regular expression matches.
+	Pattern *regexp.Regexp
+}
+
+// httpBackend is a service port requests are forwarded to. Backends of a
+// rule share its requests in proportion to their weights.
+type httpBackend struct {
+	Namespace string
+	Name      string
+	Port      int
+
+	Weight int
+}
+
+// Addr identifies the backend as the upstream address of a request.
+func (b httpBackend) Addr() string {
+	return net.JoinHostPort(b.Name+"."+b.Namespace, strconv.Itoa(b.Port))
+}
+
+// ingressRules turns an ingress into rules. Named service ports are
+// resolved against services; backends that are not services are dropped.
+func ingressRules(i networkingv1.Ingress, services []corev1.Service) []httpRule {
+	var result []httpRule
+
+	backend := func(b networkingv1.IngressBackend) []httpBackend {
+		if b.Service == nil {
+			return nil
+		}
+
+		port := int(b.Service.Port.Number)
+
+		if port == 0 {
+			port = servicePort(services, i.Namespace, b.Service.Name, b.Service.Port.Name)
+		}
+
+		if port == 0 {
+			return nil
+		}
+
+		return []httpBackend{{Namespace: i.Namespace, Name: b.Service.Name, Port: port, Weight: 1}}
+	}
+
+	for _, r := range i.Spec.Rules {
+		if r.HTTP == nil {
+			continue
+		}
+
+		for _, p := range r.HTTP.Paths {
+			path := p.Path
+
+			if path == "" {
+				path = "/"
+			}
+
+			result = append(result, httpRule{
+				Host: strings.ToLower(r.Host),
+
+				// ImplementationSpecific is treated as a prefix, as most
+				// controllers do.
+				Path: pathMatch{
+					Exact: kubernetes.Deref(p.PathType, networkingv1.PathTypeImplementationSpecific) == networkingv1.PathTypeExact,
+					Value: path,
+				},
+
+				Backends: backend(p.Backend),
+			})
+		}
+	}
+
+	if i.Spec.DefaultBackend != nil {
+		result = append(result, httpRule{
+			Path:     pathMatch{Value: "/"},
+			Backends: backend(*i.Spec.DefaultBackend),
+		})
+	}
+
+	return result
+}
+
+// httpRouteRules turns an HTTPRoute into rules for the hostnames it is bound
+// to. Matches the router cannot evaluate, like regular expression paths,
+// are left out rather than widened.
+func httpRouteRules(r gatewayv1.HTTPRoute, hostnames []string) []httpRule {
+	var result []httpRule
+
+	if len(hostnames) == 0 {
+		hostnames = []string{""}
+	}
+
+	for _, rule := range r.Spec.Rules {
+		var backends []httpBackend
+
+		for _, ref := range rule.BackendRefs {
+			if kubernetes.Deref(ref.Group, "") != "" || kubernetes.Deref(ref.Kind, "Service") != "Service" || ref.Port == nil {
+				continue
+			}
+
+			backends = append(backends, httpBackend{
+				Namespace: string(kubernetes.Deref(ref.Namespace, gatewayv1.Namespace(r.Namespace))),
+				Name:      string(ref.Name),
+				Port:      int(*ref.Port),
+
+				Weight: int(kubernetes.Deref(ref.Weight, 1)),
+			})
+		}
+
+		matches := rule.Matches
+
+		// a rule without matches matches every request
+		if len(matches) == 0 {
+			matches = []gatewayv1.HTTPRouteMatch{{}}
+		}
+
+		for _, m := range matches {
+			path, ok := httpRoutePath(m.Path)
+
+			if !ok {
+				continue
+			}
+
+			headers, ok := httpRouteHeaders(m.Headers)
+
+			if !ok {
+				continue
+			}
+
+			for _, host := range hostnames {
+				result = append(result, httpRule{
+					Host: strings.ToLower(host),
+
+					Path:    path,
+					Headers: headers,
+
+					Backends: backends,
+				})
+			}
+		}
+	}
+
+	return result
+}
+
+func httpRoutePath(m *gatewayv1.HTTPPathMatch) (pathMatch, bool) {
+	if m == nil {
+		return pathMatch{Value: "/"}, true
+	}
+
+	value := kubernetes.Deref(m.Value, "/")
+
+	switch kubernetes.Deref(m.Type, gatewayv1.PathMatchPathPrefix) {
+	case gatewayv1.PathMatchExact:
+		return pathMatch{Exact: true, Value: value}, true
+	case gatewayv1.PathMatchPathPrefix:
+		return pathMatch{Value: value}, true
+	}
+
+	return pathMatch{}, false
+}
+
+func httpRouteHeaders(matches []gatewayv1.HTTPHeaderMatch) ([]headerMatch, bool) {
+	var result []headerMatch
+
+	for _, m := range matches {
+		h := headerMatch{
+			Name:  string(m.Name),
+			Value: m.Value,
+		}
+
+		switch kubernetes.Deref(m.Type, gatewayv1.HeaderMatchExact) {
+		case gatewayv1.HeaderMatchExact:
+		case gatewayv1.HeaderMatchRegularExpression:
+			pattern, err := regexp.Compile(m.Value)
+
+			if err != nil {
+				return nil, false
+			}
+
+			h.Pattern = pattern
+		default:
+			return nil, false
+		}
+
+		result = append(result, h)
+	}
+
+	return result, true
+}
+
+// servicePort resolves a named service port to its number.
+func servicePort(services []corev1.Service, namespace, name, port string) int {
+	for _, s := range services {
+		if s.Namespace != namespace || s.Name != name {
+			continue
+		}
+
+		for _, p := range s.Spec.Ports {
+			if p.Name == port {
+				return int(p.Port)
+			}
+		}
+	}
+
+	return 0
+}
+
+// sortRules orders rules by precedence: exact paths before prefixes,
+// longer prefixes first, then more header matches. The sort is stable, so
+// ties keep the order the rules were collected in.
+func sortRules(rules []httpRule) {
+	slices.SortStableFunc(rules, func(a, b httpRule) int {
+		if a.Path.Exact != b.Path.Exact {
+			if a.Path.Exact {
+				return -1
+			}
+
+			return 1
+		}
+
+		if n := len(b.Path.Value) - len(a.Path.Value); n != 0 {
+			return n
+		}
+
+		return len(b.Headers) - len(a.Headers)
+	})
+}
+
+// matchRule returns the rule serving a request, or nil. As with virtual
+// hosts in a proxy, the most specific host is chosen first and only its
+// rules are considered: exact names, then the longest wildcard, then rules
+// for any host. rules must be sorted by sortRules.
+func matchRule(rules []httpRule, r *http.Request) *httpRule {
+	host := requestHost(r)
+
+	best := -1
+
+	for _, rule := range rules {
+		if score := hostScore(rule.Host, host); score > best {
+			best = score
+		}
+	}
+
+	if best < 0 {
+		return nil
+	}
+
+	for i := range rules {
+		rule := &rules[i]
+
+		if hostScore(rule.Host, host) != best {
+			continue
+		}
+
+		if rule.Path.matches(r.URL.Path) && headersMatch(rule.Headers, r.Header) {
+			return rule
+		}
+	}
+
+	return nil
+}
+
+// hostScore ranks how specifically a rule host matches, or -1 if it does
+// not match at all.
+func hostScore(pattern, host string) int {
+	switch {
+	case pattern == "":
+		return 0
+	case pattern == host:
+		return 1 << 16
+	case strings.HasPrefix(pattern, "*") && matchHost(pattern, host):
+		return len(pattern)
+	}
+
+	return -1
+}
+
+func requestHost(r *http.Request) string {
+	host := r.Host
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+func (m pathMatch) matches(path string) bool {
+	if path == "" {
+		path = "/"
+	}
+
+	if m.Exact {
+		return path == m.Value
+	}
+
+	prefix := strings.TrimSuffix(m.Value, "/")
+
+	if prefix == "" {
+		return true
+	}
+
+	rest, ok := strings.CutPrefix(path, prefix)
+
+	return ok && (rest == "" || strings.HasPrefix(rest, "/"))
+}
+
+func headersMatch(matches []headerMatch, header http.Header) bool {
+	for _, m := range matches {
+		values := header.Values(m.Name)
+
+		ok := slices.ContainsFunc(values, func(v string) bool {
+			if m.Pattern != nil {
+				return m.Pattern.MatchString(v)
+			}
+
+			return v == m.Value
+		})
+
+		if !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// pickBackend chooses a backend by weight; roll returns a number in
+// [0, n). It returns false if no backend has a positive weight.
+func pickBackend(backends []httpBackend, roll func(n int) int) (httpBackend, bool) {
+	total := 0
+
+	for _, b := range backends {
+		total += max(b.Weight, 0)
+	}
+
+	if total == 0 {
+		return httpBackend{}, false
+	}
+
+	n := roll(total)
+
+	for _, b := range backends {
+		if n -= max(b.Weight, 0); n < 0 {
+			return b, true
+		}
+	}
+
+	return httpBackend{}, false
+}
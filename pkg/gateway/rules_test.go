@@ -0,0 +1,179 @@
+package gateway
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/adrianliechti/loop/pkg/kubernetes"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	gatewayv1 "sigs.k8s.io/gateway-api/apis/v1"
+)
+
+func TestMatchRule(t *testing.T) {
+	prefix := networkingv1.PathTypePrefix
+	exact := networkingv1.PathTypeExact
+
+	backend := func(name string) networkingv1.IngressBackend {
+		return networkingv1.IngressBackend{
+			Service: &networkingv1.IngressServiceBackend{
+				Name: name,
+				Port: networkingv1.ServiceBackendPort{Name: "http"},
+			},
+		}
+	}
+
+	ingress := networkingv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "shop", Name: "shop"},
+		Spec: networkingv1.IngressSpec{
+			DefaultBackend: &networkingv1.IngressBackend{
+				Service: &networkingv1.IngressServiceBackend{
+					Name: "fallback",
+					Port: networkingv1.ServiceBackendPort{Number: 8080},
+				},
+			},
+
+			Rules: []networkingv1.IngressRule{
+				{
+					Host: "shop.example.com",
+					IngressRuleValue: networkingv1.IngressRuleValue{
+						HTTP: &networkingv1.HTTPIngressRuleValue{
+							Paths: []networkingv1.HTTPIngressPath{
+								{Path: "/", PathType: &prefix, Backend: backend("web")},
+								{Path: "/api", PathType: &prefix, Backend: backend("api")},
+								{Path: "/api/health", PathType: &exact, Backend: backend("health")},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	services := []corev1.Service{
+		{ObjectMeta: metav1.ObjectMeta{Namespace: "shop", Name: "web"}, Spec: corev1.ServiceSpec{Ports: []corev1.ServicePort{{Name: "http", Port: 80}}}},
+		{ObjectMeta: metav1.ObjectMeta{Namespace: "shop", Name: "api"}, Spec: corev1.ServiceSpec{Ports: []corev1.ServicePort{{Name: "http", Port: 8000}}}},
+		{ObjectMeta: metav1.ObjectMeta{Namespace: "shop", Name: "health"}, Spec: corev1.ServiceSpec{Ports: []corev1.ServicePort{{Name: "http", Port: 9000}}}},
+	}
+
+	route := gatewayv1.HTTPRoute{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "shop", Name: "canary"},
+		Spec: gatewayv1.HTTPRouteSpec{
+			Rules: []gatewayv1.HTTPRouteRule{
+				{
+					Matches: []gatewayv1.HTTPRouteMatch{
+						{
+							Path: &gatewayv1.HTTPPathMatch{Type: kubernetes.Ptr(gatewayv1.PathMatchPathPrefix), Value: kubernetes.Ptr("/")},
+							Headers: []gatewayv1.HTTPHeaderMatch{
+								{Name: "X-Canary", Value: "true"},
+							},
+						},
+					},
+					BackendRefs: []gatewayv1.HTTPBackendRef{
+						{BackendRef: gatewayv1.BackendRef{BackendObjectReference: gatewayv1.BackendObjectReference{Name: "web-canary", Port: kubernetes.Ptr(gatewayv1.PortNumber(80))}}},
+					},
+				},
+				{
+					Matches: []gatewayv1.HTTPRouteMatch{
+						{Path: &gatewayv1.HTTPPathMatch{Type: kubernetes.Ptr(gatewayv1.PathMatchExact), Value: kubernetes.Ptr("/status")}},
+						{Path: &gatewayv1.HTTPPathMatch{Type: kubernetes.Ptr(gatewayv1.PathMatchRegularExpression), Value: kubernetes.Ptr("/v[0-9]+")}},
+					},
+					BackendRefs: []gatewayv1.HTTPBackendRef{
+						{BackendRef: gatewayv1.BackendRef{BackendObjectReference: gatewayv1.BackendObjectReference{Name: "status", Port: kubernetes.Ptr(gatewayv1.PortNumber(80))}}},
+					},
+				},
+			},
+		},
+	}
+
+	rules := ingressRules(ingress, services)
+	rules = append(rules, httpRouteRules(route, []string{"*.example.com"})...)
+
+	sortRules(rules)
+
+	tests := []struct {
+		name string
+
+		host   string
+		path   string
+		header map[string]string
+
+		want string
+	}{
+		{name: "prefix", host: "shop.example.com", path: "/cart", want: "shop/web:80"},
+		{name: "longest prefix", host: "shop.example.com", path: "/api/orders", want: "shop/api:8000"},
+		{name: "prefix on path elements", host: "shop.example.com", path: "/apis", want: "shop/web:80"},
+		{name: "exact before prefix", host: "shop.example.com", path: "/api/health", want: "shop/health:9000"},
+		{name: "host with port", host: "SHOP.example.com:443", path: "/api", want: "shop/api:8000"},
+		{name: "exact host shadows wildcard", host: "shop.example.com", path: "/status", want: "shop/web:80"},
+		{name: "wildcard host", host: "blog.example.com", path: "/status", want: "shop/status:80"},
+		{name: "wildcard exact path only", host: "blog.example.com", path: "/status/x"},
+		{name: "header match", host: "blog.example.com", path: "/", header: map[string]string{"X-Canary": "true"}, want: "shop/web-canary:80"},
+		{name: "header mismatch", host: "blog.example.com", path: "/", header: map[string]string{"X-Canary": "false"}},
+		{name: "regular expressions are not widened", host: "blog.example.com", path: "/v1"},
+		{name: "default backend", host: "other.test", path: "/", want: "shop/fallback:8080"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "http://"+tt.host+tt.path, nil)
+
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+
+			rule := matchRule(rules, r)
+
+			// a matching host without a matching rule is not handed to
+			// less specific hosts
+			if tt.want == "" {
+				if rule != nil {
+					t.Fatalf("expected no rule, got %+v", rule)
+				}
+
+				return
+			}
+
+			if rule == nil || len(rule.Backends) != 1 {
+				t.Fatalf("expected a rule with one backend, got %+v", rule)
+			}
+
+			b := rule.Backends[0]
+
+			if got := b.Namespace + "/" + b.Name + ":" + strconv.Itoa(b.Port); got != tt.want {
+				t.Fatalf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestPickBackend(t *testing.T) {
+	backends := []httpBackend{
+		{Name: "stable", Weight: 90},
+		{Name: "canary", Weight: 10},
+		{Name: "off", Weight: 0},
+	}
+
+	counts := make(map[string]int)
+
+	for n := range 100 {
+		b, ok := pickBackend(backends, func(total int) int { return n % total })
+
+		if !ok {
+			t.Fatal("expected a backend")
+		}
+
+		counts[b.Name]++
+	}
+
+	if counts["stable"] != 90 || counts["canary"] != 10 || counts["off"] != 0 {
+		t.Fatalf("expected a 90/10 split, got %v", counts)
+	}
+
+	if _, ok := pickBackend([]httpBackend{{Name: "off"}}, func(int) int { return 0 }); ok {
+		t.Fatal("expected no backend without weights")
+	}
+}
@@ -0,0 +1,227 @@
+package gateway
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/adrianliechti/loop/pkg/reconcile"
+	"github.com/adrianliechti/loop/pkg/source"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+	gatewayv1 "sigs.k8s.io/gateway-api/apis/v1"
+)
+
+// The gateway finds Ingress and Gateway API hosts through sources as well,
+// so listTunnel resolves them like those of a service mesh. Both watch
+// into the gateway's caches, which the router and TCP routes read too.
+
+// ingressSource yields the rule hosts of Ingresses, entering through their
+// load balancer address.
+type ingressSource struct {
+	c *Gateway
+}
+
+func (s *ingressSource) Name() string {
+	return "ingress"
+}
+
+func (s *ingressSource) Start(ctx context.Context, notify func()) error {
+	for _, namespace := range s.c.namespaces() {
+		if err := s.c.watchIngresses(ctx, s.c.client, namespace); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Routes yields nothing with the router, which serves ingress hosts itself.
+func (s *ingressSource) Routes() []source.Route {
+	if s.c.router != nil {
+		return nil
+	}
+
+	s.c.mu.Lock()
+	ingresses := slices.Collect(maps.Values(s.c.ingresses))
+	s.c.mu.Unlock()
+
+	slices.SortFunc(ingresses, func(a, b networkingv1.Ingress) int {
+		return strings.Compare(reconcile.ResourceKey(&a), reconcile.ResourceKey(&b))
+	})
+
+	var result []source.Route
+
+	for i := range ingresses {
+		ingress := &ingresses[i]
+
+		for _, r := range ingress.Spec.Rules {
+			if r.Host == "" {
+				continue
+			}
+
+			result = append(result, source.Route{
+				Host:    r.Host,
+				Address: ingressAddress(*ingress),
+				Object:  ingress,
+			})
+		}
+	}
+
+	return result
+}
+
+// gatewaySource yields the hosts of Gateway listeners and of the routes
+// attached to them, entering through the gateway's data plane service.
+type gatewaySource struct {
+	c *Gateway
+
+	// ctx is the one Start was given; binding reads namespace labels with
+	// it.
+	ctx context.Context
+}
+
+func (s *gatewaySource) Name() string {
+	return "gateway"
+}
+
+func (s *gatewaySource) Start(ctx context.Context, notify func()) error {
+	c := s.c
+	s.ctx = ctx
+
+	for _, namespace := range c.namespaces() {
+		if err := c.watchGateways(ctx, c.client, namespace); err != nil {
+			return err
+		}
+
+		if err := watchRoutes(ctx, c, c.httproutes, &cache.ListWatch{
+			ListWithContextFunc: func(ctx context.Context, options metav1.ListOptions) (runtime.Object, error) {
+				return c.client.GatewayV1().HTTPRoutes(namespace).List(ctx, options)
+			},
+
+			WatchFuncWithContext: func(ctx context.Context, options metav1.ListOptions) (watch.Interface, error) {
+				return c.client.GatewayV1().HTTPRoutes(namespace).Watch(ctx, options)
+			},
+		}); err != nil {
+			return err
+		}
+
+		if err := watchRoutes(ctx, c, c.grpcroutes, &cache.ListWatch{
+			ListWithContextFunc: func(ctx context.Context, options metav1.ListOptions) (runtime.Object, error) {
+				return c.client.GatewayV1().GRPCRoutes(namespace).List(ctx, options)
+			},
+
+			WatchFuncWithContext: func(ctx context.Context, options metav1.ListOptions) (watch.Interface, error) {
+				return c.client.GatewayV1().GRPCRoutes(namespace).Watch(ctx, options)
+			},
+		}); err != nil {
+			return err
+		}
+
+		if err := watchRoutes(ctx, c, c.tlsroutes, &cache.ListWatch{
+			ListWithContextFunc: func(ctx context.Context, options metav1.ListOptions) (runtime.Object, error) {
+				return c.client.GatewayV1().TLSRoutes(namespace).List(ctx, options)
+			},
+
+			WatchFuncWithContext: func(ctx context.Context, options metav1.ListOptions) (watch.Interface, error) {
+				return c.client.GatewayV1().TLSRoutes(namespace).Watch(ctx, options)
+			},
+		}); err != nil {
+			return err
+		}
+
+		if err := watchRoutes(ctx, c, c.tcproutes, &cache.ListWatch{
+			ListWithContextFunc: func(ctx context.Context, options metav1.ListOptions) (runtime.Object, error) {
+				return c.client.GatewayV1().TCPRoutes(namespace).List(ctx, options)
+			},
+
+			WatchFuncWithContext: func(ctx context.Context, options metav1.ListOptions) (watch.Interface, error) {
+				return c.client.GatewayV1().TCPRoutes(namespace).Watch(ctx, options)
+			},
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Routes leaves out TCP routes, which have no hosts, and with the router
+// HTTPRoutes, which it serves itself.
+func (s *gatewaySource) Routes() []source.Route {
+	c := s.c
+
+	c.mu.Lock()
+	gateways := slices.Collect(maps.Values(c.gateways))
+	services := slices.Collect(maps.Values(c.services))
+	c.mu.Unlock()
+
+	slices.SortFunc(gateways, func(a, b gatewayv1.Gateway) int {
+		return strings.Compare(reconcile.ResourceKey(&a), reconcile.ResourceKey(&b))
+	})
+
+	var result []source.Route
+
+	for i := range gateways {
+		g := &gateways[i]
+		entry := gatewayEntry(*g, services)
+
+		for _, l := range g.Spec.Listeners {
+			if l.Hostname == nil {
+				continue
+			}
+
+			result = append(result, source.Route{
+				Host:    string(*l.Hostname),
+				Service: entry,
+				Object:  g,
+			})
+		}
+	}
+
+	ctx := s.ctx
+
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	namespaceLabels := c.namespaceLabels(ctx)
+
+	for _, r := range c.listRoutes() {
+		if r.Kind == "TCPRoute" || (c.router != nil && r.Kind == "HTTPRoute") {
+			continue
+		}
+
+		for _, b := range bindRoute(r, gateways, namespaceLabels) {
+			entry := gatewayEntry(*b.Gateway, services)
+
+			for _, host := range b.Hostnames {
+				result = append(result, source.Route{
+					Host:    host,
+					Service: entry,
+					Object:  r.Object,
+				})
+			}
+		}
+	}
+
+	return result
+}
+
+// gatewayEntry returns the data plane service of a gateway as
+// namespace/name, or nothing if it cannot be found.
+func gatewayEntry(g gatewayv1.Gateway, services []corev1.Service) string {
+	service, ok := gatewayService(g, services)
+
+	if !ok {
+		return ""
+	}
+
+	return reconcile.ResourceKey(service)
+}
@@ -0,0 +1,126 @@
+package helper
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/adrianliechti/loop/pkg/system"
+)
+
+// Client talks to a running helper. It implements system.Loopback and hands
+// out hosts sections, so it can stand in wherever loop changes system state.
+type Client struct {
+	client *http.Client
+}
+
+func NewClient(path string) *Client {
+	return &Client{
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", path)
+				},
+			},
+		},
+	}
+}
+
+// Ping reports whether the helper is up.
+func (c *Client) Ping(ctx context.Context) error {
+	return c.do(ctx, http.MethodGet, "/", nil)
+}
+
+func (c *Client) AliasIP(ctx context.Context, alias string) error {
+	return c.do(ctx, http.MethodPost, "/alias/"+url.PathEscape(alias), nil)
+}
+
+func (c *Client) UnaliasIP(ctx context.Context, alias string) error {
+	return c.do(ctx, http.MethodDelete, "/alias/"+url.PathEscape(alias), nil)
+}
+
+// Section returns a hosts file section written through the helper. The name
+// must start with "Loop ", like the sections loop writes itself.
+func (c *Client) Section(name string) system.Hosts {
+	return &section{
+		client: c,
+		name:   name,
+
+		hosts: make(map[string][]string),
+	}
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body any) error {
+	var reader io.Reader
+
+	if body != nil {
+		data, err := json.Marshal(body)
+
+		if err != nil {
+			return err
+		}
+
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, "http://helper"+path, reader)
+
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.client.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		data, _ := io.ReadAll(resp.Body)
+		message := strings.TrimSpace(string(data))
+
+		if message == "" {
+			message = resp.Status
+		}
+
+		return fmt.Errorf("helper: %s", message)
+	}
+
+	return nil
+}
+
+type section struct {
+	client *Client
+	name   string
+
+	hosts map[string][]string
+}
+
+func (s *section) Add(address string, hosts ...string) {
+	s.hosts[address] = hosts
+}
+
+// AddSRV is a no-op, as for any hosts file section.
+func (s *section) AddSRV(address string, records ...system.SRV) {
+}
+
+func (s *section) Remove(address string) {
+	delete(s.hosts, address)
+}
+
+func (s *section) Clear() {
+	clear(s.hosts)
+}
+
+func (s *section) Flush() error {
+	return s.client.do(context.Background(), http.MethodPut, "/hosts/"+url.PathEscape(s.name), s.hosts)
+}
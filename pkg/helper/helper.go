@@ -0,0 +1,269 @@
+package helper
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adrianliechti/loop/pkg/session"
+	"github.com/adrianliechti/loop/pkg/system"
+)
+
+var (
+	// sections must be loop's own, so the helper cannot rewrite the
+	// sections of other tools.
+	sectionPattern = regexp.MustCompile(`^Loop [A-Za-z0-9 ._-]{1,64}$`)
+
+	// hostPattern keeps names to a single hosts file token.
+	hostPattern = regexp.MustCompile(`^[A-Za-z0-9*._-]{1,253}$`)
+)
+
+// Server applies hosts sections and loopback aliases for an unprivileged
+// loop process. It accepts nothing else, and only from the user owning the
+// socket.
+type Server struct {
+	options ServerOptions
+
+	mu       sync.Mutex
+	sections map[string]*system.HostsSection
+	aliases  map[string]bool
+}
+
+type ServerOptions struct {
+	// Path is the unix socket to listen on.
+	Path string
+
+	// UID owns the socket; nobody else can connect.
+	UID int
+
+	// PID is the client process. The helper reverts its changes and exits
+	// once the client is gone, crashed or not.
+	PID int
+
+	Logger *slog.Logger
+}
+
+func New(options ServerOptions) *Server {
+	return &Server{
+		options: options,
+
+		sections: make(map[string]*system.HostsSection),
+		aliases:  make(map[string]bool),
+	}
+}
+
+func (s *Server) Start(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	l, err := listen(s.options.Path, s.options.UID)
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(s.options.Path)
+	defer s.revert()
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("PUT /hosts/{name}", s.handleHosts)
+	mux.HandleFunc("POST /alias/{address}", s.handleAlias)
+	mux.HandleFunc("DELETE /alias/{address}", s.handleUnalias)
+
+	server := &http.Server{
+		Handler: mux,
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if s.options.PID > 0 && !session.ProcessAlive(s.options.PID) {
+					cancel()
+				}
+			case <-ctx.Done():
+				server.Close()
+				return
+			}
+		}
+	}()
+
+	if err := server.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
+
+func (s *Server) handleHosts(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	if !sectionPattern.MatchString(name) {
+		http.Error(w, "invalid section name", http.StatusBadRequest)
+		return
+	}
+
+	var hosts map[string][]string
+
+	if err := json.NewDecoder(r.Body).Decode(&hosts); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for address, names := range hosts {
+		if _, err := parseLoopback(address); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		for _, name := range names {
+			if !hostPattern.MatchString(name) {
+				http.Error(w, fmt.Sprintf("invalid host %q", name), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	section, ok := s.sections[name]
+
+	if !ok {
+		owner := s.options.PID
+
+		if owner <= 0 {
+			owner = os.Getpid()
+		}
+
+		var err error
+
+		// the section belongs to the client's session, not the helper's
+		if section, err = system.NewHostsSectionFor(name, owner); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		s.sections[name] = section
+	}
+
+	section.Clear()
+
+	for address, names := range hosts {
+		section.Add(address, names...)
+	}
+
+	if err := section.Flush(); err != nil {
+		s.logError(r.Context(), "failed to write hosts section", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleAlias(w http.ResponseWriter, r *http.Request) {
+	address, err := parseLoopback(r.PathValue("address"))
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := system.AliasIP(r.Context(), address); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.mu.Lock()
+	s.aliases[address] = true
+	s.mu.Unlock()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleUnalias(w http.ResponseWriter, r *http.Request) {
+	address, err := parseLoopback(r.PathValue("address"))
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := system.UnaliasIP(r.Context(), address); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.mu.Lock()
+	delete(s.aliases, address)
+	s.mu.Unlock()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// revert removes whatever the client left in place, e.g. after it crashed.
+func (s *Server) revert() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for name, section := range s.sections {
+		section.Clear()
+
+		if err := section.Flush(); err != nil {
+			s.logError(context.Background(), "failed to remove hosts section "+name, err)
+		}
+	}
+
+	for address := range s.aliases {
+		if err := system.UnaliasIP(context.Background(), address); err != nil {
+			s.logError(context.Background(), "failed to remove alias "+address, err)
+		}
+	}
+}
+
+func (s *Server) logError(ctx context.Context, msg string, err error) {
+	if s.options.Logger == nil {
+		return
+	}
+
+	s.options.Logger.ErrorContext(ctx, msg, "error", err)
+}
+
+// parseLoopback accepts IPv4 loopback addresses only; tunnels never listen
+// anywhere else.
+// loopbackRange holds the addresses connect hands out: the cluster
+// networks from 127.244.0.0/16 up and the resolver's 127.246.0.0/16.
+// Everything below, 127.0.0.1 included, belongs to someone else.
+var loopbackRange = [2]netip.Addr{
+	netip.MustParseAddr("127.244.0.0"),
+	netip.MustParseAddr("127.255.255.255"),
+}
+
+func parseLoopback(value string) (string, error) {
+	addr, err := netip.ParseAddr(value)
+
+	if err != nil || addr.Less(loopbackRange[0]) || loopbackRange[1].Less(addr) {
+		return "", fmt.Errorf("invalid loopback address %q", strings.TrimSpace(value))
+	}
+
+	return addr.String(), nil
+}
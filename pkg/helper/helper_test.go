@@ -0,0 +1,113 @@
+//go:build darwin || linux
+
+package helper
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHelperWritesOnlyLoopSections(t *testing.T) {
+	dir := t.TempDir()
+
+	hostsPath := filepath.Join(dir, "hosts")
+	os.WriteFile(hostsPath, []byte("127.0.0.1 localhost\n"), 0644)
+	t.Setenv("HOSTS_PATH", hostsPath)
+
+	socket := filepath.Join(dir, "helper.sock")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := New(ServerOptions{
+		Path: socket,
+		UID:  os.Getuid(),
+	})
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- server.Start(ctx)
+	}()
+
+	client := NewClient(socket)
+
+	for i := 0; client.Ping(ctx) != nil; i++ {
+		if i > 50 {
+			t.Fatal("helper did not start")
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	info, err := os.Stat(socket)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Fatalf("expected socket mode 0600, got %o", mode)
+	}
+
+	section := client.Section("Loop Catapult")
+	section.Add("127.244.0.1", "web.shop")
+
+	if err := section.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, _ := os.ReadFile(hostsPath); !strings.Contains(string(data), "127.244.0.1 web.shop") {
+		t.Fatalf("expected entry in hosts file, got %q", data)
+	}
+
+	other := client.Section("Docker")
+	other.Add("127.0.0.1", "registry")
+
+	if err := other.Flush(); err == nil {
+		t.Fatal("expected foreign section to be rejected")
+	}
+
+	remote := client.Section("Loop Catapult")
+	remote.Add("10.0.0.1", "web.shop")
+
+	if err := remote.Flush(); err == nil {
+		t.Fatal("expected non-loopback address to be rejected")
+	}
+
+	injected := client.Section("Loop Catapult")
+	injected.Add("127.244.0.1", "web.shop\n1.2.3.4 bank.example.com")
+
+	if err := injected.Flush(); err == nil {
+		t.Fatal("expected invalid host to be rejected")
+	}
+
+	cancel()
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if data, _ := os.ReadFile(hostsPath); strings.Contains(string(data), "web.shop") {
+		t.Fatalf("expected section removed on shutdown, got %q", data)
+	}
+}
+
+func TestParseLoopback(t *testing.T) {
+	for _, value := range []string{"127.244.0.1", "127.246.0.53", "127.255.255.255"} {
+		if _, err := parseLoopback(value); err != nil {
+			t.Errorf("want %s accepted, got %v", value, err)
+		}
+	}
+
+	// only what connect hands out; the rest of lo0 is not loop's to touch
+	for _, value := range []string{"127.0.0.1", "127.243.255.255", "10.0.0.1", "::1", "::ffff:127.244.0.1"} {
+		if _, err := parseLoopback(value); err == nil {
+			t.Errorf("want %s rejected", value)
+		}
+	}
+}
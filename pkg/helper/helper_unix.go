@@ -0,0 +1,133 @@
+//go:build darwin || linux
+
+package helper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// socketDir holds the helper sockets. It is owned by root and not writable
+// by anyone else, so no user can swap a socket for a symlink before it is
+// handed over, as they could in a shared temp directory.
+const socketDir = "/var/run/loop"
+
+func listen(path string, uid int) (net.Listener, error) {
+	if err := ensureSocketDir(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	// nobody but root may connect until the socket is handed to its user
+	mask := syscall.Umask(0177)
+	l, err := net.Listen("unix", path)
+	syscall.Umask(mask)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Lchown(path, uid, -1); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// ensureSocketDir creates dir if it is socketDir, and makes sure it is a
+// directory nobody but this process's user can write to.
+func ensureSocketDir(dir string) error {
+	if dir == socketDir {
+		if err := os.Mkdir(dir, 0755); err != nil && !errors.Is(err, os.ErrExist) {
+			return err
+		}
+	}
+
+	info, err := os.Lstat(dir)
+
+	if err != nil {
+		return err
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+
+	if !info.IsDir() || !ok || int(stat.Uid) != os.Geteuid() || info.Mode().Perm()&0022 != 0 {
+		return fmt.Errorf("%s must be a directory owned and only writable by uid %d", dir, os.Geteuid())
+	}
+
+	return nil
+}
+
+// Spawn starts the helper through sudo and returns a client once it is
+// listening. The helper outlives the calling process only as long as it
+// takes to revert its changes.
+func Spawn(ctx context.Context) (*Client, error) {
+	exe, err := os.Executable()
+
+	if err != nil {
+		return nil, err
+	}
+
+	// authenticate in the foreground, where sudo can prompt for a password
+	validate := exec.CommandContext(ctx, "sudo", "-v")
+	validate.Stdin = os.Stdin
+	validate.Stdout = os.Stdout
+	validate.Stderr = os.Stderr
+
+	if err := validate.Run(); err != nil {
+		return nil, fmt.Errorf("could not authenticate with sudo: %w", err)
+	}
+
+	path := filepath.Join(socketDir, fmt.Sprintf("helper-%d.sock", os.Getpid()))
+
+	cmd := exec.Command("sudo", "-n", exe, "helper",
+		"--socket", path,
+		"--uid", strconv.Itoa(os.Getuid()),
+		"--pid", strconv.Itoa(os.Getpid()),
+	)
+
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+
+	// Keep Ctrl+C away from the helper: the client still needs it to revert
+	// its changes while shutting down.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	client := NewClient(path)
+
+	for {
+		if err := client.Ping(ctx); err == nil {
+			return client, nil
+		}
+
+		select {
+		case err := <-done:
+			return nil, fmt.Errorf("helper exited: %v", err)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
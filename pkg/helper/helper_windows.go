@@ -0,0 +1,19 @@
+//go:build windows
+
+package helper
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+var errUnsupported = errors.New("the privileged helper is not supported on Windows, run as administrator instead")
+
+func listen(path string, uid int) (net.Listener, error) {
+	return nil, errUnsupported
+}
+
+func Spawn(ctx context.Context) (*Client, error) {
+	return nil, errUnsupported
+}
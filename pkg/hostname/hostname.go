@@ -0,0 +1,157 @@
+package hostname
+
+import (
+	"slices"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// Fields are what a template can refer to. Service and Namespace name a
+// service (or a bare pod), Host is an Ingress or Gateway API host, and
+// Cluster is the context name when several clusters are connected.
+//
+// Hostname names one endpoint of a headless service, e.g. db-0, or a pod by
+// its dashed IP, e.g. 10-0-0-5; Pod is the pod behind it, if any.
+type Fields struct {
+	Service   string
+	Namespace string
+	Cluster   string
+
+	Host string
+
+	Hostname string
+	Pod      string
+}
+
+// Names renders the names a resource is published under from Go templates,
+// e.g. "{{.Service}}.{{.Namespace}}.dev.internal", written without a
+// trailing dot. A nil Names renders nothing, so callers keep their default
+// names.
+type Names struct {
+	templates []*template.Template
+
+	// hostname tells the templates that refer to Hostname themselves
+	hostname []bool
+}
+
+// New parses the templates; it returns nil if there are none.
+func New(templates []string) (*Names, error) {
+	if len(templates) == 0 {
+		return nil, nil
+	}
+
+	n := &Names{}
+
+	for _, text := range templates {
+		t, err := template.New(text).Option("missingkey=error").Parse(text)
+
+		if err != nil {
+			return nil, err
+		}
+
+		// unknown fields only fail when the template runs
+		if err := t.Execute(&strings.Builder{}, Fields{}); err != nil {
+			return nil, err
+		}
+
+		n.templates = append(n.templates, t)
+		n.hostname = append(n.hostname, refers(t.Root, "Hostname"))
+	}
+
+	return n, nil
+}
+
+// Render returns the names for f, in template order and without duplicates,
+// and false if n is nil. Templates that fail or render something that is
+// not a name, e.g. because a field they use is empty, are skipped.
+//
+// With Hostname set, templates that do not refer to it name the endpoint
+// below what they render, the way cluster DNS does: a template for
+// orders.shop.dev.internal yields db-0.orders.shop.dev.internal.
+func (n *Names) Render(f Fields) ([]string, bool) {
+	if n == nil {
+		return nil, false
+	}
+
+	var names []string
+
+	for i, t := range n.templates {
+		var b strings.Builder
+
+		if err := t.Execute(&b, f); err != nil {
+			continue
+		}
+
+		name := strings.ToLower(strings.TrimSpace(b.String()))
+
+		if f.Hostname != "" && !n.hostname[i] {
+			name = strings.ToLower(f.Hostname) + "." + name
+		}
+
+		if !valid(name) || slices.Contains(names, name) {
+			continue
+		}
+
+		names = append(names, name)
+	}
+
+	return names, true
+}
+
+func valid(name string) bool {
+	if name == "" || strings.ContainsAny(name, " \t\r\n/") {
+		return false
+	}
+
+	// e.g. "-orders" from a template whose Hostname is empty
+	return !slices.ContainsFunc(strings.Split(name, "."), func(label string) bool {
+		return label == "" || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-")
+	})
+}
+
+// refers reports whether the template tree uses the field anywhere, e.g.
+// in {{.Hostname}} or {{if .Hostname}}.
+func refers(node parse.Node, field string) bool {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return false
+		}
+
+		return slices.ContainsFunc(n.Nodes, func(node parse.Node) bool {
+			return refers(node, field)
+		})
+
+	case *parse.ActionNode:
+		return refers(n.Pipe, field)
+
+	case *parse.PipeNode:
+		if n == nil {
+			return false
+		}
+
+		return slices.ContainsFunc(n.Cmds, func(c *parse.CommandNode) bool {
+			return refers(c, field)
+		})
+
+	case *parse.CommandNode:
+		return slices.ContainsFunc(n.Args, func(node parse.Node) bool {
+			return refers(node, field)
+		})
+
+	case *parse.FieldNode:
+		return slices.Contains(n.Ident, field)
+
+	case *parse.IfNode:
+		return refers(n.Pipe, field) || refers(n.List, field) || refers(n.ElseList, field)
+
+	case *parse.RangeNode:
+		return refers(n.Pipe, field) || refers(n.List, field) || refers(n.ElseList, field)
+
+	case *parse.WithNode:
+		return refers(n.Pipe, field) || refers(n.List, field) || refers(n.ElseList, field)
+	}
+
+	return false
+}
@@ -0,0 +1,58 @@
+package hostname
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestRender(t *testing.T) {
+	names, err := New([]string{
+		"{{.Service}}.{{.Namespace}}.dev.internal",
+		"{{.Service}}.{{.Cluster}}",
+		"{{.Service}}.{{.Namespace}}.DEV.internal",
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, ok := names.Render(Fields{Service: "orders", Namespace: "shop"})
+
+	// the cluster template renders "orders." without a cluster and the
+	// last one repeats the first
+	if want := []string{"orders.shop.dev.internal"}; !ok || !slices.Equal(got, want) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+}
+
+func TestNewRejectsUnknownFields(t *testing.T) {
+	if _, err := New([]string{"{{.Name}}.internal"}); err == nil {
+		t.Fatal("want an error for an unknown field")
+	}
+}
+
+func TestNilKeepsDefaults(t *testing.T) {
+	var names *Names
+
+	if _, ok := names.Render(Fields{Service: "orders"}); ok {
+		t.Fatal("want no names from a nil Names")
+	}
+}
+
+func TestRenderEndpoint(t *testing.T) {
+	names, err := New([]string{
+		"{{.Service}}.{{.Namespace}}.dev.internal",
+		"{{.Hostname}}-{{.Service}}.dev.internal",
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, _ := names.Render(Fields{Service: "db", Namespace: "shop", Hostname: "db-0"})
+
+	// templates without Hostname name the endpoint below the service
+	if want := []string{"db-0.db.shop.dev.internal", "db-0-db.dev.internal"}; !slices.Equal(got, want) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,259 @@
+package jump
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"sync"
+
+	"github.com/adrianliechti/loop/pkg/kubernetes"
+	"github.com/adrianliechti/loop/pkg/session"
+	"github.com/adrianliechti/loop/pkg/ssh"
+	"github.com/adrianliechti/loop/pkg/system"
+
+	"github.com/google/uuid"
+
+	cryptossh "golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	tunnelImage = "ghcr.io/adrianliechti/loop-tunnel"
+
+	// relayImage ships the loop binary, which the pod runs as the UDP relay
+	// from relayPath; see dialUDP.
+	relayImage = "ghcr.io/adrianliechti/loop"
+	relayPath  = "/opt/loop/loop"
+)
+
+// Pod is a loop-tunnel (sshd) pod used to open connections from inside the
+// cluster network: traffic leaves through the pod, so targets see cluster
+// egress and NetworkPolicies apply as for any workload in the namespace.
+// The pod is created on the first Dial and recreated if it goes away.
+type Pod struct {
+	client kubernetes.Client
+
+	namespace string
+	image     string
+
+	mu     sync.Mutex
+	name   string
+	conn   *cryptossh.Client
+	cancel context.CancelFunc
+}
+
+type PodOptions struct {
+	Namespace string
+	Image     string
+}
+
+func New(client kubernetes.Client, options PodOptions) *Pod {
+	if options.Namespace == "" {
+		options.Namespace = client.Namespace()
+	}
+
+	if options.Image == "" {
+		options.Image = tunnelImage
+	}
+
+	return &Pod{
+		client: client,
+
+		namespace: options.Namespace,
+		image:     options.Image,
+	}
+}
+
+// Dial opens a connection to addr from inside the pod. TCP goes through
+// SSH port forwarding, UDP through a relay process; see dialUDP.
+func (p *Pod) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := p.connect(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch network {
+	case "udp", "udp4", "udp6":
+		return dialUDP(conn, addr)
+	}
+
+	return conn.DialContext(ctx, network, addr)
+}
+
+// Close stops the SSH session and removes the pod.
+func (p *Pod) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.reset()
+}
+
+func (p *Pod) connect(ctx context.Context) (*cryptossh.Client, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conn != nil {
+		return p.conn, nil
+	}
+
+	// The pod outlives the dial that triggered it, so it runs on its own
+	// context and ends with Close.
+	runCtx, cancel := context.WithCancel(context.Background())
+
+	p.name = "loop-tunnel-" + uuid.NewString()[0:7]
+	p.cancel = cancel
+
+	conn, err := p.start(ctx, runCtx)
+
+	if err != nil {
+		p.reset()
+		return nil, err
+	}
+
+	p.conn = conn
+
+	go func() {
+		conn.Wait()
+
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		if p.conn == conn {
+			p.reset()
+		}
+	}()
+
+	return conn, nil
+}
+
+func (p *Pod) start(ctx, runCtx context.Context) (*cryptossh.Client, error) {
+	if err := createPod(ctx, p.client, p.namespace, p.name, p.image); err != nil {
+		return nil, err
+	}
+
+	if _, err := p.client.WaitForPod(ctx, p.namespace, p.name); err != nil {
+		return nil, err
+	}
+
+	sshPort, err := system.FreePort(0)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ready := make(chan struct{})
+	done := make(chan error, 1)
+
+	go func() {
+		done <- p.client.PodPortForward(runCtx, p.namespace, p.name, "127.0.0.1", map[int]int{sshPort: 22}, ready)
+	}()
+
+	select {
+	case <-ready:
+	case err := <-done:
+		if err == nil {
+			err = errors.New("port-forward closed")
+		}
+
+		return nil, err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	return ssh.Dial(runCtx, fmt.Sprintf("127.0.0.1:%d", sshPort))
+}
+
+// reset tears down the current pod; the caller holds p.mu.
+func (p *Pod) reset() error {
+	if p.cancel != nil {
+		p.cancel()
+		p.cancel = nil
+	}
+
+	p.conn = nil
+
+	if p.name == "" {
+		return nil
+	}
+
+	name := p.name
+	p.name = ""
+
+	return deletePod(context.Background(), p.client, p.namespace, name)
+}
+
+func createPod(ctx context.Context, client kubernetes.Client, namespace, name, image string) error {
+	labels := map[string]string{
+		"app.kubernetes.io/name":     "loop-tunnel",
+		"app.kubernetes.io/instance": name,
+	}
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: labels,
+		},
+
+		Spec: corev1.PodSpec{
+			InitContainers: []corev1.Container{
+				{
+					Name:  "relay",
+					Image: relayImage,
+
+					Command: []string{"cp", "/usr/local/bin/loop", relayPath},
+
+					VolumeMounts: []corev1.VolumeMount{
+						{Name: "loop", MountPath: path.Dir(relayPath)},
+					},
+				},
+			},
+
+			Containers: []corev1.Container{
+				{
+					Name:  "tunnel",
+					Image: image,
+
+					VolumeMounts: []corev1.VolumeMount{
+						{Name: "loop", MountPath: path.Dir(relayPath), ReadOnly: true},
+					},
+				},
+			},
+
+			Volumes: []corev1.Volume{
+				{
+					Name: "loop",
+
+					VolumeSource: corev1.VolumeSource{
+						EmptyDir: &corev1.EmptyDirVolumeSource{},
+					},
+				},
+			},
+		},
+	}
+
+	// journal the pod before creating it, so a crash in between cannot
+	// leak it; rollback of a pod that never got created is a no-op
+	resource := kubernetes.PodResource(client, namespace, name)
+	session.Record(resource)
+
+	if _, err := client.CoreV1().Pods(namespace).Create(ctx, pod, metav1.CreateOptions{}); err != nil {
+		session.Release(resource)
+		return err
+	}
+
+	return nil
+}
+
+func deletePod(ctx context.Context, client kubernetes.Client, namespace, name string) error {
+	if err := client.CoreV1().Pods(namespace).Delete(ctx, name, metav1.DeleteOptions{}); err != nil && !kubernetes.IsNotFound(err) {
+		return err
+	}
+
+	session.Release(kubernetes.PodResource(client, namespace, name))
+
+	return nil
+}
@@ -0,0 +1,257 @@
+package jump
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	cryptossh "golang.org/x/crypto/ssh"
+)
+
+// maxDatagram is the largest UDP payload; it also bounds a frame.
+const maxDatagram = 65535
+
+// dialUDP relays datagrams to addr through a process in the pod: SSH
+// forwards no UDP, so the session's stdio is bridged to a UDP socket by
+// the loop relay the pod carries. A byte stream merges and splits writes,
+// so each datagram travels as a frame with a length prefix: each write is
+// sent as one datagram and each datagram read back as one read, which
+// keeps request/response protocols such as DNS or StatsD intact.
+func dialUDP(conn *cryptossh.Client, addr string) (net.Conn, error) {
+	host, portValue, err := net.SplitHostPort(addr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ip := net.ParseIP(host)
+	port, err := strconv.Atoi(portValue)
+
+	// both end up in a shell command
+	if ip == nil || err != nil || port <= 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid UDP address %q", addr)
+	}
+
+	session, err := conn.NewSession()
+
+	if err != nil {
+		return nil, err
+	}
+
+	stdin, err := session.StdinPipe()
+
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	stdout, err := session.StdoutPipe()
+
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	remote := &net.UDPAddr{IP: ip, Port: port}
+
+	if err := session.Start(relayPath + " relay " + remote.String()); err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	return newUDPConn(stdin, stdout, session.Close, remote), nil
+}
+
+// Relay is the pod end of dialUDP: it sends each frame read from r as one
+// datagram to addr and writes each datagram that comes back to w as one
+// frame, until r ends or ctx is done.
+func Relay(ctx context.Context, r io.Reader, w io.Writer, addr string) error {
+	conn, err := net.Dial("udp", addr)
+
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+
+	result := make(chan error, 2)
+
+	go func() {
+		reader := bufio.NewReader(r)
+		buf := make([]byte, maxDatagram)
+
+		for {
+			n, err := readFrame(reader, buf)
+
+			if err != nil {
+				result <- err
+				return
+			}
+
+			if _, err := conn.Write(buf[:n]); err != nil {
+				result <- err
+				return
+			}
+		}
+	}()
+
+	go func() {
+		buf := make([]byte, maxDatagram)
+
+		for {
+			n, err := conn.Read(buf)
+
+			if err != nil {
+				result <- err
+				return
+			}
+
+			if err := writeFrame(w, buf[:n]); err != nil {
+				result <- err
+				return
+			}
+		}
+	}()
+
+	err = <-result
+
+	if errors.Is(err, io.EOF) || ctx.Err() != nil {
+		return nil
+	}
+
+	return err
+}
+
+// writeFrame writes p with its length in front, in a single write.
+func writeFrame(w io.Writer, p []byte) error {
+	if len(p) > maxDatagram {
+		return fmt.Errorf("datagram of %d bytes exceeds %d", len(p), maxDatagram)
+	}
+
+	frame := make([]byte, 2+len(p))
+	binary.BigEndian.PutUint16(frame, uint16(len(p)))
+	copy(frame[2:], p)
+
+	_, err := w.Write(frame)
+	return err
+}
+
+// readFrame reads the next frame into p. Like a UDP socket, it drops what
+// does not fit.
+func readFrame(r *bufio.Reader, p []byte) (int, error) {
+	var header [2]byte
+
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, err
+	}
+
+	size := int(binary.BigEndian.Uint16(header[:]))
+	n := min(size, len(p))
+
+	if _, err := io.ReadFull(r, p[:n]); err != nil {
+		return 0, unexpectedEOF(err)
+	}
+
+	if _, err := r.Discard(size - n); err != nil {
+		return 0, unexpectedEOF(err)
+	}
+
+	return n, nil
+}
+
+// unexpectedEOF reports a stream that ends inside a frame as truncated.
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
+
+// udpConn adapts the framed stdio of a relay session to net.Conn.
+type udpConn struct {
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+
+	close func() error
+
+	remote net.Addr
+
+	// a frame must be read and written whole
+	readMu  sync.Mutex
+	writeMu sync.Mutex
+
+	once sync.Once
+}
+
+func newUDPConn(stdin io.WriteCloser, stdout io.Reader, close func() error, remote net.Addr) *udpConn {
+	return &udpConn{
+		stdin:  stdin,
+		stdout: bufio.NewReader(stdout),
+
+		close: close,
+
+		remote: remote,
+	}
+}
+
+func (c *udpConn) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	return readFrame(c.stdout, p)
+}
+
+func (c *udpConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if err := writeFrame(c.stdin, p); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (c *udpConn) Close() error {
+	c.once.Do(func() {
+		c.stdin.Close()
+		c.close()
+	})
+
+	return nil
+}
+
+func (c *udpConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{}
+}
+
+func (c *udpConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *udpConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *udpConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *udpConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
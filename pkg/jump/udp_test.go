@@ -0,0 +1,86 @@
+package jump
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func TestRelayKeepsDatagrams(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer server.Close()
+
+	received := make(chan string, 4)
+
+	go func() {
+		buf := make([]byte, maxDatagram)
+
+		for {
+			n, addr, err := server.ReadFrom(buf)
+
+			if err != nil {
+				return
+			}
+
+			received <- string(buf[:n])
+			server.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	// the two writes reach the relay as one chunk, as a byte stream may
+	// deliver them
+	var sent bytes.Buffer
+
+	client := newUDPConn(nopWriteCloser{&sent}, nil, func() error { return nil }, server.LocalAddr())
+	client.Write([]byte("one"))
+	client.Write([]byte("two"))
+
+	stdin, keepOpen := io.Pipe()
+	defer keepOpen.Close()
+
+	replies, stdout := io.Pipe()
+
+	go Relay(t.Context(), io.MultiReader(&sent, stdin), stdout, server.LocalAddr().String())
+
+	for _, want := range []string{"one", "two"} {
+		select {
+		case got := <-received:
+			if got != want {
+				t.Fatalf("want datagram %q, got %q", want, got)
+			}
+
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for datagram %q", want)
+		}
+	}
+
+	client = newUDPConn(nopWriteCloser{io.Discard}, replies, func() error { return nil }, server.LocalAddr())
+
+	for _, want := range []string{"one", "two"} {
+		buf := make([]byte, maxDatagram)
+		n, err := client.Read(buf)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := string(buf[:n]); got != want {
+			t.Fatalf("want reply %q, got %q", want, got)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package kubernetes
 import (
 	"context"
 	"io"
+	"net"
 	"os"
 	"path/filepath"
 	"sort"
@@ -13,6 +14,7 @@ import (
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/metadata"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 
@@ -30,6 +32,10 @@ type Client interface {
 	GatewayV1() gatewayv1.GatewayV1Interface
 	ApiextensionsV1() apiextensionsv1.ApiextensionsV1Interface
 
+	// Metadata reads objects as metav1.PartialObjectMetadata, without spec
+	// or status.
+	Metadata() metadata.Interface
+
 	Config() *rest.Config
 
 	Namespace() string
@@ -41,8 +47,8 @@ type Client interface {
 	ApplyFile(ctx context.Context, namespace string, path string) error
 	ApplyURL(ctx context.Context, namespace string, url string) error
 
-	PodCIDR(ctx context.Context) (string, error)
-	ServiceCIDR(ctx context.Context) (string, error)
+	PodCIDRs(ctx context.Context) ([]string, error)
+	ServiceCIDRs(ctx context.Context) ([]string, error)
 
 	ServicePods(ctx context.Context, namespace, name string) ([]corev1.Pod, error)
 	ServicePod(ctx context.Context, namespace, name string) (*corev1.Pod, error)
@@ -53,6 +59,7 @@ type Client interface {
 	PodAttach(ctx context.Context, namespace, name, container string, tty bool, stdin io.Reader, stdout, stderr io.Writer) error
 	PodLogs(ctx context.Context, namespace, name, container string, out io.Writer, follow bool) error
 	PodPortForward(ctx context.Context, namespace, name, address string, ports map[int]int, readyChan chan struct{}) error
+	PodDial(ctx context.Context, namespace, name, network string, port int) (net.Conn, error)
 
 	WaitForPod(ctx context.Context, namespace, name string) (*corev1.Pod, error)
 	WaitForService(ctx context.Context, namespace, name string) (*corev1.Service, error)
@@ -109,7 +116,19 @@ func NewFromBytes(kubeconfig []byte, context string) (Client, error) {
 		namespace = "default"
 	}
 
-	return NewFromConfig(restConfig, namespace)
+	c, err := NewFromConfig(restConfig, namespace)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if context == "" {
+		context = raw.CurrentContext
+	}
+
+	c.(*client).context = context
+
+	return c, nil
 }
 
 func NewFromConfig(config *rest.Config, namespace string) (Client, error) {
@@ -125,6 +144,12 @@ func NewFromConfig(config *rest.Config, namespace string) (Client, error) {
 		return nil, err
 	}
 
+	mc, err := metadata.NewForConfig(config)
+
+	if err != nil {
+		return nil, err
+	}
+
 	gc, err := gateway.NewForConfig(config)
 
 	if err != nil {
@@ -143,9 +168,12 @@ func NewFromConfig(config *rest.Config, namespace string) (Client, error) {
 
 		Interface: c,
 		dynamic:   dc,
+		metadata:  mc,
 
 		gateway:       gc,
 		apiextensions: ec,
+
+		streams: new(streamPool),
 	}
 
 	return client, nil
@@ -194,11 +222,18 @@ type client struct {
 	config    *rest.Config
 	namespace string
 
+	// context records where the client came from, so cleanup of a crashed
+	// session can reach the same cluster again.
+	context string
+
 	kubernetes.Interface
-	dynamic dynamic.Interface
+	dynamic  dynamic.Interface
+	metadata metadata.Interface
 
 	gateway       gateway.Interface
 	apiextensions apiextensions.Interface
+
+	streams *streamPool
 }
 
 func ConfigPath() string {
@@ -227,6 +262,10 @@ func (c *client) Resource(resource schema.GroupVersionResource) dynamic.Namespac
 	return c.dynamic.Resource(resource)
 }
 
+func (c *client) Metadata() metadata.Interface {
+	return c.metadata
+}
+
 func (c client) GatewayV1() gatewayv1.GatewayV1Interface {
 	return c.gateway.GatewayV1()
 }
@@ -0,0 +1,281 @@
+package kubernetes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/client-go/tools/portforward"
+)
+
+// PodDial opens a connection to port on the pod's loopback. Connections are
+// carried as streams over one port-forward connection per pod, shared by
+// every dial to that pod. The port-forward protocol only carries TCP.
+func (c *client) PodDial(ctx context.Context, namespace, name, network string, port int) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		return c.dialStream(ctx, namespace, name, port)
+	}
+
+	return nil, fmt.Errorf("unsupported network %q", network)
+}
+
+// streamDialTimeout bounds how long a dial waits for the port-forward
+// connection to a pod; the dialer itself takes no context.
+const streamDialTimeout = 30 * time.Second
+
+type streamPool struct {
+	mu      sync.Mutex
+	conns   map[string]httpstream.Connection
+	pending map[string]*pendingConnection
+
+	requestID atomic.Int64
+}
+
+// pendingConnection is a port-forward connection being dialed; concurrent
+// dials to the same pod wait for it instead of dialing their own.
+type pendingConnection struct {
+	done chan struct{}
+
+	conn httpstream.Connection
+	err  error
+}
+
+// streamConnection returns the shared port-forward connection to a pod,
+// dialing it if needed. The dial runs outside the pool lock, so a slow or
+// unreachable pod only holds up dials to that pod.
+func (c *client) streamConnection(ctx context.Context, namespace, name string) (httpstream.Connection, error) {
+	key := namespace + "/" + name
+
+	c.streams.mu.Lock()
+
+	if conn, ok := c.streams.conns[key]; ok {
+		c.streams.mu.Unlock()
+		return conn, nil
+	}
+
+	p, ok := c.streams.pending[key]
+
+	if !ok {
+		p = &pendingConnection{done: make(chan struct{})}
+
+		if c.streams.pending == nil {
+			c.streams.pending = make(map[string]*pendingConnection)
+		}
+
+		c.streams.pending[key] = p
+
+		go c.dialConnection(key, namespace, name, p)
+	}
+
+	c.streams.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, streamDialTimeout)
+	defer cancel()
+
+	select {
+	case <-p.done:
+		return p.conn, p.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *client) dialConnection(key, namespace, name string, p *pendingConnection) {
+	defer close(p.done)
+
+	var conn httpstream.Connection
+
+	dialer, err := c.createDialer(namespace, name)
+
+	if err == nil {
+		conn, _, err = dialer.Dial(portforward.PortForwardProtocolV1Name)
+	}
+
+	c.streams.mu.Lock()
+	defer c.streams.mu.Unlock()
+
+	delete(c.streams.pending, key)
+
+	if err != nil {
+		p.err = err
+		return
+	}
+
+	if c.streams.conns == nil {
+		c.streams.conns = make(map[string]httpstream.Connection)
+	}
+
+	c.streams.conns[key] = conn
+	p.conn = conn
+
+	// The connection dies with the pod (or the API server), so forget it
+	// and let the next dial reconnect.
+	go func() {
+		<-conn.CloseChan()
+
+		c.streams.mu.Lock()
+		defer c.streams.mu.Unlock()
+
+		if c.streams.conns[key] == conn {
+			delete(c.streams.conns, key)
+		}
+	}()
+}
+
+func (c *client) dialStream(ctx context.Context, namespace, name string, port int) (net.Conn, error) {
+	conn, err := c.streamConnection(ctx, namespace, name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	requestID := c.streams.requestID.Add(1)
+
+	headers := http.Header{}
+	headers.Set(corev1.StreamType, corev1.StreamTypeError)
+	headers.Set(corev1.PortHeader, strconv.Itoa(port))
+	headers.Set(corev1.PortForwardRequestIDHeader, strconv.FormatInt(requestID, 10))
+
+	// The connection is shared with other dials; on failure only the streams
+	// created here are dropped. A dead connection is forgotten once closed.
+	errorStream, err := conn.CreateStream(headers)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// we're not writing to this stream
+	errorStream.Close()
+
+	headers.Set(corev1.StreamType, corev1.StreamTypeData)
+
+	dataStream, err := conn.CreateStream(headers)
+
+	if err != nil {
+		conn.RemoveStreams(errorStream)
+		return nil, err
+	}
+
+	s := &streamConn{
+		conn: conn,
+
+		data:  dataStream,
+		error: errorStream,
+
+		remote: &podAddr{network: "tcp", pod: namespace + "/" + name, port: port},
+
+		done: make(chan struct{}),
+	}
+
+	go func() {
+		message, err := io.ReadAll(errorStream)
+
+		switch {
+		case err != nil:
+			s.err = err
+		case len(message) > 0:
+			s.err = errors.New(string(message))
+		}
+
+		close(s.done)
+	}()
+
+	return s, nil
+}
+
+// streamConn adapts a port-forward data stream to net.Conn.
+type streamConn struct {
+	conn httpstream.Connection
+
+	data  httpstream.Stream
+	error httpstream.Stream
+
+	remote net.Addr
+
+	once sync.Once
+	done chan struct{}
+	err  error
+}
+
+func (s *streamConn) Read(p []byte) (int, error) {
+	n, err := s.data.Read(p)
+
+	if err != nil {
+		// Prefer the kubelet's reason (e.g. connection refused in the pod)
+		// over a bare EOF.
+		select {
+		case <-s.done:
+			if s.err != nil {
+				return n, s.err
+			}
+		default:
+		}
+	}
+
+	return n, err
+}
+
+func (s *streamConn) Write(p []byte) (int, error) {
+	return s.data.Write(p)
+}
+
+// CloseWrite signals the pod that no more data will be sent.
+func (s *streamConn) CloseWrite() error {
+	return s.data.Close()
+}
+
+func (s *streamConn) Close() error {
+	s.once.Do(func() {
+		s.data.Close()
+		s.data.Reset()
+
+		s.conn.RemoveStreams(s.data, s.error)
+	})
+
+	return nil
+}
+
+func (s *streamConn) LocalAddr() net.Addr {
+	return &podAddr{network: "tcp"}
+}
+
+func (s *streamConn) RemoteAddr() net.Addr {
+	return s.remote
+}
+
+func (s *streamConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (s *streamConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (s *streamConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+type podAddr struct {
+	network string
+
+	pod  string
+	port int
+}
+
+func (a *podAddr) Network() string {
+	return a.network
+}
+
+func (a *podAddr) String() string {
+	return net.JoinHostPort(a.pod, strconv.Itoa(a.port))
+}
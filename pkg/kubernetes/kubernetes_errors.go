@@ -15,3 +15,7 @@ func IsAlreadyExists(err error) bool {
 func IsConflict(err error) bool {
 	return errors.IsConflict(err)
 }
+
+func IsForbidden(err error) bool {
+	return errors.IsForbidden(err)
+}
@@ -3,8 +3,9 @@ package kubernetes
 import (
 	"context"
 	"errors"
-	"net"
+	"net/netip"
 	"regexp"
+	"slices"
 
 	"github.com/Masterminds/semver/v3"
 
@@ -22,40 +23,110 @@ func (c *client) Version(ctx context.Context) (*semver.Version, error) {
 	return semver.NewVersion(version.GitVersion)
 }
 
-func (c *client) PodCIDR(ctx context.Context) (string, error) {
+// PodCIDRs returns the pod ranges assigned to the nodes, of both families
+// on dual-stack clusters. CNIs that manage addresses themselves, like most
+// cloud VPC plugins, leave them unset.
+func (c *client) PodCIDRs(ctx context.Context) ([]string, error) {
 	nodes, err := c.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
 
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	if len(nodes.Items) == 0 {
-		return "", errors.New("no nodes found")
+		return nil, errors.New("no nodes found")
 	}
 
-	node := nodes.Items[0]
-	cidr := node.Spec.PodCIDR
+	var result []string
 
-	addr, _, err := net.ParseCIDR(cidr)
+	for _, node := range nodes.Items {
+		cidrs := node.Spec.PodCIDRs
 
-	if err != nil {
-		return "", err
+		if len(cidrs) == 0 && node.Spec.PodCIDR != "" {
+			cidrs = []string{node.Spec.PodCIDR}
+		}
+
+		for _, cidr := range cidrs {
+			prefix, err := netip.ParsePrefix(cidr)
+
+			if err != nil {
+				return nil, err
+			}
+
+			if !slices.Contains(result, prefix.Masked().String()) {
+				result = append(result, prefix.Masked().String())
+			}
+		}
 	}
 
-	if addr.To4() == nil {
-		return "", errors.New("IPv6 not supported")
+	if len(result) == 0 {
+		return nil, errors.New("nodes have no pod CIDR assigned")
 	}
 
-	return cidr, nil
+	return result, nil
 }
 
-func (c *client) ServiceCIDR(ctx context.Context) (string, error) {
+// ServiceCIDRs returns the ranges ClusterIPs are allocated from. They are
+// read from the ServiceCIDR API where it is served, and otherwise probed
+// per family with a dry-run service the API server rejects, naming the
+// valid range.
+func (c *client) ServiceCIDRs(ctx context.Context) ([]string, error) {
+	if list, err := c.NetworkingV1().ServiceCIDRs().List(ctx, metav1.ListOptions{}); err == nil {
+		var result []string
+
+		for _, s := range list.Items {
+			for _, cidr := range s.Spec.CIDRs {
+				if !slices.Contains(result, cidr) {
+					result = append(result, cidr)
+				}
+			}
+		}
+
+		if len(result) > 0 {
+			return result, nil
+		}
+	}
+
+	var result []string
+
+	for _, probe := range []struct {
+		family    corev1.IPFamily
+		clusterIP string
+	}{
+		{corev1.IPv4Protocol, "1.1.1.1"},
+		{corev1.IPv6Protocol, "::1"},
+	} {
+		cidr, err := c.probeServiceCIDR(ctx, probe.family, probe.clusterIP)
+
+		if err != nil {
+			continue
+		}
+
+		result = append(result, cidr)
+	}
+
+	if len(result) == 0 {
+		return nil, errors.New("unable to determine Service CIDR")
+	}
+
+	return result, nil
+}
+
+var serviceCIDRPattern = regexp.MustCompile(`valid IPs is ([0-9a-fA-F.:/]+)`)
+
+func (c *client) probeServiceCIDR(ctx context.Context, family corev1.IPFamily, clusterIP string) (string, error) {
+	policy := corev1.IPFamilyPolicySingleStack
+
 	_, err := c.CoreV1().Services("default").Create(ctx, &corev1.Service{
 		ObjectMeta: metav1.ObjectMeta{
 			Name: "dummy",
 		},
 		Spec: corev1.ServiceSpec{
-			ClusterIP: "1.1.1.1",
+			ClusterIP: clusterIP,
+
+			IPFamilies:     []corev1.IPFamily{family},
+			IPFamilyPolicy: &policy,
+
 			Ports: []corev1.ServicePort{
 				{
 					Port: 80,
@@ -70,24 +141,17 @@ func (c *client) ServiceCIDR(ctx context.Context) (string, error) {
 		return "", errors.New("unable to determine Service CIDR")
 	}
 
-	r, _ := regexp.Compile(`valid IPs is ([.\/0-9]+)`)
-	matches := r.FindStringSubmatch(err.Error())
+	matches := serviceCIDRPattern.FindStringSubmatch(err.Error())
 
 	if len(matches) != 2 {
 		return "", errors.New("unable to determine Service CIDR")
 	}
 
-	cidr := matches[1]
-
-	addr, _, err := net.ParseCIDR(cidr)
+	prefix, err := netip.ParsePrefix(matches[1])
 
 	if err != nil {
 		return "", err
 	}
 
-	if addr.To4() == nil {
-		return "", errors.New("IPv6 not supported")
-	}
-
-	return cidr, nil
+	return prefix.Masked().String(), nil
 }
@@ -0,0 +1,84 @@
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/adrianliechti/loop/pkg/session"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func init() {
+	session.Register("pod", rollbackPod)
+}
+
+// PodResource describes a pod created by loop for the session journal,
+// including the context needed to delete it later.
+func PodResource(c Client, namespace, name string) session.Resource {
+	return NewResource(c, "pod", namespace, name)
+}
+
+// NewResource describes a change to a cluster resource for the session
+// journal, along with which cluster it was made in; see ResourceClient.
+func NewResource(c Client, kind, namespace, name string) session.Resource {
+	attributes := map[string]string{
+		"server": c.Config().Host,
+	}
+
+	if c, ok := c.(*client); ok {
+		attributes["context"] = c.context
+	}
+
+	return session.Resource{
+		Kind: kind,
+
+		Namespace: namespace,
+		Name:      name,
+
+		Attributes: attributes,
+	}
+}
+
+type kubeconfigKey struct{}
+
+// WithKubeconfig sets the kubeconfig ResourceClient reads instead of the
+// default one, e.g. from the --kubeconfig flag of `loop cleanup`.
+func WithKubeconfig(ctx context.Context, path string) context.Context {
+	return context.WithValue(ctx, kubeconfigKey{}, path)
+}
+
+// ResourceClient connects to the cluster a journaled resource was changed
+// in. The journal only names the context; credentials come from the
+// caller's own kubeconfig, and a context that points at another cluster by
+// now is refused.
+func ResourceClient(ctx context.Context, r session.Resource) (Client, error) {
+	kubeconfig, _ := ctx.Value(kubeconfigKey{}).(string)
+
+	c, err := NewFromFile(kubeconfig, r.Attributes["context"])
+
+	if err != nil {
+		return nil, err
+	}
+
+	// the context may point elsewhere by now; never change another cluster
+	if server := r.Attributes["server"]; server != "" && c.Config().Host != server {
+		return nil, fmt.Errorf("context %q no longer points at %s", r.Attributes["context"], server)
+	}
+
+	return c, nil
+}
+
+func rollbackPod(ctx context.Context, r session.Resource) error {
+	c, err := ResourceClient(ctx, r)
+
+	if err != nil {
+		return err
+	}
+
+	if err := c.CoreV1().Pods(r.Namespace).Delete(ctx, r.Name, metav1.DeleteOptions{}); err != nil && !IsNotFound(err) {
+		return err
+	}
+
+	return nil
+}
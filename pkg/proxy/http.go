@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+
+	"github.com/adrianliechti/loop/pkg/forward"
+)
+
+// ServeHTTP tunnels CONNECT requests and forwards plain requests in
+// absolute form, as curl sends them for http:// URLs.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		s.serveConnect(w, r)
+		return
+	}
+
+	if !r.URL.IsAbs() || r.URL.Scheme != "http" {
+		http.Error(w, "this is a proxy, requests need an absolute http:// URL", http.StatusBadRequest)
+		return
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Transport: s.transport,
+
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.Host = pr.In.Host
+		},
+
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			s.logError(r.Context(), "failed to forward", r.URL.Hostname(), urlPort(r), err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+		},
+	}
+
+	proxy.ServeHTTP(w, r)
+}
+
+func (s *Server) serveConnect(w http.ResponseWriter, r *http.Request) {
+	host, value, err := net.SplitHostPort(r.Host)
+
+	if err != nil {
+		host, value = r.Host, "443"
+	}
+
+	port, err := strconv.Atoi(value)
+
+	if err != nil {
+		http.Error(w, "invalid port", http.StatusBadRequest)
+		return
+	}
+
+	upstream, err := s.dial(r.Context(), host, port)
+
+	if err != nil {
+		s.logError(r.Context(), "failed to dial", host, port, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+
+		return
+	}
+
+	defer upstream.Close()
+
+	conn, rw, err := http.NewResponseController(w).Hijack()
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		return
+	}
+
+	// keep whatever the client sent ahead of the response
+	forward.Pipe(&bufferedConn{Conn: conn, r: rw.Reader}, upstream)
+}
+
+// urlPort returns the port of a request URL, defaulting to the scheme's.
+func urlPort(r *http.Request) int {
+	if port, err := strconv.Atoi(r.URL.Port()); err == nil {
+		return port
+	}
+
+	return 80
+}
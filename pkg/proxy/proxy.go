@@ -0,0 +1,231 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/adrianliechti/loop/pkg/forward"
+)
+
+// DefaultAddress is where the proxy listens unless told otherwise, the
+// conventional SOCKS port.
+const DefaultAddress = "127.0.0.1:1080"
+
+// Resolver maps a host and port to a dialer into the cluster. It returns
+// nil for hosts it does not know.
+type Resolver interface {
+	Lookup(host string, port int) forward.DialFunc
+}
+
+// Server is a SOCKS5 and HTTP proxy on a single port that dials cluster
+// names through the resolvers and everything else directly, so it can stay
+// configured for all traffic of a browser.
+type Server struct {
+	options ServerOptions
+
+	transport *http.Transport
+}
+
+type ServerOptions struct {
+	Address string
+
+	// Resolvers are asked in order for every connection.
+	Resolvers []Resolver
+
+	Logger *slog.Logger
+}
+
+func New(options ServerOptions) *Server {
+	if options.Address == "" {
+		options.Address = DefaultAddress
+	}
+
+	s := &Server{
+		options: options,
+	}
+
+	s.transport = &http.Transport{
+		DialContext: s.dialContext,
+	}
+
+	return s
+}
+
+// Start listens on the configured address and serves until ctx is
+// cancelled.
+func (s *Server) Start(ctx context.Context) error {
+	l, err := net.Listen("tcp", s.options.Address)
+
+	if err != nil {
+		return err
+	}
+
+	if s.options.Logger != nil {
+		s.options.Logger.InfoContext(ctx, "proxy listening", "address", l.Addr().String())
+	}
+
+	return s.Serve(ctx, l)
+}
+
+// Serve accepts connections on l. Both protocols share the port: SOCKS5
+// clients open with the version byte, anything else is handed to the HTTP
+// server.
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	httpListener := newConnListener(l.Addr())
+
+	server := &http.Server{
+		Handler: s,
+	}
+
+	go server.Serve(httpListener)
+
+	go func() {
+		<-ctx.Done()
+
+		l.Close()
+		server.Close()
+		s.transport.CloseIdleConnections()
+	}()
+
+	for {
+		conn, err := l.Accept()
+
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+
+			return err
+		}
+
+		go func() {
+			r := bufio.NewReader(conn)
+
+			b, err := r.Peek(1)
+
+			if err != nil {
+				conn.Close()
+				return
+			}
+
+			c := &bufferedConn{Conn: conn, r: r}
+
+			if b[0] == socksVersion {
+				s.serveSOCKS(ctx, c)
+				return
+			}
+
+			httpListener.push(c)
+		}()
+	}
+}
+
+// dial connects to host:port through the first resolver that knows host,
+// or directly if none does.
+func (s *Server) dial(ctx context.Context, host string, port int) (net.Conn, error) {
+	for _, r := range s.options.Resolvers {
+		if dial := r.Lookup(host, port); dial != nil {
+			return dial(ctx)
+		}
+	}
+
+	var d net.Dialer
+
+	return d.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+}
+
+func (s *Server) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, value, err := net.SplitHostPort(addr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := strconv.Atoi(value)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s.dial(ctx, host, port)
+}
+
+func (s *Server) logError(ctx context.Context, msg, host string, port int, err error) {
+	if s.options.Logger == nil {
+		return
+	}
+
+	s.options.Logger.WarnContext(ctx, msg, "host", host, "port", port, "error", err)
+}
+
+// bufferedConn returns the bytes peeked while detecting the protocol before
+// reading from the connection again.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+
+	return nil
+}
+
+// connListener feeds connections accepted elsewhere to an http.Server.
+type connListener struct {
+	addr  net.Addr
+	conns chan net.Conn
+
+	once sync.Once
+	done chan struct{}
+}
+
+func newConnListener(addr net.Addr) *connListener {
+	return &connListener{
+		addr:  addr,
+		conns: make(chan net.Conn),
+
+		done: make(chan struct{}),
+	}
+}
+
+func (l *connListener) push(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+	})
+
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/adrianliechti/loop/pkg/forward"
+
+	xproxy "golang.org/x/net/proxy"
+)
+
+// resolver sends a single cluster name to a local test server.
+type resolver struct {
+	host   string
+	target string
+}
+
+func (r resolver) Lookup(host string, port int) forward.DialFunc {
+	if host != r.host {
+		return nil
+	}
+
+	return func(ctx context.Context) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", r.target)
+	}
+}
+
+func startProxy(t *testing.T, target string) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	s := New(ServerOptions{
+		Resolvers: []Resolver{
+			resolver{host: "web.shop", target: target},
+		},
+	})
+
+	go s.Serve(ctx, l)
+
+	return l.Addr().String()
+}
+
+func startBackend(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello from %s", r.Host)
+	}))
+
+	t.Cleanup(backend.Close)
+
+	return backend
+}
+
+func TestSOCKSDialsClusterNames(t *testing.T) {
+	backend := startBackend(t)
+	addr := startProxy(t, backend.Listener.Addr().String())
+
+	dialer, err := xproxy.SOCKS5("tcp", addr, nil, xproxy.Direct)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: dialer.(xproxy.ContextDialer).DialContext,
+		},
+	}
+
+	assertBody(t, client, "http://web.shop/", "hello from web.shop")
+}
+
+func TestHTTPProxiesClusterNames(t *testing.T) {
+	backend := startBackend(t)
+	addr := startProxy(t, backend.Listener.Addr().String())
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: addr}),
+		},
+	}
+
+	assertBody(t, client, "http://web.shop/", "hello from web.shop")
+}
+
+func TestConnectFallsBackToDirect(t *testing.T) {
+	backend := startBackend(t)
+	addr := startProxy(t, "127.0.0.1:1")
+
+	conn, err := net.Dial("tcp", addr)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	target := backend.Listener.Addr().String()
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\nGET / HTTP/1.1\r\nHost: direct\r\nConnection: close\r\n\r\n", target, target)
+
+	data, err := io.ReadAll(conn)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := "hello from direct"; !strings.Contains(string(data), want) {
+		t.Fatalf("expected %q in response, got %q", want, data)
+	}
+}
+
+func assertBody(t *testing.T, client *http.Client, url, want string) {
+	t.Helper()
+
+	resp, err := client.Get(url)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+
+	if string(body) != want {
+		t.Fatalf("expected %q, got %q", want, body)
+	}
+}
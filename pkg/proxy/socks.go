@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/adrianliechti/loop/pkg/forward"
+)
+
+// SOCKS5 as of RFC 1928, without authentication and limited to CONNECT.
+const (
+	socksVersion = 0x05
+
+	socksNoAuth       = 0x00
+	socksNoAcceptable = 0xff
+
+	socksConnect = 0x01
+
+	socksIPv4   = 0x01
+	socksDomain = 0x03
+	socksIPv6   = 0x04
+
+	socksSucceeded           = 0x00
+	socksHostUnreachable     = 0x04
+	socksCommandNotSupported = 0x07
+	socksAddressNotSupported = 0x08
+)
+
+// handshakeTimeout bounds how long a client may take to name its target.
+const handshakeTimeout = 30 * time.Second
+
+func (s *Server) serveSOCKS(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+
+	host, port, err := socksHandshake(conn)
+
+	if err != nil {
+		return
+	}
+
+	upstream, err := s.dial(ctx, host, port)
+
+	if err != nil {
+		s.logError(ctx, "failed to dial", host, port, err)
+		writeSOCKSReply(conn, socksHostUnreachable)
+
+		return
+	}
+
+	defer upstream.Close()
+
+	if err := writeSOCKSReply(conn, socksSucceeded); err != nil {
+		return
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	forward.Pipe(conn, upstream)
+}
+
+// socksHandshake negotiates the method and reads the CONNECT request,
+// returning the requested host and port.
+func socksHandshake(conn net.Conn) (string, int, error) {
+	header := make([]byte, 2)
+
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", 0, err
+	}
+
+	methods := make([]byte, header[1])
+
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", 0, err
+	}
+
+	if header[0] != socksVersion || !slices.Contains(methods, socksNoAuth) {
+		conn.Write([]byte{socksVersion, socksNoAcceptable})
+		return "", 0, errors.New("no acceptable authentication method")
+	}
+
+	if _, err := conn.Write([]byte{socksVersion, socksNoAuth}); err != nil {
+		return "", 0, err
+	}
+
+	request := make([]byte, 4)
+
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return "", 0, err
+	}
+
+	if request[1] != socksConnect {
+		writeSOCKSReply(conn, socksCommandNotSupported)
+		return "", 0, fmt.Errorf("unsupported command %d", request[1])
+	}
+
+	var host string
+
+	switch request[3] {
+	case socksIPv4, socksIPv6:
+		size := net.IPv4len
+
+		if request[3] == socksIPv6 {
+			size = net.IPv6len
+		}
+
+		ip := make(net.IP, size)
+
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", 0, err
+		}
+
+		host = ip.String()
+
+	case socksDomain:
+		size := make([]byte, 1)
+
+		if _, err := io.ReadFull(conn, size); err != nil {
+			return "", 0, err
+		}
+
+		name := make([]byte, size[0])
+
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return "", 0, err
+		}
+
+		host = string(name)
+
+	default:
+		writeSOCKSReply(conn, socksAddressNotSupported)
+		return "", 0, fmt.Errorf("unsupported address type %d", request[3])
+	}
+
+	port := make([]byte, 2)
+
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", 0, err
+	}
+
+	return host, int(binary.BigEndian.Uint16(port)), nil
+}
+
+// writeSOCKSReply answers a request; the bound address is left empty since
+// clients of a CONNECT do not need it.
+func writeSOCKSReply(conn net.Conn, code byte) error {
+	_, err := conn.Write([]byte{socksVersion, code, 0x00, socksIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
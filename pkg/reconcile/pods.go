@@ -0,0 +1,112 @@
+package reconcile
+
+import (
+	"context"
+	"sync"
+
+	"github.com/adrianliechti/loop/pkg/kubernetes"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+// WatchPods lists the pods of a namespace into pods, guarded by mu, and
+// keeps them current from an informer until ctx is done. changed is called
+// outside the lock after every event, with a nil old pod for additions and
+// a nil pod for deletions. The error of the initial list is returned, so
+// callers can detect namespaces they may not list.
+func WatchPods(ctx context.Context, client kubernetes.Client, namespace string, mu *sync.Mutex, pods map[string]corev1.Pod, changed func(old, pod *corev1.Pod)) error {
+	list, err := client.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{})
+
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	for _, p := range list.Items {
+		pods[ResourceKey(&p)] = p
+	}
+	mu.Unlock()
+
+	handlers := cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			p := obj.(*corev1.Pod)
+			mu.Lock()
+			pods[ResourceKey(p)] = *p
+			mu.Unlock()
+
+			changed(nil, p)
+		},
+
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			p := newObj.(*corev1.Pod)
+			mu.Lock()
+			pods[ResourceKey(p)] = *p
+			mu.Unlock()
+
+			old, _ := oldObj.(*corev1.Pod)
+			changed(old, p)
+		},
+
+		DeleteFunc: func(obj interface{}) {
+			// a missed deletion arrives as a tombstone
+			if t, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = t.Obj
+			}
+
+			p, ok := obj.(*corev1.Pod)
+
+			if !ok {
+				return
+			}
+
+			mu.Lock()
+			delete(pods, ResourceKey(p))
+			mu.Unlock()
+
+			changed(p, nil)
+		},
+	}
+
+	watcher := cache.ToListWatcherWithWatchListSemantics(&cache.ListWatch{
+		ListWithContextFunc: func(ctx context.Context, options metav1.ListOptions) (runtime.Object, error) {
+			return client.CoreV1().Pods(namespace).List(ctx, options)
+		},
+
+		WatchFuncWithContext: func(ctx context.Context, options metav1.ListOptions) (watch.Interface, error) {
+			return client.CoreV1().Pods(namespace).Watch(ctx, options)
+		},
+	}, client)
+
+	_, controller := cache.NewInformer(watcher, &corev1.Pod{}, 0, handlers)
+	go controller.Run(ctx.Done())
+
+	return nil
+}
+
+// ServicePorts maps the service ports of the given protocol to the target
+// ports that resolve returns for them. Ports resolve cannot place, i.e.
+// for which it returns zero, are left out.
+func ServicePorts(service corev1.Service, protocol corev1.Protocol, resolve func(port corev1.ServicePort) int) map[int]int {
+	ports := make(map[int]int)
+
+	for _, port := range service.Spec.Ports {
+		// An unset protocol defaults to TCP, as the API server does.
+		if port.Protocol == "" {
+			port.Protocol = corev1.ProtocolTCP
+		}
+
+		if port.Protocol != protocol || port.Port <= 0 {
+			continue
+		}
+
+		if target := resolve(port); target > 0 {
+			ports[int(port.Port)] = target
+		}
+	}
+
+	return ports
+}
@@ -0,0 +1,276 @@
+// Package reconcile keeps the running tunnels of a discovery component, such
+// as the catapult or the gateway, in line with the tunnels its resources
+// describe, and publishes their names as they come and go.
+package reconcile
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/adrianliechti/loop/pkg/system"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// debounceDelay is how long a refresh waits for related events to arrive.
+	debounceDelay = 250 * time.Millisecond
+
+	// resyncInterval is the fallback refresh in case an event was missed;
+	// changes normally apply within a second through the informers.
+	resyncInterval = 5 * time.Minute
+
+	// retryDelay and maxRetryDelay bound the backoff after a failed refresh,
+	// e.g. when a port was still in use, so such tunnels come up soon
+	// without waiting for an unrelated event.
+	retryDelay    = time.Second
+	maxRetryDelay = 30 * time.Second
+)
+
+// Tunnel is a local address forwarding into the cluster. A desired tunnel
+// that is Equivalent to a running one replaces only its endpoints, through
+// Update, so established connections survive endpoint changes.
+type Tunnel[T any] interface {
+	Address() string
+	Hosts() []string
+	Records() []system.SRV
+	Ports() []int
+
+	Equivalent(o T) bool
+	Update(o T)
+
+	Start(ctx context.Context, readyChan chan struct{}) error
+	Stop() error
+}
+
+// Reconciler runs the desired tunnels, one per address.
+type Reconciler[T Tunnel[T]] struct {
+	options Options
+
+	trigger chan struct{}
+
+	mu      sync.Mutex
+	tunnels []T
+}
+
+type Options struct {
+	// Hosts publishes the tunnel names.
+	Hosts system.Hosts
+
+	Logger *slog.Logger
+
+	AddFunc    func(address string, hosts []string, ports []int)
+	DeleteFunc func(address string, hosts []string, ports []int)
+}
+
+func New[T Tunnel[T]](options Options) *Reconciler[T] {
+	return &Reconciler[T]{
+		options: options,
+
+		trigger: make(chan struct{}, 1),
+	}
+}
+
+// Tunnels returns the running tunnels.
+func (r *Reconciler[T]) Tunnels() []T {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.tunnels
+}
+
+// Notify schedules a refresh; events arriving while one is pending are
+// coalesced into it.
+func (r *Reconciler[T]) Notify() {
+	select {
+	case r.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Run refreshes once, then again on every notification and periodically,
+// until ctx is cancelled. Only the first refresh fails Run; later errors
+// are logged and retried with a backoff, as the next attempt may well
+// succeed.
+func (r *Reconciler[T]) Run(ctx context.Context, refresh func(ctx context.Context) error) error {
+	if err := refresh(ctx); err != nil {
+		return err
+	}
+
+	var retry <-chan time.Time
+	delay := retryDelay
+
+	for {
+		select {
+		case <-retry:
+		case <-r.trigger:
+			// Let a burst of events (a rollout touches pods, slices and
+			// services at once) settle into a single refresh.
+			select {
+			case <-time.After(debounceDelay):
+			case <-ctx.Done():
+				return nil
+			}
+
+			select {
+			case <-r.trigger:
+			default:
+			}
+
+		case <-time.After(resyncInterval):
+		case <-ctx.Done():
+			return nil
+		}
+
+		if err := refresh(ctx); err != nil {
+			if r.options.Logger != nil {
+				r.options.Logger.ErrorContext(ctx, "refresh failed", "error", err, "retry", delay)
+			}
+
+			retry = time.After(delay)
+			delay = min(delay*2, maxRetryDelay)
+
+			continue
+		}
+
+		retry = nil
+		delay = retryDelay
+	}
+}
+
+// Reset withdraws all published names, e.g. those a crashed session left.
+func (r *Reconciler[T]) Reset() {
+	r.options.Hosts.Clear()
+	r.options.Hosts.Flush()
+}
+
+// Close stops every tunnel and withdraws their names.
+func (r *Reconciler[T]) Close() {
+	r.Reset()
+
+	r.mu.Lock()
+	tunnels := r.tunnels
+	r.tunnels = nil
+	r.mu.Unlock()
+
+	for _, t := range tunnels {
+		t.Stop()
+	}
+}
+
+// Apply moves the running tunnels to the desired ones. A tunnel whose
+// address is gone or whose descriptor changed is stopped; one that is
+// still equivalent keeps running with the desired endpoints.
+func (r *Reconciler[T]) Apply(ctx context.Context, desired []T) error {
+	var result error
+	var changed bool
+
+	desiredByAddr := make(map[string]T, len(desired))
+	for _, t := range desired {
+		desiredByAddr[t.Address()] = t
+	}
+
+	r.mu.Lock()
+	previous := r.tunnels
+	r.mu.Unlock()
+
+	previousByAddr := make(map[string]T, len(previous))
+	for _, t := range previous {
+		previousByAddr[t.Address()] = t
+	}
+
+	for addr, t := range previousByAddr {
+		desiredT, kept := desiredByAddr[addr]
+
+		if kept && t.Equivalent(desiredT) {
+			continue
+		}
+
+		r.options.Hosts.Remove(t.Address())
+		changed = true
+
+		if err := t.Stop(); err != nil {
+			result = errors.Join(result, err)
+			continue
+		}
+
+		if r.options.DeleteFunc != nil {
+			r.options.DeleteFunc(t.Address(), t.Hosts(), t.Ports())
+		}
+	}
+
+	next := make([]T, 0, len(desired))
+
+	for _, t := range desired {
+		if prev, ok := previousByAddr[t.Address()]; ok && prev.Equivalent(t) {
+			prev.Update(t)
+
+			next = append(next, prev)
+			continue
+		}
+
+		// one tunnel failing must not take the others down; it is
+		// retried on the next refresh, which finds it missing
+		if err := t.Start(ctx, nil); err != nil {
+			if r.options.Logger != nil {
+				r.options.Logger.ErrorContext(ctx, "failed to start tunnel", "address", t.Address(), "error", err)
+			}
+
+			continue
+		}
+
+		r.options.Hosts.Add(t.Address(), t.Hosts()...)
+		r.options.Hosts.AddSRV(t.Address(), t.Records()...)
+		changed = true
+
+		if r.options.AddFunc != nil {
+			r.options.AddFunc(t.Address(), t.Hosts(), t.Ports())
+		}
+
+		next = append(next, t)
+	}
+
+	r.mu.Lock()
+	r.tunnels = next
+	r.mu.Unlock()
+
+	// Do not flush if context is cancelled - let Close clean up
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	// Most events only move endpoints within existing tunnels; leave the
+	// hosts file alone unless a name was added or removed.
+	if !changed {
+		return result
+	}
+
+	if err := r.options.Hosts.Flush(); err != nil {
+		return errors.Join(result, err)
+	}
+
+	return result
+}
+
+// ResourceKey identifies an object as namespace/name.
+func ResourceKey(obj metav1.Object) string {
+	return fmt.Sprintf("%s/%s", obj.GetNamespace(), obj.GetName())
+}
+
+// PodReady reports whether a pod is running, not terminating and passing
+// its readiness checks.
+func PodReady(pod corev1.Pod) bool {
+	if pod.Status.Phase != corev1.PodRunning || pod.DeletionTimestamp != nil {
+		return false
+	}
+
+	return slices.ContainsFunc(pod.Status.Conditions, func(c corev1.PodCondition) bool {
+		return c.Type == corev1.PodReady && c.Status == corev1.ConditionTrue
+	})
+}
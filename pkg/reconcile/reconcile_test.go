@@ -0,0 +1,159 @@
+package reconcile
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/adrianliechti/loop/pkg/system"
+)
+
+type fakeTunnel struct {
+	address string
+	hosts   []string
+	targets []string
+
+	err error
+
+	started, stopped int
+}
+
+func (t *fakeTunnel) Address() string       { return t.address }
+func (t *fakeTunnel) Hosts() []string       { return t.hosts }
+func (t *fakeTunnel) Records() []system.SRV { return nil }
+func (t *fakeTunnel) Ports() []int          { return nil }
+
+func (t *fakeTunnel) Equivalent(o *fakeTunnel) bool { return slices.Equal(t.hosts, o.hosts) }
+func (t *fakeTunnel) Update(o *fakeTunnel)          { t.targets = o.targets }
+
+func (t *fakeTunnel) Start(ctx context.Context, readyChan chan struct{}) error {
+	t.started++
+	return t.err
+}
+
+func (t *fakeTunnel) Stop() error {
+	t.stopped++
+	return nil
+}
+
+type recordingHosts struct {
+	entries map[string][]string
+	flushes int
+}
+
+func (h *recordingHosts) Add(address string, hosts ...string)          { h.entries[address] = hosts }
+func (h *recordingHosts) AddSRV(address string, records ...system.SRV) {}
+func (h *recordingHosts) Remove(address string)                        { delete(h.entries, address) }
+func (h *recordingHosts) Clear()                                       { clear(h.entries) }
+func (h *recordingHosts) Flush() error                                 { h.flushes++; return nil }
+
+func TestApply(t *testing.T) {
+	hosts := &recordingHosts{entries: make(map[string][]string)}
+
+	r := New[*fakeTunnel](Options{Hosts: hosts})
+
+	orders := &fakeTunnel{address: "127.0.0.2", hosts: []string{"orders"}, targets: []string{"orders-0"}}
+	carts := &fakeTunnel{address: "127.0.0.3", hosts: []string{"carts"}}
+
+	if err := r.Apply(t.Context(), []*fakeTunnel{orders, carts}); err != nil {
+		t.Fatal(err)
+	}
+
+	if orders.started != 1 || carts.started != 1 || hosts.flushes != 1 {
+		t.Fatalf("want both tunnels started and one flush, got %+v %+v %d", orders, carts, hosts.flushes)
+	}
+
+	// endpoints moved, carts gone: orders keeps running with the new pods
+	next := &fakeTunnel{address: "127.0.0.2", hosts: []string{"orders"}, targets: []string{"orders-1"}}
+
+	if err := r.Apply(t.Context(), []*fakeTunnel{next}); err != nil {
+		t.Fatal(err)
+	}
+
+	if next.started != 0 || orders.stopped != 0 || !slices.Equal(orders.targets, []string{"orders-1"}) {
+		t.Fatalf("want orders updated in place, got %+v", orders)
+	}
+
+	if carts.stopped != 1 || hosts.entries["127.0.0.3"] != nil {
+		t.Fatalf("want carts stopped and unpublished, got %+v", carts)
+	}
+
+	if tunnels := r.Tunnels(); len(tunnels) != 1 || tunnels[0] != orders {
+		t.Fatalf("want the running orders tunnel, got %v", tunnels)
+	}
+}
+
+func TestApplyKeepsOtherTunnels(t *testing.T) {
+	hosts := &recordingHosts{entries: make(map[string][]string)}
+
+	r := New[*fakeTunnel](Options{Hosts: hosts})
+
+	orders := &fakeTunnel{address: "127.0.0.2", hosts: []string{"orders"}, err: errors.New("alias failed")}
+	carts := &fakeTunnel{address: "127.0.0.3", hosts: []string{"carts"}}
+
+	if err := r.Apply(t.Context(), []*fakeTunnel{orders, carts}); err != nil {
+		t.Fatal(err)
+	}
+
+	if tunnels := r.Tunnels(); len(tunnels) != 1 || tunnels[0] != carts {
+		t.Fatalf("want only carts running, got %v", tunnels)
+	}
+
+	// the failed tunnel is retried on the next refresh
+	orders.err = nil
+
+	if err := r.Apply(t.Context(), []*fakeTunnel{orders, carts}); err != nil {
+		t.Fatal(err)
+	}
+
+	if orders.started != 2 || len(r.Tunnels()) != 2 {
+		t.Fatalf("want orders started again, got %+v", orders)
+	}
+}
+
+func TestNotifyCoalesces(t *testing.T) {
+	r := New[*fakeTunnel](Options{})
+
+	for range 10 {
+		r.Notify()
+	}
+
+	if len(r.trigger) != 1 {
+		t.Fatalf("want one pending refresh, got %d", len(r.trigger))
+	}
+}
+
+func TestRunRetriesFailedRefresh(t *testing.T) {
+	r := New[*fakeTunnel](Options{})
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	refreshed := make(chan int, 8)
+	calls := 0
+
+	go r.Run(ctx, func(ctx context.Context) error {
+		calls++
+		refreshed <- calls
+
+		// the first refresh after the initial one fails, e.g. on a port
+		// still in use
+		if calls == 2 {
+			return errors.New("address already in use")
+		}
+
+		return nil
+	})
+
+	<-refreshed
+	r.Notify()
+	<-refreshed
+
+	select {
+	case <-refreshed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("failed refresh was not retried")
+	}
+}
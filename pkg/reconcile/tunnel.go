@@ -0,0 +1,321 @@
+package reconcile
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/adrianliechti/loop/pkg/forward"
+	"github.com/adrianliechti/loop/pkg/status"
+	"github.com/adrianliechti/loop/pkg/system"
+)
+
+// ErrSkip is returned by PortTunnel.Dial for an endpoint that cannot take
+// the connection at all, so the next one is tried without counting a
+// failure.
+var ErrSkip = errors.New("endpoint skipped")
+
+// PortTunnel forwards the ports of one local address to a set of
+// endpoints, e.g. the pods behind a service. E describes an endpoint, and
+// Dial knows how to reach one; everything else is shared by the catapult
+// and the gateway.
+type PortTunnel[E any] struct {
+	// Namespace holds the endpoints; Evict only applies to it.
+	Namespace string
+
+	Names []string
+	SRV   []system.SRV
+
+	// IPs are the cluster addresses of the service, which lookups accept
+	// in place of a name.
+	IPs []string
+
+	// TCP and UDP map the local ports to the target ports.
+	TCP map[int]int
+	UDP map[int]int
+
+	// Virtual tunnels bind nothing and are only dialed through Dialer.
+	Virtual  bool
+	Loopback system.Loopback
+
+	// Dial connects to an endpoint for a local port. ErrSkip passes over
+	// the endpoint, e.g. one lacking the port.
+	Dial func(ctx context.Context, e E, network string, port int) (net.Conn, error)
+
+	address string
+
+	mu      sync.Mutex
+	targets []E
+	next    int
+	last    string
+
+	stats forward.Stats
+
+	cancel context.CancelFunc
+}
+
+func NewPortTunnel[E any](namespace string, targets []E, address string, ports, udpPorts map[int]int, hosts []string) *PortTunnel[E] {
+	return &PortTunnel[E]{
+		Namespace: namespace,
+
+		Names: hosts,
+
+		TCP: ports,
+		UDP: udpPorts,
+
+		address: address,
+		targets: targets,
+	}
+}
+
+func (t *PortTunnel[E]) Start(ctx context.Context, readyChan chan struct{}) error {
+	if t.cancel != nil {
+		t.cancel()
+		t.cancel = nil
+	}
+
+	ctx, t.cancel = context.WithCancel(ctx)
+
+	if t.Virtual {
+		if readyChan != nil {
+			close(readyChan)
+		}
+
+		return nil
+	}
+
+	if err := t.Loopback.AliasIP(ctx, t.address); err != nil {
+		return err
+	}
+
+	// A port that cannot be bound, e.g. one in use or privileged, is
+	// skipped so the rest of the tunnel and the session keep working.
+	var listeners []net.Listener
+	var conns []net.PacketConn
+
+	for s := range t.TCP {
+		l, err := net.Listen("tcp", net.JoinHostPort(t.address, strconv.Itoa(s)))
+
+		if err != nil {
+			slog.WarnContext(ctx, "failed to listen", "address", t.address, "port", s, "error", err)
+			continue
+		}
+
+		listeners = append(listeners, l)
+	}
+
+	for s := range t.UDP {
+		c, err := net.ListenPacket("udp", net.JoinHostPort(t.address, strconv.Itoa(s)))
+
+		if err != nil {
+			slog.WarnContext(ctx, "failed to listen", "address", t.address, "udp", s, "error", err)
+			continue
+		}
+
+		conns = append(conns, c)
+	}
+
+	for _, l := range listeners {
+		port := l.Addr().(*net.TCPAddr).Port
+
+		go func() {
+			if err := forward.TCP(ctx, l, t.Dialer("tcp", port)); err != nil {
+				slog.ErrorContext(ctx, "failed to forward", "address", t.address, "port", port, "error", err)
+			}
+		}()
+	}
+
+	for _, c := range conns {
+		port := c.LocalAddr().(*net.UDPAddr).Port
+
+		go func() {
+			if err := forward.UDP(ctx, c, t.Dialer("udp", port)); err != nil {
+				slog.ErrorContext(ctx, "failed to forward", "address", t.address, "udp", port, "error", err)
+			}
+		}()
+	}
+
+	if readyChan != nil {
+		close(readyChan)
+	}
+
+	return nil
+}
+
+// Dialer spreads new connections to a local port round-robin across the
+// tunnel's endpoints and fails over to the next one when an endpoint
+// cannot be reached.
+func (t *PortTunnel[E]) Dialer(network string, port int) forward.DialFunc {
+	return func(ctx context.Context) (net.Conn, error) {
+		var result error
+
+		for _, e := range t.candidates() {
+			conn, err := t.Dial(ctx, e, network, port)
+
+			if errors.Is(err, ErrSkip) {
+				continue
+			}
+
+			if err != nil {
+				t.stats.Fail(err)
+
+				result = errors.Join(result, err)
+				continue
+			}
+
+			t.mu.Lock()
+			t.last = fmt.Sprint(e)
+			t.mu.Unlock()
+
+			return t.stats.Track(conn), nil
+		}
+
+		if result == nil {
+			result = errors.New("no ready endpoints")
+			t.stats.Fail(result)
+		}
+
+		slog.WarnContext(ctx, "failed to dial", "address", t.address, "port", port, "error", result)
+
+		return nil, result
+	}
+}
+
+// candidates returns the endpoints in the order the next connection should
+// try them, advancing the round-robin position.
+func (t *PortTunnel[E]) candidates() []E {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.targets) == 0 {
+		return nil
+	}
+
+	start := t.next % len(t.targets)
+	t.next++
+
+	return append(slices.Clone(t.targets[start:]), t.targets[:start]...)
+}
+
+// Update takes over the endpoints of an equivalent desired tunnel without
+// interrupting established connections.
+func (t *PortTunnel[E]) Update(o *PortTunnel[E]) {
+	o.mu.Lock()
+	targets := o.targets
+	o.mu.Unlock()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.targets = targets
+}
+
+// Evict removes the endpoints in namespace that match, typically as soon
+// as the informer reports a pod gone, so new connections skip it before
+// the next refresh.
+func (t *PortTunnel[E]) Evict(namespace string, match func(e E) bool) {
+	if t.Namespace != namespace {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.targets = slices.DeleteFunc(slices.Clone(t.targets), match)
+}
+
+func (t *PortTunnel[E]) Address() string {
+	return t.address
+}
+
+func (t *PortTunnel[E]) Hosts() []string {
+	return t.Names
+}
+
+func (t *PortTunnel[E]) Records() []system.SRV {
+	return t.SRV
+}
+
+// Ports returns the distinct local ports of the tunnel across protocols.
+func (t *PortTunnel[E]) Ports() []int {
+	ports := slices.Collect(maps.Keys(t.TCP))
+
+	for p := range t.UDP {
+		if _, ok := t.TCP[p]; !ok {
+			ports = append(ports, p)
+		}
+	}
+
+	slices.Sort(ports)
+
+	return ports
+}
+
+// Equivalent reports whether two tunnels expose the same hosts and port
+// mappings — i.e. whether the running listeners are still correct for the
+// new desired state. Endpoints are not compared; they are swapped in place
+// through Update.
+func (t *PortTunnel[E]) Equivalent(o *PortTunnel[E]) bool {
+	if t.Namespace != o.Namespace {
+		return false
+	}
+
+	if !maps.Equal(t.TCP, o.TCP) || !maps.Equal(t.UDP, o.UDP) {
+		return false
+	}
+
+	if !slices.Equal(t.SRV, o.SRV) {
+		return false
+	}
+
+	a := slices.Clone(t.Names)
+	b := slices.Clone(o.Names)
+	slices.Sort(a)
+	slices.Sort(b)
+
+	return slices.Equal(a, b)
+}
+
+// Status reports the tunnel's configuration and traffic.
+func (t *PortTunnel[E]) Status() status.Tunnel {
+	t.mu.Lock()
+	targets := make([]string, 0, len(t.targets))
+
+	for _, e := range t.targets {
+		targets = append(targets, fmt.Sprint(e))
+	}
+
+	last := t.last
+	t.mu.Unlock()
+
+	result := status.NewTunnel(t.address, t.Names, t.TCP, t.UDP, &t.stats)
+	result.Targets = targets
+	result.Target = last
+
+	return result
+}
+
+func (t *PortTunnel[E]) Stop() error {
+	if t.cancel != nil {
+		t.cancel()
+		t.cancel = nil
+	}
+
+	if t.Virtual {
+		return nil
+	}
+
+	var result error
+
+	if err := t.Loopback.UnaliasIP(context.Background(), t.address); err != nil {
+		result = errors.Join(result, err)
+	}
+
+	return result
+}
@@ -0,0 +1,169 @@
+package reconcile
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+// fakeDialer records which endpoints are dialed and fails those listed in
+// down.
+type fakeDialer struct {
+	down   []string
+	dialed []string
+}
+
+func (d *fakeDialer) dial(ctx context.Context, e string, network string, port int) (net.Conn, error) {
+	d.dialed = append(d.dialed, e)
+
+	if slices.Contains(d.down, e) {
+		return nil, errors.New("connection refused")
+	}
+
+	client, server := net.Pipe()
+	server.Close()
+
+	return client, nil
+}
+
+type fakeLoopback struct{}
+
+func (fakeLoopback) AliasIP(ctx context.Context, alias string) error   { return nil }
+func (fakeLoopback) UnaliasIP(ctx context.Context, alias string) error { return nil }
+
+func newTestTunnel(d *fakeDialer, targets ...string) *PortTunnel[string] {
+	t := NewPortTunnel("shop", targets, "127.244.0.1", map[int]int{80: 8080}, nil, nil)
+	t.Dial = d.dial
+
+	return t
+}
+
+func dialTimes(t *testing.T, tun *PortTunnel[string], n int) {
+	t.Helper()
+
+	for range n {
+		conn, err := tun.Dialer("tcp", 80)(t.Context())
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn.Close()
+	}
+}
+
+func TestDialerRoundRobin(t *testing.T) {
+	d := &fakeDialer{}
+	tun := newTestTunnel(d, "web-a", "web-b", "web-c")
+
+	dialTimes(t, tun, 4)
+
+	want := []string{"web-a", "web-b", "web-c", "web-a"}
+
+	if !slices.Equal(d.dialed, want) {
+		t.Errorf("want %v, got %v", want, d.dialed)
+	}
+}
+
+func TestDialerFailsOver(t *testing.T) {
+	d := &fakeDialer{down: []string{"web-a"}}
+	tun := newTestTunnel(d, "web-a", "web-b")
+
+	dialTimes(t, tun, 1)
+
+	want := []string{"web-a", "web-b"}
+
+	if !slices.Equal(d.dialed, want) {
+		t.Errorf("want %v, got %v", want, d.dialed)
+	}
+
+	if got := tun.Status().Target; got != "web-b" {
+		t.Errorf("want target web-b, got %q", got)
+	}
+
+	d.down = []string{"web-a", "web-b"}
+
+	if _, err := tun.Dialer("tcp", 80)(t.Context()); err == nil {
+		t.Error("want an error with every endpoint down")
+	}
+}
+
+func TestDialerSkipsEndpoints(t *testing.T) {
+	d := &fakeDialer{}
+	tun := newTestTunnel(d, "web-a", "web-b")
+
+	dial := tun.Dial
+	tun.Dial = func(ctx context.Context, e string, network string, port int) (net.Conn, error) {
+		if e == "web-a" {
+			return nil, ErrSkip
+		}
+
+		return dial(ctx, e, network, port)
+	}
+
+	dialTimes(t, tun, 2)
+
+	want := []string{"web-b", "web-b"}
+
+	if !slices.Equal(d.dialed, want) {
+		t.Errorf("want %v, got %v", want, d.dialed)
+	}
+}
+
+func TestEvict(t *testing.T) {
+	d := &fakeDialer{}
+	tun := newTestTunnel(d, "web-a", "web-b")
+
+	tun.Evict("other", func(e string) bool { return e == "web-a" })
+	tun.Evict("shop", func(e string) bool { return e == "web-b" })
+
+	dialTimes(t, tun, 2)
+
+	want := []string{"web-a", "web-a"}
+
+	if !slices.Equal(d.dialed, want) {
+		t.Errorf("want %v, got %v", want, d.dialed)
+	}
+}
+
+func TestStartSkipsBusyPort(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer busy.Close()
+
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	freePort := free.Addr().(*net.TCPAddr).Port
+	free.Close()
+
+	busyPort := busy.Addr().(*net.TCPAddr).Port
+
+	tun := NewPortTunnel("shop", []string{"web-a"}, "127.0.0.1", map[int]int{busyPort: 8080, freePort: 8080}, nil, nil)
+	tun.Dial = (&fakeDialer{}).dial
+	tun.Loopback = fakeLoopback{}
+
+	if err := tun.Start(t.Context(), nil); err != nil {
+		t.Fatalf("want the busy port skipped, got %v", err)
+	}
+
+	defer tun.Stop()
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(freePort)))
+
+	if err != nil {
+		t.Fatalf("want the free port forwarded, got %v", err)
+	}
+
+	conn.Close()
+}
@@ -14,6 +14,7 @@ import (
 	"github.com/adrianliechti/go-cli"
 	"github.com/adrianliechti/loop/pkg/docker"
 	"github.com/adrianliechti/loop/pkg/kubernetes"
+	"github.com/adrianliechti/loop/pkg/session"
 
 	"github.com/Masterminds/semver/v3"
 	"github.com/google/uuid"
@@ -362,9 +363,15 @@ func templatePod(ctx context.Context, client kubernetes.Client, options *RunOpti
 }
 
 func startPod(ctx context.Context, client kubernetes.Client, pod *corev1.Pod) error {
+	// journal the pod before creating it, so a crash in between cannot
+	// leak it; rollback of a pod that never got created is a no-op
+	resource := kubernetes.PodResource(client, pod.Namespace, pod.Name)
+	session.Record(resource)
+
 	pod, err := client.CoreV1().Pods(pod.Namespace).Create(ctx, pod, metav1.CreateOptions{})
 
 	if err != nil {
+		session.Release(resource)
 		return err
 	}
 
@@ -382,5 +389,7 @@ func stopPod(ctx context.Context, client kubernetes.Client, namespace, name stri
 		return err
 	}
 
+	session.Release(kubernetes.PodResource(client, namespace, name))
+
 	return nil
 }
@@ -5,7 +5,9 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -13,6 +15,7 @@ import (
 	"github.com/adrianliechti/loop/pkg/dockerproxy"
 	"github.com/adrianliechti/loop/pkg/kubernetes"
 	"github.com/adrianliechti/loop/pkg/remotemount"
+	"github.com/adrianliechti/loop/pkg/session"
 	"github.com/adrianliechti/loop/pkg/ssh"
 	"github.com/adrianliechti/loop/pkg/system"
 
@@ -20,6 +23,10 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+func init() {
+	session.Register("docker-context", rollbackContext)
+}
+
 type ConnectOptions struct {
 	Namespace string
 }
@@ -136,6 +143,18 @@ func Connect(ctx context.Context, client kubernetes.Client, name string, options
 
 	currentContext := strings.TrimSpace(string(val))
 
+	contextResource := session.Resource{
+		Kind: "docker-context",
+		Name: loopContext,
+
+		Attributes: map[string]string{
+			"previous": currentContext,
+			"config":   dockerConfig(),
+		},
+	}
+
+	session.Record(contextResource)
+
 	defer func() {
 		cli.Info("★ Resetting Docker context to '" + currentContext + "'")
 
@@ -145,7 +164,9 @@ func Connect(ctx context.Context, client kubernetes.Client, name string, options
 			runDocker(docker, "context", "use", "default")
 		}
 
-		runDocker(docker, "context", "rm", "-f", loopContext)
+		if err := runDocker(docker, "context", "rm", "-f", loopContext); err == nil {
+			session.Release(contextResource)
+		}
 	}()
 
 	cli.Info("★ Setting Docker context to '" + loopContext + "'")
@@ -248,8 +269,54 @@ func waitForDocker(ctx context.Context, port int) error {
 	}
 }
 
+// rollbackContext switches away from and removes the context of a crashed
+// session, which would otherwise point Docker at a dead proxy.
+func rollbackContext(ctx context.Context, r session.Resource) error {
+	env := append(os.Environ(), "DOCKER_CONFIG="+r.Attributes["config"])
+
+	show := exec.CommandContext(ctx, "docker", "context", "show")
+	show.Env = env
+
+	val, err := show.Output()
+
+	if err != nil {
+		return fmt.Errorf("could not get current Docker context: %w", err)
+	}
+
+	if strings.TrimSpace(string(val)) == r.Name {
+		previous := r.Attributes["previous"]
+
+		if previous == "" || previous == r.Name {
+			previous = "default"
+		}
+
+		if err := runDockerEnv(env, "docker", "context", "use", previous); err != nil {
+			return err
+		}
+	}
+
+	return runDockerEnv(env, "docker", "context", "rm", "-f", r.Name)
+}
+
+// dockerConfig returns the directory holding the Docker contexts, so a
+// cleanup running under sudo still edits the user's contexts.
+func dockerConfig() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return dir
+	}
+
+	home, _ := os.UserHomeDir()
+
+	return filepath.Join(home, ".docker")
+}
+
 func runDocker(docker string, args ...string) error {
+	return runDockerEnv(nil, docker, args...)
+}
+
+func runDockerEnv(env []string, docker string, args ...string) error {
 	cmd := exec.Command(docker, args...)
+	cmd.Env = env
 
 	if out, err := cmd.CombinedOutput(); err != nil {
 		return fmt.Errorf("docker %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
@@ -0,0 +1,328 @@
+package intercept
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/adrianliechti/go-cli"
+	"github.com/adrianliechti/loop/pkg/kubernetes"
+	"github.com/adrianliechti/loop/pkg/session"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// restoreImage ships the loop binary, which runs Guard next to the
+	// tunnel.
+	restoreImage = "ghcr.io/adrianliechti/loop"
+
+	// leaseDuration is how long the intercept pod waits for a renewal
+	// before it restores the service itself; the session renews the lease
+	// every leaseRenewal.
+	leaseDuration = 30 * time.Second
+	leaseRenewal  = 10 * time.Second
+
+	// accountKind journals the service account that owns everything the
+	// intercept creates in the cluster, the pod included.
+	accountKind = "intercept-account"
+)
+
+func init() {
+	session.Register(accountKind, rollbackAccount)
+}
+
+// GuardOptions describes the intercept a Guard watches over.
+type GuardOptions struct {
+	// Name is the pod, its service account and its lease.
+	Name    string
+	Service string
+
+	// Labels select the pod; the service is only restored while it still
+	// selects them.
+	Labels map[string]string
+
+	// Interval and TTL default to checking the lease every five seconds
+	// and giving up on it after leaseDuration without a renewal.
+	Interval time.Duration
+	TTL      time.Duration
+}
+
+// Guard runs in the intercept pod and puts the original selector back once
+// the session stops renewing its lease, e.g. because the laptop crashed,
+// went to sleep or lost the network. It then deletes the account, which
+// takes the pod and the rest with it. Renewals are told apart by the
+// renew time changing rather than by its value, so clock skew between the
+// laptop and the cluster does not matter.
+func Guard(ctx context.Context, client kubernetes.Client, namespace string, options GuardOptions) error {
+	if options.Interval == 0 {
+		options.Interval = 5 * time.Second
+	}
+
+	if options.TTL == 0 {
+		options.TTL = leaseDuration
+	}
+
+	var last metav1.MicroTime
+	renewed := time.Now()
+
+	ticker := time.NewTicker(options.Interval)
+	defer ticker.Stop()
+
+	for time.Since(renewed) < options.TTL {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		lease, err := client.CoordinationV1().Leases(namespace).Get(ctx, options.Name, metav1.GetOptions{})
+
+		if kubernetes.IsNotFound(err) {
+			break
+		}
+
+		if err != nil {
+			continue
+		}
+
+		if lease.Spec.RenewTime != nil && !lease.Spec.RenewTime.Equal(&last) {
+			last = *lease.Spec.RenewTime
+			renewed = time.Now()
+		}
+	}
+
+	if err := restoreSelector(ctx, client, namespace, options.Service, options.Labels); err != nil {
+		return err
+	}
+
+	propagation := metav1.DeletePropagationBackground
+
+	if err := client.CoreV1().ServiceAccounts(namespace).Delete(ctx, options.Name, metav1.DeleteOptions{PropagationPolicy: &propagation}); err != nil && !kubernetes.IsNotFound(err) {
+		return err
+	}
+
+	return nil
+}
+
+// createGuard creates the service account the restore container runs as,
+// its permissions and the lease it watches. Everything is owned by the
+// account, so deleting it cleans up the intercept.
+func createGuard(ctx context.Context, client kubernetes.Client, namespace, name, service string) (*corev1.ServiceAccount, error) {
+	// journaled before it exists, like the pods
+	resource := kubernetes.NewResource(client, accountKind, namespace, name)
+	session.Record(resource)
+
+	account, err := client.CoreV1().ServiceAccounts(namespace).Create(ctx, &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+		},
+	}, metav1.CreateOptions{})
+
+	if err != nil {
+		session.Release(resource)
+		return nil, err
+	}
+
+	owner := []metav1.OwnerReference{
+		*metav1.NewControllerRef(account, corev1.SchemeGroupVersion.WithKind("ServiceAccount")),
+	}
+
+	role := &rbacv1.Role{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            name,
+			OwnerReferences: owner,
+		},
+
+		Rules: []rbacv1.PolicyRule{
+			{
+				APIGroups:     []string{""},
+				Resources:     []string{"services"},
+				ResourceNames: []string{service},
+				Verbs:         []string{"get", "update"},
+			},
+			{
+				APIGroups:     []string{coordinationv1.GroupName},
+				Resources:     []string{"leases"},
+				ResourceNames: []string{name},
+				Verbs:         []string{"get"},
+			},
+			{
+				APIGroups:     []string{""},
+				Resources:     []string{"serviceaccounts"},
+				ResourceNames: []string{name},
+				Verbs:         []string{"delete"},
+			},
+		},
+	}
+
+	if _, err := client.RbacV1().Roles(namespace).Create(ctx, role, metav1.CreateOptions{}); err != nil {
+		return nil, err
+	}
+
+	binding := &rbacv1.RoleBinding{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            name,
+			OwnerReferences: owner,
+		},
+
+		RoleRef: rbacv1.RoleRef{
+			APIGroup: rbacv1.GroupName,
+			Kind:     "Role",
+			Name:     name,
+		},
+
+		Subjects: []rbacv1.Subject{
+			{
+				Kind:      rbacv1.ServiceAccountKind,
+				Namespace: namespace,
+				Name:      name,
+			},
+		},
+	}
+
+	if _, err := client.RbacV1().RoleBindings(namespace).Create(ctx, binding, metav1.CreateOptions{}); err != nil {
+		return nil, err
+	}
+
+	now := metav1.NewMicroTime(time.Now())
+
+	lease := &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            name,
+			OwnerReferences: owner,
+		},
+
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity:       &name,
+			LeaseDurationSeconds: kubernetes.Ptr(int32(leaseDuration / time.Second)),
+
+			AcquireTime: &now,
+			RenewTime:   &now,
+		},
+	}
+
+	if _, err := client.CoordinationV1().Leases(namespace).Create(ctx, lease, metav1.CreateOptions{}); err != nil {
+		return nil, err
+	}
+
+	return account, nil
+}
+
+// guardPod runs the pod as the account, owned by it, with a container
+// running Guard next to the tunnel.
+func guardPod(pod *corev1.Pod, account *corev1.ServiceAccount, image, service string) error {
+	labels, err := json.Marshal(pod.Labels)
+
+	if err != nil {
+		return err
+	}
+
+	pod.OwnerReferences = []metav1.OwnerReference{
+		*metav1.NewControllerRef(account, corev1.SchemeGroupVersion.WithKind("ServiceAccount")),
+	}
+
+	pod.Spec.ServiceAccountName = account.Name
+
+	pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{
+		Name:  "restore",
+		Image: image,
+
+		Command: []string{
+			"/usr/local/bin/loop", "intercept-guard",
+			"--namespace", account.Namespace,
+			"--name", account.Name,
+			"--service", service,
+			"--labels", string(labels),
+		},
+	})
+
+	return nil
+}
+
+// renewLease keeps the lease of the intercept pod fresh until ctx is done.
+func renewLease(ctx context.Context, client kubernetes.Client, namespace, name string) {
+	ticker := time.NewTicker(leaseRenewal)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		patch, err := json.Marshal(map[string]any{
+			"spec": map[string]any{"renewTime": metav1.NewMicroTime(time.Now())},
+		})
+
+		if err != nil {
+			continue
+		}
+
+		if _, err := client.CoordinationV1().Leases(namespace).Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil && ctx.Err() == nil {
+			cli.Warnf("★ failed to renew intercept lease %s/%s: %v", namespace, name, err)
+		}
+	}
+}
+
+func deleteAccount(ctx context.Context, client kubernetes.Client, namespace, name string) error {
+	propagation := metav1.DeletePropagationBackground
+
+	if err := client.CoreV1().ServiceAccounts(namespace).Delete(ctx, name, metav1.DeleteOptions{PropagationPolicy: &propagation}); err != nil && !kubernetes.IsNotFound(err) {
+		return err
+	}
+
+	session.Release(kubernetes.NewResource(client, accountKind, namespace, name))
+
+	return nil
+}
+
+func rollbackAccount(ctx context.Context, r session.Resource) error {
+	client, err := kubernetes.ResourceClient(ctx, r)
+
+	if err != nil {
+		return err
+	}
+
+	return deleteAccount(ctx, client, r.Namespace, r.Name)
+}
+
+// checkBound makes sure a remote forward listens on the pod IP, where the
+// service sends traffic, and not just on loopback, as sshd does without
+// GatewayPorts. It dials the pod IP from inside the pod and takes the
+// connection off the listener before any traffic is routed there.
+func checkBound(dial func(network, addr string) (net.Conn, error), l net.Listener, addr string) error {
+	conn, err := dial("tcp", addr)
+
+	if err != nil {
+		return fmt.Errorf("intercept pod does not listen on %s; sshd needs GatewayPorts enabled: %w", addr, err)
+	}
+
+	defer conn.Close()
+
+	accepted := make(chan error, 1)
+
+	go func() {
+		c, err := l.Accept()
+
+		if err == nil {
+			c.Close()
+		}
+
+		accepted <- err
+	}()
+
+	select {
+	case err := <-accepted:
+		return err
+	case <-time.After(10 * time.Second):
+		return fmt.Errorf("intercept pod does not forward connections to %s", addr)
+	}
+}
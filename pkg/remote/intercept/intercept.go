@@ -0,0 +1,547 @@
+package intercept
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adrianliechti/go-cli"
+	"github.com/adrianliechti/loop/pkg/kubernetes"
+	"github.com/adrianliechti/loop/pkg/session"
+	"github.com/adrianliechti/loop/pkg/ssh"
+	"github.com/adrianliechti/loop/pkg/system"
+
+	"github.com/google/uuid"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+	watchtools "k8s.io/client-go/tools/watch"
+	"k8s.io/client-go/util/retry"
+)
+
+const tunnelImage = "ghcr.io/adrianliechti/loop-tunnel"
+
+// Annotation holds the original selector of an intercepted service, so it
+// can be restored by whoever finds the service first: the session itself,
+// the rollback of a crashed session, or someone fixing it by hand.
+const Annotation = "loop.adrianliechti.io/intercept"
+
+// resourceKind journals intercepted services for the session rollback.
+const resourceKind = "intercept"
+
+func init() {
+	session.Register(resourceKind, rollbackIntercept)
+}
+
+type RunOptions struct {
+	Namespace string
+	Image     string
+
+	// RestoreImage runs the container that restores the service should
+	// the session die; it runs Guard through the loop binary.
+	RestoreImage string
+
+	Service string
+
+	Ports []Port
+}
+
+// Port routes a service port to a local port.
+type Port struct {
+	Port      int
+	LocalPort int
+}
+
+// Run points a service at a loop-tunnel pod that reverse-forwards each
+// intercepted port over SSH to the local machine, and blocks until ctx is
+// cancelled or the tunnel fails. The original selector is restored on the
+// way out; should the process die first, a container in the pod restores
+// it once the session stops renewing its lease, and the session journal on
+// the next run. Ports that are not intercepted are unreachable while the
+// service points at the pod.
+func Run(ctx context.Context, client kubernetes.Client, options *RunOptions) error {
+	if options == nil {
+		options = new(RunOptions)
+	}
+
+	if options.Namespace == "" {
+		options.Namespace = client.Namespace()
+	}
+
+	if options.Image == "" {
+		options.Image = tunnelImage
+	}
+
+	if options.RestoreImage == "" {
+		options.RestoreImage = restoreImage
+	}
+
+	if len(options.Ports) == 0 {
+		return errors.New("at least one port is required")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	service, err := client.CoreV1().Services(options.Namespace).Get(ctx, options.Service, metav1.GetOptions{})
+
+	if err != nil {
+		return err
+	}
+
+	if len(service.Spec.Selector) == 0 {
+		return fmt.Errorf("service %s/%s has no selector to retarget", service.Namespace, service.Name)
+	}
+
+	if _, ok := service.Annotations[Annotation]; ok {
+		return fmt.Errorf("service %s/%s is already intercepted; run 'loop cleanup' if that session crashed", service.Namespace, service.Name)
+	}
+
+	containerPorts, err := selectPorts(service, options.Ports)
+
+	if err != nil {
+		return err
+	}
+
+	podName := "loop-intercept-" + uuid.NewString()[0:7]
+
+	cli.Infof("★ creating intercept pod %s/%s...", options.Namespace, podName)
+
+	account, err := createGuard(ctx, client, options.Namespace, podName, options.Service)
+
+	if err != nil {
+		// whatever was created before the failure goes with the account
+		deleteAccount(context.Background(), client, options.Namespace, podName)
+
+		if !kubernetes.IsForbidden(err) {
+			return err
+		}
+
+		cli.Warnf("★ cannot let the pod restore the service itself (%v); should this session die, run 'loop cleanup'", err)
+		account = nil
+	}
+
+	if account != nil {
+		defer func() {
+			if err := deleteAccount(context.Background(), client, options.Namespace, podName); err != nil {
+				cli.Warnf("★ failed to remove intercept account %s/%s: %v", options.Namespace, podName, err)
+			}
+		}()
+
+		go renewLease(ctx, client, options.Namespace, podName)
+	}
+
+	pod := newPod(podName, options.Image, containerPorts)
+
+	if account != nil {
+		if err := guardPod(pod, account, options.RestoreImage, options.Service); err != nil {
+			return err
+		}
+	}
+
+	if err := createPod(ctx, client, options.Namespace, pod); err != nil {
+		return err
+	}
+
+	defer func() {
+		cli.Infof("★ removing intercept pod %s/%s...", options.Namespace, podName)
+
+		if err := deletePod(context.Background(), client, options.Namespace, podName); err != nil {
+			cli.Warnf("★ failed to remove intercept pod %s/%s: %v", options.Namespace, podName, err)
+		}
+	}()
+
+	running, err := client.WaitForPod(ctx, options.Namespace, podName)
+
+	if err != nil {
+		return err
+	}
+
+	sshPort, err := system.FreePort(0)
+
+	if err != nil {
+		return err
+	}
+
+	forwardReady := make(chan struct{})
+	forwardDone := make(chan error, 1)
+
+	go func() {
+		forwardDone <- client.PodPortForward(ctx, options.Namespace, podName, "127.0.0.1", map[int]int{sshPort: 22}, forwardReady)
+		cancel()
+	}()
+
+	select {
+	case <-forwardReady:
+	case err := <-forwardDone:
+		return errOrContext(ctx, err)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	sshClient, err := ssh.Dial(ctx, fmt.Sprintf("127.0.0.1:%d", sshPort))
+
+	if err != nil {
+		return err
+	}
+
+	defer sshClient.Close()
+
+	for i, p := range options.Ports {
+		port := strconv.Itoa(int(containerPorts[i].ContainerPort))
+
+		// listen on the pod IP, where the service sends traffic
+		l, err := sshClient.Listen("tcp", net.JoinHostPort("0.0.0.0", port))
+
+		if err != nil {
+			return err
+		}
+
+		defer l.Close()
+
+		if err := checkBound(sshClient.Dial, l, net.JoinHostPort(running.Status.PodIP, port)); err != nil {
+			return err
+		}
+
+		go ssh.Forward(l, net.JoinHostPort("127.0.0.1", strconv.Itoa(p.LocalPort)))
+	}
+
+	sshDone := make(chan error, 1)
+
+	go func() {
+		sshDone <- sshClient.Wait()
+		cancel()
+	}()
+
+	// journal the service before touching it, so a crash in between still
+	// leads to a restore, which is a no-op without the annotation
+	resource := kubernetes.NewResource(client, resourceKind, options.Namespace, options.Service)
+	session.Record(resource)
+
+	defer func() {
+		// ctx is done by now; restoring must not be cut short by it
+		restoreCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		cli.Infof("★ restoring selector of service %s/%s...", options.Namespace, options.Service)
+
+		if err := restore(restoreCtx, client, options.Namespace, options.Service); err != nil {
+			cli.Warnf("★ failed to restore service %s/%s, run 'loop cleanup': %v", options.Namespace, options.Service, err)
+			return
+		}
+
+		session.Release(resource)
+	}()
+
+	if err := retarget(ctx, client, options.Namespace, options.Service, pod.Labels); err != nil {
+		return err
+	}
+
+	for _, p := range options.Ports {
+		cli.Infof("★ intercepting %s/%s port %d => tcp://127.0.0.1:%d", options.Namespace, options.Service, p.Port, p.LocalPort)
+	}
+
+	cli.Info("★ Press Ctrl+C to restore the service")
+
+	watchDone := make(chan error, 1)
+
+	go func() {
+		watchDone <- watchIntercept(ctx, client, options.Namespace, options.Service, pod.Labels)
+	}()
+
+	select {
+	case err := <-watchDone:
+		return errOrContext(ctx, err)
+	case err := <-forwardDone:
+		return errOrContext(ctx, err)
+	case err := <-sshDone:
+		return errOrContext(ctx, err)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// selectPorts resolves the intercepted service ports to the ports the pod
+// has to listen on: the target ports, as kube-proxy sends traffic there.
+// Named target ports become named container ports of the same number as the
+// service port.
+func selectPorts(service *corev1.Service, ports []Port) ([]corev1.ContainerPort, error) {
+	var containerPorts []corev1.ContainerPort
+
+	for _, p := range ports {
+		var match *corev1.ServicePort
+
+		for i, port := range service.Spec.Ports {
+			if int(port.Port) == p.Port && (port.Protocol == "" || port.Protocol == corev1.ProtocolTCP) {
+				match = &service.Spec.Ports[i]
+				break
+			}
+		}
+
+		if match == nil {
+			return nil, fmt.Errorf("service %s/%s has no TCP port %d", service.Namespace, service.Name, p.Port)
+		}
+
+		containerPort := corev1.ContainerPort{
+			ContainerPort: match.Port,
+			Protocol:      corev1.ProtocolTCP,
+		}
+
+		if match.TargetPort.IntValue() > 0 {
+			containerPort.ContainerPort = int32(match.TargetPort.IntValue())
+		} else if match.TargetPort.StrVal != "" {
+			containerPort.Name = match.TargetPort.StrVal
+		}
+
+		containerPorts = append(containerPorts, containerPort)
+	}
+
+	return containerPorts, nil
+}
+
+// retarget points the service at the pod labels, keeping the original
+// selector in the annotation.
+func retarget(ctx context.Context, client kubernetes.Client, namespace, name string, labels map[string]string) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		service, err := client.CoreV1().Services(namespace).Get(ctx, name, metav1.GetOptions{})
+
+		if err != nil {
+			return err
+		}
+
+		if _, ok := service.Annotations[Annotation]; ok {
+			return fmt.Errorf("service %s/%s is already intercepted", namespace, name)
+		}
+
+		original, err := json.Marshal(service.Spec.Selector)
+
+		if err != nil {
+			return err
+		}
+
+		if service.Annotations == nil {
+			service.Annotations = make(map[string]string)
+		}
+
+		service.Annotations[Annotation] = string(original)
+		service.Spec.Selector = labels
+
+		_, err = client.CoreV1().Services(namespace).Update(ctx, service, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// restore puts back the selector kept in the annotation. A service without
+// the annotation was restored already, or never retargeted.
+func restore(ctx context.Context, client kubernetes.Client, namespace, name string) error {
+	return restoreSelector(ctx, client, namespace, name, nil)
+}
+
+// restoreSelector is restore that, given labels, leaves the service alone
+// unless it still selects them, so a selector someone changed meanwhile
+// is kept.
+func restoreSelector(ctx context.Context, client kubernetes.Client, namespace, name string, labels map[string]string) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		service, err := client.CoreV1().Services(namespace).Get(ctx, name, metav1.GetOptions{})
+
+		if err != nil {
+			if kubernetes.IsNotFound(err) {
+				return nil
+			}
+
+			return err
+		}
+
+		value, ok := service.Annotations[Annotation]
+
+		if !ok {
+			return nil
+		}
+
+		if labels != nil && !maps.Equal(service.Spec.Selector, labels) {
+			return nil
+		}
+
+		var selector map[string]string
+
+		if err := json.Unmarshal([]byte(value), &selector); err != nil {
+			return fmt.Errorf("invalid %s annotation: %w", Annotation, err)
+		}
+
+		delete(service.Annotations, Annotation)
+		service.Spec.Selector = selector
+
+		_, err = client.CoreV1().Services(namespace).Update(ctx, service, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// watchIntercept returns an error as soon as the service no longer selects
+// the pod, e.g. because the pod restored it while this machine slept past
+// the lease, so the session does not go on intercepting nothing.
+func watchIntercept(ctx context.Context, client kubernetes.Client, namespace, name string, labels map[string]string) error {
+	selector := fields.OneTermEqualSelector("metadata.name", name).String()
+
+	lw := cache.ToListWatcherWithWatchListSemantics(&cache.ListWatch{
+		ListWithContextFunc: func(ctx context.Context, options metav1.ListOptions) (runtime.Object, error) {
+			options.FieldSelector = selector
+			return client.CoreV1().Services(namespace).List(ctx, options)
+		},
+
+		WatchFuncWithContext: func(ctx context.Context, options metav1.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = selector
+			return client.CoreV1().Services(namespace).Watch(ctx, options)
+		},
+	}, client)
+
+	_, err := watchtools.UntilWithSync(ctx, lw, &corev1.Service{}, nil, func(event watch.Event) (bool, error) {
+		if event.Type == watch.Deleted {
+			return false, fmt.Errorf("service %s/%s was deleted", namespace, name)
+		}
+
+		service, ok := event.Object.(*corev1.Service)
+
+		if !ok {
+			return false, nil
+		}
+
+		if _, ok := service.Annotations[Annotation]; !ok || !maps.Equal(service.Spec.Selector, labels) {
+			return false, fmt.Errorf("service %s/%s no longer points at the intercept pod, e.g. because its lease expired while this machine slept; intercept it again", namespace, name)
+		}
+
+		return false, nil
+	})
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	return err
+}
+
+func rollbackIntercept(ctx context.Context, r session.Resource) error {
+	client, err := kubernetes.ResourceClient(ctx, r)
+
+	if err != nil {
+		return err
+	}
+
+	return restore(ctx, client, r.Namespace, r.Name)
+}
+
+func newPod(name, image string, ports []corev1.ContainerPort) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+
+			Labels: map[string]string{
+				"app.kubernetes.io/name":     "loop-intercept",
+				"app.kubernetes.io/instance": name,
+			},
+		},
+
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name:  "tunnel",
+					Image: image,
+
+					Ports: ports,
+				},
+			},
+		},
+	}
+}
+
+func createPod(ctx context.Context, client kubernetes.Client, namespace string, pod *corev1.Pod) error {
+	// journal the pod before creating it, so a crash in between cannot
+	// leak it; rollback of a pod that never got created is a no-op
+	resource := kubernetes.PodResource(client, namespace, pod.Name)
+	session.Record(resource)
+
+	if _, err := client.CoreV1().Pods(namespace).Create(ctx, pod, metav1.CreateOptions{}); err != nil {
+		session.Release(resource)
+		return err
+	}
+
+	return nil
+}
+
+func deletePod(ctx context.Context, client kubernetes.Client, namespace, name string) error {
+	if err := client.CoreV1().Pods(namespace).Delete(ctx, name, metav1.DeleteOptions{}); err != nil && !kubernetes.IsNotFound(err) {
+		return err
+	}
+
+	session.Release(kubernetes.PodResource(client, namespace, name))
+
+	return nil
+}
+
+// ParsePorts parses port arguments of the form service-port:local-port, or a
+// single port for both.
+func ParsePorts(args []string) ([]Port, error) {
+	var result []Port
+
+	seen := map[int]string{}
+
+	for _, arg := range args {
+		remote, local, found := strings.Cut(arg, ":")
+
+		if !found {
+			local = remote
+		}
+
+		port, err := parsePort(remote)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q: %w", arg, err)
+		}
+
+		localPort, err := parsePort(local)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q: %w", arg, err)
+		}
+
+		if prev, ok := seen[port]; ok {
+			return nil, fmt.Errorf("ports %q and %q both intercept port %d", prev, arg, port)
+		}
+
+		seen[port] = arg
+
+		result = append(result, Port{
+			Port:      port,
+			LocalPort: localPort,
+		})
+	}
+
+	return result, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+
+	if err != nil || port <= 0 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+
+	return port, nil
+}
+
+func errOrContext(ctx context.Context, err error) error {
+	if err != nil {
+		return err
+	}
+
+	return ctx.Err()
+}
@@ -0,0 +1,290 @@
+package intercept
+
+import (
+	"maps"
+	"net"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/adrianliechti/loop/pkg/kubernetes"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	coordinationv1client "k8s.io/client-go/kubernetes/typed/coordination/v1"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	rbacv1client "k8s.io/client-go/kubernetes/typed/rbac/v1"
+	"k8s.io/client-go/rest"
+)
+
+// fakeClient serves the typed clients the intercept uses from a fake
+// clientset; anything else panics through the nil embedded Client.
+type fakeClient struct {
+	kubernetes.Client
+
+	clientset *fake.Clientset
+}
+
+func (c *fakeClient) CoreV1() corev1client.CoreV1Interface {
+	return c.clientset.CoreV1()
+}
+
+func (c *fakeClient) Config() *rest.Config {
+	return &rest.Config{Host: "https://cluster.test"}
+}
+
+func (c *fakeClient) RbacV1() rbacv1client.RbacV1Interface {
+	return c.clientset.RbacV1()
+}
+
+func (c *fakeClient) CoordinationV1() coordinationv1client.CoordinationV1Interface {
+	return c.clientset.CoordinationV1()
+}
+
+// IsWatchListSemanticsUnSupported keeps the watches on plain list/watch,
+// which is all the fake clientset implements.
+func (c *fakeClient) IsWatchListSemanticsUnSupported() bool {
+	return c.clientset.IsWatchListSemanticsUnSupported()
+}
+
+func TestParsePorts(t *testing.T) {
+	ports, err := ParsePorts([]string{"8080:3000", "9090"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ports) != 2 || ports[0] != (Port{Port: 8080, LocalPort: 3000}) || ports[1] != (Port{Port: 9090, LocalPort: 9090}) {
+		t.Fatalf("unexpected ports %+v", ports)
+	}
+
+	for _, args := range [][]string{{"8080:"}, {"http:3000"}, {"0"}, {"8080:3000", "8080:4000"}} {
+		if _, err := ParsePorts(args); err == nil {
+			t.Errorf("want an error for %q", args)
+		}
+	}
+}
+
+func TestRetargetRestores(t *testing.T) {
+	selector := map[string]string{"app": "orders"}
+
+	clientset := fake.NewClientset(&corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "orders", Namespace: "shop"},
+
+		Spec: corev1.ServiceSpec{
+			Selector: maps.Clone(selector),
+		},
+	})
+
+	client := &fakeClient{clientset: clientset}
+	labels := map[string]string{"app.kubernetes.io/instance": "loop-intercept-abcdefg"}
+
+	if err := retarget(t.Context(), client, "shop", "orders", labels); err != nil {
+		t.Fatal(err)
+	}
+
+	service, _ := clientset.CoreV1().Services("shop").Get(t.Context(), "orders", metav1.GetOptions{})
+
+	if !maps.Equal(service.Spec.Selector, labels) {
+		t.Fatalf("want the pod selected, got %v", service.Spec.Selector)
+	}
+
+	if err := retarget(t.Context(), client, "shop", "orders", labels); err == nil {
+		t.Fatal("want an error intercepting twice")
+	}
+
+	// restoring twice, as the session and a later rollback may, is harmless
+	for range 2 {
+		if err := restore(t.Context(), client, "shop", "orders"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	service, _ = clientset.CoreV1().Services("shop").Get(t.Context(), "orders", metav1.GetOptions{})
+
+	if !maps.Equal(service.Spec.Selector, selector) {
+		t.Fatalf("want %v restored, got %v", selector, service.Spec.Selector)
+	}
+
+	if _, ok := service.Annotations[Annotation]; ok {
+		t.Fatal("want the annotation removed")
+	}
+}
+
+func TestGuardOwnsEverything(t *testing.T) {
+	clientset := fake.NewClientset()
+	client := &fakeClient{clientset: clientset}
+
+	account, err := createGuard(t.Context(), client, "shop", "loop-intercept-abcdefg", "orders")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	role, err := clientset.RbacV1().Roles("shop").Get(t.Context(), account.Name, metav1.GetOptions{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the pod may only touch the intercepted service and its own objects
+	for _, rule := range role.Rules {
+		if len(rule.ResourceNames) != 1 {
+			t.Errorf("want rules scoped to one resource, got %+v", rule)
+		}
+	}
+
+	if _, err := clientset.CoordinationV1().Leases("shop").Get(t.Context(), account.Name, metav1.GetOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	pod := newPod(account.Name, tunnelImage, nil)
+
+	if err := guardPod(pod, account, restoreImage, "orders"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pod.OwnerReferences) != 1 || pod.OwnerReferences[0].Name != account.Name || pod.Spec.ServiceAccountName != account.Name {
+		t.Fatalf("want the pod owned by and running as the account, got %+v", pod.ObjectMeta.OwnerReferences)
+	}
+
+	// the loop image has no shell; the guard is the binary itself
+	if command := pod.Spec.Containers[1].Command; !slices.Equal(command[:2], []string{"/usr/local/bin/loop", "intercept-guard"}) {
+		t.Errorf("want the restore container to run the guard, got %v", command)
+	}
+}
+
+func TestGuardRestores(t *testing.T) {
+	selector := map[string]string{"app": "orders"}
+	labels := map[string]string{"app.kubernetes.io/instance": "loop-intercept-abcdefg"}
+
+	for _, tc := range []struct {
+		name    string
+		changed map[string]string
+		want    map[string]string
+	}{
+		{name: "stale lease", want: selector},
+		{name: "selector changed meanwhile", changed: map[string]string{"app": "orders-v2"}, want: map[string]string{"app": "orders-v2"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			clientset := fake.NewClientset(&corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{Name: "orders", Namespace: "shop"},
+
+				Spec: corev1.ServiceSpec{
+					Selector: maps.Clone(selector),
+				},
+			})
+
+			client := &fakeClient{clientset: clientset}
+
+			account, err := createGuard(t.Context(), client, "shop", "loop-intercept-abcdefg", "orders")
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := retarget(t.Context(), client, "shop", "orders", labels); err != nil {
+				t.Fatal(err)
+			}
+
+			if tc.changed != nil {
+				service, _ := clientset.CoreV1().Services("shop").Get(t.Context(), "orders", metav1.GetOptions{})
+				service.Spec.Selector = tc.changed
+				clientset.CoreV1().Services("shop").Update(t.Context(), service, metav1.UpdateOptions{})
+			}
+
+			// nobody renews the lease
+			err = Guard(t.Context(), client, "shop", GuardOptions{
+				Name:    account.Name,
+				Service: "orders",
+
+				Labels: labels,
+
+				Interval: 10 * time.Millisecond,
+				TTL:      50 * time.Millisecond,
+			})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			service, _ := clientset.CoreV1().Services("shop").Get(t.Context(), "orders", metav1.GetOptions{})
+
+			if !maps.Equal(service.Spec.Selector, tc.want) {
+				t.Fatalf("want selector %v, got %v", tc.want, service.Spec.Selector)
+			}
+
+			if _, err := clientset.CoreV1().ServiceAccounts("shop").Get(t.Context(), account.Name, metav1.GetOptions{}); !kubernetes.IsNotFound(err) {
+				t.Fatalf("want the account deleted, got %v", err)
+			}
+		})
+	}
+}
+
+func TestWatchIntercept(t *testing.T) {
+	labels := map[string]string{"app.kubernetes.io/instance": "loop-intercept-abcdefg"}
+
+	clientset := fake.NewClientset(&corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "orders", Namespace: "shop"},
+
+		Spec: corev1.ServiceSpec{
+			Selector: map[string]string{"app": "orders"},
+		},
+	})
+
+	client := &fakeClient{clientset: clientset}
+
+	if err := retarget(t.Context(), client, "shop", "orders", labels); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- watchIntercept(t.Context(), client, "shop", "orders", labels)
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("want the watch to go on while intercepted, got %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// the pod restores the service behind the session's back
+	if err := restore(t.Context(), client, "shop", "orders"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("want an error once the service is restored")
+		}
+
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the watch to notice")
+	}
+}
+
+func TestCheckBound(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	port := l.Addr().(*net.TCPAddr).Port
+
+	if err := checkBound(net.Dial, l, l.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	// sshd without GatewayPorts only binds loopback, so the pod IP refuses
+	if err := checkBound(net.Dial, l, net.JoinHostPort("127.0.0.2", strconv.Itoa(port))); err == nil {
+		t.Fatal("want an error when the pod IP is not bound")
+	}
+}
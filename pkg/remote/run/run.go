@@ -12,6 +12,7 @@ import (
 	"github.com/adrianliechti/go-cli"
 	"github.com/adrianliechti/loop/pkg/docker"
 	"github.com/adrianliechti/loop/pkg/kubernetes"
+	"github.com/adrianliechti/loop/pkg/session"
 	"github.com/adrianliechti/loop/pkg/sftp"
 	"github.com/adrianliechti/loop/pkg/ssh"
 	"github.com/adrianliechti/loop/pkg/system"
@@ -267,9 +268,15 @@ func templatePod(container *Container, options *RunOptions) *corev1.Pod {
 }
 
 func createPod(ctx context.Context, client kubernetes.Client, pod *corev1.Pod) error {
+	// journal the pod before creating it, so a crash in between cannot
+	// leak it; rollback of a pod that never got created is a no-op
+	resource := kubernetes.PodResource(client, pod.Namespace, pod.Name)
+	session.Record(resource)
+
 	pod, err := client.CoreV1().Pods(pod.Namespace).Create(ctx, pod, metav1.CreateOptions{})
 
 	if err != nil {
+		session.Release(resource)
 		return err
 	}
 
@@ -287,6 +294,8 @@ func deletePod(ctx context.Context, client kubernetes.Client, namespace, name st
 		return err
 	}
 
+	session.Release(kubernetes.PodResource(client, namespace, name))
+
 	return nil
 }
 
@@ -11,6 +11,7 @@ import (
 
 	"github.com/adrianliechti/go-cli"
 	"github.com/adrianliechti/loop/pkg/kubernetes"
+	"github.com/adrianliechti/loop/pkg/session"
 	"github.com/adrianliechti/loop/pkg/ssh"
 	"github.com/adrianliechti/loop/pkg/system"
 
@@ -308,9 +309,17 @@ func createPod(ctx context.Context, client kubernetes.Client, namespace, name, i
 		},
 	}
 
-	_, err := client.CoreV1().Pods(namespace).Create(ctx, pod, metav1.CreateOptions{})
+	// journal the pod before creating it, so a crash in between cannot
+	// leak it; rollback of a pod that never got created is a no-op
+	resource := kubernetes.PodResource(client, namespace, name)
+	session.Record(resource)
 
-	return err
+	if _, err := client.CoreV1().Pods(namespace).Create(ctx, pod, metav1.CreateOptions{}); err != nil {
+		session.Release(resource)
+		return err
+	}
+
+	return nil
 }
 
 func deletePod(ctx context.Context, client kubernetes.Client, namespace, name string) error {
@@ -318,6 +327,8 @@ func deletePod(ctx context.Context, client kubernetes.Client, namespace, name st
 		return err
 	}
 
+	session.Release(kubernetes.PodResource(client, namespace, name))
+
 	return nil
 }
 
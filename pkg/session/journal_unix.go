@@ -0,0 +1,69 @@
+//go:build darwin || linux
+
+package session
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// systemDir keeps the journals of elevated processes.
+func systemDir() string {
+	if runtime.GOOS == "darwin" {
+		return "/var/db/loop/sessions"
+	}
+
+	return "/var/lib/loop/sessions"
+}
+
+func elevated() bool {
+	return os.Geteuid() == 0
+}
+
+// checkDir makes sure nobody but the current user, or root for the system
+// directory, can add or replace journals in dir.
+func checkDir(dir string) error {
+	info, err := os.Lstat(dir)
+
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		return fmt.Errorf("session directory %s is not a directory", dir)
+	}
+
+	uid, mask := os.Geteuid(), os.FileMode(0077)
+
+	if dir == systemDir() {
+		uid, mask = 0, 0022
+	}
+
+	if owner(info) != uid {
+		return fmt.Errorf("session directory %s is owned by another user", dir)
+	}
+
+	if info.Mode().Perm()&mask != 0 {
+		return fmt.Errorf("session directory %s is accessible to other users", dir)
+	}
+
+	return nil
+}
+
+// trusted reports whether a file belongs to the current user or root.
+func trusted(info os.FileInfo) bool {
+	uid := owner(info)
+	return uid == os.Geteuid() || uid == 0
+}
+
+func owner(info os.FileInfo) int {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+
+	if !ok {
+		return -1
+	}
+
+	return int(stat.Uid)
+}
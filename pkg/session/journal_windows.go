@@ -0,0 +1,36 @@
+//go:build windows
+
+package session
+
+import (
+	"fmt"
+	"os"
+)
+
+// systemDir is the same as the user's: elevated processes on Windows run as
+// the same user, and the profile is private to it.
+func systemDir() string {
+	return Dir()
+}
+
+func elevated() bool {
+	return false
+}
+
+func checkDir(dir string) error {
+	info, err := os.Lstat(dir)
+
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		return fmt.Errorf("session directory %s is not a directory", dir)
+	}
+
+	return nil
+}
+
+func trusted(info os.FileInfo) bool {
+	return true
+}
@@ -0,0 +1,23 @@
+//go:build windows
+
+package session
+
+import "os"
+
+// ProcessAlive reports whether a process with the given PID exists.
+func ProcessAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+
+	// FindProcess opens a handle on Windows, which fails for unknown PIDs
+	p, err := os.FindProcess(pid)
+
+	if err != nil {
+		return false
+	}
+
+	p.Release()
+
+	return true
+}
@@ -0,0 +1,367 @@
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Session is the journal of one loop process: the local and cluster state it
+// changed and has not reverted yet. If the process dies before reverting, a
+// later process finds the journal and rolls the changes back.
+type Session struct {
+	PID     int       `json:"pid"`
+	Command []string  `json:"command"`
+	Started time.Time `json:"started"`
+
+	Resources []Resource `json:"resources"`
+
+	// dir is the directory the journal was read from or is written to.
+	dir string
+}
+
+// Resource is one change to roll back, e.g. a hosts section or a pod.
+type Resource struct {
+	Kind string `json:"kind"`
+
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+
+	// Attributes carry what the rollback needs beyond the name, e.g. the
+	// kubeconfig context a pod was created in.
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+func (r Resource) String() string {
+	if r.Namespace != "" {
+		return fmt.Sprintf("%s %s/%s", r.Kind, r.Namespace, r.Name)
+	}
+
+	return fmt.Sprintf("%s %s", r.Kind, r.Name)
+}
+
+func (r Resource) same(o Resource) bool {
+	return r.Kind == o.Kind && r.Namespace == o.Namespace && r.Name == o.Name
+}
+
+// RollbackFunc reverts a resource left behind by a dead session.
+type RollbackFunc func(ctx context.Context, r Resource) error
+
+var (
+	handlersMu sync.Mutex
+	handlers   = make(map[string]RollbackFunc)
+
+	mu      sync.Mutex
+	current *Session
+)
+
+// Register sets how resources of the given kind are rolled back. Packages
+// register their kinds in init, next to the code that creates them.
+func Register(kind string, fn RollbackFunc) {
+	handlersMu.Lock()
+	defer handlersMu.Unlock()
+
+	handlers[kind] = fn
+}
+
+// Record adds a resource to the journal of the running process.
+func Record(r Resource) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if current == nil {
+		current = &Session{
+			PID:     os.Getpid(),
+			Command: os.Args[1:],
+			Started: time.Now(),
+
+			dir: Dir(),
+		}
+	}
+
+	if slices.ContainsFunc(current.Resources, r.same) {
+		return
+	}
+
+	current.Resources = append(current.Resources, r)
+
+	if err := save(current); err != nil {
+		slog.Warn("failed to write session journal", "error", err)
+	}
+}
+
+// Release removes a resource that was reverted from the journal of the
+// running process. The journal is deleted once it is empty.
+func Release(r Resource) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if current == nil || !slices.ContainsFunc(current.Resources, r.same) {
+		return
+	}
+
+	current.Resources = slices.DeleteFunc(current.Resources, r.same)
+
+	if err := save(current); err != nil {
+		slog.Warn("failed to write session journal", "error", err)
+	}
+}
+
+// List returns the journals of all sessions, running or not: those of the
+// current user and, for regular users, those of elevated processes.
+func List() ([]*Session, error) {
+	dirs := []string{Dir()}
+
+	if dir := systemDir(); dir != Dir() {
+		dirs = append(dirs, dir)
+	}
+
+	var result []*Session
+
+	for _, dir := range dirs {
+		sessions, err := listDir(dir)
+
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, sessions...)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Started.Before(result[j].Started)
+	})
+
+	return result, nil
+}
+
+// listDir reads the journals in dir. Journals are trusted to name what to
+// roll back, so only those owned by the current user or root are read.
+func listDir(dir string) ([]*Session, error) {
+	if err := checkDir(dir); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*Session
+
+	for _, path := range paths {
+		info, err := os.Lstat(path)
+
+		if err != nil || !info.Mode().IsRegular() || !trusted(info) {
+			continue
+		}
+
+		data, err := os.ReadFile(path)
+
+		if err != nil {
+			continue
+		}
+
+		var s Session
+
+		if err := json.Unmarshal(data, &s); err != nil || s.PID == 0 {
+			continue
+		}
+
+		s.dir = dir
+		result = append(result, &s)
+	}
+
+	return result, nil
+}
+
+// Alive reports whether the process owning the session is still running.
+func (s *Session) Alive() bool {
+	return s.PID == os.Getpid() || ProcessAlive(s.PID)
+}
+
+// Recover rolls back the sessions of the current user whose process is
+// gone. Resources that cannot be reverted, e.g. for lack of permissions,
+// stay in the journal and are reported in the returned sessions, as are
+// dead sessions of elevated processes.
+func Recover(ctx context.Context) ([]*Session, error) {
+	sessions, err := List()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*Session
+	var errs error
+
+	for _, s := range sessions {
+		if s.Alive() {
+			continue
+		}
+
+		if s.dir != Dir() {
+			result = append(result, s)
+			continue
+		}
+
+		if err := s.Rollback(ctx); err != nil {
+			errs = errors.Join(errs, err)
+		}
+
+		if len(s.Resources) > 0 {
+			result = append(result, s)
+		}
+	}
+
+	return result, errs
+}
+
+// Rollback reverts the resources of a dead session, newest first, and
+// updates its journal with whatever is left.
+func (s *Session) Rollback(ctx context.Context) error {
+	var remaining []Resource
+	var errs error
+
+	for _, r := range slices.Backward(s.Resources) {
+		handlersMu.Lock()
+		fn, ok := handlers[r.Kind]
+		handlersMu.Unlock()
+
+		if !ok {
+			remaining = append(remaining, r)
+			continue
+		}
+
+		if err := fn(ctx, r); err != nil {
+			errs = errors.Join(errs, fmt.Errorf("%s: %w", r, err))
+			remaining = append(remaining, r)
+
+			continue
+		}
+
+		slog.InfoContext(ctx, "rolled back stale session resource", "pid", s.PID, "resource", r.String())
+	}
+
+	slices.Reverse(remaining)
+	s.Resources = remaining
+
+	if err := save(s); err != nil {
+		errs = errors.Join(errs, err)
+	}
+
+	return errs
+}
+
+// Dir is where the journals of the current user are kept: a private
+// directory for regular users, a root-owned one for elevated processes.
+// Both survive reboots, since the hosts file does.
+func Dir() string {
+	if elevated() {
+		return systemDir()
+	}
+
+	dir, err := os.UserCacheDir()
+
+	if err != nil {
+		dir = os.TempDir()
+	}
+
+	return filepath.Join(dir, "loop", "sessions")
+}
+
+func save(s *Session) error {
+	dir := s.dir
+
+	if dir == "" {
+		dir = Dir()
+	}
+
+	path := filepath.Join(dir, strconv.Itoa(s.PID)+".json")
+
+	if len(s.Resources) == 0 {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+
+		return nil
+	}
+
+	if err := ensureDir(dir); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(s, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	// write to a fresh temporary file first so a crash never leaves a torn
+	// journal; CreateTemp never opens an existing file
+	f, err := os.CreateTemp(dir, ".journal-*")
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+
+	// regular users read the journals of elevated processes to report them
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// ensureDir creates dir, private to the user or root-owned and read-only
+// for others, and refuses one that someone else created or can write to.
+func ensureDir(dir string) error {
+	perm := os.FileMode(0700)
+
+	if dir == systemDir() {
+		perm = 0755
+	}
+
+	if err := os.MkdirAll(dir, perm); err != nil {
+		return err
+	}
+
+	return checkDir(dir)
+}
+
+// Summary describes the resources of a session in one line.
+func (s *Session) Summary() string {
+	var items []string
+
+	for _, r := range s.Resources {
+		items = append(items, r.String())
+	}
+
+	return strings.Join(items, ", ")
+}
@@ -0,0 +1,262 @@
+// Package istio finds the hosts of Istio Gateways and the VirtualServices
+// bound to them. Their traffic enters through the ingress gateway pods a
+// Gateway selects.
+package istio
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/adrianliechti/loop/pkg/kubernetes"
+	"github.com/adrianliechti/loop/pkg/source"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var (
+	gatewayResources = []schema.GroupVersionResource{
+		{Group: "networking.istio.io", Version: "v1", Resource: "gateways"},
+		{Group: "networking.istio.io", Version: "v1beta1", Resource: "gateways"},
+	}
+
+	virtualServiceResources = []schema.GroupVersionResource{
+		{Group: "networking.istio.io", Version: "v1", Resource: "virtualservices"},
+		{Group: "networking.istio.io", Version: "v1beta1", Resource: "virtualservices"},
+	}
+)
+
+// meshGateway is the reserved gateway name for sidecar routing, which has
+// no ingress to tunnel to.
+const meshGateway = "mesh"
+
+type Source struct {
+	client     kubernetes.Client
+	namespaces []string
+
+	mu              sync.Mutex
+	gateways        []*source.Store
+	virtualServices []*source.Store
+}
+
+// New returns a source for the VirtualServices in namespaces, or all
+// namespaces if there are none given.
+func New(client kubernetes.Client, namespaces []string) *Source {
+	return &Source{
+		client:     client,
+		namespaces: namespaces,
+	}
+}
+
+func (s *Source) Name() string {
+	return "istio"
+}
+
+// Start watches the Gateways and VirtualServices. Gateways usually live
+// with the ingress gateway in istio-system, so they are watched across
+// namespaces, falling back to the scoped namespaces without permission.
+func (s *Source) Start(ctx context.Context, notify func()) error {
+	namespaces := s.namespaces
+
+	if len(namespaces) == 0 {
+		namespaces = []string{""}
+	}
+
+	gateways, err := source.Watch(ctx, s.client, "", notify, gatewayResources...)
+
+	if err != nil && !kubernetes.IsForbidden(err) {
+		return err
+	}
+
+	var gatewayStores []*source.Store
+
+	if err == nil {
+		if gateways == nil {
+			return nil
+		}
+
+		gatewayStores = append(gatewayStores, gateways)
+	} else {
+		for _, namespace := range namespaces {
+			store, err := source.Watch(ctx, s.client, namespace, notify, gatewayResources...)
+
+			if err != nil {
+				return err
+			}
+
+			// not served in this namespace; the others may still be
+			if store == nil {
+				continue
+			}
+
+			gatewayStores = append(gatewayStores, store)
+		}
+	}
+
+	var virtualServiceStores []*source.Store
+
+	for _, namespace := range namespaces {
+		store, err := source.Watch(ctx, s.client, namespace, notify, virtualServiceResources...)
+
+		if err != nil {
+			return err
+		}
+
+		virtualServiceStores = append(virtualServiceStores, store)
+	}
+
+	s.mu.Lock()
+	s.gateways = gatewayStores
+	s.virtualServices = virtualServiceStores
+	s.mu.Unlock()
+
+	return nil
+}
+
+// Routes returns the hosts of the Gateways, then those of the
+// VirtualServices bound to them, each entering through the pods the
+// Gateway selects.
+func (s *Source) Routes() []source.Route {
+	s.mu.Lock()
+	gatewayStores := s.gateways
+	virtualServiceStores := s.virtualServices
+	s.mu.Unlock()
+
+	gateways := make(map[string]*unstructured.Unstructured)
+
+	var result []source.Route
+
+	for _, store := range gatewayStores {
+		for _, g := range store.List() {
+			gateways[g.GetNamespace()+"/"+g.GetName()] = g
+
+			selector := gatewaySelector(g)
+
+			for _, server := range gatewayServers(g) {
+				if !concrete(server.host) {
+					continue
+				}
+
+				result = append(result, source.Route{
+					Host:     server.host,
+					Selector: selector,
+					Object:   g,
+				})
+			}
+		}
+	}
+
+	for _, store := range virtualServiceStores {
+		for _, vs := range store.List() {
+			hosts, _, _ := unstructured.NestedStringSlice(vs.Object, "spec", "hosts")
+			refs, _, _ := unstructured.NestedStringSlice(vs.Object, "spec", "gateways")
+
+			for _, ref := range refs {
+				if ref == meshGateway {
+					continue
+				}
+
+				namespace, name, ok := strings.Cut(ref, "/")
+
+				if !ok {
+					namespace, name = vs.GetNamespace(), ref
+				}
+
+				g, ok := gateways[namespace+"/"+name]
+
+				if !ok {
+					continue
+				}
+
+				for _, host := range hosts {
+					if !concrete(host) || !serves(g, vs.GetNamespace(), host) {
+						continue
+					}
+
+					result = append(result, source.Route{
+						Host:     strings.ToLower(host),
+						Selector: gatewaySelector(g),
+						Object:   vs,
+					})
+				}
+			}
+		}
+	}
+
+	return result
+}
+
+type server struct {
+	// namespace restricts the VirtualServices that may bind the host: "*"
+	// for any, "." for the gateway's own namespace.
+	namespace string
+	host      string
+}
+
+// gatewayServers returns the hosts of a Gateway's servers, which take the
+// form [namespace/]host.
+func gatewayServers(g *unstructured.Unstructured) []server {
+	servers, _, _ := unstructured.NestedSlice(g.Object, "spec", "servers")
+
+	var result []server
+
+	for _, item := range servers {
+		m, ok := item.(map[string]interface{})
+
+		if !ok {
+			continue
+		}
+
+		hosts, _, _ := unstructured.NestedStringSlice(m, "hosts")
+
+		for _, h := range hosts {
+			namespace, host, ok := strings.Cut(h, "/")
+
+			if !ok {
+				namespace, host = "*", h
+			}
+
+			if namespace == "." {
+				namespace = g.GetNamespace()
+			}
+
+			result = append(result, server{namespace: namespace, host: strings.ToLower(host)})
+		}
+	}
+
+	return result
+}
+
+func gatewaySelector(g *unstructured.Unstructured) map[string]string {
+	selector, _, _ := unstructured.NestedStringMap(g.Object, "spec", "selector")
+	return selector
+}
+
+// serves reports whether a Gateway accepts host from a VirtualService in
+// namespace.
+func serves(g *unstructured.Unstructured, namespace, host string) bool {
+	host = strings.ToLower(host)
+
+	for _, s := range gatewayServers(g) {
+		if s.namespace != "*" && s.namespace != namespace {
+			continue
+		}
+
+		if s.host == "*" || s.host == host {
+			return true
+		}
+
+		if suffix, ok := strings.CutPrefix(s.host, "*"); ok && strings.HasSuffix(host, suffix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// concrete reports whether host names a single host, as only those can be
+// published.
+func concrete(host string) bool {
+	return host != "" && !strings.Contains(host, "*")
+}
@@ -0,0 +1,96 @@
+package istio
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/adrianliechti/loop/pkg/kubernetes"
+	"github.com/adrianliechti/loop/pkg/source"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/fake"
+)
+
+// fakeClient serves the dynamic client from a fake; anything else panics
+// through the nil embedded Client.
+type fakeClient struct {
+	kubernetes.Client
+
+	dynamic *fake.FakeDynamicClient
+}
+
+func (c *fakeClient) Resource(resource schema.GroupVersionResource) dynamic.NamespaceableResourceInterface {
+	return c.dynamic.Resource(resource)
+}
+
+func (c *fakeClient) IsWatchListSemanticsUnSupported() bool {
+	return true
+}
+
+func TestRoutes(t *testing.T) {
+	gateway := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "networking.istio.io/v1",
+		"kind":       "Gateway",
+		"metadata":   map[string]interface{}{"namespace": "istio-system", "name": "public"},
+		"spec": map[string]interface{}{
+			"selector": map[string]interface{}{"istio": "ingressgateway"},
+			"servers": []interface{}{
+				map[string]interface{}{"hosts": []interface{}{"*/*.example.com", "./status.example.com"}},
+			},
+		},
+	}}
+
+	virtualService := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "networking.istio.io/v1",
+		"kind":       "VirtualService",
+		"metadata":   map[string]interface{}{"namespace": "shop", "name": "shop"},
+		"spec": map[string]interface{}{
+			"hosts":    []interface{}{"shop.example.com", "shop.other.com", "*.example.com"},
+			"gateways": []interface{}{"istio-system/public", "mesh"},
+		},
+	}}
+
+	client := &fakeClient{
+		dynamic: fake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+			gatewayResources[0]:        "GatewayList",
+			virtualServiceResources[0]: "VirtualServiceList",
+		}),
+	}
+
+	for gvr, obj := range map[schema.GroupVersionResource]*unstructured.Unstructured{
+		gatewayResources[0]:        gateway,
+		virtualServiceResources[0]: virtualService,
+	} {
+		if _, err := client.Resource(gvr).Namespace(obj.GetNamespace()).Create(t.Context(), obj, metav1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := New(client, []string{"shop"})
+
+	if err := s.Start(t.Context(), func() {}); err != nil {
+		t.Fatal(err)
+	}
+
+	var hosts []string
+
+	for _, r := range s.Routes() {
+		if r.Selector["istio"] != "ingressgateway" {
+			t.Errorf("%s: want the gateway selector, got %v", r.Host, r.Selector)
+		}
+
+		hosts = append(hosts, r.Host)
+	}
+
+	// shop.other.com is not served by the gateway, *.example.com names no
+	// single host
+	if want := []string{"status.example.com", "shop.example.com"}; !slices.Equal(hosts, want) {
+		t.Fatalf("want %v, got %v", want, hosts)
+	}
+}
+
+var _ source.Source = (*Source)(nil)
@@ -0,0 +1,173 @@
+// Package knative finds the URLs of Knative Services. Their traffic enters
+// through the networking layer, e.g. Kourier or an Istio gateway, which
+// Knative reports on the Ingress it creates for each Service.
+package knative
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/adrianliechti/loop/pkg/kubernetes"
+	"github.com/adrianliechti/loop/pkg/source"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var (
+	serviceResource = schema.GroupVersionResource{Group: "serving.knative.dev", Version: "v1", Resource: "services"}
+	ingressResource = schema.GroupVersionResource{Group: "networking.internal.knative.dev", Version: "v1alpha1", Resource: "ingresses"}
+)
+
+type Source struct {
+	client     kubernetes.Client
+	namespaces []string
+
+	mu        sync.Mutex
+	services  []*source.Store
+	ingresses []*source.Store
+}
+
+// New returns a source for the Knative Services in namespaces, or all
+// namespaces if there are none given.
+func New(client kubernetes.Client, namespaces []string) *Source {
+	return &Source{
+		client:     client,
+		namespaces: namespaces,
+	}
+}
+
+func (s *Source) Name() string {
+	return "knative"
+}
+
+func (s *Source) Start(ctx context.Context, notify func()) error {
+	namespaces := s.namespaces
+
+	if len(namespaces) == 0 {
+		namespaces = []string{""}
+	}
+
+	var services, ingresses []*source.Store
+
+	for _, namespace := range namespaces {
+		store, err := source.Watch(ctx, s.client, namespace, notify, serviceResource)
+
+		if err != nil {
+			return err
+		}
+
+		// not served in this namespace; the others may still be
+		if store == nil {
+			continue
+		}
+
+		services = append(services, store)
+
+		store, err = source.Watch(ctx, s.client, namespace, notify, ingressResource)
+
+		if err != nil {
+			return err
+		}
+
+		ingresses = append(ingresses, store)
+	}
+
+	s.mu.Lock()
+	s.services = services
+	s.ingresses = ingresses
+	s.mu.Unlock()
+
+	return nil
+}
+
+// Routes returns the URL host of every Knative Service reachable from
+// outside the cluster. Cluster-local Services are left to the catapult,
+// which already serves their private services.
+func (s *Source) Routes() []source.Route {
+	s.mu.Lock()
+	services := s.services
+	ingresses := s.ingresses
+	s.mu.Unlock()
+
+	var result []source.Route
+
+	for i, store := range services {
+		for _, svc := range store.List() {
+			host := serviceHost(svc)
+
+			if host == "" || strings.HasSuffix(host, ".svc.cluster.local") || strings.HasSuffix(host, ".svc") {
+				continue
+			}
+
+			route := source.Route{
+				Host:   host,
+				Object: svc,
+			}
+
+			// The Ingress is named after the Route, which is named after
+			// the Service.
+			if ing, ok := ingresses[i].Get(svc.GetNamespace(), svc.GetName()); ok {
+				route.Service, route.Address = ingressEntry(ing)
+			}
+
+			result = append(result, route)
+		}
+	}
+
+	return result
+}
+
+func serviceHost(svc *unstructured.Unstructured) string {
+	raw, _, _ := unstructured.NestedString(svc.Object, "status", "url")
+
+	u, err := url.Parse(raw)
+
+	if err != nil {
+		return ""
+	}
+
+	return strings.ToLower(u.Hostname())
+}
+
+// ingressEntry returns the networking layer service of an Ingress as
+// namespace/name, or else its load balancer address.
+func ingressEntry(ing *unstructured.Unstructured) (string, string) {
+	entries, ok, _ := unstructured.NestedSlice(ing.Object, "status", "publicLoadBalancer", "ingress")
+
+	// older releases report a single load balancer
+	if !ok {
+		entries, _, _ = unstructured.NestedSlice(ing.Object, "status", "loadBalancer", "ingress")
+	}
+
+	var address string
+
+	for _, item := range entries {
+		m, ok := item.(map[string]interface{})
+
+		if !ok {
+			continue
+		}
+
+		// e.g. kourier.kourier-system.svc.cluster.local
+		if internal, _, _ := unstructured.NestedString(m, "domainInternal"); internal != "" {
+			parts := strings.Split(internal, ".")
+
+			if len(parts) >= 3 && parts[2] == "svc" {
+				return parts[1] + "/" + parts[0], ""
+			}
+		}
+
+		if ip, _, _ := unstructured.NestedString(m, "ip"); ip != "" {
+			address = ip
+		}
+
+		if domain, _, _ := unstructured.NestedString(m, "domain"); domain != "" && address == "" {
+			address = domain
+		}
+	}
+
+	return "", address
+}
@@ -0,0 +1,90 @@
+package knative
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/adrianliechti/loop/pkg/kubernetes"
+	"github.com/adrianliechti/loop/pkg/source"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// fakeClient serves the dynamic client from a fake; anything else panics
+// through the nil embedded Client.
+type fakeClient struct {
+	kubernetes.Client
+
+	dynamic *fake.FakeDynamicClient
+}
+
+func (c *fakeClient) Resource(resource schema.GroupVersionResource) dynamic.NamespaceableResourceInterface {
+	return c.dynamic.Resource(resource)
+}
+
+func (c *fakeClient) IsWatchListSemanticsUnSupported() bool {
+	return true
+}
+
+func TestRoutesAcrossNamespaces(t *testing.T) {
+	service := func(namespace, name, url string) *unstructured.Unstructured {
+		return &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "serving.knative.dev/v1",
+			"kind":       "Service",
+			"metadata":   map[string]interface{}{"namespace": namespace, "name": name},
+			"status":     map[string]interface{}{"url": url},
+		}}
+	}
+
+	client := &fakeClient{
+		dynamic: fake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+			serviceResource: "ServiceList",
+			ingressResource: "IngressList",
+		}),
+	}
+
+	for _, obj := range []*unstructured.Unstructured{
+		service("shop", "orders", "https://orders.shop.example.com"),
+		service("blog", "posts", "https://posts.blog.example.com"),
+		service("blog", "drafts", "http://drafts.blog.svc.cluster.local"),
+	} {
+		if _, err := client.Resource(serviceResource).Namespace(obj.GetNamespace()).Create(t.Context(), obj, metav1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Knative is not served in the first namespace
+	client.dynamic.PrependReactor("list", "services", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetNamespace() != "legacy" {
+			return false, nil, nil
+		}
+
+		return true, nil, apierrors.NewNotFound(serviceResource.GroupResource(), "")
+	})
+
+	s := New(client, []string{"legacy", "shop", "blog"})
+
+	if err := s.Start(t.Context(), func() {}); err != nil {
+		t.Fatal(err)
+	}
+
+	var hosts []string
+
+	for _, r := range s.Routes() {
+		hosts = append(hosts, r.Host)
+	}
+
+	// drafts is cluster-local and left to the catapult
+	if want := []string{"orders.shop.example.com", "posts.blog.example.com"}; !slices.Equal(hosts, want) {
+		t.Fatalf("want %v, got %v", want, hosts)
+	}
+}
+
+var _ source.Source = (*Source)(nil)
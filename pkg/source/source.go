@@ -0,0 +1,184 @@
+// Package source defines how the gateway and catapult learn about hosts:
+// their own Services, Ingresses and Gateway API resources, and those of a
+// service mesh or serverless platform, which sources watch through the
+// dynamic client with the help of this package.
+package source
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/adrianliechti/loop/pkg/kubernetes"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Source turns cluster objects into routes. Start begins watching and
+// calls notify whenever the routes may have changed; Routes must be safe
+// to call concurrently with the watch.
+type Source interface {
+	Name() string
+
+	Start(ctx context.Context, notify func()) error
+
+	Routes() []Route
+}
+
+// Route is a host and where its traffic enters the cluster. The entry is
+// given by whichever the source knows: the service itself, the labels of
+// the data plane pods, or the address the host resolves to.
+type Route struct {
+	Host string
+
+	// Service is the data plane service as namespace/name.
+	Service string
+
+	// Selector matches the labels of the data plane pods; the service
+	// selecting them is used.
+	Selector map[string]string
+
+	// Address is a load balancer IP or hostname.
+	Address string
+
+	// Object is the resource the route was found on, for filtering and
+	// reporting.
+	Object metav1.Object
+}
+
+// Store caches the objects of a resource, keyed by namespace/name.
+type Store struct {
+	mu    sync.Mutex
+	items map[string]*unstructured.Unstructured
+}
+
+// List returns the cached objects sorted by namespace/name.
+func (s *Store) List() []*unstructured.Unstructured {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := make([]*unstructured.Unstructured, 0, len(s.items))
+
+	for _, obj := range s.items {
+		result = append(result, obj)
+	}
+
+	slices.SortFunc(result, func(a, b *unstructured.Unstructured) int {
+		return strings.Compare(key(a), key(b))
+	})
+
+	return result
+}
+
+// Get returns the cached object namespace/name.
+func (s *Store) Get(namespace, name string) (*unstructured.Unstructured, bool) {
+	if s == nil {
+		return nil, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	obj, ok := s.items[namespace+"/"+name]
+
+	return obj, ok
+}
+
+// Watch caches a resource in namespace, or all namespaces if it is empty.
+// The versions are tried in order; if the cluster serves none of them,
+// e.g. because the platform is not installed, Watch returns a nil store,
+// which lists nothing.
+func Watch(ctx context.Context, client kubernetes.Client, namespace string, notify func(), versions ...schema.GroupVersionResource) (*Store, error) {
+	for _, gvr := range versions {
+		resource := client.Resource(gvr).Namespace(namespace)
+
+		list, err := resource.List(ctx, metav1.ListOptions{})
+
+		if err != nil {
+			if kubernetes.IsNotFound(err) {
+				continue
+			}
+
+			return nil, err
+		}
+
+		s := &Store{
+			items: make(map[string]*unstructured.Unstructured),
+		}
+
+		for i := range list.Items {
+			s.items[key(&list.Items[i])] = &list.Items[i]
+		}
+
+		set := func(obj interface{}) {
+			u, ok := obj.(*unstructured.Unstructured)
+
+			if !ok {
+				return
+			}
+
+			s.mu.Lock()
+			s.items[key(u)] = u
+			s.mu.Unlock()
+
+			notify()
+		}
+
+		handlers := cache.ResourceEventHandlerFuncs{
+			AddFunc: set,
+
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				set(newObj)
+			},
+
+			DeleteFunc: func(obj interface{}) {
+				if d, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+					obj = d.Obj
+				}
+
+				u, ok := obj.(*unstructured.Unstructured)
+
+				if !ok {
+					return
+				}
+
+				s.mu.Lock()
+				delete(s.items, key(u))
+				s.mu.Unlock()
+
+				notify()
+			},
+		}
+
+		watcher := cache.ToListWatcherWithWatchListSemantics(&cache.ListWatch{
+			ListWithContextFunc: func(ctx context.Context, options metav1.ListOptions) (runtime.Object, error) {
+				return resource.List(ctx, options)
+			},
+
+			WatchFuncWithContext: func(ctx context.Context, options metav1.ListOptions) (watch.Interface, error) {
+				return resource.Watch(ctx, options)
+			},
+		}, client)
+
+		_, controller := cache.NewInformer(watcher, &unstructured.Unstructured{}, 0, handlers)
+		go controller.Run(ctx.Done())
+
+		return s, nil
+	}
+
+	return nil, nil
+}
+
+func key(obj metav1.Object) string {
+	return obj.GetNamespace() + "/" + obj.GetName()
+}
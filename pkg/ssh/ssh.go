@@ -239,6 +239,54 @@ func (c *Client) Run(ctx context.Context) error {
 	return nil
 }
 
+// Dial establishes an SSH connection without opening a session. The returned
+// client can dial TCP connections from the remote side (direct-tcpip) and
+// is closed when ctx is cancelled.
+func Dial(ctx context.Context, addr string, options ...Option) (*ssh.Client, error) {
+	c := New(addr, options...)
+
+	config := &ssh.ClientConfig{
+		User: c.username,
+
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+
+	dialer := &net.Dialer{Timeout: 15 * time.Second}
+
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	stopConn := context.AfterFunc(ctx, func() { conn.Close() })
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+
+	stopConn()
+
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		return nil, err
+	}
+
+	client := ssh.NewClient(sshConn, chans, reqs)
+
+	context.AfterFunc(ctx, func() { client.Close() })
+
+	return client, nil
+}
+
+// Forward accepts connections on l, e.g. a listener on the remote side of
+// a client from Dial, and connects each to addr on this side until l is
+// closed.
+func Forward(l net.Listener, addr string) error {
+	return tunnelConnections(l, &net.Dialer{}, addr)
+}
+
 type dialer interface {
 	Dial(network, addr string) (net.Conn, error)
 }
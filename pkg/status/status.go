@@ -0,0 +1,238 @@
+package status
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adrianliechti/loop/pkg/forward"
+	"github.com/adrianliechti/loop/pkg/session"
+)
+
+// Status describes one running `loop connect` session.
+type Status struct {
+	PID     int       `json:"pid"`
+	Started time.Time `json:"started"`
+
+	Tunnels []Tunnel `json:"tunnels"`
+}
+
+// Tunnel describes one local address and the workloads behind it.
+type Tunnel struct {
+	Source  string `json:"source"`
+	Cluster string `json:"cluster,omitempty"`
+
+	Address  string   `json:"address"`
+	Hosts    []string `json:"hosts"`
+	Ports    []int    `json:"ports,omitempty"`
+	UDPPorts []int    `json:"udpPorts,omitempty"`
+
+	// Targets are the endpoints connections are spread across; Target is
+	// the one the latest connection went to.
+	Targets []string `json:"targets,omitempty"`
+	Target  string   `json:"target,omitempty"`
+
+	Active        int64 `json:"active"`
+	BytesSent     int64 `json:"bytesSent"`
+	BytesReceived int64 `json:"bytesReceived"`
+
+	LastError     string     `json:"lastError,omitempty"`
+	LastErrorTime *time.Time `json:"lastErrorTime,omitempty"`
+}
+
+// NewTunnel describes a tunnel listening on address with the given service
+// port mappings and traffic counters.
+func NewTunnel(address string, hosts []string, ports, udpPorts map[int]int, stats *forward.Stats) Tunnel {
+	sent, received := stats.Bytes()
+
+	t := Tunnel{
+		Address:  address,
+		Hosts:    slices.Clone(hosts),
+		Ports:    slices.Sorted(maps.Keys(ports)),
+		UDPPorts: slices.Sorted(maps.Keys(udpPorts)),
+
+		Active:        stats.Active(),
+		BytesSent:     sent,
+		BytesReceived: received,
+	}
+
+	if err, at := stats.LastError(); err != nil {
+		t.LastError = err.Error()
+		t.LastErrorTime = &at
+	}
+
+	return t
+}
+
+// Source reports the tunnels of a component such as the catapult.
+type Source interface {
+	Status() []Tunnel
+}
+
+type Server struct {
+	options ServerOptions
+	started time.Time
+}
+
+type ServerOptions struct {
+	// Path of the unix socket; defaults to a per-process socket that
+	// List discovers.
+	Path string
+
+	Sources []Source
+}
+
+func New(options ServerOptions) *Server {
+	if options.Path == "" {
+		options.Path = filepath.Join(socketDir(), fmt.Sprintf("%s%d.sock", socketPrefix, os.Getpid()))
+	}
+
+	return &Server{
+		options: options,
+		started: time.Now(),
+	}
+}
+
+// Start serves the status on the unix socket until ctx is cancelled.
+func (s *Server) Start(ctx context.Context) error {
+	l, err := listen(s.options.Path)
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(s.options.Path)
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.Status())
+	})
+
+	server := &http.Server{
+		Handler: mux,
+	}
+
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	if err := server.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
+
+// Status collects the current tunnels of every source.
+func (s *Server) Status() Status {
+	result := Status{
+		PID:     os.Getpid(),
+		Started: s.started,
+
+		Tunnels: make([]Tunnel, 0),
+	}
+
+	for _, source := range s.options.Sources {
+		result.Tunnels = append(result.Tunnels, source.Status()...)
+	}
+
+	return result
+}
+
+// List queries every running session. Sockets nobody answers on are left
+// over from sessions that died and are removed.
+func List(ctx context.Context) ([]Status, error) {
+	paths, err := filepath.Glob(filepath.Join(socketDir(), socketPrefix+"*.sock"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	var result []Status
+
+	for _, path := range paths {
+		status, err := Get(ctx, path)
+
+		if err != nil {
+			var netErr *net.OpError
+
+			if errors.As(err, &netErr) && netErr.Op == "dial" && !processAlive(path) {
+				os.Remove(path)
+			}
+
+			continue
+		}
+
+		result = append(result, *status)
+	}
+
+	return result, nil
+}
+
+// Get queries the session listening on the socket at path.
+func Get(ctx context.Context, path string) (*Status, error) {
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://loop/status", nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	var status Status
+
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, err
+	}
+
+	return &status, nil
+}
+
+const socketPrefix = "loop-connect-"
+
+// processAlive reports whether the session that created the socket at path
+// is still running, judging by the PID in its name.
+func processAlive(path string) bool {
+	name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), socketPrefix), ".sock")
+	pid, err := strconv.Atoi(name)
+
+	if err != nil {
+		return false
+	}
+
+	return session.ProcessAlive(pid)
+}
@@ -0,0 +1,95 @@
+//go:build darwin || linux
+
+package status
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// socketDir holds the sockets of one user's sessions, as tmux does: only
+// that user may enter it, so nobody else can read a session's tunnels or
+// swap its socket for a symlink. It lives in /tmp because sudo resets
+// TMPDIR on macOS, and a session run through sudo belongs to the user who
+// invoked it.
+func socketDir() string {
+	return filepath.Join("/tmp", fmt.Sprintf("loop-%d", sessionUID()))
+}
+
+// sessionUID returns the user a session belongs to: the one who ran sudo,
+// if it did.
+func sessionUID() int {
+	if os.Geteuid() == 0 {
+		if uid, err := strconv.Atoi(os.Getenv("SUDO_UID")); err == nil {
+			return uid
+		}
+	}
+
+	return os.Getuid()
+}
+
+func listen(path string) (net.Listener, error) {
+	uid := sessionUID()
+
+	if err := ensureSocketDir(filepath.Dir(path), uid); err != nil {
+		return nil, err
+	}
+
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	// nobody but the owner may connect, before and after the handover
+	mask := syscall.Umask(0177)
+	l, err := net.Listen("unix", path)
+	syscall.Umask(mask)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Lchown(path, uid, -1); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// ensureSocketDir creates dir if it is socketDir, hands it to uid, and makes
+// sure it is a directory only uid can use. One that someone else created
+// first is refused rather than taken over.
+func ensureSocketDir(dir string, uid int) error {
+	if dir == socketDir() {
+		err := os.Mkdir(dir, 0700)
+
+		if err != nil && !errors.Is(err, os.ErrExist) {
+			return err
+		}
+
+		if err == nil {
+			if err := os.Lchown(dir, uid, -1); err != nil {
+				return err
+			}
+		}
+	}
+
+	info, err := os.Lstat(dir)
+
+	if err != nil {
+		return err
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+
+	if !info.IsDir() || !ok || int(stat.Uid) != uid || info.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("%s must be a directory owned and only accessible by uid %d", dir, uid)
+	}
+
+	return nil
+}
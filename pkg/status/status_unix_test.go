@@ -0,0 +1,46 @@
+//go:build darwin || linux
+
+package status
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenOwnerOnly(t *testing.T) {
+	dir := t.TempDir()
+
+	if err := os.Chmod(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "loop-connect-1.sock")
+
+	l, err := listen(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	info, err := os.Stat(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if perm := info.Mode().Perm(); perm&0077 != 0 {
+		t.Fatalf("want the socket closed to others, got %v", perm)
+	}
+
+	// a directory others can enter is not trusted with the socket
+	if err := os.Chmod(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := listen(filepath.Join(dir, "loop-connect-2.sock")); err == nil {
+		t.Fatal("want an error for a directory open to others")
+	}
+}
@@ -0,0 +1,22 @@
+//go:build windows
+
+package status
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+// socketDir is the user's own temp directory.
+func socketDir() string {
+	return os.TempDir()
+}
+
+func listen(path string) (net.Listener, error) {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,25 @@
+package system
+
+import (
+	"context"
+)
+
+// Loopback adds and removes the loopback addresses tunnels listen on.
+type Loopback interface {
+	AliasIP(ctx context.Context, alias string) error
+	UnaliasIP(ctx context.Context, alias string) error
+}
+
+// DefaultLoopback changes the loopback interface directly, which takes root
+// on macOS.
+var DefaultLoopback Loopback = loopback{}
+
+type loopback struct{}
+
+func (loopback) AliasIP(ctx context.Context, alias string) error {
+	return AliasIP(ctx, alias)
+}
+
+func (loopback) UnaliasIP(ctx context.Context, alias string) error {
+	return UnaliasIP(ctx, alias)
+}
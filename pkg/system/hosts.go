@@ -1,23 +1,93 @@
 package system
 
 import (
+	"context"
 	"fmt"
+	"maps"
 	"os"
+	"regexp"
 	"runtime"
 	"slices"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/adrianliechti/loop/pkg/session"
 	"github.com/rogpeppe/go-internal/lockedfile"
 )
 
+func init() {
+	// A crashed session leaves its section behind; flushing an empty
+	// section of the same owner removes it. The file is always the system
+	// hosts file, never a path taken from the journal.
+	session.Register("hosts", func(ctx context.Context, r session.Resource) error {
+		owner, _ := strconv.Atoi(r.Attributes["owner"])
+
+		s, err := NewHostsSectionFor(r.Name, owner)
+
+		if err != nil {
+			return err
+		}
+
+		return s.Flush()
+	})
+}
+
+// Hosts publishes names for mapped addresses, either into the system hosts
+// file or through the embedded DNS server.
+type Hosts interface {
+	Add(address string, hosts ...string)
+	AddSRV(address string, records ...SRV)
+	Remove(address string)
+	Clear()
+	Flush() error
+}
+
+// SRV describes a service record for a named port, e.g.
+// _http._tcp.web.shop.svc.cluster.local pointing at web.shop.svc.cluster.local:80.
+type SRV struct {
+	Name   string
+	Target string
+	Port   int
+}
+
+// DiscardHosts drops every name, for sessions that resolve names
+// themselves, e.g. the proxy.
+var DiscardHosts Hosts = discardHosts{}
+
+type discardHosts struct{}
+
+func (discardHosts) Add(address string, hosts ...string)   {}
+func (discardHosts) AddSRV(address string, records ...SRV) {}
+func (discardHosts) Remove(address string)                 {}
+func (discardHosts) Clear()                                {}
+func (discardHosts) Flush() error                          { return nil }
+
+// sectionHeader matches the start of a section; sections written by
+// sessions carry the owner's pid, older ones only a name.
+var sectionHeader = regexp.MustCompile(`^# Start Section (.+?)(?: \[pid (\d+)\])?$`)
+
+// HostsSection is the block of hosts file entries owned by one process.
+// Sections are keyed by name and owner, so concurrent sessions each keep
+// their own block and never rewrite or remove each other's.
 type HostsSection struct {
 	name string
 	path string
 
+	owner   int
+	started time.Time
+
 	hosts map[string][]string
 }
 
 func NewHostsSection(name string) (*HostsSection, error) {
+	return NewHostsSectionFor(name, os.Getpid())
+}
+
+// NewHostsSectionFor returns a section owned by another process, e.g. the
+// client of the privileged helper. The section counts as stale once the
+// owner is gone.
+func NewHostsSectionFor(name string, owner int) (*HostsSection, error) {
 	path := "/etc/hosts"
 
 	if runtime.GOOS == "windows" {
@@ -32,6 +102,9 @@ func NewHostsSection(name string) (*HostsSection, error) {
 		name: name,
 		path: path,
 
+		owner:   owner,
+		started: time.Now(),
+
 		hosts: make(map[string][]string),
 	}, nil
 }
@@ -40,6 +113,10 @@ func (s *HostsSection) Add(address string, hosts ...string) {
 	s.hosts[address] = hosts
 }
 
+// AddSRV is a no-op: the hosts file cannot express service records.
+func (s *HostsSection) AddSRV(address string, records ...SRV) {
+}
+
 func (s *HostsSection) Remove(address string) {
 	delete(s.hosts, address)
 }
@@ -48,50 +125,138 @@ func (s *HostsSection) Clear() {
 	clear(s.hosts)
 }
 
+// Flush replaces the section in the hosts file. The file is read and
+// written under one lock, so concurrent sessions cannot lose each other's
+// updates.
 func (s *HostsSection) Flush() error {
+	// journal the section before writing it, so a crash right after the
+	// write still gets rolled back
+	if len(s.hosts) > 0 {
+		session.Record(s.resource())
+	}
+
+	err := lockedfile.Transform(s.path, func(data []byte) ([]byte, error) {
+		return []byte(s.update(string(data))), nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if len(s.hosts) == 0 {
+		session.Release(s.resource())
+	}
+
+	return nil
+}
+
+// update returns text with the section replaced. Sections of owners that
+// are gone, and unowned ones of the same name left by older versions, are
+// dropped along the way.
+func (s *HostsSection) update(text string) string {
 	ln := "\n"
 
 	if runtime.GOOS == "windows" {
 		ln = "\r\n"
 	}
 
-	data, err := lockedfile.Read(s.path)
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
 
-	if err != nil {
-		return err
-	}
+	var result []string
+	var skipped []string
+
+	end := ""
+
+	for _, line := range lines {
+		if end != "" {
+			skipped = append(skipped, line)
+
+			if strings.TrimSpace(line) == end {
+				end = ""
+				skipped = nil
+			}
+
+			continue
+		}
 
-	text := string(data)
+		m := sectionHeader.FindStringSubmatch(strings.TrimSpace(line))
 
-	headerStart := fmt.Sprintf("# Start Section %s%s", s.name, ln)
-	headerEnd := fmt.Sprintf("# End Section %s%s", s.name, ln)
+		if m == nil || !s.replaces(m[1], m[2]) {
+			result = append(result, line)
+			continue
+		}
 
-	sectionStart := strings.Index(text, headerStart)
-	sectionEnd := strings.LastIndex(text, headerEnd)
+		end = "# End Section " + strings.TrimPrefix(strings.TrimSpace(line), "# Start Section ")
+		skipped = []string{line}
 
-	if sectionStart >= 0 && sectionEnd >= 0 && sectionEnd > sectionStart {
-		text = text[:sectionStart] + text[sectionEnd+len(headerEnd):]
+		// take the blank line separating the section along
+		if n := len(result); n > 0 && strings.TrimSpace(result[n-1]) == "" {
+			skipped = append([]string{result[n-1]}, skipped...)
+			result = result[:n-1]
+		}
 	}
 
-	if len(s.hosts) > 0 {
-		text = strings.TrimRight(text, ln) + ln + ln
-		text += headerStart
+	// a section without end marker is left alone rather than cut short
+	result = append(result, skipped...)
+
+	text = strings.TrimRight(strings.Join(result, ln), ln) + ln
+
+	if len(s.hosts) == 0 {
+		return text
+	}
+
+	title := fmt.Sprintf("%s [pid %d]", s.name, s.owner)
 
-		for address, hosts := range s.hosts {
-			slices.Sort(hosts)
+	text += ln
+	text += "# Start Section " + title + ln
+	text += fmt.Sprintf("# Owner pid=%d started=%s%s", s.owner, s.started.UTC().Format(time.RFC3339), ln)
 
-			for _, host := range hosts {
-				text += fmt.Sprintf("%s %s%s", address, host, ln)
+	for _, address := range slices.Sorted(maps.Keys(s.hosts)) {
+		hosts := slices.Clone(s.hosts[address])
+		slices.Sort(hosts)
+
+		for _, host := range hosts {
+			// Wildcards need a resolver; the hosts file only knows exact names.
+			if strings.Contains(host, "*") {
+				continue
 			}
+
+			text += fmt.Sprintf("%s %s%s", address, host, ln)
 		}
+	}
+
+	text += "# End Section " + title + ln
 
-		text += fmt.Sprintf("%s%s", headerEnd, ln)
+	return text
+}
+
+// replaces reports whether an existing section is superseded by this one
+// or stale.
+func (s *HostsSection) replaces(name, owner string) bool {
+	if owner == "" {
+		return name == s.name
 	}
 
-	text = strings.TrimRight(text, ln) + ln
+	pid, err := strconv.Atoi(owner)
 
-	if err := lockedfile.Write(s.path, strings.NewReader(text), 0644); err != nil {
-		return err
+	if err != nil {
+		return false
+	}
+
+	if pid == s.owner {
+		return name == s.name
+	}
+
+	return !session.ProcessAlive(pid)
+}
+
+func (s *HostsSection) resource() session.Resource {
+	return session.Resource{
+		Kind: "hosts",
+		Name: s.name,
+
+		Attributes: map[string]string{
+			"owner": strconv.Itoa(s.owner),
+		},
 	}
-	return nil
 }
@@ -0,0 +1,87 @@
+package system
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestSection(t *testing.T, path, name string, owner int) *HostsSection {
+	t.Helper()
+
+	s, err := NewHostsSectionFor(name, owner)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.path = path
+
+	return s
+}
+
+func TestHostsSectionsOfSessionsCoexist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+
+	legacy := "127.0.0.1 localhost\n\n# Start Section Loop Catapult\n127.244.0.9 old\n# End Section Loop Catapult\n"
+	stale := "\n# Start Section Loop Gateway [pid 99999999]\n127.245.0.9 gone\n# End Section Loop Gateway [pid 99999999]\n"
+
+	if err := os.WriteFile(path, []byte(legacy+stale), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	first := newTestSection(t, path, "Loop Catapult", os.Getpid())
+	second := newTestSection(t, path, "Loop Catapult", os.Getppid())
+
+	t.Cleanup(func() {
+		second.Clear()
+		second.Flush()
+	})
+
+	first.Add("127.244.0.1", "web.shop")
+	second.Add("127.244.0.2", "api.billing")
+
+	for i := 0; i < 3; i++ {
+		if err := first.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := second.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, _ := os.ReadFile(path)
+	text := string(data)
+
+	for _, want := range []string{"127.0.0.1 localhost", "127.244.0.1 web.shop", "127.244.0.2 api.billing"} {
+		if !strings.Contains(text, want) {
+			t.Fatalf("expected %q in %q", want, text)
+		}
+	}
+
+	for _, gone := range []string{"old", "gone"} {
+		if strings.Contains(text, gone) {
+			t.Fatalf("expected stale entry %q removed from %q", gone, text)
+		}
+	}
+
+	if strings.Contains(text, "\n\n\n") {
+		t.Fatalf("expected sections to not pile up blank lines, got %q", text)
+	}
+
+	// one session shutting down leaves the other one's entries alone
+	first.Clear()
+
+	if err := first.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ = os.ReadFile(path)
+	text = string(data)
+
+	if strings.Contains(text, "web.shop") || !strings.Contains(text, "127.244.0.2 api.billing") {
+		t.Fatalf("expected only the second session's entries, got %q", text)
+	}
+}
@@ -6,9 +6,22 @@ import (
 	"context"
 	"errors"
 	"os/exec"
+
+	"github.com/adrianliechti/loop/pkg/session"
 )
 
+func init() {
+	// aliases do not survive a reboot, so a failure usually means the
+	// alias is gone already
+	session.Register("alias", func(ctx context.Context, r session.Resource) error {
+		UnaliasIP(ctx, r.Name)
+		return nil
+	})
+}
+
 func AliasIP(ctx context.Context, alias string) error {
+	session.Record(session.Resource{Kind: "alias", Name: alias})
+
 	output, err := exec.CommandContext(ctx, "ifconfig", "lo0", "alias", alias).CombinedOutput()
 
 	if err != nil {
@@ -25,5 +38,7 @@ func UnaliasIP(ctx context.Context, alias string) error {
 		return errors.New(string(output))
 	}
 
+	session.Release(session.Resource{Kind: "alias", Name: alias})
+
 	return nil
 }
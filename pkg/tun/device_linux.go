@@ -0,0 +1,103 @@
+//go:build linux
+
+package tun
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// deviceAddress gives the kernel an IPv6 source address to pick for the
+// routed prefixes, as hosts without global IPv6 have none that fits.
+const deviceAddress = "fd6c:6f6f:7000::1/128"
+
+type linuxDevice struct {
+	*os.File
+
+	name string
+}
+
+func (d *linuxDevice) Name() string {
+	return d.name
+}
+
+// openDevice creates a TUN interface, one packet per read and write, and
+// routes prefixes to it. It is not persistent, so the kernel removes it
+// and its routes once the process lets go of it, even after a crash.
+func openDevice(ctx context.Context, name string, mtu int, prefixes []netip.Prefix) (device, error) {
+	fd, err := unix.Open("/dev/net/tun", unix.O_RDWR|unix.O_CLOEXEC, 0)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ifr, err := unix.NewIfreq(name)
+
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+
+	ifr.SetUint16(unix.IFF_TUN | unix.IFF_NO_PI)
+
+	if err := unix.IoctlIfreq(fd, unix.TUNSETIFF, ifr); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+
+	// non-blocking, so Close interrupts a pending Read
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+
+	d := &linuxDevice{
+		File: os.NewFile(uintptr(fd), "/dev/net/tun"),
+		name: ifr.Name(),
+	}
+
+	if err := configureDevice(ctx, d.name, mtu, prefixes); err != nil {
+		d.Close()
+		return nil, err
+	}
+
+	return d, nil
+}
+
+func configureDevice(ctx context.Context, name string, mtu int, prefixes []netip.Prefix) error {
+	if err := run(ctx, "ip", "link", "set", "dev", name, "mtu", strconv.Itoa(mtu), "up"); err != nil {
+		return err
+	}
+
+	if slices.ContainsFunc(prefixes, func(p netip.Prefix) bool { return p.Addr().Is6() }) {
+		if err := run(ctx, "ip", "-6", "addr", "replace", deviceAddress, "dev", name); err != nil {
+			return err
+		}
+	}
+
+	for _, p := range prefixes {
+		if err := run(ctx, "ip", "route", "replace", p.Masked().String(), "dev", name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func run(ctx context.Context, name string, args ...string) error {
+	output, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+
+	if err != nil {
+		return errors.New(strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package tun
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+)
+
+func openDevice(ctx context.Context, name string, mtu int, prefixes []netip.Prefix) (device, error) {
+	return nil, errors.New("TUN mode is only supported on Linux")
+}
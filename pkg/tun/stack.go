@@ -0,0 +1,305 @@
+package tun
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/adrianliechti/loop/pkg/forward"
+
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	netstack "gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+const (
+	nicID = 1
+
+	// queueSize is how many packets the stack buffers for the device.
+	queueSize = 512
+
+	// tcpDialTimeout bounds connecting upstream; the local socket keeps
+	// retransmitting its SYN meanwhile.
+	tcpDialTimeout = 10 * time.Second
+
+	// tcpMaxInFlight bounds the connections waiting for their upstream.
+	tcpMaxInFlight = 1024
+
+	// udpFlowTimeout ends a flow after this long without traffic in either
+	// direction, as forward.UDP does.
+	udpFlowTimeout = 60 * time.Second
+)
+
+// DialFunc connects to a flow's destination through the cluster; network
+// is "tcp" or "udp". UDP connections keep datagram boundaries: one
+// datagram per read and per write.
+type DialFunc func(ctx context.Context, network string, addr netip.AddrPort) (net.Conn, error)
+
+// stack terminates the TCP and UDP flows arriving as packets on a device in
+// gVisor's netstack and forwards each of them through its own upstream
+// connection. The netstack answers for every address routed to the device.
+type stack struct {
+	device io.ReadWriter
+	mtu    int
+
+	dial   DialFunc
+	logger *slog.Logger
+
+	writeMu sync.Mutex
+}
+
+func newStack(device io.ReadWriter, mtu int, dial DialFunc, logger *slog.Logger) *stack {
+	return &stack{
+		device: device,
+		mtu:    mtu,
+
+		dial:   dial,
+		logger: logger,
+	}
+}
+
+// Run reads packets until the device is closed or ctx is cancelled, then
+// tears down every flow.
+func (s *stack) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	ns := netstack.New(netstack.Options{
+		NetworkProtocols:   []netstack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+		TransportProtocols: []netstack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+	})
+
+	defer ns.Destroy()
+
+	link := channel.New(queueSize, uint32(s.mtu), "")
+
+	if err := ns.CreateNIC(nicID, link); err != nil {
+		return errors.New(err.String())
+	}
+
+	// accept packets for any address and answer from it
+	if err := ns.SetPromiscuousMode(nicID, true); err != nil {
+		return errors.New(err.String())
+	}
+
+	if err := ns.SetSpoofing(nicID, true); err != nil {
+		return errors.New(err.String())
+	}
+
+	sack := tcpip.TCPSACKEnabled(true)
+
+	if err := ns.SetTransportProtocolOption(tcp.ProtocolNumber, &sack); err != nil {
+		return errors.New(err.String())
+	}
+
+	ns.SetRouteTable([]tcpip.Route{
+		{Destination: header.IPv4EmptySubnet, NIC: nicID},
+		{Destination: header.IPv6EmptySubnet, NIC: nicID},
+	})
+
+	tcpForwarder := tcp.NewForwarder(ns, 0, tcpMaxInFlight, func(r *tcp.ForwarderRequest) {
+		s.handleTCP(ctx, r)
+	})
+
+	udpForwarder := udp.NewForwarder(ns, func(r *udp.ForwarderRequest) bool {
+		return s.handleUDP(ctx, r)
+	})
+
+	ns.SetTransportProtocolHandler(tcp.ProtocolNumber, tcpForwarder.HandlePacket)
+	ns.SetTransportProtocolHandler(udp.ProtocolNumber, udpForwarder.HandlePacket)
+
+	go func() {
+		for {
+			pkt := link.ReadContext(ctx)
+
+			if pkt == nil {
+				return
+			}
+
+			s.write(pkt)
+		}
+	}()
+
+	buf := make([]byte, s.mtu)
+
+	for {
+		n, err := s.device.Read(buf)
+
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+
+			return err
+		}
+
+		var protocol tcpip.NetworkProtocolNumber
+
+		switch header.IPVersion(buf[:n]) {
+		case header.IPv4Version:
+			protocol = ipv4.ProtocolNumber
+		case header.IPv6Version:
+			protocol = ipv6.ProtocolNumber
+		default:
+			continue
+		}
+
+		pkt := netstack.NewPacketBuffer(netstack.PacketBufferOptions{
+			Payload: buffer.MakeWithData(append([]byte(nil), buf[:n]...)),
+		})
+
+		link.InjectInbound(protocol, pkt)
+		pkt.DecRef()
+	}
+}
+
+func (s *stack) write(pkt *netstack.PacketBuffer) {
+	defer pkt.DecRef()
+
+	view := pkt.ToView()
+	defer view.Release()
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	if _, err := s.device.Write(view.AsSlice()); err != nil {
+		s.log("failed to write packet", "error", err)
+	}
+}
+
+// handleTCP connects upstream before completing the handshake, so a flow
+// that cannot be connected is refused rather than accepted and dropped.
+func (s *stack) handleTCP(ctx context.Context, r *tcp.ForwarderRequest) {
+	addr := destination(r.ID())
+
+	dialCtx, cancel := context.WithTimeout(ctx, tcpDialTimeout)
+	upstream, err := s.dial(dialCtx, "tcp", addr)
+	cancel()
+
+	if err != nil {
+		s.log("failed to connect", "address", addr, "error", err)
+
+		r.Complete(true)
+		return
+	}
+
+	defer upstream.Close()
+
+	var wq waiter.Queue
+
+	ep, tcpErr := r.CreateEndpoint(&wq)
+
+	if tcpErr != nil {
+		r.Complete(true)
+		return
+	}
+
+	r.Complete(false)
+
+	conn := gonet.NewTCPConn(&wq, ep)
+	defer conn.Close()
+
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+		upstream.Close()
+	})
+
+	defer stop()
+
+	forward.Pipe(conn, upstream)
+}
+
+// handleUDP takes over a new flow; the endpoint it creates receives the
+// flow's later datagrams directly.
+func (s *stack) handleUDP(ctx context.Context, r *udp.ForwarderRequest) bool {
+	var wq waiter.Queue
+
+	ep, err := r.CreateEndpoint(&wq)
+
+	if err != nil {
+		return false
+	}
+
+	conn := gonet.NewUDPConn(&wq, ep)
+
+	go s.relayUDP(ctx, conn, destination(r.ID()))
+
+	return true
+}
+
+// relayUDP relays the datagrams between a local socket and a cluster
+// address, one write upstream per datagram and one datagram per read back.
+func (s *stack) relayUDP(ctx context.Context, conn net.Conn, addr netip.AddrPort) {
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	upstream, err := s.dial(ctx, "udp", addr)
+
+	if err != nil {
+		s.log("failed to connect", "address", addr, "error", err)
+		return
+	}
+
+	defer upstream.Close()
+
+	timer := time.AfterFunc(udpFlowTimeout, cancel)
+	defer timer.Stop()
+
+	context.AfterFunc(ctx, func() {
+		conn.Close()
+		upstream.Close()
+	})
+
+	copyDatagrams := func(dst, src net.Conn) {
+		defer cancel()
+
+		buf := make([]byte, 65535)
+
+		for {
+			n, err := src.Read(buf)
+
+			if err != nil {
+				return
+			}
+
+			timer.Reset(udpFlowTimeout)
+
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+	}
+
+	go copyDatagrams(conn, upstream)
+	copyDatagrams(upstream, conn)
+}
+
+// destination returns the cluster address a flow goes to, which the
+// netstack sees as the local end.
+func destination(id netstack.TransportEndpointID) netip.AddrPort {
+	addr, _ := netip.AddrFromSlice(id.LocalAddress.AsSlice())
+	return netip.AddrPortFrom(addr, id.LocalPort)
+}
+
+func (s *stack) log(msg string, args ...any) {
+	if s.logger == nil {
+		return
+	}
+
+	s.logger.Debug(msg, args...)
+}
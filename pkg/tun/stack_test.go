@@ -0,0 +1,296 @@
+package tun
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	netstack "gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+)
+
+// pipeDevice hands packets written by the test client to the stack and
+// those the stack writes back to the client.
+type pipeDevice struct {
+	in  chan []byte
+	out chan []byte
+}
+
+func newPipeDevice() *pipeDevice {
+	return &pipeDevice{
+		in:  make(chan []byte, 64),
+		out: make(chan []byte, 64),
+	}
+}
+
+func (d *pipeDevice) Read(b []byte) (int, error) {
+	p, ok := <-d.in
+
+	if !ok {
+		return 0, io.EOF
+	}
+
+	return copy(b, p), nil
+}
+
+// Write drops packets nobody is reading anymore, like a full TUN queue.
+func (d *pipeDevice) Write(b []byte) (int, error) {
+	select {
+	case d.out <- append([]byte(nil), b...):
+	default:
+	}
+
+	return len(b), nil
+}
+
+func startStack(t *testing.T, dial DialFunc) *pipeDevice {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	device := newPipeDevice()
+	s := newStack(device, DefaultMTU, dial, nil)
+
+	done := make(chan struct{})
+
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		close(device.in)
+		<-done
+	})
+
+	return device
+}
+
+// newClient returns a netstack with addr on the other end of device, the
+// way the kernel sits on the other end of the TUN interface.
+func newClient(t *testing.T, device *pipeDevice, addr netip.Addr) *netstack.Stack {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s := netstack.New(netstack.Options{
+		NetworkProtocols:   []netstack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+		TransportProtocols: []netstack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+	})
+
+	link := channel.New(64, DefaultMTU, "")
+
+	if err := s.CreateNIC(nicID, link); err != nil {
+		t.Fatal(err)
+	}
+
+	protocol := ipv4.ProtocolNumber
+
+	if addr.Is6() {
+		protocol = ipv6.ProtocolNumber
+	}
+
+	address := tcpip.ProtocolAddress{
+		Protocol:          protocol,
+		AddressWithPrefix: tcpip.AddrFromSlice(addr.AsSlice()).WithPrefix(),
+	}
+
+	if err := s.AddProtocolAddress(nicID, address, netstack.AddressProperties{}); err != nil {
+		t.Fatal(err)
+	}
+
+	s.SetRouteTable([]tcpip.Route{
+		{Destination: header.IPv4EmptySubnet, NIC: nicID},
+		{Destination: header.IPv6EmptySubnet, NIC: nicID},
+	})
+
+	go func() {
+		for {
+			pkt := link.ReadContext(ctx)
+
+			if pkt == nil {
+				return
+			}
+
+			view := pkt.ToView()
+			device.in <- append([]byte(nil), view.AsSlice()...)
+			view.Release()
+			pkt.DecRef()
+		}
+	}()
+
+	go func() {
+		for {
+			select {
+			case b := <-device.out:
+				protocol := ipv4.ProtocolNumber
+
+				if header.IPVersion(b) == header.IPv6Version {
+					protocol = ipv6.ProtocolNumber
+				}
+
+				pkt := netstack.NewPacketBuffer(netstack.PacketBufferOptions{Payload: buffer.MakeWithData(b)})
+				link.InjectInbound(protocol, pkt)
+				pkt.DecRef()
+
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// registered before startStack's cleanup, so it runs after it
+	t.Cleanup(func() {
+		cancel()
+		s.Destroy()
+	})
+
+	return s
+}
+
+func fullAddress(addr netip.AddrPort) tcpip.FullAddress {
+	return tcpip.FullAddress{NIC: nicID, Addr: tcpip.AddrFromSlice(addr.Addr().AsSlice()), Port: addr.Port()}
+}
+
+func TestTCPEcho(t *testing.T) {
+	service := netip.MustParseAddrPort("10.96.0.10:80")
+
+	// a real socket, so the half-close reaches the echo server
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+
+		if err != nil {
+			return
+		}
+
+		io.Copy(conn, conn)
+		conn.Close()
+	}()
+
+	client := newClient(t, startStack(t, func(ctx context.Context, network string, addr netip.AddrPort) (net.Conn, error) {
+		if network != "tcp" || addr != service {
+			return nil, errors.New("unexpected dial")
+		}
+
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", l.Addr().String())
+	}), netip.MustParseAddr("10.0.0.1"))
+
+	ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+	defer cancel()
+
+	conn, err := gonet.DialContextTCP(ctx, client, fullAddress(service), ipv4.ProtocolNumber)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	// closing our side ends the echo, which closes the other side
+	if err := conn.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+
+	echoed, err := io.ReadAll(conn)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(echoed) != "hello" {
+		t.Fatalf("want hello echoed, got %q", echoed)
+	}
+}
+
+func TestTCPRefused(t *testing.T) {
+	pod := netip.MustParseAddrPort("10.244.1.7:5432")
+
+	client := newClient(t, startStack(t, func(ctx context.Context, network string, addr netip.AddrPort) (net.Conn, error) {
+		return nil, errors.New("no pod")
+	}), netip.MustParseAddr("10.0.0.1"))
+
+	ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+	defer cancel()
+
+	conn, err := gonet.DialContextTCP(ctx, client, fullAddress(pod), ipv4.ProtocolNumber)
+
+	if err == nil {
+		conn.Close()
+		t.Fatal("want the connection refused")
+	}
+
+	if ctx.Err() != nil {
+		t.Fatalf("want a reset rather than a timeout, got %v", err)
+	}
+}
+
+func TestUDPIPv6(t *testing.T) {
+	service := netip.MustParseAddrPort("[fd00:10:96::a]:53")
+
+	client := newClient(t, startStack(t, func(ctx context.Context, network string, addr netip.AddrPort) (net.Conn, error) {
+		if network != "udp" || addr != service {
+			return nil, errors.New("unexpected dial")
+		}
+
+		local, remote := net.Pipe()
+
+		go func() {
+			buf := make([]byte, 512)
+			n, _ := remote.Read(buf)
+			remote.Write(append([]byte("re: "), buf[:n]...))
+		}()
+
+		return local, nil
+	}), netip.MustParseAddr("fd00::1"))
+
+	remote := fullAddress(service)
+
+	conn, err := gonet.DialUDP(client, nil, &remote, ipv6.ProtocolNumber)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.Write([]byte("query")); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 512)
+	n, err := conn.Read(buf)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if payload := string(buf[:n]); payload != "re: query" {
+		t.Fatalf("want the reply relayed, got %q", payload)
+	}
+}
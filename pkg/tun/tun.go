@@ -0,0 +1,89 @@
+// Package tun routes cluster networks into the process: packets for pod
+// and service addresses arrive on a TUN device, and a small userspace
+// stack terminates their TCP and UDP flows and forwards each of them
+// through the cluster. Clients can then connect to raw ClusterIPs and pod
+// IPs, e.g. those handed out in Kafka broker metadata.
+package tun
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/netip"
+)
+
+// DefaultMTU keeps packets within what the loopback path and the stack
+// handle comfortably.
+const DefaultMTU = 1500
+
+type Options struct {
+	// Name is the interface name; the kernel picks loopN by default.
+	Name string
+
+	// Prefixes are routed to the interface, e.g. the pod and service CIDRs
+	// of both families.
+	Prefixes []netip.Prefix
+
+	MTU int
+
+	// Dial connects each flow through the cluster.
+	Dial DialFunc
+
+	Logger *slog.Logger
+}
+
+// device is a TUN interface; every Read and Write is one IP packet.
+type device interface {
+	Read(b []byte) (int, error)
+	Write(b []byte) (int, error)
+	Close() error
+
+	Name() string
+}
+
+type Tun struct {
+	options Options
+}
+
+func New(options Options) *Tun {
+	if options.Name == "" {
+		options.Name = "loop%d"
+	}
+
+	if options.MTU == 0 {
+		options.MTU = DefaultMTU
+	}
+
+	return &Tun{
+		options: options,
+	}
+}
+
+// Start creates the interface, routes the prefixes to it and serves flows
+// until ctx is cancelled. The interface and its routes go away with it.
+func (t *Tun) Start(ctx context.Context) error {
+	if len(t.options.Prefixes) == 0 {
+		return errors.New("no prefixes to route")
+	}
+
+	if t.options.Dial == nil {
+		return errors.New("no dialer")
+	}
+
+	device, err := openDevice(ctx, t.options.Name, t.options.MTU, t.options.Prefixes)
+
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		device.Close()
+	}()
+
+	if t.options.Logger != nil {
+		t.options.Logger.InfoContext(ctx, "routing cluster networks", "interface", device.Name(), "prefixes", t.options.Prefixes)
+	}
+
+	return newStack(device, t.options.MTU, t.options.Dial, t.options.Logger).Run(ctx)
+}